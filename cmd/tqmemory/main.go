@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/mevdschee/tqmemory/internal/config"
 	"github.com/mevdschee/tqmemory/pkg/server"
@@ -23,6 +24,7 @@ func main() {
 	memory := flag.Int("m", 64, "Max memory to use for items in megabytes")
 	connections := flag.Int("c", 1024, "Max simultaneous connections")
 	threads := flag.Int("t", 4, "Number of threads to use")
+	delimiter := flag.String("D", "", "Key prefix delimiter for stats detail (enables stats detail)")
 
 	// Long name alternatives (same variables)
 	flag.IntVar(port, "port", 11211, "TCP port to listen on")
@@ -31,11 +33,20 @@ func main() {
 	flag.IntVar(memory, "memory", 64, "Max memory in megabytes")
 	flag.IntVar(connections, "connections", 1024, "Max simultaneous connections")
 	flag.IntVar(threads, "threads", 4, "Number of threads")
+	flag.StringVar(delimiter, "delimiter", "", "Key prefix delimiter for stats detail")
 
 	// TQMemory-specific options (not in memcached)
 	staleMultiplier := flag.Float64("stale", 2.0, "Stale multiplier (hard TTL = soft TTL × this, 0 to disable)")
 	configFile := flag.String("config", "", "Path to config file")
 	pprofEnabled := flag.Bool("pprof", false, "Enable pprof profiling server on :6062")
+	eventLoop := flag.Bool("eventloop", false, "Use the event-loop (epoll/kqueue) network backend")
+	metricsAddr := flag.String("metrics", "", "Serve Prometheus metrics on this address (e.g. :9150)")
+	hotKeys := flag.Int("hotkeys", 0, "Hot keys tracked per thread (0 to disable)")
+	hotKeyShare := flag.Float64("hotkey-share", 0, "Log keys above this share of a thread's traffic (0 to disable)")
+	slowLogThreshold := flag.Int("slowlog-threshold", 10000, "Slow log threshold in microseconds")
+	slowLogLen := flag.Int("slowlog-len", tqmemory.DefaultSlowLogLen, "Slow log entries kept (0 to disable)")
+	adminTokenFlag := flag.String("admin-token", "", "Token of the admin command, enables admin commands")
+	nsDelimiter := flag.String("ns-delimiter", ":", "Ends the namespace of a key for ns_invalidate and mi")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
@@ -47,10 +58,19 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  -m, -memory <num>        Max memory in megabytes (default: 64)\n")
 		fmt.Fprintf(os.Stderr, "  -c, -connections <num>   Max simultaneous connections (default: 1024)\n")
 		fmt.Fprintf(os.Stderr, "  -t, -threads <num>       Number of threads (default: 4)\n")
+		fmt.Fprintf(os.Stderr, "  -D, -delimiter <char>    Key prefix delimiter, enables stats detail (default: off, : when enabled)\n")
 		fmt.Fprintf(os.Stderr, "\nTQMemory options:\n")
 		fmt.Fprintf(os.Stderr, "  -stale <num>             Stale multiplier (default: 2.0, 0 to disable)\n")
 		fmt.Fprintf(os.Stderr, "  -config <file>           Path to config file\n")
 		fmt.Fprintf(os.Stderr, "  -pprof                   Enable pprof profiling server on :6062\n")
+		fmt.Fprintf(os.Stderr, "  -eventloop               Use the event-loop (epoll/kqueue) network backend\n")
+		fmt.Fprintf(os.Stderr, "  -metrics <addr>          Serve Prometheus metrics on <addr>/metrics\n")
+		fmt.Fprintf(os.Stderr, "  -hotkeys <num>           Hot keys tracked per thread (default: 0, off)\n")
+		fmt.Fprintf(os.Stderr, "  -hotkey-share <frac>     Log keys above this share of a thread's traffic (default: 0, off)\n")
+		fmt.Fprintf(os.Stderr, "  -slowlog-threshold <us>  Slow log threshold in microseconds (default: 10000)\n")
+		fmt.Fprintf(os.Stderr, "  -slowlog-len <num>       Slow log entries kept (default: 128, 0 to disable)\n")
+		fmt.Fprintf(os.Stderr, "  -admin-token <token>     Token of the admin command, enables admin commands\n")
+		fmt.Fprintf(os.Stderr, "  -ns-delimiter <char>     Ends the namespace of a key for ns_invalidate and mi (default: :)\n")
 	}
 	flag.Parse()
 
@@ -58,6 +78,9 @@ func main() {
 	var listenString string
 	var threadCount int
 	var maxConnections int
+	var useEventLoop bool
+	var metricsListen string
+	var adminToken string
 
 	// Load config file if specified
 	if *configFile != "" {
@@ -78,6 +101,20 @@ func main() {
 		log.Printf("Loaded config from %s", *configFile)
 		// Apply stale multiplier from config file
 		cfg.StaleMultiplier = fileCfg.StaleMultiplier
+		useEventLoop = fileCfg.EventLoop
+		metricsListen = fileCfg.Metrics
+		cfg.HotKeys = fileCfg.HotKeys
+		cfg.HotKeyLogShare = fileCfg.HotKeyShare
+		cfg.SlowLogThreshold = time.Duration(fileCfg.SlowLogThreshold) * time.Microsecond
+		cfg.SlowLogLen = fileCfg.SlowLogLen
+		adminToken = fileCfg.AdminToken
+		if fileCfg.Delimiter != "" {
+			cfg.PrefixDelimiter = fileCfg.Delimiter[0]
+			cfg.DetailEnabled = true
+		}
+		if fileCfg.NsDelimiter != "" {
+			cfg.NamespaceDelimiter = fileCfg.NsDelimiter[0]
+		}
 	} else {
 		// Use command-line flags
 		if *socketPath != "" {
@@ -92,6 +129,21 @@ func main() {
 		cfg.StaleMultiplier = *staleMultiplier
 		threadCount = *threads
 		maxConnections = *connections
+		useEventLoop = *eventLoop
+		metricsListen = *metricsAddr
+		cfg.HotKeys = *hotKeys
+		cfg.HotKeyLogShare = *hotKeyShare
+		cfg.SlowLogThreshold = time.Duration(*slowLogThreshold) * time.Microsecond
+		cfg.SlowLogLen = *slowLogLen
+		adminToken = *adminTokenFlag
+		// Like memcached -D, setting a delimiter turns on stats detail
+		if *delimiter != "" {
+			cfg.PrefixDelimiter = (*delimiter)[0]
+			cfg.DetailEnabled = true
+		}
+		if *nsDelimiter != "" {
+			cfg.NamespaceDelimiter = (*nsDelimiter)[0]
+		}
 	}
 
 	cache, err := tqmemory.NewSharded(cfg, threadCount)
@@ -100,14 +152,31 @@ func main() {
 	}
 	defer cache.Close()
 
-	// Use standard networking (io_uring is experimental)
+	// Use goroutine-per-connection networking unless the event loop is requested
 	srv := server.NewWithOptions(cache, listenString, maxConnections)
+	srv.SetAdminToken(adminToken)
 	go func() {
-		if err := srv.Start(); err != nil {
+		start := srv.Start
+		if useEventLoop {
+			start = srv.StartEventLoop
+		}
+		if err := start(); err != nil {
 			log.Fatalf("Server failed: %v", err)
 		}
 	}()
 
+	// Start the metrics server if enabled
+	if metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.MetricsHandler())
+		go func() {
+			log.Printf("Serving metrics on %s/metrics", metricsListen)
+			if err := http.ListenAndServe(metricsListen, mux); err != nil {
+				log.Println("Metrics server failed:", err)
+			}
+		}()
+	}
+
 	// Start pprof server if enabled
 	if *pprofEnabled {
 		go func() {
@@ -9,23 +9,35 @@ import (
 // Config represents the application configuration.
 // Uses the same option names as memcached command-line flags.
 type Config struct {
-	Port            int     // -p, -port: TCP port to listen on (default: 11211)
-	Listen          string  // -l, -listen: Interface to listen on (default: INADDR_ANY)
-	Memory          int     // -m, -memory: Max memory in megabytes (default: 64)
-	Connections     int     // -c, -connections: Max simultaneous connections (default: 1024)
-	Threads         int     // -t, -threads: Number of threads (default: 4)
-	StaleMultiplier float64 // -stale: Stale multiplier for thundering herd protection (default: 2.0)
+	Port             int     // -p, -port: TCP port to listen on (default: 11211)
+	Listen           string  // -l, -listen: Interface to listen on (default: INADDR_ANY)
+	Memory           int     // -m, -memory: Max memory in megabytes (default: 64)
+	Connections      int     // -c, -connections: Max simultaneous connections (default: 1024)
+	Threads          int     // -t, -threads: Number of threads (default: 4)
+	StaleMultiplier  float64 // -stale: Stale multiplier for thundering herd protection (default: 2.0)
+	EventLoop        bool    // -eventloop: Use the event-loop network backend (default: false)
+	Delimiter        string  // -D, -delimiter: Key prefix delimiter, enables stats detail (default: none)
+	Metrics          string  // -metrics: Address of the Prometheus metrics listener (default: none)
+	HotKeys          int     // -hotkeys: Hot keys tracked per thread for reads and writes (default: 0, off)
+	HotKeyShare      float64 // -hotkey-share: Log keys above this share of a thread's traffic (default: 0, off)
+	SlowLogThreshold int     // -slowlog-threshold: Slow log threshold in microseconds (default: 10000)
+	SlowLogLen       int     // -slowlog-len: Slow log entries kept (default: 128, 0 to disable)
+	AdminToken       string  // -admin-token: Token of the admin command, enables admin commands (default: none)
+	NsDelimiter      string  // -ns-delimiter: Ends the namespace of a key for namespace invalidation (default: :)
 }
 
 // DefaultConfig returns memcached-compatible defaults
 func DefaultConfig() *Config {
 	return &Config{
-		Port:            11211,
-		Listen:          "",
-		Memory:          64,
-		Connections:     1024,
-		Threads:         4,
-		StaleMultiplier: 2.0,
+		Port:             11211,
+		Listen:           "",
+		Memory:           64,
+		Connections:      1024,
+		Threads:          4,
+		StaleMultiplier:  2.0,
+		SlowLogThreshold: 10000,
+		SlowLogLen:       128,
+		NsDelimiter:      ":",
 	}
 }
 
@@ -84,6 +96,34 @@ func parse(data string) (*Config, error) {
 			if n, err := strconv.ParseFloat(value, 64); err == nil {
 				cfg.StaleMultiplier = n
 			}
+		case "metrics":
+			cfg.Metrics = value
+		case "delimiter":
+			cfg.Delimiter = value
+		case "ns_delimiter":
+			cfg.NsDelimiter = value
+		case "hotkeys":
+			if n, err := strconv.Atoi(value); err == nil {
+				cfg.HotKeys = n
+			}
+		case "slowlog_threshold":
+			if n, err := strconv.Atoi(value); err == nil {
+				cfg.SlowLogThreshold = n
+			}
+		case "slowlog_len":
+			if n, err := strconv.Atoi(value); err == nil {
+				cfg.SlowLogLen = n
+			}
+		case "admin_token":
+			cfg.AdminToken = value
+		case "hotkey_share":
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				cfg.HotKeyShare = n
+			}
+		case "eventloop":
+			if b, err := strconv.ParseBool(value); err == nil {
+				cfg.EventLoop = b
+			}
 		}
 	}
 
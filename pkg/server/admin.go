@@ -0,0 +1,79 @@
+package server
+
+import "crypto/subtle"
+
+// Admin commands change or remove many items at once. They are refused
+// unless the server has an admin token and the connection sent it with the
+// admin command.
+
+// SetAdminToken sets the token the admin command must present to allow
+// admin commands on a connection. Without a token admin commands are
+// disabled.
+func (s *Server) SetAdminToken(token string) {
+	s.adminToken = token
+}
+
+// handleTextAdmin handles: admin <token>
+func (c *conn) handleTextAdmin(tokens [][]byte) {
+	if len(tokens) != 2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if c.adminToken == "" {
+		c.writer.WriteString("CLIENT_ERROR admin commands are disabled\r\n")
+		return
+	}
+	if subtle.ConstantTimeCompare(tokens[1], []byte(c.adminToken)) != 1 {
+		c.writer.WriteString("CLIENT_ERROR bad admin token\r\n")
+		return
+	}
+	c.admin = true
+	c.writer.WriteString("OK\r\n")
+}
+
+// checkAdmin reports whether the connection may run admin commands, and
+// writes the error if not.
+func (c *conn) checkAdmin() bool {
+	if !c.admin {
+		c.writer.WriteString("CLIENT_ERROR permission denied\r\n")
+	}
+	return c.admin
+}
+
+// handleTextDeletePattern handles: delete_pattern <pattern> [dryrun] [noreply]
+// It removes the items whose key matches the glob pattern (a trailing '*'
+// matches a prefix) and responds with "DELETED <count>", or only counts
+// them with dryrun and responds with "MATCHED <count>". Admin only.
+func (c *conn) handleTextDeletePattern(tokens [][]byte) {
+	if !c.checkAdmin() {
+		return
+	}
+	if len(tokens) < 2 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	var dryRun, noreply bool
+	for _, token := range tokens[2:] {
+		switch string(token) {
+		case "dryrun":
+			dryRun = true
+		case "noreply":
+			noreply = true
+		default:
+			c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+
+	n := c.cache.DeletePattern(string(tokens[1]), dryRun)
+	if noreply {
+		return
+	}
+	if dryRun {
+		c.writer.WriteString("MATCHED ")
+	} else {
+		c.writer.WriteString("DELETED ")
+	}
+	c.writeUint(uint64(n))
+	c.writer.WriteString("\r\n")
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTextDeletePattern(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"set user:1:a 0 0 1 noreply\r\na", ""},
+		{"set user:1:b 0 0 1 noreply\r\nb", ""},
+		{"set user:2:a 0 0 1 noreply\r\na", ""},
+		{"delete_pattern user:1:*", "CLIENT_ERROR permission denied\r\n"},
+		{"admin secret", "CLIENT_ERROR admin commands are disabled\r\n"},
+	})
+
+	c.SetAdminToken("secret")
+	runTextTests(t, c, out, []textTest{
+		{"admin wrong", "CLIENT_ERROR bad admin token\r\n"},
+		{"delete_pattern user:1:*", "CLIENT_ERROR permission denied\r\n"},
+		{"admin secret", "OK\r\n"},
+		{"delete_pattern user:1:* dryrun", "MATCHED 2\r\n"},
+		{"delete_pattern user:1:*", "DELETED 2\r\n"},
+		{"delete_pattern user:?:a noreply", ""},
+		{"get user:1:a user:1:b user:2:a", "END\r\n"},
+		{"delete_pattern user:* force", "CLIENT_ERROR bad command line format\r\n"},
+	})
+}
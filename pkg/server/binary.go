@@ -2,12 +2,10 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"io"
 	"log"
-	"net"
-	"os"
-	"strconv"
 	"sync"
 	"time"
 
@@ -42,28 +40,59 @@ const (
 	reqMagic = 0x80
 	resMagic = 0x81
 
-	opGet       = 0x00
-	opSet       = 0x01
-	opAdd       = 0x02
-	opReplace   = 0x03
-	opDelete    = 0x04
-	opIncrement = 0x05
-	opDecrement = 0x06
-	opQuit      = 0x07
-	opFlush     = 0x08
-	opGetQ      = 0x09
-	opNoop      = 0x0a
-	opVersion   = 0x0b
-	opGetK      = 0x0c
-	opGetKQ     = 0x0d
-	opAppend    = 0x0e
-	opPrepend   = 0x0f
-	opStat      = 0x10
-	opTouch     = 0x1c
-	opGAT       = 0x1d
-	opGATK      = 0x1e
+	opGet        = 0x00
+	opSet        = 0x01
+	opAdd        = 0x02
+	opReplace    = 0x03
+	opDelete     = 0x04
+	opIncrement  = 0x05
+	opDecrement  = 0x06
+	opQuit       = 0x07
+	opFlush      = 0x08
+	opGetQ       = 0x09
+	opNoop       = 0x0a
+	opVersion    = 0x0b
+	opGetK       = 0x0c
+	opGetKQ      = 0x0d
+	opAppend     = 0x0e
+	opPrepend    = 0x0f
+	opStat       = 0x10
+	opSetQ       = 0x11
+	opAddQ       = 0x12
+	opReplaceQ   = 0x13
+	opDeleteQ    = 0x14
+	opIncrementQ = 0x15
+	opDecrementQ = 0x16
+	opQuitQ      = 0x17
+	opFlushQ     = 0x18
+	opAppendQ    = 0x19
+	opPrependQ   = 0x1a
+	opVerbosity  = 0x1b
+	opTouch      = 0x1c
+	opGAT        = 0x1d
+	opGATQ       = 0x1e
+	opGATK       = 0x23 // 0x1f to 0x22 are HELLO and SASL, which are not supported
+	opGATKQ      = 0x24
 )
 
+// quietOpcodes maps the quiet mutations to their regular opcode.
+// Quiet mutations only send a response when they fail.
+var quietOpcodes = map[uint8]uint8{
+	opSetQ:       opSet,
+	opAddQ:       opAdd,
+	opReplaceQ:   opReplace,
+	opDeleteQ:    opDelete,
+	opIncrementQ: opIncrement,
+	opDecrementQ: opDecrement,
+	opQuitQ:      opQuit,
+	opFlushQ:     opFlush,
+	opAppendQ:    opAppend,
+	opPrependQ:   opPrepend,
+}
+
+// maxBinaryBodyLen is the largest request body that is buffered (value plus extras and key)
+const maxBinaryBodyLen = maxValueSize + 512
+
 const (
 	resSuccess       = 0x0000
 	resKeyNotFound   = 0x0001
@@ -71,6 +100,7 @@ const (
 	resValueTooLarge = 0x0003
 	resInvalidArgs   = 0x0004
 	resItemNotStored = 0x0005
+	resNonNumeric    = 0x0006
 	resUnknownCmd    = 0x0081
 	resOOM           = 0x0082
 )
@@ -87,10 +117,29 @@ type binaryHeader struct {
 	CAS      uint64
 }
 
-func (s *Server) handleBinary(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer) {
+// parseBinaryHeader decodes the 24-byte request header at the start of buf.
+func parseBinaryHeader(buf []byte) binaryHeader {
+	return binaryHeader{
+		Magic:    buf[0],
+		Opcode:   buf[1],
+		KeyLen:   binary.BigEndian.Uint16(buf[2:4]),
+		ExtraLen: buf[4],
+		DataType: buf[5],
+		VBucket:  binary.BigEndian.Uint16(buf[6:8]),
+		BodyLen:  binary.BigEndian.Uint32(buf[8:12]),
+		Opaque:   binary.BigEndian.Uint32(buf[12:16]),
+		CAS:      binary.BigEndian.Uint64(buf[16:24]),
+	}
+}
+
+// handleBinary serves a binary protocol connection with blocking reads.
+func (c *conn) handleBinary(reader *bufio.Reader) {
 	headerBuf := make([]byte, 24)
 
 	for {
+		if reader.Buffered() == 0 {
+			c.state.Store(connWaiting)
+		}
 		if _, err := io.ReadFull(reader, headerBuf); err != nil {
 			if err != io.EOF {
 				log.Printf("Binary read header error: %v", err)
@@ -98,22 +147,14 @@ func (s *Server) handleBinary(conn net.Conn, reader *bufio.Reader, writer *bufio
 			return
 		}
 
+		c.busy()
+
 		if headerBuf[0] != reqMagic {
 			log.Printf("Invalid magic byte: %x", headerBuf[0])
 			return
 		}
 
-		req := binaryHeader{
-			Magic:    headerBuf[0],
-			Opcode:   headerBuf[1],
-			KeyLen:   binary.BigEndian.Uint16(headerBuf[2:4]),
-			ExtraLen: headerBuf[4],
-			DataType: headerBuf[5],
-			VBucket:  binary.BigEndian.Uint16(headerBuf[6:8]),
-			BodyLen:  binary.BigEndian.Uint32(headerBuf[8:12]),
-			Opaque:   binary.BigEndian.Uint32(headerBuf[12:16]),
-			CAS:      binary.BigEndian.Uint64(headerBuf[16:24]),
-		}
+		req := parseBinaryHeader(headerBuf)
 
 		// Use pooled body buffer based on size
 		var bodyBuf []byte
@@ -138,73 +179,191 @@ func (s *Server) handleBinary(conn net.Conn, reader *bufio.Reader, writer *bufio
 			return
 		}
 
-		extras := bodyBuf[:req.ExtraLen]
-		key := string(bodyBuf[req.ExtraLen : uint32(req.ExtraLen)+uint32(req.KeyLen)])
-		value := bodyBuf[uint32(req.ExtraLen)+uint32(req.KeyLen):]
-
-		switch req.Opcode {
-		case opSet:
-			s.handleBinaryStorage(writer, req, extras, key, value, "SET")
-		case opAdd:
-			s.handleBinaryStorage(writer, req, extras, key, value, "ADD")
-		case opReplace:
-			s.handleBinaryStorage(writer, req, extras, key, value, "REPLACE")
-		case opDelete:
-			s.handleBinaryDelete(writer, req, key)
-		case opIncrement:
-			s.handleBinaryIncrDecr(writer, req, extras, key, true)
-		case opDecrement:
-			s.handleBinaryIncrDecr(writer, req, extras, key, false)
-		case opFlush:
-			s.handleBinaryFlush(writer, req)
-		case opGet:
-			s.handleBinaryGet(writer, req, key, false)
-		case opGetQ:
-			s.handleBinaryGet(writer, req, key, true)
-		case opGetK:
-			s.handleBinaryGetK(writer, req, key, false)
-		case opGetKQ:
-			s.handleBinaryGetK(writer, req, key, true)
-		case opVersion:
-			s.handleBinaryVersion(writer, req)
-		case opQuit:
-			if poolToReturn != nil {
-				poolToReturn.Put(bodyBuf[:cap(bodyBuf)])
-			}
-			return
-		case opNoop:
-			s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, 0)
-		case opAppend:
-			s.handleBinaryAppendPrepend(writer, req, key, value, true)
-		case opPrepend:
-			s.handleBinaryAppendPrepend(writer, req, key, value, false)
-		case opStat:
-			s.handleBinaryStats(writer, req)
-		case opTouch:
-			s.handleBinaryTouch(writer, req, extras, key)
-		case opGAT:
-			s.handleBinaryGAT(writer, req, extras, key)
-		case opGATK:
-			s.handleBinaryGATK(writer, req, extras, key)
-		default:
-			log.Printf("Binary Unknown Opcode: 0x%02x", req.Opcode)
-			s.sendBinaryResponse(writer, req, resUnknownCmd, nil, nil, nil, 0)
-		}
+		start := time.Now()
+		quit := c.execBinary(req, bodyBuf)
+		c.recordLatency(start)
 
 		// Return pooled buffer
 		if poolToReturn != nil {
 			poolToReturn.Put(bodyBuf[:cap(bodyBuf)])
 		}
 
+		if quit {
+			c.writer.Flush()
+			return
+		}
+
 		if reader.Buffered() == 0 {
-			writer.Flush()
+			c.writer.Flush()
+		}
+	}
+}
+
+// processBinary executes all complete requests in buf without blocking.
+// It returns the number of bytes consumed; an incomplete trailing request
+// is left in buf until more data arrives.
+func (c *conn) processBinary(buf []byte) (consumed int, quit bool) {
+	for consumed < len(buf) {
+		// The input after a request that waits for a worker waits for its response
+		if c.blocked.Load() {
+			return consumed, false
+		}
+		rest := buf[consumed:]
+
+		// Discard the remainder of an oversized body
+		if c.skip > 0 {
+			n := min(c.skip, len(rest))
+			c.skip -= n
+			consumed += n
+			continue
+		}
+
+		if len(rest) < 24 {
+			return consumed, false
 		}
+		if rest[0] != reqMagic {
+			log.Printf("Invalid magic byte: %x", rest[0])
+			return consumed, true
+		}
+
+		req := parseBinaryHeader(rest)
+		bodyLen := int(req.BodyLen)
+
+		// Don't buffer bodies that can never be stored
+		if bodyLen > maxBinaryBodyLen {
+			c.sendBinaryResponse(req, resValueTooLarge, nil, nil, nil, 0)
+			c.skip = bodyLen
+			consumed += 24
+			continue
+		}
+
+		if len(rest) < 24+bodyLen {
+			return consumed, false
+		}
+		consumed += 24 + bodyLen
+
+		start := time.Now()
+		quit := c.execBinary(req, rest[24:24+bodyLen])
+		if c.blocked.Load() {
+			// Recorded when the request is done
+			c.started = start
+		} else {
+			c.recordLatency(start)
+		}
+		if quit {
+			return consumed, true
+		}
+	}
+	return consumed, false
+}
+
+// execBinary executes a single binary request.
+// It returns true if the connection should be closed.
+func (c *conn) execBinary(req binaryHeader, bodyBuf []byte) bool {
+	if int(req.ExtraLen)+int(req.KeyLen) > len(bodyBuf) {
+		c.sendBinaryResponse(req, resInvalidArgs, nil, nil, nil, 0)
+		return false
+	}
+
+	extras := bodyBuf[:req.ExtraLen]
+	key := string(bodyBuf[req.ExtraLen : uint32(req.ExtraLen)+uint32(req.KeyLen)])
+	value := bodyBuf[uint32(req.ExtraLen)+uint32(req.KeyLen):]
+
+	// Responses keep the quiet opcode, only the dispatch uses the regular one
+	opcode, quiet := quietOpcodes[req.Opcode]
+	if !quiet {
+		opcode = req.Opcode
+	}
+	c.quiet = quiet
+	c.lastCmd.Store(binaryCommands[req.Opcode])
+	if c.gc != nil && !loopBinary(opcode) {
+		c.offloadBinary(req, opcode, extras, key, value)
+		return false
+	}
+	return c.runBinary(req, opcode, extras, key, value)
+}
+
+// loopBinary reports whether a binary request runs on the event loop: it
+// doesn't wait for a worker or submits its request. The other requests are
+// offloaded.
+func loopBinary(opcode uint8) bool {
+	switch opcode {
+	case opGet, opGetQ, opGetK, opGetKQ, opSet, opAdd, opReplace, opDelete,
+		opQuit, opNoop, opVersion, opVerbosity:
+		return true
+	}
+	// Unknown opcodes only write an error
+	return binaryCommands[opcode] == nil
+}
+
+// offloadBinary offloads a binary request, with its body copied out of the
+// inbound buffer.
+func (c *conn) offloadBinary(req binaryHeader, opcode uint8, extras []byte, key string, value []byte) {
+	extrasCopy, valueCopy := bytes.Clone(extras), bytes.Clone(value)
+	c.offload(func() { c.runBinary(req, opcode, extrasCopy, key, valueCopy) })
+}
+
+// runBinary runs a binary request with the regular opcode, see execBinary.
+func (c *conn) runBinary(req binaryHeader, opcode uint8, extras []byte, key string, value []byte) bool {
+	switch opcode {
+	case opSet:
+		c.handleBinaryStorage(req, extras, key, value, "SET")
+	case opAdd:
+		c.handleBinaryStorage(req, extras, key, value, "ADD")
+	case opReplace:
+		c.handleBinaryStorage(req, extras, key, value, "REPLACE")
+	case opDelete:
+		c.handleBinaryDelete(req, key)
+	case opIncrement:
+		c.handleBinaryIncrDecr(req, extras, key, true)
+	case opDecrement:
+		c.handleBinaryIncrDecr(req, extras, key, false)
+	case opFlush:
+		c.handleBinaryFlush(req)
+	case opGet:
+		c.handleBinaryGet(req, key, false)
+	case opGetQ:
+		c.handleBinaryGet(req, key, true)
+	case opGetK:
+		c.handleBinaryGetK(req, key, false)
+	case opGetKQ:
+		c.handleBinaryGetK(req, key, true)
+	case opVersion:
+		c.handleBinaryVersion(req)
+	case opQuit:
+		c.sendBinaryResponse(req, resSuccess, nil, nil, nil, 0)
+		return true
+	case opNoop:
+		c.sendBinaryResponse(req, resSuccess, nil, nil, nil, 0)
+	case opAppend:
+		c.handleBinaryAppendPrepend(req, key, value, true)
+	case opPrepend:
+		c.handleBinaryAppendPrepend(req, key, value, false)
+	case opStat:
+		c.handleBinaryStats(req, key)
+	case opTouch:
+		c.handleBinaryTouch(req, extras, key)
+	case opGAT:
+		c.handleBinaryGATCommon(req, extras, key, false, false)
+	case opGATK:
+		c.handleBinaryGATCommon(req, extras, key, true, false)
+	case opGATQ:
+		c.handleBinaryGATCommon(req, extras, key, false, true)
+	case opGATKQ:
+		c.handleBinaryGATCommon(req, extras, key, true, true)
+	case opVerbosity:
+		// Accept verbosity without changing the log level
+		c.sendBinaryResponse(req, resSuccess, nil, nil, nil, 0)
+	default:
+		log.Printf("Binary Unknown Opcode: 0x%02x", req.Opcode)
+		c.sendBinaryResponse(req, resUnknownCmd, nil, nil, nil, 0)
 	}
+	return false
 }
 
-func (s *Server) handleBinaryStorage(writer *bufio.Writer, req binaryHeader, extras []byte, key string, value []byte, op string) {
+func (c *conn) handleBinaryStorage(req binaryHeader, extras []byte, key string, value []byte, op string) {
 	if len(extras) != 8 {
-		s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resInvalidArgs, nil, nil, nil, 0)
 		return
 	}
 
@@ -219,86 +378,116 @@ func (s *Server) handleBinaryStorage(writer *bufio.Writer, req binaryHeader, ext
 		}
 	}
 
+	if c.gc != nil {
+		r := &tqmemory.Request{Op: storageOps[op], Key: key, Value: bytes.Clone(value), TTL: ttl, Cas: req.CAS}
+		if req.CAS > 0 {
+			r.Op = tqmemory.OpCas
+		}
+		c.submit(r, func(resp *tqmemory.Response) { c.sendBinaryStored(req, resp.Cas, resp.Err) })
+		return
+	}
+
 	var err error
 	var newCas uint64
 	if req.CAS > 0 {
-		newCas, err = s.cache.Cas(key, value, ttl, req.CAS)
+		newCas, err = c.cache.Cas(key, value, ttl, req.CAS)
 	} else {
 		switch op {
 		case "SET":
-			newCas, err = s.cache.Set(key, value, ttl)
+			newCas, err = c.cache.Set(key, value, ttl)
 		case "ADD":
-			newCas, err = s.cache.Add(key, value, ttl)
+			newCas, err = c.cache.Add(key, value, ttl)
 		case "REPLACE":
-			newCas, err = s.cache.Replace(key, value, ttl)
+			newCas, err = c.cache.Replace(key, value, ttl)
 		}
 	}
+	c.sendBinaryStored(req, newCas, err)
+}
 
+// sendBinaryStored sends the response to a set, add or replace.
+func (c *conn) sendBinaryStored(req binaryHeader, newCas uint64, err error) {
 	if err != nil {
 		if err == tqmemory.ErrValueTooLarge {
-			s.sendBinaryResponse(writer, req, resValueTooLarge, nil, nil, nil, 0)
+			c.sendBinaryResponse(req, resValueTooLarge, nil, nil, nil, 0)
 			return
 		}
-		if err == os.ErrExist {
-			s.sendBinaryResponse(writer, req, resKeyExists, nil, nil, nil, 0)
+		if err == tqmemory.ErrKeyExists || err == tqmemory.ErrCasMismatch {
+			c.sendBinaryResponse(req, resKeyExists, nil, nil, nil, 0)
 			return
 		}
-		if err == os.ErrNotExist {
-			s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+		if err == tqmemory.ErrKeyNotFound {
+			c.sendBinaryResponse(req, resKeyNotFound, nil, nil, nil, 0)
 			return
 		}
-		s.sendBinaryResponse(writer, req, resItemNotStored, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resItemNotStored, nil, nil, nil, 0)
 		return
 	}
 
-	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, newCas)
+	c.sendBinaryResponse(req, resSuccess, nil, nil, nil, newCas)
 }
 
-func (s *Server) handleBinaryGet(writer *bufio.Writer, req binaryHeader, key string, quiet bool) {
-	val, cas, flags, err := s.cache.Get(key)
-	if err != nil {
-		if quiet {
-			return
-		}
-		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+func (c *conn) handleBinaryGet(req binaryHeader, key string, quiet bool) {
+	if c.gc != nil {
+		c.submit(&tqmemory.Request{Op: tqmemory.OpGet, Key: key}, func(resp *tqmemory.Response) {
+			c.sendBinaryValue(req, nil, resp.Value, resp.Cas, resp.Flags, resp.Err, quiet)
+		})
 		return
 	}
+	val, cas, flags, err := c.cache.Get(key)
+	c.sendBinaryValue(req, nil, val, cas, flags, err, quiet)
+}
 
-	// Use pooled extras buffer, set flags in last byte
-	extras := extrasPool.Get().([]byte)
-	extras[0], extras[1], extras[2], extras[3] = 0, 0, 0, byte(flags)
-	s.sendBinaryResponse(writer, req, resSuccess, extras, nil, val, cas)
-	extrasPool.Put(extras)
+func (c *conn) handleBinaryGetK(req binaryHeader, key string, quiet bool) {
+	if c.gc != nil {
+		c.submit(&tqmemory.Request{Op: tqmemory.OpGet, Key: key}, func(resp *tqmemory.Response) {
+			c.sendBinaryValue(req, []byte(key), resp.Value, resp.Cas, resp.Flags, resp.Err, quiet)
+		})
+		return
+	}
+	val, cas, flags, err := c.cache.Get(key)
+	c.sendBinaryValue(req, []byte(key), val, cas, flags, err, quiet)
 }
 
-func (s *Server) handleBinaryGetK(writer *bufio.Writer, req binaryHeader, key string, quiet bool) {
-	val, cas, flags, err := s.cache.Get(key)
+// sendBinaryValue sends the response to a get, with the key if not nil.
+// A quiet get doesn't report a miss.
+func (c *conn) sendBinaryValue(req binaryHeader, key, val []byte, cas uint64, flags int, err error, quiet bool) {
 	if err != nil {
 		if quiet {
 			return
 		}
-		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resKeyNotFound, nil, nil, nil, 0)
 		return
 	}
+
 	// Use pooled extras buffer, set flags in last byte
 	extras := extrasPool.Get().([]byte)
 	extras[0], extras[1], extras[2], extras[3] = 0, 0, 0, byte(flags)
-	s.sendBinaryResponse(writer, req, resSuccess, extras, []byte(key), val, cas)
+	c.sendBinaryResponse(req, resSuccess, extras, key, val, cas)
 	extrasPool.Put(extras)
 }
 
-func (s *Server) handleBinaryDelete(writer *bufio.Writer, req binaryHeader, key string) {
-	err := s.cache.Delete(key)
+func (c *conn) handleBinaryDelete(req binaryHeader, key string) {
+	if c.gc != nil {
+		c.submit(&tqmemory.Request{Op: tqmemory.OpDelete, Key: key}, func(resp *tqmemory.Response) {
+			c.sendBinaryDeleted(req, resp.Err)
+		})
+		return
+	}
+	c.sendBinaryDeleted(req, c.cache.Delete(key))
+}
+
+// sendBinaryDeleted sends the response to a delete.
+func (c *conn) sendBinaryDeleted(req binaryHeader, err error) {
 	if err == nil {
-		s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resSuccess, nil, nil, nil, 0)
 	} else {
-		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resKeyNotFound, nil, nil, nil, 0)
 	}
 }
 
-func (s *Server) handleBinaryIncrDecr(writer *bufio.Writer, req binaryHeader, extras []byte, key string, incr bool) {
-	if len(extras) < 20 {
-		s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
+func (c *conn) handleBinaryIncrDecr(req binaryHeader, extras []byte, key string, incr bool) {
+	if len(extras) != 20 {
+		c.sendBinaryResponse(req, resInvalidArgs, nil, nil, nil, 0)
 		return
 	}
 
@@ -310,94 +499,98 @@ func (s *Server) handleBinaryIncrDecr(writer *bufio.Writer, req binaryHeader, ex
 	var cas uint64
 	var err error
 
-	if incr {
-		newVal, cas, err = s.cache.Increment(key, delta)
-	} else {
-		newVal, cas, err = s.cache.Decrement(key, delta)
-	}
-
-	if err == os.ErrNotExist {
-		if expiry == 0xFFFFFFFF {
-			s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
-			return
+	// Expiry 0xffffffff means the counter must exist, otherwise it is
+	// created with the initial value in the same worker operation
+	if expiry == 0xFFFFFFFF {
+		if incr {
+			newVal, cas, err = c.cache.Increment(key, delta)
+		} else {
+			newVal, cas, err = c.cache.Decrement(key, delta)
 		}
-
-		var ttl time.Duration
-		if expiry > 0 {
-			if expiry > 2592000 {
-				ttl = time.Until(time.Unix(int64(expiry), 0))
-			} else {
-				ttl = time.Duration(expiry) * time.Second
-			}
+	} else {
+		ttl := exptimeToTTL(int64(expiry))
+		if incr {
+			newVal, cas, err = c.cache.IncrementOrCreate(key, delta, initial, ttl)
+		} else {
+			newVal, cas, err = c.cache.DecrementOrCreate(key, delta, initial, ttl)
 		}
+	}
 
-		initS := strconv.FormatUint(initial, 10)
-		cas, err = s.cache.Set(key, []byte(initS), ttl)
-		if err != nil {
-			s.sendBinaryResponse(writer, req, resItemNotStored, nil, nil, nil, 0)
-			return
+	if err != nil {
+		switch err {
+		case tqmemory.ErrKeyNotFound:
+			c.sendBinaryResponse(req, resKeyNotFound, nil, nil, nil, 0)
+		case tqmemory.ErrNotNumeric:
+			c.sendBinaryResponse(req, resNonNumeric, nil, nil, nil, 0)
+		default:
+			c.sendBinaryResponse(req, resInvalidArgs, nil, nil, nil, 0)
 		}
-		newVal = initial
-	} else if err != nil {
-		s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
 		return
 	}
 
 	resBody := make([]byte, 8)
 	binary.BigEndian.PutUint64(resBody, newVal)
-	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, resBody, cas)
+	c.sendBinaryResponse(req, resSuccess, nil, nil, resBody, cas)
 }
 
-func (s *Server) handleBinaryFlush(writer *bufio.Writer, req binaryHeader) {
-	s.cache.FlushAll()
-	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, 0)
+func (c *conn) handleBinaryFlush(req binaryHeader) {
+	c.cache.FlushAll()
+	c.sendBinaryResponse(req, resSuccess, nil, nil, nil, 0)
 }
 
-func (s *Server) handleBinaryAppendPrepend(writer *bufio.Writer, req binaryHeader, key string, value []byte, isAppend bool) {
+func (c *conn) handleBinaryAppendPrepend(req binaryHeader, key string, value []byte, isAppend bool) {
 	if req.ExtraLen != 0 {
-		s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resInvalidArgs, nil, nil, nil, 0)
 		return
 	}
 
 	var err error
 	var cas uint64
 	if isAppend {
-		cas, err = s.cache.Append(key, value)
+		cas, err = c.cache.Append(key, value)
 	} else {
-		cas, err = s.cache.Prepend(key, value)
+		cas, err = c.cache.Prepend(key, value)
 	}
 
 	if err != nil {
 		if err == tqmemory.ErrValueTooLarge {
-			s.sendBinaryResponse(writer, req, resValueTooLarge, nil, nil, nil, 0)
-			return
-		}
-		if err == os.ErrNotExist {
-			s.sendBinaryResponse(writer, req, resItemNotStored, nil, nil, nil, 0)
+			c.sendBinaryResponse(req, resValueTooLarge, nil, nil, nil, 0)
 			return
 		}
-		s.sendBinaryResponse(writer, req, resItemNotStored, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resItemNotStored, nil, nil, nil, 0)
 		return
 	}
 
-	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, cas)
+	c.sendBinaryResponse(req, resSuccess, nil, nil, nil, cas)
 }
 
-func (s *Server) handleBinaryVersion(writer *bufio.Writer, req binaryHeader) {
-	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, []byte("1.0.0"), 0)
+func (c *conn) handleBinaryVersion(req binaryHeader) {
+	c.sendBinaryResponse(req, resSuccess, nil, nil, []byte("1.0.0"), 0)
 }
 
-func (s *Server) handleBinaryStats(writer *bufio.Writer, req binaryHeader) {
-	stats := s.cache.Stats()
-	for k, v := range stats {
-		s.sendBinaryResponse(writer, req, resSuccess, nil, []byte(k), []byte(v), 0)
+// handleBinaryStats sends the stats of the group named by the key, one
+// response per stat, followed by an empty terminating response.
+func (c *conn) handleBinaryStats(req binaryHeader, key string) {
+	if key == "reset" {
+		c.resetStats()
+		c.sendBinaryResponse(req, resSuccess, nil, nil, nil, 0)
+		return
 	}
-	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, 0)
+
+	stats, ok := c.statsGroup(key)
+	if !ok {
+		c.sendBinaryResponse(req, resKeyNotFound, nil, nil, nil, 0)
+		return
+	}
+	for _, st := range stats {
+		c.sendBinaryResponse(req, resSuccess, nil, []byte(st.name), []byte(st.value), 0)
+	}
+	c.sendBinaryResponse(req, resSuccess, nil, nil, nil, 0)
 }
 
-func (s *Server) handleBinaryTouch(writer *bufio.Writer, req binaryHeader, extras []byte, key string) {
+func (c *conn) handleBinaryTouch(req binaryHeader, extras []byte, key string) {
 	if len(extras) != 4 {
-		s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resInvalidArgs, nil, nil, nil, 0)
 		return
 	}
 	expiry := binary.BigEndian.Uint32(extras[0:4])
@@ -410,25 +603,19 @@ func (s *Server) handleBinaryTouch(writer *bufio.Writer, req binaryHeader, extra
 		}
 	}
 
-	cas, err := s.cache.Touch(key, ttl)
+	cas, err := c.cache.Touch(key, ttl)
 	if err != nil {
-		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resKeyNotFound, nil, nil, nil, 0)
 		return
 	}
-	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, cas)
-}
-
-func (s *Server) handleBinaryGAT(writer *bufio.Writer, req binaryHeader, extras []byte, key string) {
-	s.handleBinaryGATCommon(writer, req, extras, key, false)
-}
-
-func (s *Server) handleBinaryGATK(writer *bufio.Writer, req binaryHeader, extras []byte, key string) {
-	s.handleBinaryGATCommon(writer, req, extras, key, true)
+	c.sendBinaryResponse(req, resSuccess, nil, nil, nil, cas)
 }
 
-func (s *Server) handleBinaryGATCommon(writer *bufio.Writer, req binaryHeader, extras []byte, key string, returnKey bool) {
+// handleBinaryGATCommon handles GAT, GATK and their quiet variants, which
+// like GETQ only suppress the response on a miss.
+func (c *conn) handleBinaryGATCommon(req binaryHeader, extras []byte, key string, returnKey bool, quiet bool) {
 	if len(extras) != 4 {
-		s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
+		c.sendBinaryResponse(req, resInvalidArgs, nil, nil, nil, 0)
 		return
 	}
 	expiry := binary.BigEndian.Uint32(extras[0:4])
@@ -441,15 +628,19 @@ func (s *Server) handleBinaryGATCommon(writer *bufio.Writer, req binaryHeader, e
 		}
 	}
 
-	cas, err := s.cache.Touch(key, ttl)
+	cas, err := c.cache.Touch(key, ttl)
 	if err != nil {
-		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+		if !quiet {
+			c.sendBinaryResponse(req, resKeyNotFound, nil, nil, nil, 0)
+		}
 		return
 	}
 
-	val, _, _, err := s.cache.Get(key)
+	val, _, _, err := c.cache.Get(key)
 	if err != nil {
-		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+		if !quiet {
+			c.sendBinaryResponse(req, resKeyNotFound, nil, nil, nil, 0)
+		}
 		return
 	}
 
@@ -459,10 +650,15 @@ func (s *Server) handleBinaryGATCommon(writer *bufio.Writer, req binaryHeader, e
 		keyBytes = []byte(key)
 	}
 
-	s.sendBinaryResponse(writer, req, resSuccess, resExtras, keyBytes, val, cas)
+	c.sendBinaryResponse(req, resSuccess, resExtras, keyBytes, val, cas)
 }
 
-func (s *Server) sendBinaryResponse(writer *bufio.Writer, req binaryHeader, status uint16, extras []byte, key []byte, value []byte, cas uint64) {
+func (c *conn) sendBinaryResponse(req binaryHeader, status uint16, extras []byte, key []byte, value []byte, cas uint64) {
+	// Quiet mutations only report errors
+	if c.quiet && status == resSuccess {
+		return
+	}
+
 	totalBodyLen := uint32(len(extras) + len(key) + len(value))
 	// Header is 24 bytes
 	var buf [24]byte
@@ -477,25 +673,25 @@ func (s *Server) sendBinaryResponse(writer *bufio.Writer, req binaryHeader, stat
 	binary.BigEndian.PutUint32(buf[12:16], req.Opaque)
 	binary.BigEndian.PutUint64(buf[16:24], cas)
 
-	if _, err := writer.Write(buf[:]); err != nil {
+	if _, err := c.writer.Write(buf[:]); err != nil {
 		log.Printf("Response Write Error: %v", err)
 		return
 	}
 
 	if len(extras) > 0 {
-		if _, err := writer.Write(extras); err != nil {
+		if _, err := c.writer.Write(extras); err != nil {
 			log.Printf("Response Write Extras Error: %v", err)
 			return
 		}
 	}
 	if len(key) > 0 {
-		if _, err := writer.Write(key); err != nil {
+		if _, err := c.writer.Write(key); err != nil {
 			log.Printf("Response Write Key Error: %v", err)
 			return
 		}
 	}
 	if len(value) > 0 {
-		if _, err := writer.Write(value); err != nil {
+		if _, err := c.writer.Write(value); err != nil {
 			log.Printf("Response Write Value Error: %v", err)
 			return
 		}
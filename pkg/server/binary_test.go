@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// binaryRequest encodes a binary protocol request.
+func binaryRequest(opcode uint8, opaque uint32, extras []byte, key, value string) []byte {
+	buf := make([]byte, 24, 24+len(extras)+len(key)+len(value))
+	buf[0] = reqMagic
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+	buf = append(buf, extras...)
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+type binaryResponse struct {
+	opcode uint8
+	status uint16
+	opaque uint32
+}
+
+// parseBinaryResponses decodes the headers of all responses in buf.
+func parseBinaryResponses(t *testing.T, buf []byte) []binaryResponse {
+	var responses []binaryResponse
+	for len(buf) > 0 {
+		if len(buf) < 24 || buf[0] != resMagic {
+			t.Fatalf("malformed response: %x", buf)
+		}
+		bodyLen := int(binary.BigEndian.Uint32(buf[8:12]))
+		responses = append(responses, binaryResponse{
+			opcode: buf[1],
+			status: binary.BigEndian.Uint16(buf[6:8]),
+			opaque: binary.BigEndian.Uint32(buf[12:16]),
+		})
+		buf = buf[24+bodyLen:]
+	}
+	return responses
+}
+
+func TestBinaryIncrementCreate(t *testing.T) {
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras[0:8], 5)
+	binary.BigEndian.PutUint64(extras[8:16], 100)
+
+	var out bytes.Buffer
+	c := newTestConn(newMapCache(), &out)
+	c.processBinary(binaryRequest(opIncrement, 1, extras, "counter", ""))
+	c.processBinary(binaryRequest(opIncrement, 2, extras, "counter", ""))
+	c.writer.Flush()
+
+	// The first request creates the counter, the second increments it
+	buf := out.Bytes()
+	for _, want := range []uint64{100, 105} {
+		if len(buf) < 32 || binary.BigEndian.Uint16(buf[6:8]) != resSuccess {
+			t.Fatalf("unexpected response: %x", buf)
+		}
+		if got := binary.BigEndian.Uint64(buf[24:32]); got != want {
+			t.Errorf("counter = %d, want %d", got, want)
+		}
+		buf = buf[32:]
+	}
+}
+
+func TestBinaryIncrementExtrasLength(t *testing.T) {
+	var out bytes.Buffer
+	c := newTestConn(newMapCache(), &out)
+	for i, n := range []int{0, 16, 24} {
+		c.processBinary(binaryRequest(opIncrement, uint32(i), make([]byte, n), "counter", ""))
+	}
+	c.writer.Flush()
+
+	got := parseBinaryResponses(t, out.Bytes())
+	if len(got) != 3 {
+		t.Fatalf("got %d responses %v, want 3", len(got), got)
+	}
+	for i, res := range got {
+		if res.status != resInvalidArgs {
+			t.Errorf("response %d has status %#x, want %#x", i, res.status, resInvalidArgs)
+		}
+	}
+}
+
+func TestBinaryQuietOpcodes(t *testing.T) {
+	storeExtras := make([]byte, 8)
+	incrExtras := make([]byte, 20)
+	binary.BigEndian.PutUint64(incrExtras[0:8], 1)
+	binary.BigEndian.PutUint32(incrExtras[16:20], 0xffffffff)
+	touchExtras := make([]byte, 4)
+
+	var in []byte
+	in = append(in, binaryRequest(opSetQ, 1, storeExtras, "foo", "1")...)
+	in = append(in, binaryRequest(opAddQ, 2, storeExtras, "foo", "2")...)
+	in = append(in, binaryRequest(opReplaceQ, 3, storeExtras, "missing", "3")...)
+	in = append(in, binaryRequest(opAppendQ, 4, nil, "foo", "0")...)
+	in = append(in, binaryRequest(opPrependQ, 5, nil, "missing", "0")...)
+	in = append(in, binaryRequest(opIncrementQ, 6, incrExtras, "foo", "")...)
+	in = append(in, binaryRequest(opDecrementQ, 7, incrExtras, "missing", "")...)
+	in = append(in, binaryRequest(opGATQ, 8, touchExtras, "missing", "")...)
+	in = append(in, binaryRequest(opGATKQ, 9, touchExtras, "foo", "")...)
+	in = append(in, binaryRequest(opDeleteQ, 10, nil, "foo", "")...)
+	in = append(in, binaryRequest(opDeleteQ, 11, nil, "foo", "")...)
+	in = append(in, binaryRequest(opFlushQ, 12, nil, "", "")...)
+	in = append(in, binaryRequest(opVerbosity, 13, touchExtras, "", "")...)
+	in = append(in, binaryRequest(opNoop, 14, nil, "", "")...)
+	in = append(in, binaryRequest(opQuitQ, 15, nil, "", "")...)
+	in = append(in, binaryRequest(opNoop, 16, nil, "", "")...)
+
+	var out bytes.Buffer
+	c := newTestConn(newMapCache(), &out)
+	consumed, quit := c.processBinary(in)
+	c.writer.Flush()
+
+	if !quit {
+		t.Error("expected QuitQ to close the connection")
+	}
+	if consumed == len(in) {
+		t.Error("expected requests after QuitQ to be left unprocessed")
+	}
+
+	// Only failures, hits and non-quiet responses are sent, in request order
+	want := []binaryResponse{
+		{opAddQ, resKeyExists, 2},
+		{opReplaceQ, resKeyNotFound, 3},
+		{opPrependQ, resItemNotStored, 5},
+		{opDecrementQ, resKeyNotFound, 7},
+		{opGATKQ, resSuccess, 9},
+		{opDeleteQ, resKeyNotFound, 11},
+		{opVerbosity, resSuccess, 13},
+		{opNoop, resSuccess, 14},
+	}
+	got := parseBinaryResponses(t, out.Bytes())
+	if len(got) != len(want) {
+		t.Fatalf("got %d responses %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("response %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBinaryGATOpcodes(t *testing.T) {
+	// The opcodes of memcached's protocol_binary.h, not the package constants
+	const (
+		set            = 0x01
+		noop           = 0x0a
+		gat            = 0x1d
+		gatq           = 0x1e
+		saslListMechs  = 0x20
+		gatk           = 0x23
+		gatkq          = 0x24
+		unknownCommand = 0x0081
+	)
+	storeExtras := make([]byte, 8)
+	touchExtras := make([]byte, 4)
+
+	var in []byte
+	in = append(in, binaryRequest(set, 1, storeExtras, "foo", "bar")...)
+	in = append(in, binaryRequest(gat, 2, touchExtras, "foo", "")...)
+	in = append(in, binaryRequest(gatq, 3, touchExtras, "missing", "")...)
+	in = append(in, binaryRequest(gatq, 4, touchExtras, "foo", "")...)
+	in = append(in, binaryRequest(gatk, 5, touchExtras, "foo", "")...)
+	in = append(in, binaryRequest(gatkq, 6, touchExtras, "missing", "")...)
+	in = append(in, binaryRequest(gatkq, 7, touchExtras, "foo", "")...)
+	in = append(in, binaryRequest(saslListMechs, 8, nil, "", "")...)
+	in = append(in, binaryRequest(noop, 9, nil, "", "")...)
+
+	var out bytes.Buffer
+	c := newTestConn(newMapCache(), &out)
+	c.processBinary(in)
+	c.writer.Flush()
+
+	// The quiet misses are not answered, only GATK and GATKQ return the key
+	want := []struct {
+		res binaryResponse
+		key string
+	}{
+		{binaryResponse{set, resSuccess, 1}, ""},
+		{binaryResponse{gat, resSuccess, 2}, ""},
+		{binaryResponse{gatq, resSuccess, 4}, ""},
+		{binaryResponse{gatk, resSuccess, 5}, "foo"},
+		{binaryResponse{gatkq, resSuccess, 7}, "foo"},
+		{binaryResponse{saslListMechs, unknownCommand, 8}, ""},
+		{binaryResponse{noop, resSuccess, 9}, ""},
+	}
+	got := parseBinaryResponses(t, out.Bytes())
+	if len(got) != len(want) {
+		t.Fatalf("got %d responses %v, want %d", len(got), got, len(want))
+	}
+	buf := out.Bytes()
+	for i := range want {
+		if got[i] != want[i].res {
+			t.Errorf("response %d = %+v, want %+v", i, got[i], want[i].res)
+		}
+		extrasLen := int(buf[4])
+		keyLen := int(binary.BigEndian.Uint16(buf[2:4]))
+		if key := string(buf[24+extrasLen : 24+extrasLen+keyLen]); key != want[i].key {
+			t.Errorf("response %d has key %q, want %q", i, key, want[i].key)
+		}
+		buf = buf[24+binary.BigEndian.Uint32(buf[8:12]):]
+	}
+}
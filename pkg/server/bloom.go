@@ -0,0 +1,73 @@
+package server
+
+import "strconv"
+
+// handleTextBFReserve handles:
+// bfreserve <key> <exptime> <error_rate> <capacity> [noreply]
+// It responds with OK, or EXISTS if the key exists.
+func (c *conn) handleTextBFReserve(tokens [][]byte) {
+	if len(tokens) < 5 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, ok := parseInt(tokens[2])
+	errorRate, err := strconv.ParseFloat(string(tokens[3]), 64)
+	capacity, err2 := strconv.Atoi(string(tokens[4]))
+	if !ok || err != nil || err2 != nil {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if err := c.cache.BFReserve(string(tokens[1]), exptimeToTTL(exptime), errorRate, capacity); err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !isNoreply(tokens, 5) {
+		c.writer.WriteString("OK\r\n")
+	}
+}
+
+// handleTextBFAdd handles: bfadd <key> <exptime> <item>... [noreply]
+// A missing filter is created with the exptime for 100 items with an error
+// rate of 1%. It responds with the number of items that were not in the
+// filter yet.
+func (c *conn) handleTextBFAdd(tokens [][]byte) {
+	tokens, noreply := trimNoreply(tokens)
+	if len(tokens) < 4 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, ok := parseInt(tokens[2])
+	items, ok2 := parseMembers(tokens[3:])
+	if !ok || !ok2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	n, err := c.cache.BFAdd(string(tokens[1]), exptimeToTTL(exptime), items...)
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !noreply {
+		c.writeUint(uint64(n))
+		c.writer.WriteString("\r\n")
+	}
+}
+
+// handleTextBFExists handles: bfexists <key> <item>
+// It responds with 1 if the item may have been added, and 0 if not.
+func (c *conn) handleTextBFExists(tokens [][]byte) {
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	ok, err := c.cache.BFExists(string(tokens[1]), string(tokens[2]))
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if ok {
+		c.writer.WriteString("1\r\n")
+	} else {
+		c.writer.WriteString("0\r\n")
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+func TestTextBloomFilter(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"bfreserve seen 0 0.001 1000", "OK\r\n"},
+		{"bfreserve seen 0 0.01 10", "EXISTS\r\n"},
+		{"bfreserve bad 0 2 10", "CLIENT_ERROR " + tqmemory.ErrBloomParams.Error() + "\r\n"},
+		{"bfreserve huge 0 0.001 100000000", "CLIENT_ERROR " + tqmemory.ErrBloomParams.Error() + "\r\n"},
+		{"bfadd seen 0 id1 id2 id1", "2\r\n"},
+		{"bfadd seen 0 id2", "0\r\n"},
+		{"bfexists seen id1", "1\r\n"},
+		{"bfexists seen id3", "0\r\n"},
+		{"bfadd auto 0 x noreply", ""},
+		{"bfexists auto x", "1\r\n"},
+		{"bfexists none x", "0\r\n"},
+	})
+}
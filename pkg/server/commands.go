@@ -0,0 +1,66 @@
+package server
+
+import "time"
+
+// command identifies a protocol command for stats conns and the latency
+// histograms. Text and binary commands with the same name share a command.
+type command struct {
+	id   int // index in commands and Server.latency
+	name string
+}
+
+// commands holds all known commands by id.
+var commands []*command
+
+// commandNamed returns the command with the given name, adding it if new.
+func commandNamed(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	cmd := &command{id: len(commands), name: name}
+	commands = append(commands, cmd)
+	return cmd
+}
+
+// textCommands holds the text commands by their lower case name.
+var textCommands = func() map[string]*command {
+	m := make(map[string]*command)
+	for _, name := range []string{"set", "add", "replace", "append", "prepend",
+		"cas", "get", "gets", "delete", "incr", "decr", "touch", "gat", "gats",
+		"flush_all", "ma", "mi", "ms", "mn", "verbosity", "quit", "version", "stats", "slowlog", "watch", "keyspace", "lru_crawler",
+		"subscribe", "publish", "hset", "hget", "hgetall", "hdel", "hincrby",
+		"lpush", "rpush", "lpop", "rpop", "blpop", "brpop", "lrange", "ltrim", "llen",
+		"sadd", "srem", "sismember", "smembers", "scard",
+		"zadd", "zincrby", "zrem", "zrange", "zrangebyscore", "zrank", "zscore",
+		"pfadd", "pfcount", "pfmerge", "bfreserve", "bfadd", "bfexists",
+		"ns_invalidate", "ns_generation", "tag_invalidate",
+		"admin", "delete_pattern"} {
+		m[name] = commandNamed(name)
+	}
+	return m
+}()
+
+// binaryCommands holds the binary commands by opcode (0x00 to 0x24). The
+// unsupported HELLO and SASL opcodes (0x1f to 0x22) have no command.
+var binaryCommands = func() (cmds [256]*command) {
+	for op, name := range []string{"get", "set", "add", "replace", "delete",
+		"incr", "decr", "quit", "flush", "getq", "noop", "version", "getk",
+		"getkq", "append", "prepend", "stats", "setq", "addq", "replaceq",
+		"deleteq", "incrq", "decrq", "quitq", "flushq", "appendq", "prependq",
+		"verbosity", "touch", "gat", "gatq", "", "", "", "", "gatk", "gatkq"} {
+		if name != "" {
+			cmds[op] = commandNamed(name)
+		}
+	}
+	return cmds
+}()
+
+// recordLatency records the time since start for the last command of the
+// connection.
+func (c *conn) recordLatency(start time.Time) {
+	if cmd := c.lastCmd.Load(); cmd != nil {
+		c.latency[cmd.id].Record(time.Since(start))
+	}
+}
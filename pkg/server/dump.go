@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"strconv"
+	"time"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// handleTextLruCrawler handles: lru_crawler metadump all|<shard>
+// Other lru_crawler subcommands have no equivalent, there is no crawler.
+// On the event loop the dump is written by another goroutine.
+func (c *conn) handleTextLruCrawler(tokens [][]byte) {
+	if len(tokens) != 3 || string(tokens[1]) != "metadump" {
+		c.writer.WriteString("CLIENT_ERROR usage: lru_crawler metadump all|<shard>\r\n")
+		return
+	}
+	shard := -1
+	if arg := string(tokens[2]); arg != "all" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 || n >= c.cache.WorkerCount() {
+			c.writer.WriteString("CLIENT_ERROR shard out of range\r\n")
+			return
+		}
+		shard = n
+	}
+
+	c.detach(func(w *bufio.Writer) {
+		var buf []byte
+		c.cache.Metadump(shard, func(meta tqmemory.ItemMeta) bool {
+			buf = appendMetadump(buf[:0], &meta)
+			_, err := w.Write(buf)
+			return err == nil
+		})
+		w.WriteString("END\r\n")
+	})
+}
+
+// appendMetadump appends an item in memcached's metadump format, followed
+// by the hard expiry: "key=foo exp=1700000060 la=1700000000 cas=1 fetch=no cls=1 size=63 hexp=1700000120".
+// Times are Unix seconds, -1 when the item does not expire.
+func appendMetadump(buf []byte, meta *tqmemory.ItemMeta) []byte {
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return -1
+		}
+		return t.Unix()
+	}
+	buf = append(buf, "key="...)
+	buf = appendURIEncoded(buf, meta.Key)
+	buf = append(buf, " exp="...)
+	buf = strconv.AppendInt(buf, unix(meta.SoftExpiry), 10)
+	buf = append(buf, " la="...)
+	buf = strconv.AppendInt(buf, meta.LastAccess.Unix(), 10)
+	buf = append(buf, " cas="...)
+	buf = strconv.AppendUint(buf, meta.Cas, 10)
+	buf = append(buf, " fetch="...)
+	buf = append(buf, yesNo(meta.Fetched)...)
+	buf = append(buf, " cls="...)
+	buf = strconv.AppendInt(buf, int64(meta.Class), 10)
+	buf = append(buf, " size="...)
+	buf = strconv.AppendInt(buf, int64(meta.Size), 10)
+	buf = append(buf, " hexp="...)
+	buf = strconv.AppendInt(buf, unix(meta.HardExpiry), 10)
+	return append(buf, '\n')
+}
+
+// handleTextCachedump handles: stats cachedump <class> <limit>
+// It lists up to limit items (all if 0) of a size class as
+// "ITEM <key> [<value bytes> b; <expiry> s]", with expiry 0 for items that
+// don't expire, like memcached. On the event loop the dump is written by
+// another goroutine.
+func (c *conn) handleTextCachedump(tokens [][]byte) {
+	if len(tokens) != 4 {
+		c.writer.WriteString("CLIENT_ERROR bad command line\r\n")
+		return
+	}
+	class, err1 := strconv.Atoi(string(tokens[2]))
+	limit, err2 := strconv.Atoi(string(tokens[3]))
+	if err1 != nil || err2 != nil || limit < 0 {
+		c.writer.WriteString("CLIENT_ERROR bad command line\r\n")
+		return
+	}
+
+	c.detach(func(w *bufio.Writer) {
+		count := 0
+		c.cache.Metadump(-1, func(meta tqmemory.ItemMeta) bool {
+			if meta.Class != class {
+				return true
+			}
+			var exp int64
+			if !meta.SoftExpiry.IsZero() {
+				exp = meta.SoftExpiry.Unix()
+			}
+			_, err := w.WriteString("ITEM " + meta.Key + " [" + strconv.Itoa(meta.Size-len(meta.Key)) +
+				" b; " + strconv.FormatInt(exp, 10) + " s]\r\n")
+			count++
+			return err == nil && (limit == 0 || count < limit)
+		})
+		w.WriteString("END\r\n")
+	})
+}
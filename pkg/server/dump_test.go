@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTextMetadump(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"set a:b 0 0 3\r\nbar", "STORED\r\n"},
+		{"set big 0 0 200\r\n" + strings.Repeat("x", 200), "STORED\r\n"},
+	})
+
+	out.Reset()
+	processAll(c, []byte("lru_crawler metadump all\r\n"))
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 4 || lines[2] != "END\r" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	var found bool
+	for _, line := range lines[:2] {
+		if strings.HasPrefix(line, "key=a%3Ab exp=-1 la=") {
+			found = strings.Contains(line, " fetch=no cls=1 size=6 hexp=-1")
+		}
+	}
+	if !found {
+		t.Errorf("missing a:b in %q", out.String())
+	}
+
+	runTextTests(t, c, out, []textTest{
+		{"stats cachedump 1 0", "ITEM a:b [3 b; 0 s]\r\nEND\r\n"},
+		{"stats cachedump 5 1", "ITEM big [200 b; 0 s]\r\nEND\r\n"},
+		{"stats cachedump 2 0", "END\r\n"},
+		{"stats cachedump 1", "CLIENT_ERROR bad command line\r\n"},
+		{"lru_crawler metadump 2", "CLIENT_ERROR shard out of range\r\n"},
+		{"lru_crawler crawl all", "CLIENT_ERROR usage: lru_crawler metadump all|<shard>\r\n"},
+	})
+}
+
+func TestMetadumpEventLoop(t *testing.T) {
+	cache := newTestCache(t)
+	for i := range 5000 {
+		cache.Set("key"+strconv.Itoa(i), []byte("value"), 0)
+	}
+	nc := dialTest(t, startEventLoop(t, cache))
+
+	// The commands after the dump are answered after it
+	nc.Write([]byte("set before 0 0 1\r\nx\r\nlru_crawler metadump all\r\nstats cachedump 1 2\r\nget before\r\n"))
+	r := bufio.NewReader(nc)
+	if line, _ := r.ReadString('\n'); line != "STORED\r\n" {
+		t.Fatalf("got %q, want STORED", line)
+	}
+	items := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		if !strings.HasPrefix(line, "key=") {
+			t.Fatalf("unexpected dump line %q", line)
+		}
+		items++
+	}
+	if items != 5001 {
+		t.Errorf("got %d items, want 5001", items)
+	}
+	want := "ITEM "
+	for range 2 {
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, want) {
+			t.Errorf("got %q, want an item", line)
+		}
+	}
+	want = "END\r\nVALUE before 0 1\r\nx\r\nEND\r\n"
+	if got := readReply(t, r, len(want)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
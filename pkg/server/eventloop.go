@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// writerPool pools response writers for the event-loop backend, so idle
+// connections don't hold on to a write buffer.
+var writerPool = sync.Pool{
+	New: func() any { return bufio.NewWriterSize(nil, 65536) },
+}
+
+// eventLoop is the gnet event handler of the event-loop backend.
+// Connections are multiplexed over a few epoll (kqueue on BSD) event loops
+// instead of running a goroutine per connection. Requests are parsed
+// incrementally from the inbound buffer and executed as soon as they are
+// complete, but the loop never waits for a worker: the common commands are
+// submitted to the worker and answered when the loop is woken with the
+// response, the other commands that need a worker are offloaded to another
+// goroutine. Until then the input of the connection is not processed, so
+// the responses stay in order.
+type eventLoop struct {
+	gnet.BuiltinEventEngine
+	s *Server
+}
+
+// StartEventLoop runs the server on the event-loop backend (TCP or Unix
+// socket based on address). It blocks until the engine stops.
+func (s *Server) StartEventLoop() error {
+	network := s.network()
+	if network == "unix" {
+		// Remove existing socket file if present
+		os.Remove(s.addr)
+	}
+
+	s.eventLoop = true
+	log.Printf("Listening on %s %s with event loop (max connections: %d)", network, s.addr, s.maxConnections)
+
+	return gnet.Run(&eventLoop{s: s}, network+"://"+s.addr,
+		gnet.WithMulticore(true),
+		gnet.WithTCPNoDelay(gnet.TCPNoDelay),
+		gnet.WithReuseAddr(true),
+	)
+}
+
+func (el *eventLoop) OnOpen(gc gnet.Conn) ([]byte, gnet.Action) {
+	// Check connection limit
+	if atomic.AddInt32(&el.s.currConns, 1) > el.s.maxConnections {
+		log.Printf("Connection limit reached (%d), rejecting %s", el.s.maxConnections, gc.RemoteAddr())
+		atomic.AddInt32(&el.s.currConns, -1)
+		return nil, gnet.Close
+	}
+	atomic.AddUint64(&el.s.totalConns, 1)
+	// Only what every connection needs, the rest is made on first use
+	c := &conn{Server: el.s, out: statsWriter{w: gc, s: el.s}, gc: gc}
+	el.s.register(c, gc.RemoteAddr())
+	gc.SetContext(c)
+	return nil, gnet.None
+}
+
+func (el *eventLoop) OnClose(gc gnet.Conn, err error) gnet.Action {
+	if c, ok := gc.Context().(*conn); ok {
+		el.s.unregister(c)
+		if c.async != nil {
+			c.async.close()
+		}
+		atomic.AddInt32(&el.s.currConns, -1)
+	}
+	return gnet.None
+}
+
+func (el *eventLoop) OnTraffic(gc gnet.Conn) gnet.Action {
+	c := gc.Context().(*conn)
+	// A detached or offloaded command is done, the input after it can be processed
+	if c.resumed.Swap(false) {
+		c.blocked.Store(false)
+	}
+	resp := c.reply.Swap(nil)
+	if c.blocked.Load() && resp == nil {
+		// The command still runs, and may be using the writer
+		return gnet.None
+	}
+
+	c.busy()
+	c.writer = writerPool.Get().(*bufio.Writer)
+	c.writer.Reset(&c.out)
+
+	// The worker answered the submitted command
+	if resp != nil {
+		c.respond(resp)
+		c.respond = nil
+		c.recordLatency(c.started)
+		c.blocked.Store(false)
+	}
+
+	quit := el.process(gc, c)
+
+	c.writer.Flush()
+	c.writer.Reset(nil)
+	writerPool.Put(c.writer)
+	c.writer = nil
+
+	// Started only now, so the command has the writer to itself
+	if fn := c.offloaded; fn != nil {
+		c.offloaded = nil
+		go c.runOffloaded(fn)
+	}
+
+	if quit {
+		return gnet.Close
+	}
+	return gnet.None
+}
+
+// process executes the complete requests in the inbound buffer of gc and
+// reports whether the connection should be closed.
+func (el *eventLoop) process(gc gnet.Conn, c *conn) bool {
+	buf, err := gc.Peek(-1)
+	if err != nil || len(buf) == 0 {
+		return false
+	}
+
+	// Detect the protocol on the first byte of the connection
+	if !c.detected {
+		c.binary = buf[0] == reqMagic
+		c.detected = true
+	}
+
+	// The unconsumed bytes of the previous call were already counted
+	atomic.AddUint64(&el.s.bytesRead, uint64(len(buf)-c.pending))
+
+	var consumed int
+	var quit bool
+	if c.binary {
+		consumed, quit = c.processBinary(buf)
+	} else {
+		consumed, quit = c.processText(buf)
+	}
+	// Discard(0) would drop the whole inbound buffer
+	if consumed > 0 {
+		gc.Discard(consumed)
+	}
+	c.pending = len(buf) - consumed
+	if c.pending > 0 {
+		c.state.Store(connNread)
+	} else {
+		c.state.Store(connWaiting)
+	}
+	return quit
+}
+
+// submit sends req to its worker without waiting for the response. respond
+// writes the response on the event loop once the worker answered; the input
+// after the command is not processed until then, so the responses stay in
+// order. req must not refer to the inbound buffer, it is reused before the
+// worker gets to the request.
+func (c *conn) submit(req *tqmemory.Request, respond func(resp *tqmemory.Response)) {
+	c.blocked.Store(true)
+	c.respond = respond
+	if c.replied == nil {
+		c.replied = c.storeReply
+	}
+	req.Done = c.replied
+	c.cache.Submit(req)
+}
+
+// storeReply stores the response of the submitted command and wakes the
+// event loop to write it. It runs on the worker.
+func (c *conn) storeReply(resp *tqmemory.Response) {
+	c.reply.Store(resp)
+	c.wake()
+}
+
+// wake processes the pending input of the connection again.
+func (c *conn) wake() {
+	c.gc.Wake(nil)
+}
+
+// streamWriter returns the writer for output from other goroutines. On the
+// event loop it is made on first use, so idle connections don't hold one;
+// it must be called on the event loop, before the output is written.
+func (c *conn) streamWriter() io.Writer {
+	if c.stream == nil {
+		c.async = newAsyncWriter(c.gc)
+		c.stream = &statsWriter{w: c.async, s: c.Server}
+	}
+	return c.stream
+}
+
+// offload runs fn, a command that waits for workers, on another goroutine
+// once the event loop is done with the connection. fn writes its response
+// to c.writer, the input after the command is processed when it returned.
+// fn must not refer to the inbound buffer.
+func (c *conn) offload(fn func()) {
+	c.blocked.Store(true)
+	c.offloaded = fn
+	// Made here, runOffloaded writes to it from another goroutine
+	c.streamWriter()
+}
+
+// runOffloaded runs an offloaded command and wakes the event loop.
+func (c *conn) runOffloaded(fn func()) {
+	c.writer = writerPool.Get().(*bufio.Writer)
+	c.writer.Reset(c.stream)
+	fn()
+	c.recordLatency(c.started)
+	// Returns once the output was handed to the event loop
+	c.writer.Flush()
+	c.writer.Reset(nil)
+	writerPool.Put(c.writer)
+	c.writer = nil
+	c.resumed.Store(true)
+	c.wake()
+}
+
+// cloneTokens copies tokens out of the inbound buffer, for a command that
+// is executed after the loop moved on.
+func cloneTokens(tokens [][]byte) [][]byte {
+	n := 0
+	for _, token := range tokens {
+		n += len(token)
+	}
+	buf := make([]byte, 0, n)
+	clone := make([][]byte, len(tokens))
+	for i, token := range tokens {
+		start := len(buf)
+		buf = append(buf, token...)
+		clone[i] = buf[start:len(buf):len(buf)]
+	}
+	return clone
+}
+
+// detach runs fn on another goroutine when the connection is served by an
+// event loop, so a command that waits or writes a lot doesn't hold up the
+// other connections of the loop. fn writes its response to w. The input
+// after the command is only processed when the loop runs again after fn
+// returned, so the responses stay in order. Without an event loop, or when
+// the command was offloaded already, fn runs right away and writes to
+// c.writer.
+func (c *conn) detach(fn func(w *bufio.Writer)) {
+	if c.gc == nil || c.blocked.Load() {
+		fn(c.writer)
+		return
+	}
+	c.blocked.Store(true)
+	stream := c.streamWriter()
+	go func() {
+		w := bufio.NewWriterSize(stream, watchBatch)
+		fn(w)
+		// Returns once the output was handed to the event loop
+		w.Flush()
+		c.resumed.Store(true)
+		c.wake()
+	}()
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// startEventLoop runs a server on the event-loop backend on a free port and
+// returns its address. The server is stopped when the test ends.
+func startEventLoop(t *testing.T, cache tqmemory.CacheInterface) string {
+	t.Helper()
+	s := New(cache, freeAddr(t))
+	startEngine(t, s.addr, s.StartEventLoop)
+	return s.addr
+}
+
+// freeAddr returns a local TCP address that is not in use.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startEngine runs a gnet engine listening on addr and waits until it
+// accepts connections. The engine is stopped when the test ends.
+func startEngine(t *testing.T, addr string, run func() error) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- run() }()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		nc, err := net.Dial("tcp", addr)
+		if err == nil {
+			nc.Close()
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatal(err)
+		default:
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("event loop did not start")
+		}
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		gnet.Stop(ctx, "tcp://"+addr)
+		<-done
+	})
+}
+
+// dialTest connects to addr and closes the connection when the test ends.
+func dialTest(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { nc.Close() })
+	return nc
+}
+
+// readReply reads n bytes of response, or fails the test.
+func readReply(t *testing.T, r io.Reader, n int) string {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("read %d bytes: %v (got %q)", n, err, buf)
+	}
+	return string(buf)
+}
+
+func TestEventLoop(t *testing.T) {
+	cache := newTestCache(t)
+	addr := startEventLoop(t, cache)
+
+	t.Run("split reads", func(t *testing.T) {
+		nc := dialTest(t, addr)
+		for _, part := range []string{"se", "t foo 0 0 3\r\nb", "ar", "\r\nget fo", "o\r\n"} {
+			nc.Write([]byte(part))
+			time.Sleep(20 * time.Millisecond)
+		}
+		want := "STORED\r\nVALUE foo 0 3\r\nbar\r\nEND\r\n"
+		if got := readReply(t, nc, len(want)); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("pipelining", func(t *testing.T) {
+		nc := dialTest(t, addr)
+		nc.Write([]byte("set p 0 0 1\r\nx\r\nget p\r\nget p p\r\nincr n 1\r\ndelete p\r\nget p\r\nversion\r\n"))
+		r := bufio.NewReader(nc)
+		want := "STORED\r\nVALUE p 0 1\r\nx\r\nEND\r\n" +
+			"VALUE p 0 1\r\nx\r\nVALUE p 0 1\r\nx\r\nEND\r\nNOT_FOUND\r\nDELETED\r\nEND\r\n"
+		if got := readReply(t, r, len(want)); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "VERSION ") {
+			t.Errorf("got %q, want the version", line)
+		}
+	})
+
+	t.Run("binary detection", func(t *testing.T) {
+		nc := dialTest(t, addr)
+		extras := make([]byte, 8)
+		nc.Write(append(binaryRequest(opSet, 1, extras, "bin", "value"),
+			binaryRequest(opGet, 2, nil, "bin", "")...))
+		// The set response has no body, the get response has 4 bytes of
+		// flags and the value
+		buf := readReply(t, nc, 24+24+4+5)
+		responses := parseBinaryResponses(t, []byte(buf))
+		if len(responses) != 2 || responses[0].opaque != 1 || responses[1].opaque != 2 ||
+			responses[0].status != 0 || responses[1].status != 0 || !strings.HasSuffix(buf, "value") {
+			t.Errorf("unexpected responses %+v %q", responses, buf)
+		}
+	})
+
+	t.Run("oversized body", func(t *testing.T) {
+		nc := dialTest(t, addr)
+		go func() {
+			nc.Write([]byte("set big 0 0 2000000\r\n"))
+			nc.Write([]byte(strings.Repeat("x", 2000000)))
+			nc.Write([]byte("\r\nget foo\r\n"))
+		}()
+		want := "SERVER_ERROR object too large for cache\r\nVALUE foo 0 3\r\nbar\r\nEND\r\n"
+		if got := readReply(t, nc, len(want)); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
+
+// wakeConn is an event-loop connection that only signals woken when the
+// loop is woken, for tests that run the loop side themselves.
+type wakeConn struct {
+	gnet.Conn
+	woken chan struct{}
+}
+
+func (c wakeConn) Wake(callback gnet.AsyncCallback) error {
+	c.woken <- struct{}{}
+	return nil
+}
+
+// stallCache holds the submitted requests for the key "slow" until release
+// is closed, like a worker that is busy.
+type stallCache struct {
+	tqmemory.CacheInterface
+	release chan struct{}
+}
+
+func (s *stallCache) WithClient(addr string) tqmemory.CacheInterface {
+	return s
+}
+
+func (s *stallCache) Submit(req *tqmemory.Request) {
+	if req.Key != "slow" {
+		s.CacheInterface.Submit(req)
+		return
+	}
+	go func() {
+		<-s.release
+		s.CacheInterface.Submit(req)
+	}()
+}
+
+func TestEventLoopStalledWorker(t *testing.T) {
+	cache := &stallCache{CacheInterface: newTestCache(t), release: make(chan struct{})}
+	addr := startEventLoop(t, cache)
+
+	slow := dialTest(t, addr)
+	slow.Write([]byte("get slow\r\nversion\r\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	// The loop keeps serving the other connections
+	nc := dialTest(t, addr)
+	nc.Write([]byte("set x 0 0 1\r\nx\r\nget x\r\n"))
+	want := "STORED\r\nVALUE x 0 1\r\nx\r\nEND\r\n"
+	if got := readReply(t, nc, len(want)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The input after the stalled get waits for its response
+	slow.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _ := slow.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("got a response before the worker answered")
+	}
+	slow.SetReadDeadline(time.Now().Add(10 * time.Second))
+	close(cache.release)
+	r := bufio.NewReader(slow)
+	if got := readReply(t, r, 5); got != "END\r\n" {
+		t.Errorf("got %q, want the get response first", got)
+	}
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "VERSION ") {
+		t.Errorf("got %q, want the version", line)
+	}
+}
+
+// countingEngine only accepts connections and counts the open ones, the
+// baseline of the memory used by a connection.
+type countingEngine struct {
+	gnet.BuiltinEventEngine
+	open atomic.Int32
+}
+
+func (e *countingEngine) OnOpen(gc gnet.Conn) ([]byte, gnet.Action) {
+	e.open.Add(1)
+	return nil, gnet.None
+}
+
+func (e *countingEngine) OnClose(gc gnet.Conn, err error) gnet.Action {
+	e.open.Add(-1)
+	return gnet.None
+}
+
+func TestEventLoopIdleConnMemory(t *testing.T) {
+	const n = 1000
+	heap := func() uint64 {
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	// growth opens n connections to addr and returns the heap growth per
+	// connection, once open reports that all of them were accepted.
+	growth := func(addr string, open func() int) int64 {
+		before := heap()
+		conns := make([]net.Conn, n)
+		for i := range conns {
+			conns[i] = dialTest(t, addr)
+		}
+		for start := time.Now(); open() < n; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("%d of %d connections accepted", open(), n)
+			}
+		}
+		grown := int64(heap()-before) / n
+		for _, nc := range conns {
+			nc.Close()
+		}
+		return grown
+	}
+
+	bare := &countingEngine{}
+	bareAddr := freeAddr(t)
+	startEngine(t, bareAddr, func() error {
+		return gnet.Run(bare, "tcp://"+bareAddr, gnet.WithMulticore(true))
+	})
+	baseline := growth(bareAddr, func() int { return int(bare.open.Load()) })
+
+	s := New(newTestCache(t), freeAddr(t))
+	startEngine(t, s.addr, s.StartEventLoop)
+	perConn := growth(s.addr, s.CurrentConnections) - baseline
+	t.Logf("an idle connection takes %d bytes on top of gnet's %d", perConn, baseline)
+	if perConn > 512 {
+		t.Errorf("an idle connection takes %d bytes, want at most 512", perConn)
+	}
+}
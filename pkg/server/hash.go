@@ -0,0 +1,153 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// Hashes hold fields inside a single item. A get of a hash returns the
+// netstrings of its fields and values, ordered by field.
+
+// writeTypedError writes the response to a failed typed value command, or
+// NOT_FOUND for a missing key.
+func (c *conn) writeTypedError(err error) {
+	switch err {
+	case tqmemory.ErrKeyNotFound:
+		c.writer.WriteString("NOT_FOUND\r\n")
+	case tqmemory.ErrKeyExists:
+		c.writer.WriteString("EXISTS\r\n")
+	case tqmemory.ErrWrongType, tqmemory.ErrNotNumeric, tqmemory.ErrOverflow, tqmemory.ErrBloomParams:
+		c.writer.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+	case tqmemory.ErrValueTooLarge:
+		c.writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+	default:
+		c.writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+	}
+}
+
+// handleTextHSet handles:
+// hset <key> <field> <exptime> <bytes> [noreply]\r\n<data>\r\n
+// The exptime only applies when the hash is created.
+func (c *conn) handleTextHSet(tokens [][]byte, data []byte) {
+	if len(tokens) < 5 || len(tokens[1]) > maxKeyLength || len(tokens[2]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, ok := parseInt(tokens[3])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if _, ok := parseSize(tokens[4]); !ok {
+		c.writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return
+	}
+	if data == nil {
+		c.writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
+	noreply := isNoreply(tokens, 5)
+
+	fields := map[string][]byte{string(tokens[2]): data}
+	if _, err := c.cache.HSet(string(tokens[1]), fields, exptimeToTTL(exptime)); err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !noreply {
+		c.writer.WriteString("STORED\r\n")
+	}
+}
+
+// handleTextHGet handles: hget <key> <field>
+// The value is returned like a get response with the field as the key.
+func (c *conn) handleTextHGet(tokens [][]byte) {
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	value, err := c.cache.HGet(string(tokens[1]), string(tokens[2]))
+	if err != nil && err != tqmemory.ErrKeyNotFound {
+		c.writeTypedError(err)
+		return
+	}
+	if err == nil {
+		c.writeTextValue(tokens[2], value, 0, 0, false)
+	}
+	c.writer.WriteString("END\r\n")
+}
+
+// handleTextHGetAll handles: hgetall <key>
+// The fields are returned like a multi-get response, ordered by field.
+func (c *conn) handleTextHGetAll(tokens [][]byte) {
+	if len(tokens) < 2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	fields, err := c.cache.HGetAll(string(tokens[1]))
+	if err != nil && err != tqmemory.ErrKeyNotFound {
+		c.writeTypedError(err)
+		return
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	for _, field := range names {
+		c.writeTextValue([]byte(field), fields[field], 0, 0, false)
+	}
+	c.writer.WriteString("END\r\n")
+}
+
+// handleTextHDel handles: hdel <key> <field>... [noreply]
+// It responds with "DELETED <count>", the number of removed fields.
+func (c *conn) handleTextHDel(tokens [][]byte) {
+	noreply := isNoreply(tokens, len(tokens)-1)
+	if noreply {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	fields := make([]string, len(tokens)-2)
+	for i, field := range tokens[2:] {
+		fields[i] = string(field)
+	}
+	n, err := c.cache.HDel(string(tokens[1]), fields...)
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !noreply {
+		c.writer.WriteString("DELETED ")
+		c.writeUint(uint64(n))
+		c.writer.WriteString("\r\n")
+	}
+}
+
+// handleTextHIncrBy handles: hincrby <key> <field> <delta> [noreply]
+// The delta may be negative, a missing field starts at 0. It responds with
+// the new value.
+func (c *conn) handleTextHIncrBy(tokens [][]byte) {
+	if len(tokens) < 4 || len(tokens[1]) > maxKeyLength || len(tokens[2]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	delta, ok := parseInt(tokens[3])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+	n, err := c.cache.HIncrBy(string(tokens[1]), string(tokens[2]), delta, 0)
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !isNoreply(tokens, 4) {
+		c.writer.Write(strconv.AppendInt(c.writer.AvailableBuffer(), n, 10))
+		c.writer.WriteString("\r\n")
+	}
+}
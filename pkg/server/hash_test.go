@@ -0,0 +1,27 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTextHash(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"hset user:1 name 0 5\r\nalice", "STORED\r\n"},
+		{"hset user:1 visits 0 1 noreply\r\n1", ""},
+		{"hincrby user:1 visits 2", "3\r\n"},
+		{"hincrby user:1 name 1", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{"hget user:1 name", "VALUE name 0 5\r\nalice\r\nEND\r\n"},
+		{"hget user:1 missing", "END\r\n"},
+		{"hgetall user:1", "VALUE name 0 5\r\nalice\r\nVALUE visits 0 1\r\n3\r\nEND\r\n"},
+		{"get user:1", "VALUE user:1 0 28\r\n4:name,5:alice,6:visits,1:3,\r\nEND\r\n"},
+		{"append user:1 0 0 1\r\nx", "CLIENT_ERROR operation against a key holding the wrong kind of value\r\n"},
+		{"hdel user:1 name missing", "DELETED 1\r\n"},
+		{"hdel user:1 visits noreply", ""},
+		{"hgetall user:1", "END\r\n"},
+		{"set plain 0 0 1\r\na", "STORED\r\n"},
+		{"hget plain a", "CLIENT_ERROR operation against a key holding the wrong kind of value\r\n"},
+	})
+}
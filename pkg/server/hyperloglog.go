@@ -0,0 +1,72 @@
+package server
+
+// handleTextPFAdd handles: pfadd <key> <exptime> <element>... [noreply]
+// The exptime only applies when the HyperLogLog is created. It responds
+// with 1 if the estimate may have changed, and 0 if not.
+func (c *conn) handleTextPFAdd(tokens [][]byte) {
+	tokens, noreply := trimNoreply(tokens)
+	if len(tokens) < 4 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, ok := parseInt(tokens[2])
+	elements, ok2 := parseMembers(tokens[3:])
+	if !ok || !ok2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	changed, err := c.cache.PFAdd(string(tokens[1]), exptimeToTTL(exptime), elements...)
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if noreply {
+		return
+	}
+	if changed {
+		c.writer.WriteString("1\r\n")
+	} else {
+		c.writer.WriteString("0\r\n")
+	}
+}
+
+// handleTextPFCount handles: pfcount <key>...
+// It responds with the estimated number of distinct elements added to the
+// HyperLogLogs together.
+func (c *conn) handleTextPFCount(tokens [][]byte) {
+	if len(tokens) < 2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	keys, _ := parseMembers(tokens[1:])
+	n, err := c.cache.PFCount(keys...)
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	c.writeUint(uint64(n))
+	c.writer.WriteString("\r\n")
+}
+
+// handleTextPFMerge handles: pfmerge <dest> <exptime> <source>... [noreply]
+// The exptime only applies when dest is created.
+func (c *conn) handleTextPFMerge(tokens [][]byte) {
+	tokens, noreply := trimNoreply(tokens)
+	if len(tokens) < 4 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, ok := parseInt(tokens[2])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	sources, _ := parseMembers(tokens[3:])
+	if err := c.cache.PFMerge(string(tokens[1]), exptimeToTTL(exptime), sources...); err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !noreply {
+		c.writer.WriteString("OK\r\n")
+	}
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTextHyperLogLog(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"pfadd day1 0 alice bob", "1\r\n"},
+		{"pfadd day1 0 alice", "0\r\n"},
+		{"pfadd day2 0 bob carol noreply", ""},
+		{"pfcount day1", "2\r\n"},
+		{"pfcount day1 day2", "3\r\n"},
+		{"pfmerge week 0 day1 day2", "OK\r\n"},
+		{"pfcount week", "3\r\n"},
+		{"pfcount none", "0\r\n"},
+		{"set plain 0 0 1\r\na", "STORED\r\n"},
+		{"pfadd plain 0 x", "CLIENT_ERROR operation against a key holding the wrong kind of value\r\n"},
+		{"pfmerge week 0", "CLIENT_ERROR bad command line format\r\n"},
+	})
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// keyspaceTypes maps the arguments of the keyspace command to event types.
+var keyspaceTypes = map[string]tqmemory.KeyspaceEventType{
+	"set":    tqmemory.KeyspaceSet,
+	"delete": tqmemory.KeyspaceDelete,
+	"expire": tqmemory.KeyspaceExpire,
+	"evict":  tqmemory.KeyspaceEvict,
+	"flush":  tqmemory.KeyspaceFlush,
+}
+
+// handleTextKeyspace handles:
+// keyspace [set] [delete] [expire] [evict] [flush] [match=<pattern>]...
+// Without types all changes are streamed, without patterns those of all
+// keys. After "OK" the connection only streams event lines, further input
+// is ignored.
+func (c *conn) handleTextKeyspace(tokens [][]byte) {
+	var types tqmemory.KeyspaceEventType
+	var match []string
+	for _, token := range tokens[1:] {
+		if pattern, ok := bytes.CutPrefix(token, []byte("match=")); ok {
+			match = append(match, string(pattern))
+			continue
+		}
+		t, ok := keyspaceTypes[string(token)]
+		if !ok {
+			c.writer.WriteString("CLIENT_ERROR unknown keyspace event type\r\n")
+			return
+		}
+		types |= t
+	}
+	if types == 0 {
+		types = tqmemory.KeyspaceAll
+	}
+
+	c.keyspace = c.cache.SubscribeKeyspace(types, 0, match...)
+	c.writer.WriteString("OK\r\n")
+	// The events are written by another goroutine from now on
+	c.writer.Flush()
+	go streamEvents(c.streamWriter(), c.keyspace, appendKeyspaceEvent, appendSkipped)
+}
+
+// appendKeyspaceEvent appends an event as a line in the key=value format of
+// watch, e.g. "ts=1700000000.123456 id=1 type=set key=foo shard=0".
+func appendKeyspaceEvent(buf []byte, ev *tqmemory.KeyspaceEvent) []byte {
+	buf = appendTimestamp(buf, ev.Time)
+	buf = append(buf, " id="...)
+	buf = strconv.AppendUint(buf, ev.ID, 10)
+	buf = append(buf, " type="...)
+	buf = append(buf, ev.Type.String()...)
+	if ev.Type != tqmemory.KeyspaceFlush {
+		buf = append(buf, " key="...)
+		buf = appendURIEncoded(buf, ev.Key)
+	}
+	buf = append(buf, " shard="...)
+	buf = strconv.AppendInt(buf, int64(ev.Shard), 10)
+	return append(buf, '\n')
+}
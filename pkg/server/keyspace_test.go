@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+func TestTextKeyspace(t *testing.T) {
+	cache := newTestCache(t)
+
+	out := &bytes.Buffer{}
+	subscribed := newTestConn(cache, out)
+	pr, pw := io.Pipe()
+	subscribed.stream = pw
+	runTextTests(t, subscribed, out, []textTest{
+		{"keyspace bogus", "CLIENT_ERROR unknown keyspace event type\r\n"},
+		{"keyspace set delete flush match=user:*", "OK\r\n"},
+		{"get ignored", ""},
+	})
+
+	c := newTestConn(cache, out)
+	runTextTests(t, c, out, []textTest{
+		{"set other 0 0 1\r\na", "STORED\r\n"},
+		{"set user:1 0 0 1\r\na", "STORED\r\n"},
+		{"delete user:1", "DELETED\r\n"},
+		{"flush_all", "OK\r\n"},
+	})
+	r := bufio.NewReader(pr)
+	for _, want := range []string{
+		`^ts=\d+\.\d{6} id=\d+ type=set key=user%3A1 shard=\d\n$`,
+		`^ts=\d+\.\d{6} id=\d+ type=delete key=user%3A1 shard=\d\n$`,
+		`^ts=\d+\.\d{6} id=\d+ type=flush shard=\d\n$`,
+	} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(want).MatchString(line) {
+			t.Errorf("got %q, want %s", line, want)
+		}
+	}
+
+	subscribed.unregister(subscribed)
+	pr.Close()
+}
+
+func TestAppendKeyspaceEvent(t *testing.T) {
+	ev := tqmemory.KeyspaceEvent{Type: tqmemory.KeyspaceEvict, ID: 7, Time: time.Unix(1700000000, 1000),
+		Key: "a b", Shard: 2}
+	want := "ts=1700000000.000001 id=7 type=evict key=a%20b shard=2\n"
+	if got := string(appendKeyspaceEvent(nil, &ev)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// handleTextPush handles:
+// lpush|rpush <key> <exptime> <bytes> [noreply]\r\n<data>\r\n
+// The exptime only applies when the list is created. It responds with the
+// length of the list.
+func (c *conn) handleTextPush(tokens [][]byte, data []byte, front bool) {
+	if len(tokens) < 4 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, ok := parseInt(tokens[2])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if _, ok := parseSize(tokens[3]); !ok {
+		c.writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return
+	}
+	if data == nil {
+		c.writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
+
+	key, ttl := string(tokens[1]), exptimeToTTL(exptime)
+	var n int
+	var err error
+	if front {
+		n, err = c.cache.LPush(key, ttl, data)
+	} else {
+		n, err = c.cache.RPush(key, ttl, data)
+	}
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !isNoreply(tokens, 4) {
+		c.writeUint(uint64(n))
+		c.writer.WriteString("\r\n")
+	}
+}
+
+// handleTextPop handles: lpop|rpop <key>
+// The element is returned like a get response.
+func (c *conn) handleTextPop(tokens [][]byte, front bool) {
+	if len(tokens) < 2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	var value []byte
+	var err error
+	if front {
+		value, err = c.cache.LPop(string(tokens[1]))
+	} else {
+		value, err = c.cache.RPop(string(tokens[1]))
+	}
+	c.writer.Write(appendPopResponse(c.writer.AvailableBuffer(), tokens[1], value, err))
+}
+
+// maxPopTimeout caps the timeout of a blocking pop, in seconds (30 days).
+const maxPopTimeout = 30 * 24 * 3600
+
+// handleTextBlockingPop handles: blpop|brpop <key> <timeout>
+// The timeout is in seconds and may have a fraction, with 0 it waits until
+// an element is pushed, like Redis. It responds like lpop, with "END" when
+// the timeout passes.
+//
+// On the event loop the pop waits on another goroutine, so the loop keeps
+// serving other connections. The input of the connection is not processed
+// until the response is written. The pop stops waiting when the connection
+// is closed, and an element popped for a closed connection is pushed back.
+func (c *conn) handleTextBlockingPop(tokens [][]byte, front bool) {
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	seconds, err := strconv.ParseFloat(string(tokens[2]), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds < 0 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	seconds = min(seconds, maxPopTimeout)
+	key, timeout := string(tokens[1]), time.Duration(seconds*float64(time.Second))
+	c.detach(func(w *bufio.Writer) {
+		var value []byte
+		var err error
+		if front {
+			value, err = c.cache.BLPop(key, timeout, c.closing())
+		} else {
+			value, err = c.cache.BRPop(key, timeout, c.closing())
+		}
+		w.Write(appendPopResponse(w.AvailableBuffer(), []byte(key), value, err))
+		if err == nil && w.Flush() != nil {
+			// Back to the end of the list it was popped from
+			if front {
+				c.cache.LPush(key, 0, value)
+			} else {
+				c.cache.RPush(key, 0, value)
+			}
+		}
+	})
+}
+
+// appendPopResponse appends the response to a pop of key.
+func appendPopResponse(buf, key, value []byte, err error) []byte {
+	switch err {
+	case nil:
+		buf = append(buf, "VALUE "...)
+		buf = append(buf, key...)
+		buf = append(buf, " 0 "...)
+		buf = strconv.AppendInt(buf, int64(len(value)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, value...)
+		buf = append(buf, "\r\n"...)
+	case tqmemory.ErrKeyNotFound:
+	default:
+		return append(buf, "CLIENT_ERROR "+err.Error()+"\r\n"...)
+	}
+	return append(buf, "END\r\n"...)
+}
+
+// handleTextLRange handles: lrange <key> <start> <stop>
+// The elements from start to stop (inclusive, counted from the end when
+// negative) are returned like a multi-get of the key.
+func (c *conn) handleTextLRange(tokens [][]byte) {
+	start, stop, ok := parseListRange(tokens)
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	values, err := c.cache.LRange(string(tokens[1]), start, stop)
+	if err != nil && err != tqmemory.ErrKeyNotFound {
+		c.writeTypedError(err)
+		return
+	}
+	for _, value := range values {
+		c.writeTextValue(tokens[1], value, 0, 0, false)
+	}
+	c.writer.WriteString("END\r\n")
+}
+
+// handleTextLTrim handles: ltrim <key> <start> <stop> [noreply]
+// It responds with "OK", also for a missing list.
+func (c *conn) handleTextLTrim(tokens [][]byte) {
+	start, stop, ok := parseListRange(tokens)
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if err := c.cache.LTrim(string(tokens[1]), start, stop); err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !isNoreply(tokens, 4) {
+		c.writer.WriteString("OK\r\n")
+	}
+}
+
+// parseListRange parses the key, start and stop of lrange and ltrim.
+func parseListRange(tokens [][]byte) (int, int, bool) {
+	if len(tokens) < 4 {
+		return 0, 0, false
+	}
+	start, ok := parseInt(tokens[2])
+	if !ok {
+		return 0, 0, false
+	}
+	stop, ok := parseInt(tokens[3])
+	return int(start), int(stop), ok
+}
+
+// handleTextLLen handles: llen <key>
+// It responds with the length of the list, 0 if it doesn't exist.
+func (c *conn) handleTextLLen(tokens [][]byte) {
+	if len(tokens) < 2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	n, err := c.cache.LLen(string(tokens[1]))
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	c.writeUint(uint64(n))
+	c.writer.WriteString("\r\n")
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTextList(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"rpush q 0 1\r\na", "1\r\n"},
+		{"rpush q 0 1\r\nb", "2\r\n"},
+		{"lpush q 0 1 noreply\r\nz", ""},
+		{"lrange q 0 -1", "VALUE q 0 1\r\nz\r\nVALUE q 0 1\r\na\r\nVALUE q 0 1\r\nb\r\nEND\r\n"},
+		{"llen q", "3\r\n"},
+		{"ltrim q 1 -1", "OK\r\n"},
+		{"lpop q", "VALUE q 0 1\r\na\r\nEND\r\n"},
+		{"rpop q", "VALUE q 0 1\r\nb\r\nEND\r\n"},
+		{"rpop q", "END\r\n"},
+		{"llen q", "0\r\n"},
+		{"blpop q 0.01", "END\r\n"},
+		{"blpop q x", "CLIENT_ERROR bad command line format\r\n"},
+		{"blpop q nan", "CLIENT_ERROR bad command line format\r\n"},
+		{"blpop q inf", "CLIENT_ERROR bad command line format\r\n"},
+		{"blpop q -1", "CLIENT_ERROR bad command line format\r\n"},
+		{"set plain 0 0 1\r\na", "STORED\r\n"},
+		{"lpop plain", "CLIENT_ERROR operation against a key holding the wrong kind of value\r\n"},
+	})
+}
+
+func TestTextBlockingPopEventLoop(t *testing.T) {
+	cache := newTestCache(t)
+
+	var out bytes.Buffer
+	c := newTestConn(cache, &out)
+	pr, pw := io.Pipe()
+	c.stream = pw
+	woken := make(chan struct{}, 1)
+	c.gc = wakeConn{woken: woken}
+
+	// The input after the pop is left until the pop is answered
+	input := []byte("mn\r\nbrpop jobs 5\r\nmn\r\n")
+	consumed, _ := c.processText(input)
+	c.writer.Flush()
+	if got, want := out.String(), "MN\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	other := newTestConn(cache, &bytes.Buffer{})
+	processAll(other, []byte("rpush jobs 0 3\r\nabc\r\n"))
+	line, _ := bufio.NewReader(pr).ReadString('\n')
+	if want := "VALUE jobs 0 3\r\n"; line != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+	go io.Copy(io.Discard, pr)
+	<-woken
+	// Blocked until the loop runs, so no input is processed out of order
+	if !c.blocked.Load() || !c.resumed.Load() {
+		t.Fatal("expected the connection to stay blocked until the event loop runs")
+	}
+	if c.resumed.Swap(false) {
+		c.blocked.Store(false)
+	}
+
+	out.Reset()
+	c.processText(input[consumed:])
+	c.writer.Flush()
+	if got, want := out.String(), "MN\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	pw.Close()
+}
+
+func TestTextBlockingPopClosed(t *testing.T) {
+	cache := newTestCache(t)
+
+	// The pop of a closed connection stops waiting
+	c := newTestConn(cache, &bytes.Buffer{})
+	pr, pw := io.Pipe()
+	pr.Close()
+	c.stream = pw
+	woken := make(chan struct{}, 1)
+	c.gc = wakeConn{woken: woken}
+	c.processText([]byte("brpop jobs 60\r\n"))
+	for cache.Stats()["blocked_clients"] != "1" {
+		time.Sleep(time.Millisecond)
+	}
+	c.unregister(c)
+	select {
+	case <-woken:
+	case <-time.After(time.Second):
+		t.Fatal("the pop kept waiting after the connection was closed")
+	}
+	if got := cache.Stats()["blocked_clients"]; got != "0" {
+		t.Errorf("got %s blocked clients after close, want 0", got)
+	}
+
+	// An element popped for a connection that is gone is pushed back
+	c = newTestConn(cache, &bytes.Buffer{})
+	c.stream = pw
+	c.gc = wakeConn{woken: woken}
+	c.processText([]byte("brpop jobs 5\r\n"))
+	for cache.Stats()["blocked_clients"] != "1" {
+		time.Sleep(time.Millisecond)
+	}
+	cache.RPush("jobs", 0, []byte("abc"))
+	<-woken
+	if values, _ := cache.LRange("jobs", 0, -1); len(values) != 1 || string(values[0]) != "abc" {
+		t.Errorf("got %q, want the element back in the list", values)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// Meta commands take a key followed by single letter flags, where a flag may
+// carry a token (e.g. "N30" or "Oabc"). Only the subset of the memcached meta
+// protocol that has no classic text equivalent is supported, plus ms for
+// storing items with tags.
+
+// writeMetaReturnFlags writes the flags that are echoed in a meta response
+// (opaque, key and CAS) in the order in which they were requested.
+func (c *conn) writeMetaReturnFlags(flags [][]byte, key []byte, cas uint64) {
+	for _, flag := range flags {
+		switch flag[0] {
+		case 'O':
+			c.writer.WriteByte(' ')
+			c.writer.Write(flag)
+		case 'k':
+			c.writer.WriteString(" k")
+			c.writer.Write(key)
+		case 'c':
+			c.writer.WriteString(" c")
+			c.writeUint(cas)
+		}
+	}
+	c.writer.WriteString("\r\n")
+}
+
+// handleMetaArithmetic handles the meta arithmetic command:
+// ma <key> [N<exptime>] [J<initial>] [D<delta>] [M<mode>] [O<opaque>] [q] [k] [v] [c]
+// With N a missing counter is created with the initial value in the same
+// worker operation, instead of a racy add followed by incr.
+func (c *conn) handleMetaArithmetic(tokens [][]byte) {
+	if len(tokens) < 2 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	key, flags := tokens[1], tokens[2:]
+
+	incr := true
+	delta := uint64(1)
+	var initial uint64
+	var exptime int64
+	var create, quiet, returnValue bool
+	for _, flag := range flags {
+		arg := flag[1:]
+		ok := true
+		switch flag[0] {
+		case 'N':
+			create = true
+			exptime, ok = parseInt(arg)
+		case 'J':
+			initial, ok = parseUint(arg, 64)
+		case 'D':
+			delta, ok = parseUint(arg, 64)
+		case 'M':
+			switch string(arg) {
+			case "I", "i", "+":
+				incr = true
+			case "D", "d", "-":
+				incr = false
+			default:
+				c.writer.WriteString("CLIENT_ERROR invalid mode for ma\r\n")
+				return
+			}
+		case 'q':
+			quiet = true
+		case 'v':
+			returnValue = true
+		case 'O', 'k', 'c':
+			// Returned in the response
+		default:
+			c.writer.WriteString("CLIENT_ERROR invalid flag\r\n")
+			return
+		}
+		if !ok {
+			c.writer.WriteString("CLIENT_ERROR bad token in command line format\r\n")
+			return
+		}
+	}
+
+	var newVal, cas uint64
+	var err error
+	switch {
+	case create && incr:
+		newVal, cas, err = c.cache.IncrementOrCreate(string(key), delta, initial, exptimeToTTL(exptime))
+	case create:
+		newVal, cas, err = c.cache.DecrementOrCreate(string(key), delta, initial, exptimeToTTL(exptime))
+	case incr:
+		newVal, cas, err = c.cache.Increment(string(key), delta)
+	default:
+		newVal, cas, err = c.cache.Decrement(string(key), delta)
+	}
+
+	if err != nil {
+		switch err {
+		case tqmemory.ErrKeyNotFound:
+			// Quiet mode suppresses the miss, like memcached's md and ma
+			if !quiet {
+				c.writer.WriteString("NF")
+				c.writeMetaReturnFlags(flags, key, 0)
+			}
+		case tqmemory.ErrNotNumeric:
+			c.writer.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+		default:
+			c.writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		}
+		return
+	}
+
+	if returnValue {
+		c.writer.WriteString("VA ")
+		c.writeUint(uint64(decimalLen(newVal)))
+		c.writeMetaReturnFlags(flags, key, cas)
+		c.writeUint(newVal)
+		c.writer.WriteString("\r\n")
+		return
+	}
+	if !quiet {
+		c.writer.WriteString("HD")
+		c.writeMetaReturnFlags(flags, key, cas)
+	}
+}
+
+// handleMetaSet handles the meta set command:
+// ms <key> <datalen> [T<exptime>] [F<flags>] [G<tag>]... [O<opaque>] [q] [k] [c]
+// Each G flag attaches a tag, that "tag_invalidate" removes the item by.
+// Only the set mode is supported.
+func (c *conn) handleMetaSet(tokens [][]byte, value []byte) {
+	if len(tokens) < 3 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	size, ok := parseSize(tokens[2])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return
+	}
+	// The data was discarded
+	if size > maxValueSize {
+		c.writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
+	key, flags := tokens[1], tokens[3:]
+
+	var exptime int64
+	var tags []string
+	var quiet bool
+	for _, flag := range flags {
+		arg := flag[1:]
+		ok := true
+		switch flag[0] {
+		case 'T':
+			exptime, ok = parseInt(arg)
+		case 'F':
+			// Client flags are not stored, like the text storage commands
+			_, ok = parseUint(arg, 32)
+		case 'G':
+			if len(arg) == 0 || len(arg) > maxKeyLength {
+				ok = false
+				break
+			}
+			tags = append(tags, string(arg))
+		case 'q':
+			quiet = true
+		case 'O', 'k', 'c':
+			// Returned in the response
+		default:
+			c.writer.WriteString("CLIENT_ERROR invalid flag\r\n")
+			return
+		}
+		if !ok {
+			c.writer.WriteString("CLIENT_ERROR bad token in command line format\r\n")
+			return
+		}
+	}
+
+	// The key is retained by the cache, so it is copied out of the read buffer
+	cas, err := c.cache.SetWithTags(string(key), value, exptimeToTTL(exptime), tags)
+	if err != nil {
+		c.writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	// Quiet mode suppresses the success, like memcached's ms
+	if !quiet {
+		c.writer.WriteString("HD")
+		c.writeMetaReturnFlags(flags, key, cas)
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// latencyBuckets are the upper bounds of the exported latency histogram
+// buckets. The recorded histograms are finer, see tqmemory.Histogram.
+var latencyBuckets = []time.Duration{
+	10 * time.Microsecond, 25 * time.Microsecond, 50 * time.Microsecond,
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, time.Second,
+}
+
+// cacheMetric is a cache counter exported from tqmemory.Stats.
+type cacheMetric struct {
+	name  string
+	kind  string // "counter" or "gauge"
+	help  string
+	value func(s *tqmemory.Stats) float64
+}
+
+func statCounter(name, help string, value func(s *tqmemory.Stats) uint64) cacheMetric {
+	return cacheMetric{name, "counter", help, func(s *tqmemory.Stats) float64 { return float64(value(s)) }}
+}
+
+func statGauge(name, help string, value func(s *tqmemory.Stats) int64) cacheMetric {
+	return cacheMetric{name, "gauge", help, func(s *tqmemory.Stats) float64 { return float64(value(s)) }}
+}
+
+var cacheMetrics = []cacheMetric{
+	statGauge("tqmemory_items", "Items currently stored.", func(s *tqmemory.Stats) int64 { return int64(s.CurrItems) }),
+	statGauge("tqmemory_bytes", "Memory used by keys and values.", func(s *tqmemory.Stats) int64 { return s.Bytes }),
+	statGauge("tqmemory_limit_bytes", "Memory limit (0 = unlimited).", func(s *tqmemory.Stats) int64 { return s.LimitMaxBytes }),
+	statCounter("tqmemory_items_total", "Items stored since start.", func(s *tqmemory.Stats) uint64 { return s.TotalItems }),
+	statCounter("tqmemory_cmd_get_total", "Keys requested by get commands.", func(s *tqmemory.Stats) uint64 { return s.CmdGet }),
+	statCounter("tqmemory_cmd_set_total", "Storage commands.", func(s *tqmemory.Stats) uint64 { return s.CmdSet }),
+	statCounter("tqmemory_cmd_flush_total", "Flush commands.", func(s *tqmemory.Stats) uint64 { return s.CmdFlush }),
+	statCounter("tqmemory_cmd_touch_total", "Touch commands.", func(s *tqmemory.Stats) uint64 { return s.CmdTouch }),
+	statCounter("tqmemory_get_hits_total", "Keys found by get commands.", func(s *tqmemory.Stats) uint64 { return s.GetHits }),
+	statCounter("tqmemory_get_misses_total", "Keys not found by get commands.", func(s *tqmemory.Stats) uint64 { return s.GetMisses }),
+	statCounter("tqmemory_get_expired_total", "Keys not found by get commands because they expired.", func(s *tqmemory.Stats) uint64 { return s.GetExpired }),
+	statCounter("tqmemory_delete_hits_total", "Deletes of existing keys.", func(s *tqmemory.Stats) uint64 { return s.DeleteHits }),
+	statCounter("tqmemory_delete_misses_total", "Deletes of missing keys.", func(s *tqmemory.Stats) uint64 { return s.DeleteMisses }),
+	statCounter("tqmemory_incr_hits_total", "Increments of existing keys.", func(s *tqmemory.Stats) uint64 { return s.IncrHits }),
+	statCounter("tqmemory_incr_misses_total", "Increments of missing keys.", func(s *tqmemory.Stats) uint64 { return s.IncrMisses }),
+	statCounter("tqmemory_decr_hits_total", "Decrements of existing keys.", func(s *tqmemory.Stats) uint64 { return s.DecrHits }),
+	statCounter("tqmemory_decr_misses_total", "Decrements of missing keys.", func(s *tqmemory.Stats) uint64 { return s.DecrMisses }),
+	statCounter("tqmemory_cas_hits_total", "Successful CAS updates.", func(s *tqmemory.Stats) uint64 { return s.CasHits }),
+	statCounter("tqmemory_cas_misses_total", "CAS updates of missing keys.", func(s *tqmemory.Stats) uint64 { return s.CasMisses }),
+	statCounter("tqmemory_cas_badval_total", "CAS updates with a mismatching CAS value.", func(s *tqmemory.Stats) uint64 { return s.CasBadval }),
+	statCounter("tqmemory_touch_hits_total", "Touches of existing keys.", func(s *tqmemory.Stats) uint64 { return s.TouchHits }),
+	statCounter("tqmemory_touch_misses_total", "Touches of missing keys.", func(s *tqmemory.Stats) uint64 { return s.TouchMisses }),
+	statCounter("tqmemory_evictions_total", "Items evicted by the LRU.", func(s *tqmemory.Stats) uint64 { return s.Evictions }),
+	statCounter("tqmemory_evicted_unfetched_total", "Evicted items that were never fetched.", func(s *tqmemory.Stats) uint64 { return s.EvictedUnfetched }),
+	statCounter("tqmemory_expired_unfetched_total", "Expired items that were never fetched.", func(s *tqmemory.Stats) uint64 { return s.ExpiredUnfetched }),
+	statCounter("tqmemory_namespace_reclaimed_total", "Items removed because their namespace was invalidated.", func(s *tqmemory.Stats) uint64 { return s.NamespaceReclaimed }),
+	statCounter("tqmemory_tag_invalidated_total", "Items removed by a tag invalidation.", func(s *tqmemory.Stats) uint64 { return s.TagInvalidated }),
+	statCounter("tqmemory_pattern_deleted_total", "Items removed by a pattern delete.", func(s *tqmemory.Stats) uint64 { return s.PatternDeleted }),
+	statGauge("tqmemory_blocked_clients", "Blocking pops waiting for an element.", func(s *tqmemory.Stats) int64 { return int64(s.BlockedClients) }),
+}
+
+// runtimeMetrics maps Go runtime metrics to exported metric names.
+var runtimeMetrics = []struct {
+	sample string
+	name   string
+	kind   string
+	help   string
+}{
+	{"/sched/goroutines:goroutines", "go_goroutines", "gauge", "Number of goroutines."},
+	{"/sched/gomaxprocs:threads", "go_gomaxprocs", "gauge", "Value of GOMAXPROCS."},
+	{"/memory/classes/total:bytes", "go_memory_total_bytes", "gauge", "Memory mapped by the Go runtime."},
+	{"/memory/classes/heap/objects:bytes", "go_heap_objects_bytes", "gauge", "Memory occupied by live and unswept heap objects."},
+	{"/gc/heap/allocs:bytes", "go_heap_allocs_bytes_total", "counter", "Bytes allocated on the heap."},
+	{"/gc/cycles/total:gc-cycles", "go_gc_cycles_total", "counter", "Completed GC cycles."},
+}
+
+// MetricsHandler returns an HTTP handler that serves the server, cache and
+// Go runtime metrics in the Prometheus text exposition format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		s.writeMetrics(bw)
+		bw.Flush()
+	})
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name, kind, help string) {
+	w.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " " + kind + "\n")
+}
+
+func (w metricsWriter) value(name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	w.WriteByte('\n')
+}
+
+func (w metricsWriter) metric(name, kind, help string, v float64) {
+	w.header(name, kind, help)
+	w.value(name, "", v)
+}
+
+// histogram writes the cumulative buckets, sum and count of a histogram,
+// unless it is empty. h must not change while it is written.
+func (w metricsWriter) histogram(name, labels string, h *tqmemory.Histogram) {
+	count := h.Count()
+	if count == 0 {
+		return
+	}
+	for _, le := range latencyBuckets {
+		w.value(name+"_bucket", labels+`,le="`+strconv.FormatFloat(le.Seconds(), 'g', -1, 64)+`"`,
+			float64(h.CountBelow(le)))
+	}
+	w.value(name+"_bucket", labels+`,le="+Inf"`, float64(count))
+	w.value(name+"_sum", labels, h.Sum().Seconds())
+	w.value(name+"_count", labels, float64(count))
+}
+
+// writeMetrics writes all metrics to bw.
+func (s *Server) writeMetrics(bw *bufio.Writer) {
+	w := metricsWriter{bw}
+
+	// Server
+	w.metric("tqmemory_uptime_seconds", "gauge", "Seconds since the cache started.",
+		time.Since(s.cache.GetStartTime()).Seconds())
+	w.metric("tqmemory_connections", "gauge", "Open connections.", float64(s.CurrentConnections()))
+	w.metric("tqmemory_max_connections", "gauge", "Connection limit.", float64(s.maxConnections))
+	w.metric("tqmemory_connections_total", "counter", "Connections accepted.",
+		float64(atomic.LoadUint64(&s.totalConns)))
+	w.metric("tqmemory_read_bytes_total", "counter", "Bytes read from clients.",
+		float64(atomic.LoadUint64(&s.bytesRead)))
+	w.metric("tqmemory_written_bytes_total", "counter", "Bytes written to clients.",
+		float64(atomic.LoadUint64(&s.bytesWritten)))
+	published, delivered, dropped := s.pubSub.Stats()
+	w.metric("tqmemory_pubsub_published_total", "counter", "Messages published.",
+		float64(published))
+	w.metric("tqmemory_pubsub_delivered_total", "counter", "Messages queued for subscribers.",
+		float64(delivered))
+	w.metric("tqmemory_pubsub_dropped_total", "counter", "Messages dropped for slow subscribers.",
+		float64(dropped))
+
+	// Cache totals
+	workers := s.cache.WorkerStats()
+	var total tqmemory.Stats
+	for i := range workers {
+		total.Add(&workers[i])
+	}
+	for _, m := range cacheMetrics {
+		w.metric(m.name, m.kind, m.help, m.value(&total))
+	}
+
+	// Per shard
+	shard := func(i int) string { return `shard="` + strconv.Itoa(i) + `"` }
+	w.header("tqmemory_shard_items", "gauge", "Items currently stored per shard.")
+	for i := range workers {
+		w.value("tqmemory_shard_items", shard(i), float64(workers[i].CurrItems))
+	}
+	w.header("tqmemory_shard_bytes", "gauge", "Memory used by keys and values per shard.")
+	for i := range workers {
+		w.value("tqmemory_shard_bytes", shard(i), float64(workers[i].Bytes))
+	}
+	w.header("tqmemory_shard_evictions_total", "counter", "Items evicted by the LRU per shard.")
+	for i := range workers {
+		w.value("tqmemory_shard_evictions_total", shard(i), float64(workers[i].Evictions))
+	}
+	w.header("tqmemory_shard_queue_depth", "gauge", "Requests waiting in the worker channel per shard.")
+	for i, depth := range s.cache.QueueDepths() {
+		w.value("tqmemory_shard_queue_depth", shard(i), float64(depth))
+	}
+
+	// Command latency
+	const latency = "tqmemory_command_duration_seconds"
+	w.header(latency, "histogram", "Time from parsing a command to buffering its response.")
+	for _, cmd := range commands {
+		// Export a snapshot, so the buckets add up to the count
+		var h tqmemory.Histogram
+		h.Merge(&s.latency[cmd.id])
+		w.histogram(latency, `command="`+cmd.name+`"`, &h)
+	}
+
+	// Worker latency
+	ops := s.cache.Latency()
+	for _, m := range []struct {
+		name, help string
+		hist       func(l *tqmemory.OpLatency) *tqmemory.Histogram
+	}{
+		{"tqmemory_queue_wait_seconds", "Time requests wait in a worker channel.",
+			func(l *tqmemory.OpLatency) *tqmemory.Histogram { return &l.Queue }},
+		{"tqmemory_exec_seconds", "Time requests take to execute in a worker.",
+			func(l *tqmemory.OpLatency) *tqmemory.Histogram { return &l.Exec }},
+	} {
+		w.header(m.name, "histogram", m.help)
+		for i := range ops {
+			w.histogram(m.name, `op="`+ops[i].Op+`"`, m.hist(&ops[i]))
+		}
+	}
+
+	// Go runtime
+	samples := make([]metrics.Sample, len(runtimeMetrics))
+	for i, m := range runtimeMetrics {
+		samples[i].Name = m.sample
+	}
+	metrics.Read(samples)
+	for i, m := range runtimeMetrics {
+		if samples[i].Value.Kind() == metrics.KindUint64 {
+			w.metric(m.name, m.kind, m.help, float64(samples[i].Value.Uint64()))
+		}
+	}
+	w.header("go_info", "gauge", "Go version the server was built with.")
+	w.value("go_info", `version="`+runtime.Version()+`"`, 1)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	cache := newTestCache(t)
+
+	c := newTestConn(cache, &bytes.Buffer{})
+	processAll(c, []byte("set foo 0 0 3\r\nbar\r\nget foo\r\nget foo\r\n"))
+
+	rec := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	out := string(body)
+
+	for _, want := range []string{
+		"# TYPE tqmemory_items gauge\ntqmemory_items 1\n",
+		"tqmemory_get_hits_total 2\n",
+		"tqmemory_limit_bytes 67108864\n",
+		`tqmemory_shard_queue_depth{shard="1"} 0` + "\n",
+		"# TYPE tqmemory_command_duration_seconds histogram\n",
+		`tqmemory_command_duration_seconds_bucket{command="get",le="+Inf"} 2` + "\n",
+		`tqmemory_command_duration_seconds_count{command="set"} 1` + "\n",
+		`tqmemory_queue_wait_seconds_count{op="get"} 2` + "\n",
+		`tqmemory_exec_seconds_bucket{op="set",le="+Inf"} 1` + "\n",
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `command="delete"`) {
+		t.Error("commands that were never executed should not be exported")
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+// A namespace is a key prefix that ends at the namespace delimiter, e.g. the
+// namespace "tenant:42" holds the keys "tenant:42:...". Invalidating it
+// makes all its keys miss, without knowing the keys.
+
+// handleTextNsInvalidate handles: ns_invalidate <namespace> [noreply]
+// It responds with "INVALIDATED <generation>".
+func (c *conn) handleTextNsInvalidate(tokens [][]byte) {
+	if len(tokens) < 2 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	gen := c.cache.InvalidateNamespace(string(tokens[1]))
+	if !isNoreply(tokens, 2) {
+		c.writer.WriteString("INVALIDATED ")
+		c.writeUint(gen)
+		c.writer.WriteString("\r\n")
+	}
+}
+
+// handleTextNsGeneration handles: ns_generation <namespace>
+// It responds with "GENERATION <generation>", the number of invalidations.
+func (c *conn) handleTextNsGeneration(tokens [][]byte) {
+	if len(tokens) < 2 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	c.writer.WriteString("GENERATION ")
+	c.writeUint(c.cache.NamespaceGeneration(string(tokens[1])))
+	c.writer.WriteString("\r\n")
+}
+
+// handleMetaInvalidate handles the meta namespace invalidation command:
+// mi <namespace> [O<opaque>] [q] [k] [g]
+// The response is "HD", with g the new generation is returned as "g<n>".
+func (c *conn) handleMetaInvalidate(tokens [][]byte) {
+	if len(tokens) < 2 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	ns, flags := tokens[1], tokens[2:]
+
+	var quiet bool
+	for _, flag := range flags {
+		switch flag[0] {
+		case 'q':
+			quiet = true
+		case 'O', 'k', 'g':
+			// Returned in the response
+		default:
+			c.writer.WriteString("CLIENT_ERROR invalid flag\r\n")
+			return
+		}
+	}
+
+	gen := c.cache.InvalidateNamespace(string(ns))
+	if quiet {
+		return
+	}
+	c.writer.WriteString("HD")
+	for _, flag := range flags {
+		if flag[0] == 'g' {
+			c.writer.WriteString(" g")
+			c.writeUint(gen)
+		}
+	}
+	c.writeMetaReturnFlags(flags, ns, 0)
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTextNamespaceInvalidation(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"set tenant:42:a 0 0 1 noreply\r\na", ""},
+		{"set tenant:43:a 0 0 1 noreply\r\na", ""},
+		{"ns_generation tenant:42", "GENERATION 0\r\n"},
+		{"ns_invalidate tenant:42", "INVALIDATED 1\r\n"},
+		{"get tenant:42:a", "END\r\n"},
+		{"get tenant:43:a", "VALUE tenant:43:a 0 1\r\na\r\nEND\r\n"},
+		{"ns_invalidate tenant:42 noreply", ""},
+		{"mi tenant:42 g Oabc k", "HD g3 Oabc ktenant:42\r\n"},
+		{"mi tenant:42 q", ""},
+		{"ns_generation tenant:42", "GENERATION 4\r\n"},
+		{"mi tenant:42 v", "CLIENT_ERROR invalid flag\r\n"},
+		{"ns_invalidate", "CLIENT_ERROR bad command line format\r\n"},
+	})
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// subscriberBuffer is the number of messages a subscriber can fall behind
+// before messages are dropped for it.
+const subscriberBuffer = 1024
+
+// handleTextSubscribe handles: subscribe <channel>... [pattern=<pattern>]...
+// After "OK" the connection only streams the messages of the channels and
+// of the channels that match the glob patterns, further input is ignored.
+func (c *conn) handleTextSubscribe(tokens [][]byte) {
+	var channels, patterns []string
+	for _, token := range tokens[1:] {
+		if len(token) > maxKeyLength {
+			c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+		if pattern, ok := bytes.CutPrefix(token, []byte("pattern=")); ok {
+			patterns = append(patterns, string(pattern))
+			continue
+		}
+		channels = append(channels, string(token))
+	}
+	if len(channels) == 0 && len(patterns) == 0 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	sub := c.pubSub.Subscribe(channels, patterns, subscriberBuffer)
+	c.subscriber = sub
+	c.writer.WriteString("OK\r\n")
+	// The messages are written by another goroutine from now on
+	c.writer.Flush()
+	go streamEvents(c.streamWriter(), sub, func(buf []byte, msg *tqmemory.Message) []byte {
+		return appendMessage(buf, msg, sub.Pattern(msg.Channel))
+	}, appendSkippedMessages)
+}
+
+// handleTextPublish handles: publish <channel> <bytes> [noreply]\r\n<data>\r\n
+// It responds with "PUBLISHED <count>", the number of subscribers the
+// message was queued for.
+func (c *conn) handleTextPublish(tokens [][]byte, data []byte) {
+	if len(tokens) < 3 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if _, ok := parseSize(tokens[2]); !ok {
+		c.writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return
+	}
+	if data == nil {
+		c.writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
+	n := c.pubSub.Publish(string(tokens[1]), data)
+	if !isNoreply(tokens, 3) {
+		c.writer.WriteString("PUBLISHED ")
+		c.writeUint(uint64(n))
+		c.writer.WriteString("\r\n")
+	}
+}
+
+// appendSkippedMessages appends the number of dropped messages as a
+// "SKIPPED <count>" line.
+func appendSkippedMessages(buf []byte, n uint64) []byte {
+	buf = append(buf, "SKIPPED "...)
+	buf = strconv.AppendUint(buf, n, 10)
+	return append(buf, "\r\n"...)
+}
+
+// appendMessage appends a message in the format of a get response value:
+// "MESSAGE <channel> <bytes> [<pattern>]\r\n<data>\r\n", with the pattern
+// the message was delivered for, if any.
+func appendMessage(buf []byte, msg *tqmemory.Message, pattern string) []byte {
+	buf = append(buf, "MESSAGE "...)
+	buf = append(buf, msg.Channel...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(len(msg.Data)), 10)
+	if pattern != "" {
+		buf = append(buf, ' ')
+		buf = append(buf, pattern...)
+	}
+	buf = append(buf, "\r\n"...)
+	buf = append(buf, msg.Data...)
+	return append(buf, "\r\n"...)
+}
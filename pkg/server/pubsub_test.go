@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+func TestTextPubSub(t *testing.T) {
+	cache := newMapCache()
+	out := &bytes.Buffer{}
+	subscribed := newTestConn(cache, out)
+	pr, pw := io.Pipe()
+	subscribed.stream = pw
+	processAll(subscribed, []byte("subscribe\r\nsubscribe news pattern=user:*\r\nget ignored\r\n"))
+	if got, want := out.String(), "CLIENT_ERROR bad command line format\r\nOK\r\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	out.Reset()
+	c := newTestConn(cache, out)
+	c.Server = subscribed.Server
+	processAll(c, []byte("publish news 5\r\nhello\r\npublish other 1\r\nx\r\npublish user:1 2 noreply\r\nhi\r\npublish news x\r\n"))
+	if got, want := out.String(), "PUBLISHED 1\r\nPUBLISHED 0\r\nCLIENT_ERROR bad data chunk\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	r := bufio.NewReader(pr)
+	for _, want := range []string{"MESSAGE news 5\r\n", "hello\r\n", "MESSAGE user:1 2 user:*\r\n", "hi\r\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Errorf("got %q, want %q", line, want)
+		}
+	}
+
+	subscribed.unregister(subscribed)
+	pr.Close()
+	if channels, patterns := c.pubSub.Counts(); channels != 0 || patterns != 0 {
+		t.Errorf("got %d channels and %d patterns after unsubscribing, want none", channels, patterns)
+	}
+}
+
+func TestPubSubSlowSubscriber(t *testing.T) {
+	var p tqmemory.PubSub
+	s := p.Subscribe([]string{"a"}, []string{"*"}, subscriberBuffer)
+	defer s.Close()
+	for i := 0; i < subscriberBuffer+10; i++ {
+		p.Publish("a", []byte("x"))
+	}
+	if got := len(s.Events()); got != subscriberBuffer {
+		t.Errorf("got %d queued messages, want %d", got, subscriberBuffer)
+	}
+	if got := s.Dropped(); got != 10 {
+		t.Errorf("got %d dropped, want 10", got)
+	}
+	if published, delivered, dropped := p.Stats(); published != subscriberBuffer+10 || delivered != subscriberBuffer || dropped != 10 {
+		t.Errorf("got %d published, %d delivered and %d dropped, want %d, %d and 10", published, delivered, dropped, subscriberBuffer+10, subscriberBuffer)
+	}
+}
+
+// stalledWriter is a stream that never drains, like a subscriber that
+// stopped reading: writes block until it is released.
+type stalledWriter struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w stalledWriter) Write(p []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return 0, io.ErrClosedPipe
+}
+
+func TestTextPubSubStalledSubscriber(t *testing.T) {
+	cache := newTestCache(t)
+	out := &bytes.Buffer{}
+	subscribed := newTestConn(cache, out)
+	stream := stalledWriter{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	subscribed.stream = stream
+	processAll(subscribed, []byte("subscribe news\r\n"))
+	defer subscribed.unregister(subscribed)
+	defer close(stream.release)
+
+	c := newTestConn(cache, out)
+	c.Server = subscribed.Server
+	processAll(c, []byte("publish news 1 noreply\r\nx\r\n"))
+	<-stream.writing
+	for range subscriberBuffer + 10 {
+		processAll(c, []byte("publish news 1 noreply\r\nx\r\n"))
+	}
+	out.Reset()
+	processAll(c, []byte("stats\r\n"))
+	for _, want := range []string{"STAT pubsub_delivered 1025\r\n", "STAT pubsub_dropped 10\r\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("stats don't contain %q", want)
+		}
+	}
+}
+
+func TestAppendMessage(t *testing.T) {
+	msg := tqmemory.Message{Channel: "news", Data: []byte("a b")}
+	want := "MESSAGE news 3 n*\r\na b\r\n"
+	if got := string(appendMessage(nil, &msg, "n*")); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
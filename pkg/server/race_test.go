@@ -0,0 +1,7 @@
+//go:build race
+
+package server
+
+// raceEnabled reports whether the race detector is on. It makes sync.Pool
+// drop items at random, so the allocation counts don't hold.
+const raceEnabled = true
@@ -6,10 +6,12 @@ import (
 	"log"
 	"net"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+	"github.com/panjf2000/gnet/v2"
 )
 
 // Server represents the TQMemory network server.
@@ -18,6 +20,56 @@ type Server struct {
 	addr           string
 	maxConnections int32
 	currConns      int32
+	totalConns     uint64 // connections accepted since start
+	bytesRead      uint64
+	bytesWritten   uint64
+	connIDs        uint64               // last connection number handed out
+	connsMu        sync.Mutex           // guards conns
+	conns          map[*conn]struct{}   // open connections, for stats conns
+	eventLoop      bool                 // serving on the event-loop backend
+	latency        []tqmemory.Histogram // server time per command, by command id
+	adminToken     string               // token of the admin command ("" = admin commands disabled)
+	pubSub         tqmemory.PubSub      // channel subscriptions of the connections
+}
+
+// conn holds the per-connection protocol state.
+// It is shared by the goroutine-per-connection and the event-loop backends,
+// so the protocol handlers do not depend on how bytes reach them.
+type conn struct {
+	*Server
+	cache      tqmemory.CacheInterface // the server's cache, tagging requests with the client address (made by busy)
+	writer     *bufio.Writer
+	out        statsWriter                       // the connection, counting written bytes
+	binary     bool                              // protocol detected from the first byte
+	detected   bool                              // protocol has been detected (event loop only)
+	skip       int                               // bytes of an oversized payload still to be discarded (event loop only)
+	pending    int                               // inbound bytes left unconsumed by the previous read (event loop only)
+	quiet      bool                              // the binary request being executed is a quiet mutation
+	watcher    *tqmemory.Watcher                 // set by the watch command, the connection then only streams events
+	keyspace   *tqmemory.KeyspaceSubscription    // set by the keyspace command, likewise
+	subscriber *tqmemory.Subscriber              // set by the subscribe command, likewise
+	stream     io.Writer                         // writes from other goroutines, for the watch and keyspace events and messages (see streamWriter)
+	async      *asyncWriter                      // the stream, closed with the connection (event loop only)
+	admin      bool                              // the admin token was sent, admin commands are allowed
+	gc         gnet.Conn                         // the connection of the event loop (event loop only)
+	blocked    atomic.Bool                       // a detached, submitted or offloaded command is running, input is not processed (event loop only)
+	resumed    atomic.Bool                       // the detached or offloaded command is done, set before wake (event loop only)
+	respond    func(*tqmemory.Response)          // writes the response of the submitted command (event loop only)
+	reply      atomic.Pointer[tqmemory.Response] // the response of the submitted command, set before wake (event loop only)
+	replied    func(*tqmemory.Response)          // Done of the submitted requests, c.storeReply made on the first submit (event loop only)
+	offloaded  func()                            // runs on another goroutine once the loop is done with the connection (event loop only)
+	started    time.Time                         // when the submitted or offloaded command started (event loop only)
+	closeMu    sync.Mutex                        // guards closed and gone
+	closed     chan struct{}                     // closed when the connection is closed, ends a waiting blocking pop (see closing)
+	gone       bool                              // the connection was closed
+
+	// Connection details for stats conns, read by other connections
+	id       uint64
+	addr     string
+	opened   time.Time
+	state    atomic.Int32            // one of connWaiting, connParseCmd, connNread
+	lastCmd  atomic.Pointer[command] // the last command executed
+	lastTime atomic.Int64            // when the last batch of commands started (Unix nanoseconds)
 }
 
 // New creates a new Server instance.
@@ -26,6 +78,7 @@ func New(cache tqmemory.CacheInterface, addr string) *Server {
 		cache:          cache,
 		addr:           addr,
 		maxConnections: 1024, // memcached default
+		latency:        make([]tqmemory.Histogram, len(commands)),
 	}
 }
 
@@ -35,15 +88,23 @@ func NewWithOptions(cache tqmemory.CacheInterface, addr string, maxConnections i
 		cache:          cache,
 		addr:           addr,
 		maxConnections: int32(maxConnections),
+		latency:        make([]tqmemory.Histogram, len(commands)),
+	}
+}
+
+// network returns the network type ("tcp" or "unix") for the configured address.
+func (s *Server) network() string {
+	if len(s.addr) > 0 && s.addr[0] == '/' {
+		return "unix"
 	}
+	return "tcp"
 }
 
 // Start runs the server (TCP or Unix socket based on address).
+// Every connection is served by its own goroutine.
 func (s *Server) Start() error {
-	// Determine network type based on address
-	network := "tcp"
-	if len(s.addr) > 0 && s.addr[0] == '/' {
-		network = "unix"
+	network := s.network()
+	if network == "unix" {
 		// Remove existing socket file if present
 		os.Remove(s.addr)
 	}
@@ -72,41 +133,50 @@ func (s *Server) Start() error {
 		}
 
 		atomic.AddInt32(&s.currConns, 1)
+		atomic.AddUint64(&s.totalConns, 1)
 		go s.handleConnection(conn)
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(netConn net.Conn) {
 	defer func() {
-		conn.Close()
+		netConn.Close()
 		atomic.AddInt32(&s.currConns, -1)
 	}()
 
 	// Enable TCP_NODELAY to disable Nagle's algorithm for lower latency
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
+	if tcpConn, ok := netConn.(*net.TCPConn); ok {
 		tcpConn.SetNoDelay(true)
 	}
 
 	// Use 64KB read buffer to match write buffer
-	reader := bufio.NewReaderSize(conn, 65536)
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReaderSize(&statsReader{r: netConn, s: s}, 65536)
+	netConn.SetReadDeadline(time.Now().Add(5 * time.Second))
 
 	firstByte, err := reader.Peek(1)
 	if err != nil {
 		if err != io.EOF {
-			log.Printf("Peek error from %s: %v", conn.RemoteAddr(), err)
+			log.Printf("Peek error from %s: %v", netConn.RemoteAddr(), err)
 		}
 		return
 	}
-	conn.SetReadDeadline(time.Time{}) // Reset deadline
+	netConn.SetReadDeadline(time.Time{}) // Reset deadline
 
 	// Use buffered writer for all responses (64KB buffer for better batching)
-	writer := bufio.NewWriterSize(conn, 65536)
+	c := &conn{
+		Server: s,
+		out:    statsWriter{w: netConn, s: s},
+		binary: firstByte[0] == reqMagic,
+	}
+	c.writer = bufio.NewWriterSize(&c.out, 65536)
+	c.stream = &c.out
+	s.register(c, netConn.RemoteAddr())
+	defer s.unregister(c)
 
-	if firstByte[0] == 0x80 {
-		s.handleBinary(conn, reader, writer)
+	if c.binary {
+		c.handleBinary(reader)
 	} else {
-		s.handleText(conn, reader, writer)
+		c.handleText(reader)
 	}
 }
 
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// Members of sets and sorted sets are returned as "MEMBER <member>" lines
+// (with the score for sorted sets) followed by "END".
+
+// parseMembers returns the member tokens as strings, or false if a member
+// is too long.
+func parseMembers(tokens [][]byte) ([]string, bool) {
+	members := make([]string, len(tokens))
+	for i, token := range tokens {
+		if len(token) > maxKeyLength {
+			return nil, false
+		}
+		members[i] = string(token)
+	}
+	return members, true
+}
+
+// parseScore parses a score, which may be "-inf" or "+inf" but not NaN.
+func parseScore(b []byte) (float64, bool) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	return f, err == nil && !math.IsNaN(f)
+}
+
+// writeMember writes a MEMBER line, with the score if withScore.
+func (c *conn) writeMember(member string, score float64, withScore bool) {
+	c.writer.WriteString("MEMBER ")
+	c.writer.WriteString(member)
+	if withScore {
+		c.writer.WriteByte(' ')
+		c.writeScore(score)
+	}
+	c.writer.WriteString("\r\n")
+}
+
+// writeScore writes a score in the shortest decimal notation.
+func (c *conn) writeScore(score float64) {
+	c.writer.Write(strconv.AppendFloat(c.writer.AvailableBuffer(), score, 'f', -1, 64))
+}
+
+// trimNoreply removes a trailing noreply from the tokens of a command with
+// a variable number of arguments.
+func trimNoreply(tokens [][]byte) ([][]byte, bool) {
+	if isNoreply(tokens, len(tokens)-1) {
+		return tokens[:len(tokens)-1], true
+	}
+	return tokens, false
+}
+
+// handleTextSAdd handles: sadd <key> <exptime> <member>... [noreply]
+// The exptime only applies when the set is created. It responds with the
+// number of added members.
+func (c *conn) handleTextSAdd(tokens [][]byte) {
+	tokens, noreply := trimNoreply(tokens)
+	if len(tokens) < 4 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, ok := parseInt(tokens[2])
+	members, ok2 := parseMembers(tokens[3:])
+	if !ok || !ok2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	n, err := c.cache.SAdd(string(tokens[1]), exptimeToTTL(exptime), members...)
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !noreply {
+		c.writeUint(uint64(n))
+		c.writer.WriteString("\r\n")
+	}
+}
+
+// handleTextRemoveMembers handles: srem|zrem <key> <member>... [noreply]
+// It responds with "DELETED <count>", the number of removed members.
+func (c *conn) handleTextRemoveMembers(tokens [][]byte, sorted bool) {
+	tokens, noreply := trimNoreply(tokens)
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	members, _ := parseMembers(tokens[2:])
+	var n int
+	var err error
+	if sorted {
+		n, err = c.cache.ZRem(string(tokens[1]), members...)
+	} else {
+		n, err = c.cache.SRem(string(tokens[1]), members...)
+	}
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !noreply {
+		c.writer.WriteString("DELETED ")
+		c.writeUint(uint64(n))
+		c.writer.WriteString("\r\n")
+	}
+}
+
+// handleTextSIsMember handles: sismember <key> <member>
+// It responds with 1 if the member is in the set, and 0 if not.
+func (c *conn) handleTextSIsMember(tokens [][]byte) {
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	ok, err := c.cache.SIsMember(string(tokens[1]), string(tokens[2]))
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if ok {
+		c.writer.WriteString("1\r\n")
+	} else {
+		c.writer.WriteString("0\r\n")
+	}
+}
+
+// handleTextSMembers handles: smembers <key>
+// The members are returned in sorted order.
+func (c *conn) handleTextSMembers(tokens [][]byte) {
+	if len(tokens) < 2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	members, err := c.cache.SMembers(string(tokens[1]))
+	if err != nil && err != tqmemory.ErrKeyNotFound {
+		c.writeTypedError(err)
+		return
+	}
+	for _, member := range members {
+		c.writeMember(member, 0, false)
+	}
+	c.writer.WriteString("END\r\n")
+}
+
+// handleTextSCard handles: scard <key>
+// It responds with the number of members, 0 if the set doesn't exist.
+func (c *conn) handleTextSCard(tokens [][]byte) {
+	if len(tokens) < 2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	n, err := c.cache.SCard(string(tokens[1]))
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	c.writeUint(uint64(n))
+	c.writer.WriteString("\r\n")
+}
+
+// handleTextZAdd handles:
+// zadd <key> <exptime> <score> <member> [<score> <member>]... [noreply]
+// The exptime only applies when the sorted set is created. It responds with
+// the number of added members.
+func (c *conn) handleTextZAdd(tokens [][]byte) {
+	tokens, noreply := trimNoreply(tokens)
+	if len(tokens) < 5 || len(tokens)%2 == 0 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	exptime, ok := parseInt(tokens[2])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	members := make([]tqmemory.ZMember, 0, (len(tokens)-3)/2)
+	for i := 3; i < len(tokens); i += 2 {
+		score, ok := parseScore(tokens[i])
+		if !ok {
+			c.writer.WriteString("CLIENT_ERROR invalid score\r\n")
+			return
+		}
+		if len(tokens[i+1]) > maxKeyLength {
+			c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+		members = append(members, tqmemory.ZMember{Member: string(tokens[i+1]), Score: score})
+	}
+	n, err := c.cache.ZAdd(string(tokens[1]), exptimeToTTL(exptime), members...)
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !noreply {
+		c.writeUint(uint64(n))
+		c.writer.WriteString("\r\n")
+	}
+}
+
+// handleTextZIncrBy handles: zincrby <key> <increment> <member> [noreply]
+// A missing member starts at 0. It responds with the new score.
+func (c *conn) handleTextZIncrBy(tokens [][]byte) {
+	if len(tokens) < 4 || len(tokens[1]) > maxKeyLength || len(tokens[3]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	delta, ok := parseScore(tokens[2])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR invalid score\r\n")
+		return
+	}
+	score, err := c.cache.ZIncrBy(string(tokens[1]), string(tokens[3]), delta, 0)
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	if !isNoreply(tokens, 4) {
+		c.writeScore(score)
+		c.writer.WriteString("\r\n")
+	}
+}
+
+// handleTextZRange handles: zrange <key> <start> <stop> [rev]
+// The members from rank start to stop (counted from the end when negative)
+// are returned with their scores, from the highest score with rev.
+func (c *conn) handleTextZRange(tokens [][]byte) {
+	start, stop, ok := parseListRange(tokens)
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	reverse := len(tokens) > 4 && string(tokens[4]) == "rev"
+	members, err := c.cache.ZRange(string(tokens[1]), start, stop, reverse)
+	c.writeZMembers(members, err)
+}
+
+// handleTextZRangeByScore handles: zrangebyscore <key> <min> <max>
+// The members with a score from min to max (inclusive, "-inf" and "+inf"
+// are allowed) are returned in score order.
+func (c *conn) handleTextZRangeByScore(tokens [][]byte) {
+	if len(tokens) < 4 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	min, ok := parseScore(tokens[2])
+	max, ok2 := parseScore(tokens[3])
+	if !ok || !ok2 {
+		c.writer.WriteString("CLIENT_ERROR invalid score\r\n")
+		return
+	}
+	members, err := c.cache.ZRangeByScore(string(tokens[1]), min, max)
+	c.writeZMembers(members, err)
+}
+
+// writeZMembers writes the response to a sorted set range.
+func (c *conn) writeZMembers(members []tqmemory.ZMember, err error) {
+	if err != nil && err != tqmemory.ErrKeyNotFound {
+		c.writeTypedError(err)
+		return
+	}
+	for _, m := range members {
+		c.writeMember(m.Member, m.Score, true)
+	}
+	c.writer.WriteString("END\r\n")
+}
+
+// handleTextZRank handles: zrank <key> <member> [rev]
+// It responds with the rank counted from 0, from the highest score with
+// rev, or NOT_FOUND.
+func (c *conn) handleTextZRank(tokens [][]byte) {
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	reverse := len(tokens) > 3 && string(tokens[3]) == "rev"
+	rank, err := c.cache.ZRank(string(tokens[1]), string(tokens[2]), reverse)
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	c.writeUint(uint64(rank))
+	c.writer.WriteString("\r\n")
+}
+
+// handleTextZScore handles: zscore <key> <member>
+// It responds with the score of the member, or NOT_FOUND.
+func (c *conn) handleTextZScore(tokens [][]byte) {
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	score, err := c.cache.ZScore(string(tokens[1]), string(tokens[2]))
+	if err != nil {
+		c.writeTypedError(err)
+		return
+	}
+	c.writeScore(score)
+	c.writer.WriteString("\r\n")
+}
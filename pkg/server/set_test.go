@@ -0,0 +1,42 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTextSet(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"sadd tags 0 go cache go", "2\r\n"},
+		{"sadd tags 0 db noreply", ""},
+		{"scard tags", "3\r\n"},
+		{"sismember tags go", "1\r\n"},
+		{"sismember tags rust", "0\r\n"},
+		{"smembers tags", "MEMBER cache\r\nMEMBER db\r\nMEMBER go\r\nEND\r\n"},
+		{"srem tags go rust", "DELETED 1\r\n"},
+		{"smembers none", "END\r\n"},
+		{"set plain 0 0 1\r\na", "STORED\r\n"},
+		{"sadd plain 0 x", "CLIENT_ERROR operation against a key holding the wrong kind of value\r\n"},
+	})
+}
+
+func TestTextSortedSet(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"zadd board 0 10 alice 20 bob 5 carol", "3\r\n"},
+		{"zincrby board 2.5 carol", "7.5\r\n"},
+		{"zrange board 0 -1", "MEMBER carol 7.5\r\nMEMBER alice 10\r\nMEMBER bob 20\r\nEND\r\n"},
+		{"zrange board 0 0 rev", "MEMBER bob 20\r\nEND\r\n"},
+		{"zrangebyscore board 7 +inf", "MEMBER carol 7.5\r\nMEMBER alice 10\r\nMEMBER bob 20\r\nEND\r\n"},
+		{"zrank board bob", "2\r\n"},
+		{"zrank board bob rev", "0\r\n"},
+		{"zscore board alice", "10\r\n"},
+		{"zscore board dave", "NOT_FOUND\r\n"},
+		{"zrem board alice dave", "DELETED 1\r\n"},
+		{"zadd board 0 NaN x", "CLIENT_ERROR invalid score\r\n"},
+		{"zadd board 0 1", "CLIENT_ERROR bad command line format\r\n"},
+	})
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// stat is a single name/value pair of the stats output.
+type stat struct {
+	name  string
+	value string
+}
+
+// statsReader counts the bytes read from a connection.
+type statsReader struct {
+	r io.Reader
+	s *Server
+}
+
+func (r *statsReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddUint64(&r.s.bytesRead, uint64(n))
+	return n, err
+}
+
+// statsWriter counts the bytes written to a connection.
+type statsWriter struct {
+	w io.Writer
+	s *Server
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddUint64(&w.s.bytesWritten, uint64(n))
+	return n, err
+}
+
+// Connection states reported by "stats conns", named like memcached's.
+const (
+	connWaiting  int32 = iota // waiting for a command
+	connParseCmd              // executing commands
+	connNread                 // waiting for the rest of a command
+)
+
+var connStateNames = [...]string{"conn_waiting", "conn_parse_cmd", "conn_nread"}
+
+// register adds a connection to the list reported by "stats conns".
+func (s *Server) register(c *conn, addr net.Addr) {
+	c.id = atomic.AddUint64(&s.connIDs, 1)
+	c.opened = time.Now()
+	if s.network() == "unix" {
+		c.addr = "unix:" + s.addr
+	} else if addr != nil {
+		c.addr = addr.Network() + ":" + addr.String()
+	}
+	c.lastTime.Store(c.opened.UnixNano())
+	s.connsMu.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.connsMu.Unlock()
+}
+
+// unregister removes a closed connection from the list.
+func (s *Server) unregister(c *conn) {
+	if c.watcher != nil {
+		c.watcher.Close()
+	}
+	if c.keyspace != nil {
+		c.keyspace.Close()
+	}
+	if c.subscriber != nil {
+		c.subscriber.Close()
+	}
+	c.closeMu.Lock()
+	c.gone = true
+	if c.closed != nil {
+		close(c.closed)
+	}
+	c.closeMu.Unlock()
+	s.connsMu.Lock()
+	delete(s.conns, c)
+	s.connsMu.Unlock()
+}
+
+// closing returns a channel that is closed when the connection is closed.
+// It is made on first use, so idle connections don't hold one.
+func (c *conn) closing() <-chan struct{} {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+		if c.gone {
+			close(c.closed)
+		}
+	}
+	return c.closed
+}
+
+// busy marks the connection as executing commands. The first time, it
+// makes the view of the cache that records the client address of the
+// connection, so idle connections don't hold one.
+func (c *conn) busy() {
+	if c.cache == nil {
+		c.cache = c.Server.cache.WithClient(c.addr)
+	}
+	c.lastTime.Store(time.Now().UnixNano())
+	c.state.Store(connParseCmd)
+}
+
+// stats returns the server statistics followed by the cache statistics,
+// in a stable order.
+func (s *Server) stats() []stat {
+	now := time.Now()
+	stats := []stat{
+		{"pid", strconv.Itoa(os.Getpid())},
+		{"uptime", strconv.FormatInt(int64(now.Sub(s.cache.GetStartTime()).Seconds()), 10)},
+		{"time", strconv.FormatInt(now.Unix(), 10)},
+		{"version", "1.0.0"},
+		{"curr_connections", strconv.Itoa(s.CurrentConnections())},
+		{"total_connections", strconv.FormatUint(atomic.LoadUint64(&s.totalConns), 10)},
+		{"bytes_read", strconv.FormatUint(atomic.LoadUint64(&s.bytesRead), 10)},
+		{"bytes_written", strconv.FormatUint(atomic.LoadUint64(&s.bytesWritten), 10)},
+	}
+	channels, patterns := s.pubSub.Counts()
+	published, delivered, dropped := s.pubSub.Stats()
+	stats = append(stats,
+		stat{"pubsub_channels", strconv.Itoa(channels)},
+		stat{"pubsub_patterns", strconv.Itoa(patterns)},
+		stat{"pubsub_published", strconv.FormatUint(published, 10)},
+		stat{"pubsub_delivered", strconv.FormatUint(delivered, 10)},
+		stat{"pubsub_dropped", strconv.FormatUint(dropped, 10)},
+	)
+
+	cacheStats := s.cache.Stats()
+	names := make([]string, 0, len(cacheStats))
+	for name := range cacheStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats = append(stats, stat{name, cacheStats[name]})
+	}
+	return stats
+}
+
+// statsGroup returns the statistics requested by the argument of a stats
+// command ("" for the general statistics), or false if the group is unknown.
+func (s *Server) statsGroup(group string) ([]stat, bool) {
+	switch group {
+	case "":
+		return s.stats(), true
+	case "settings":
+		return s.settings(), true
+	case "items":
+		return itemStats(s.cache.ItemStats()), true
+	case "slabs":
+		return slabStats(s.cache.ItemStats()), true
+	case "sizes":
+		return sizeStats(s.cache.ItemStats()), true
+	case "conns":
+		return s.connStats(), true
+	case "latency":
+		return s.latencyStats(), true
+	case "hotkeys":
+		return hotKeyStats(s.cache.HotKeys()), true
+	}
+	return nil, false
+}
+
+// resetStats zeroes the server and cache counters, like "stats reset".
+func (s *Server) resetStats() {
+	atomic.StoreUint64(&s.totalConns, 0)
+	atomic.StoreUint64(&s.bytesRead, 0)
+	atomic.StoreUint64(&s.bytesWritten, 0)
+	s.pubSub.ResetStats()
+	for i := range s.latency {
+		s.latency[i].Reset()
+	}
+	s.cache.ResetStats()
+}
+
+// settings returns the effective configuration, using memcached's names
+// where an equivalent exists.
+func (s *Server) settings() []stat {
+	cfg := s.cache.Config()
+
+	inter, port, socket := "NULL", "0", "NULL"
+	if s.network() == "unix" {
+		socket = s.addr
+	} else if host, p, err := net.SplitHostPort(s.addr); err == nil {
+		port = p
+		if host != "" {
+			inter = host
+		}
+	}
+	evictions := "on"
+	if cfg.MaxMemory == 0 {
+		evictions = "off" // nothing is evicted without a memory limit
+	}
+	backend := "goroutine"
+	if s.eventLoop {
+		backend = "eventloop"
+	}
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+
+	return []stat{
+		{"maxbytes", strconv.FormatInt(cfg.MaxMemory, 10)},
+		{"maxconns", strconv.Itoa(int(s.maxConnections))},
+		{"tcpport", port},
+		{"inter", inter},
+		{"domain_socket", socket},
+		{"evictions", evictions},
+		{"growth_factor", f(tqmemory.SizeClassFactor)},
+		{"chunk_size", strconv.Itoa(tqmemory.SizeClassMin)},
+		{"num_threads", strconv.Itoa(s.cache.WorkerCount())},
+		{"cas_enabled", "yes"},
+		{"binding_protocol", "auto-negotiate"},
+		{"item_size_max", strconv.Itoa(cfg.MaxValueSize)},
+		{"key_size_max", strconv.Itoa(cfg.MaxKeySize)},
+		{"default_ttl", strconv.FormatInt(int64(cfg.DefaultTTL/time.Second), 10)},
+		{"stale_multiplier", f(cfg.StaleMultiplier)},
+		{"channel_capacity", strconv.Itoa(cfg.ChannelCapacity)},
+		{"detail_enabled", yesNo(s.cache.DetailEnabled())},
+		{"stat_key_prefix", string(cfg.PrefixDelimiter)},
+		{"hot_keys", strconv.Itoa(cfg.HotKeys)},
+		{"hot_key_log_share", f(cfg.HotKeyLogShare)},
+		{"slowlog_threshold_us", strconv.FormatInt(cfg.SlowLogThreshold.Microseconds(), 10)},
+		{"slowlog_max_len", strconv.Itoa(cfg.SlowLogLen)},
+		{"network_backend", backend},
+	}
+}
+
+// yesNo formats a boolean setting like memcached.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// itemStats returns the per size class item counters of the non-empty
+// classes, like memcached's "stats items".
+func itemStats(items tqmemory.ItemStats) []stat {
+	var stats []stat
+	u := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	for i, class := range items.Classes {
+		if class.Items == 0 && class.Evicted == 0 && class.ExpiredUnfetched == 0 {
+			continue
+		}
+		prefix := "items:" + strconv.Itoa(i+1) + ":"
+		stats = append(stats,
+			stat{prefix + "number", u(class.Items)},
+			stat{prefix + "evicted", u(class.Evicted)},
+			stat{prefix + "evicted_unfetched", u(class.EvictedUnfetched)},
+			stat{prefix + "expired_unfetched", u(class.ExpiredUnfetched)},
+		)
+	}
+	return stats
+}
+
+// slabStats emulates memcached's "stats slabs" from the size classes: every
+// item takes one chunk and pages are allocated on demand, so there are no
+// free chunks.
+func slabStats(items tqmemory.ItemStats) []stat {
+	const pageSize = 1024 * 1024 // memcached's slab page size
+
+	var stats []stat
+	var active int
+	var malloced int64
+	for i, class := range items.Classes {
+		if class.Items == 0 {
+			continue
+		}
+		perPage := max(pageSize/class.ChunkSize, 1)
+		pages := (int64(class.Items) + perPage - 1) / perPage
+		active++
+		malloced += pages * perPage * class.ChunkSize
+
+		prefix := strconv.Itoa(i+1) + ":"
+		stats = append(stats,
+			stat{prefix + "chunk_size", strconv.FormatInt(class.ChunkSize, 10)},
+			stat{prefix + "chunks_per_page", strconv.FormatInt(perPage, 10)},
+			stat{prefix + "total_pages", strconv.FormatInt(pages, 10)},
+			stat{prefix + "total_chunks", strconv.FormatInt(pages*perPage, 10)},
+			stat{prefix + "used_chunks", strconv.FormatUint(class.Items, 10)},
+			stat{prefix + "free_chunks", strconv.FormatInt(pages*perPage-int64(class.Items), 10)},
+			stat{prefix + "mem_requested", strconv.FormatInt(class.Bytes, 10)},
+		)
+	}
+	return append(stats,
+		stat{"active_slabs", strconv.Itoa(active)},
+		stat{"total_malloced", strconv.FormatInt(malloced, 10)},
+	)
+}
+
+// sizeStats returns the item count by size, in SizeBucket steps, like
+// memcached's "stats sizes".
+func sizeStats(items tqmemory.ItemStats) []stat {
+	sizes := make([]int64, 0, len(items.Sizes))
+	for size := range items.Sizes {
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+
+	stats := make([]stat, len(sizes))
+	for i, size := range sizes {
+		stats[i] = stat{strconv.FormatInt(size, 10), strconv.FormatUint(items.Sizes[size], 10)}
+	}
+	return stats
+}
+
+// connStats lists the open connections with their address, age, state and
+// last command, ordered by connection number.
+func (s *Server) connStats() []stat {
+	s.connsMu.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.connsMu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	now := time.Now()
+	var stats []stat
+	for _, c := range conns {
+		lastCmd := "none"
+		if cmd := c.lastCmd.Load(); cmd != nil {
+			lastCmd = cmd.name
+		}
+		idle := now.Sub(time.Unix(0, c.lastTime.Load()))
+		prefix := strconv.FormatUint(c.id, 10) + ":"
+		stats = append(stats,
+			stat{prefix + "addr", c.addr},
+			stat{prefix + "age", strconv.FormatInt(int64(now.Sub(c.opened).Seconds()), 10)},
+			stat{prefix + "state", connStateNames[c.state.Load()]},
+			stat{prefix + "secs_since_last_cmd", strconv.FormatInt(int64(idle.Seconds()), 10)},
+			stat{prefix + "last_cmd", lastCmd},
+		)
+	}
+	return stats
+}
+
+// CommandLatency returns the p50, p99 and p999 of the time the server spends
+// on each command that was executed, from parsing the command to buffering
+// its response.
+func (s *Server) CommandLatency() map[string]tqmemory.LatencySummary {
+	latency := make(map[string]tqmemory.LatencySummary)
+	for _, cmd := range commands {
+		if summary := s.latency[cmd.id].Summary(); summary.Count > 0 {
+			latency[cmd.name] = summary
+		}
+	}
+	return latency
+}
+
+// hotKeyStats returns the most read and written keys, ranked from 1, with
+// their estimated access count, share of their shard's traffic and shard.
+func hotKeyStats(hot tqmemory.HotKeys) []stat {
+	var stats []stat
+	for _, list := range []struct {
+		name string
+		keys []tqmemory.HotKey
+	}{{"reads", hot.Reads}, {"writes", hot.Writes}} {
+		for i, k := range list.keys {
+			prefix := list.name + ":" + strconv.Itoa(i+1) + ":"
+			stats = append(stats,
+				stat{prefix + "key", k.Key},
+				stat{prefix + "count", strconv.FormatUint(k.Count, 10)},
+				stat{prefix + "share", strconv.FormatFloat(k.Share, 'f', 4, 64)},
+				stat{prefix + "shard", strconv.Itoa(k.Shard)},
+			)
+		}
+	}
+	return stats
+}
+
+// latencyStats returns the latency percentiles in microseconds: the total
+// server time per command, followed by the time spent waiting in a worker
+// queue and executing in a worker per worker operation.
+func (s *Server) latencyStats() []stat {
+	var stats []stat
+	add := func(prefix string, summary tqmemory.LatencySummary) {
+		us := func(d time.Duration) string {
+			return strconv.FormatFloat(float64(d)/float64(time.Microsecond), 'f', -1, 64)
+		}
+		stats = append(stats,
+			stat{prefix + "_count", strconv.FormatUint(summary.Count, 10)},
+			stat{prefix + "_p50_us", us(summary.P50)},
+			stat{prefix + "_p99_us", us(summary.P99)},
+			stat{prefix + "_p999_us", us(summary.P999)},
+		)
+	}
+	for _, cmd := range commands {
+		if summary := s.latency[cmd.id].Summary(); summary.Count > 0 {
+			add(cmd.name+":total", summary)
+		}
+	}
+	for _, op := range s.cache.Latency() {
+		add(op.Op+":queue", op.Queue.Summary())
+		add(op.Op+":exec", op.Exec.Summary())
+	}
+	return stats
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// statsOutput runs a text command on c and returns the response.
+func statsOutput(t *testing.T, c *conn, cmd string) string {
+	t.Helper()
+	var out bytes.Buffer
+	c.writer.Reset(&out)
+	processAll(c, []byte(cmd+"\r\n"))
+	return out.String()
+}
+
+func TestTextStatsGroups(t *testing.T) {
+	cache := newTestCache(t)
+
+	c := newTestConn(cache, &bytes.Buffer{})
+	c.register(c, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000})
+	processAll(c, []byte("set foo 0 0 3\r\nbar\r\nget foo\r\n"))
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"stats settings", []string{"STAT maxbytes 67108864\r\n", "STAT tcpport 0\r\n", "STAT num_threads 2\r\n", "STAT item_size_max 1048576\r\n"}},
+		{"stats items", []string{"STAT items:1:number 1\r\n", "STAT items:1:evicted 0\r\n"}},
+		{"stats slabs", []string{"STAT 1:chunk_size 96\r\n", "STAT 1:used_chunks 1\r\n", "STAT 1:mem_requested 6\r\n", "STAT active_slabs 1\r\n"}},
+		{"stats sizes", []string{"STAT 32 1\r\nEND\r\n"}},
+		{"stats conns", []string{"STAT 1:addr tcp:10.0.0.1:5000\r\n", "STAT 1:state conn_waiting\r\n", "STAT 1:last_cmd stats\r\n"}},
+		{"stats bogus", []string{"ERROR\r\n"}},
+		{"stats reset", []string{"RESET\r\n"}},
+		{"stats", []string{"STAT cmd_get 0\r\n", "STAT curr_items 1\r\n"}},
+	}
+	for _, tt := range tests {
+		out := statsOutput(t, c, tt.cmd)
+		for _, want := range tt.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("%q: missing %q in\n%s", tt.cmd, want, out)
+			}
+		}
+	}
+
+	c.unregister(c)
+	if out := statsOutput(t, c, "stats conns"); out != "END\r\n" {
+		t.Errorf("expected no connections, got %q", out)
+	}
+}
+
+func TestTextStatsDetail(t *testing.T) {
+	cache := newTestCache(t)
+
+	var out bytes.Buffer
+	c := newTestConn(cache, &out)
+	processAll(c, []byte("stats detail on\r\n"+
+		"set a:1 0 0 1\r\nx\r\n"+
+		"get a:1 a:2 b:1\r\n"+
+		"delete b:1\r\n"+
+		"stats detail off\r\n"+
+		"get a:1\r\n"+
+		"stats detail dump\r\n"+
+		"stats detail\r\n"))
+
+	want := "OK\r\n" +
+		"STORED\r\n" +
+		"VALUE a:1 0 1\r\nx\r\nEND\r\n" +
+		"NOT_FOUND\r\n" +
+		"OK\r\n" +
+		"VALUE a:1 0 1\r\nx\r\nEND\r\n" +
+		"PREFIX a get 2 hit 1 set 1 del 0\r\n" +
+		"PREFIX b get 1 hit 0 set 0 del 1\r\n" +
+		"END\r\n" +
+		"CLIENT_ERROR usage: stats detail on|off|dump\r\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestTextStatsLatency(t *testing.T) {
+	cache := newTestCache(t)
+
+	c := newTestConn(cache, &bytes.Buffer{})
+	processAll(c, []byte("set foo 0 0 3\r\nbar\r\nget foo\r\nget foo bar\r\n"))
+
+	out := statsOutput(t, c, "stats latency")
+	for _, want := range []string{
+		"STAT set:total_count 1\r\n",
+		"STAT get:total_count 2\r\n",
+		"STAT get:total_p50_us ",
+		"STAT get:queue_count 1\r\n",
+		"STAT get:exec_p999_us ",
+		"STAT get_multi:exec_count ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	if got := c.CommandLatency()["get"].Count; got != 2 {
+		t.Errorf("expected 2 gets, got %d", got)
+	}
+}
+
+func TestTextStatsHotKeys(t *testing.T) {
+	cfg := tqmemory.DefaultConfig()
+	cfg.HotKeys = 10
+	cache, err := tqmemory.NewSharded(cfg, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	c := newTestConn(cache, &bytes.Buffer{})
+	processAll(c, []byte("set foo 0 0 3\r\nbar\r\nget foo\r\nget foo\r\n"))
+
+	out := statsOutput(t, c, "stats hotkeys")
+	for _, want := range []string{
+		"STAT reads:1:key foo\r\n",
+		"STAT reads:1:count 2\r\n",
+		"STAT reads:1:share 1.0000\r\n",
+		"STAT reads:1:shard ",
+		"STAT writes:1:key foo\r\n",
+		"STAT writes:1:count 1\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestTextSlowlog(t *testing.T) {
+	cfg := tqmemory.DefaultConfig()
+	cfg.SlowLogThreshold = 0 // log every request
+	cache, err := tqmemory.NewSharded(cfg, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	out := &bytes.Buffer{}
+	c := newTestConn(cache, out)
+	c.cache = nil // made with the client address by the first busy
+	c.register(c, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000})
+	defer c.unregister(c)
+	c.busy()
+	processAll(c, []byte("set foo 0 0 3\r\nbar\r\nappend foo 0 0 2\r\nxy\r\nslowlog len\r\nslowlog get 1\r\n"))
+
+	lines := strings.Split(out.String(), "\r\n")
+	if len(lines) != 6 || lines[2] != "2" || lines[4] != "END" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	fields := strings.Fields(lines[3])
+	if len(fields) != 12 || fields[0] != "SLOWLOG" || fields[1] != "1" || fields[6] != "append" ||
+		fields[7] != "foo" || fields[8] != "1" || fields[9] != "2" || fields[11] != "tcp:10.0.0.1:5000" {
+		t.Errorf("unexpected entry %q", lines[3])
+	}
+
+	out.Reset()
+	processAll(c, []byte("slowlog reset\r\nslowlog len\r\nslowlog foo\r\n"))
+	if got, want := out.String(), "RESET\r\n0\r\nCLIENT_ERROR usage: slowlog get [count]|len|reset\r\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
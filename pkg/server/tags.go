@@ -0,0 +1,17 @@
+package server
+
+// handleTextTagInvalidate handles: tag_invalidate <tag> [noreply]
+// It removes the items stored with the tag (see ms) and responds with
+// "DELETED <count>".
+func (c *conn) handleTextTagInvalidate(tokens [][]byte) {
+	if len(tokens) < 2 || len(tokens[1]) > maxKeyLength {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	n := c.cache.InvalidateTag(string(tokens[1]))
+	if !isNoreply(tokens, 2) {
+		c.writer.WriteString("DELETED ")
+		c.writeUint(uint64(n))
+		c.writer.WriteString("\r\n")
+	}
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTextTagInvalidate(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newTestConn(newTestCache(t), out)
+	runTextTests(t, c, out, []textTest{
+		{"ms page:1 4 T0 Gproduct:1 Gproduct:2 Oabc k\r\nhtml", "HD Oabc kpage:1\r\n"},
+		{"ms page:2 4 Gproduct:1 q\r\nhtml", ""},
+		{"ms page:3 4\r\nhtml", "HD\r\n"},
+		{"get page:1", "VALUE page:1 0 4\r\nhtml\r\nEND\r\n"},
+		{"tag_invalidate product:2", "DELETED 1\r\n"},
+		{"tag_invalidate product:1", "DELETED 1\r\n"},
+		{"get page:1 page:2 page:3", "VALUE page:3 0 4\r\nhtml\r\nEND\r\n"},
+		{"tag_invalidate product:1 noreply", ""},
+		{"ms page:4 4 X\r\nhtml", "CLIENT_ERROR invalid flag\r\n"},
+		{"ms page:4 4 G\r\nhtml", "CLIENT_ERROR bad token in command line format\r\n"},
+		{"ms page:4 x", "CLIENT_ERROR bad data chunk\r\n"},
+		{"tag_invalidate", "CLIENT_ERROR bad command line format\r\n"},
+	})
+}
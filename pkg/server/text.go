@@ -2,13 +2,11 @@ package server
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
 	"io"
 	"log"
-	"net"
-	"os"
+	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/mevdschee/tqmemory/pkg/tqmemory"
@@ -20,129 +18,379 @@ const (
 	maxValueSize  = 1024 * 1024 // Memcached default max item size (1MB)
 )
 
-func (s *Server) handleText(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer) {
+// handleText serves a text protocol connection with blocking reads.
+// Commands are parsed in place from the read buffer, only commands that
+// don't fit in the buffer are read separately.
+func (c *conn) handleText(reader *bufio.Reader) {
 	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
+		// Block until data is available, then process everything buffered
+		if reader.Buffered() == 0 {
+			c.state.Store(connWaiting)
+		}
+		if _, err := reader.Peek(1); err != nil {
 			if err != io.EOF {
 				log.Printf("Read error: %v", err)
 			}
 			return
 		}
+		c.busy()
+		buf, _ := reader.Peek(reader.Buffered())
+
+		consumed, quit := c.processText(buf)
+		reader.Discard(consumed)
 
-		line = strings.TrimSpace(line)
-		if line == "" {
+		// Flush once all pipelined commands are processed (batched writes)
+		if quit || reader.Buffered() == 0 {
+			c.writer.Flush()
+		}
+		if quit {
+			return
+		}
+		if consumed > 0 {
 			continue
 		}
 
-		parts := strings.Fields(line)
-		if len(parts) == 0 {
+		// The pending command is incomplete, wait for more data
+		c.state.Store(connNread)
+		if reader.Buffered() < reader.Size() {
+			if _, err := reader.Peek(reader.Buffered() + 1); err != nil {
+				if err != io.EOF {
+					log.Printf("Read error: %v", err)
+				}
+				return
+			}
 			continue
 		}
 
-		cmd := strings.ToUpper(parts[0])
-
-		switch cmd {
-		case "SET":
-			s.handleTextStorage(reader, writer, parts, "SET")
-		case "ADD":
-			s.handleTextStorage(reader, writer, parts, "ADD")
-		case "REPLACE":
-			s.handleTextStorage(reader, writer, parts, "REPLACE")
-		case "APPEND":
-			s.handleTextAppendPrepend(reader, writer, parts, false)
-		case "PREPEND":
-			s.handleTextAppendPrepend(reader, writer, parts, true)
-		case "CAS":
-			s.handleTextCas(reader, writer, parts)
-		case "GET":
-			s.handleTextGet(writer, parts, false)
-		case "GETS":
-			s.handleTextGet(writer, parts, true)
-		case "DELETE":
-			s.handleTextDelete(writer, parts)
-		case "INCR":
-			s.handleTextIncrDecr(writer, parts, true)
-		case "DECR":
-			s.handleTextIncrDecr(writer, parts, false)
-		case "TOUCH":
-			s.handleTextTouch(writer, parts)
-		case "GAT":
-			s.handleTextGat(writer, parts, false)
-		case "GATS":
-			s.handleTextGat(writer, parts, true)
-		case "FLUSH_ALL":
-			s.handleTextFlushAll(writer, parts)
-		case "VERBOSITY":
-			// Silently accept verbosity command (noreply handled implicitly)
-		case "QUIT":
+		// The pending command doesn't fit in the read buffer
+		quit = c.readLargeText(reader)
+		if quit || reader.Buffered() == 0 {
+			c.writer.Flush()
+		}
+		if quit {
 			return
-		case "VERSION":
-			writer.WriteString("VERSION 1.0.0\r\n")
-		case "STATS":
-			s.handleTextStats(writer)
-		default:
-			writer.WriteString("ERROR\r\n")
 		}
+	}
+}
 
-		// Flush once per command (batched writes)
-		if reader.Buffered() == 0 {
-			writer.Flush()
+// readLargeText reads and executes a command that is larger than the read
+// buffer: a storage command with a large value or a very long multi-get.
+func (c *conn) readLargeText(reader *bufio.Reader) bool {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return true
+	}
+	tokens := tokenize(line, nil)
+
+	var data []byte
+	if n := textDataLen(tokens); n > maxValueSize {
+		c.skip = n + 2
+	} else if n >= 0 {
+		data = make([]byte, n+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			c.writer.WriteString("SERVER_ERROR read error\r\n")
+			return true
 		}
 	}
+	if len(tokens) == 0 {
+		return false
+	}
+	start := time.Now()
+	quit := c.execText(tokens, data)
+	c.recordLatency(start)
+	return quit
 }
 
-func (s *Server) handleTextStorage(reader *bufio.Reader, writer *bufio.Writer, parts []string, op string) {
-	if len(parts) < 5 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
-		return
-	}
+// processText executes all complete commands in buf without blocking.
+// It returns the number of bytes consumed; an incomplete trailing command
+// is left in buf until more data arrives.
+func (c *conn) processText(buf []byte) (consumed int, quit bool) {
+	var tokenBuf [maxTokens][]byte
 
-	key := parts[1]
-	// Validate flags (must be numeric)
-	_, err := strconv.ParseUint(parts[2], 10, 32)
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
-		return
-	}
-	// Validate exptime (must be numeric)
-	exptime, err := strconv.ParseInt(parts[3], 10, 64)
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
-		return
+	for consumed < len(buf) {
+		// A watching or subscribed connection only streams events
+		if c.watcher != nil || c.keyspace != nil || c.subscriber != nil {
+			return len(buf), false
+		}
+		// The input after a command that waits for a worker waits for its response
+		if c.blocked.Load() {
+			return consumed, false
+		}
+		rest := buf[consumed:]
+
+		// Discard the remainder of an oversized data block
+		if c.skip > 0 {
+			n := min(c.skip, len(rest))
+			c.skip -= n
+			consumed += n
+			continue
+		}
+
+		nl := bytes.IndexByte(rest, '\n')
+		if nl < 0 {
+			// Like memcached, only multi-gets may exceed maxLineLength
+			if len(rest) > maxLineLength && !isMultiGet(rest) {
+				return consumed, true
+			}
+			return consumed, false
+		}
+
+		tokens := tokenize(rest[:nl], tokenBuf[:0])
+		frame := nl + 1
+
+		var data []byte
+		if n := textDataLen(tokens); n > maxValueSize {
+			c.skip = n + 2
+		} else if n >= 0 {
+			if len(rest) < frame+n+2 {
+				return consumed, false
+			}
+			data = rest[frame : frame+n+2]
+			frame += n + 2
+		}
+		consumed += frame
+
+		if len(tokens) == 0 {
+			continue
+		}
+		start := time.Now()
+		quit := c.execText(tokens, data)
+		if c.blocked.Load() {
+			// Recorded when the command is done
+			c.started = start
+		} else {
+			c.recordLatency(start)
+		}
+		if quit {
+			return consumed, true
+		}
 	}
-	// Validate bytes (must be numeric)
-	bytes, err := strconv.Atoi(parts[4])
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
-		return
+	return consumed, false
+}
+
+// textDataLen returns the length of the data block that follows a storage
+// command line, or -1 if the command carries no (valid) data block.
+func textDataLen(tokens [][]byte) int {
+	if len(tokens) < 3 {
+		return -1
+	}
+	var cmdBuf [maxCommandLength]byte
+	var size []byte
+	switch string(lowerCommand(tokens[0], &cmdBuf)) {
+	case "set", "add", "replace", "append", "prepend", "cas", "hset":
+		if len(tokens) < 5 {
+			return -1
+		}
+		size = tokens[4]
+	case "ms", "publish":
+		size = tokens[2]
+	case "lpush", "rpush":
+		if len(tokens) < 4 {
+			return -1
+		}
+		size = tokens[3]
+	default:
+		return -1
 	}
-	// Check value size limit (Memcached default is 1MB)
-	if bytes > maxValueSize {
-		// Still need to read and discard the data
-		discard := make([]byte, bytes)
-		io.ReadFull(reader, discard)
-		reader.ReadByte() // \r
-		reader.ReadByte() // \n
-		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
-		return
+	n, ok := parseSize(size)
+	if !ok {
+		return -1
 	}
-	noreply := len(parts) > 5 && parts[5] == "noreply"
+	return n
+}
 
-	// Read value
-	value := make([]byte, bytes)
-	if _, err := io.ReadFull(reader, value); err != nil {
-		writer.WriteString("SERVER_ERROR read error\r\n")
-		return
+// execText executes a single text command. For storage commands, data holds
+// the value including its trailing "\r\n" (nil if the value was discarded).
+// It returns true if the connection should be closed.
+func (c *conn) execText(tokens [][]byte, data []byte) bool {
+	if data != nil {
+		if !bytes.HasSuffix(data, crlf) {
+			c.writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return false
+		}
+		data = data[:len(data)-2]
 	}
 
-	// Read \r\n
-	c, _ := reader.ReadByte()
-	if c == '\r' {
-		reader.ReadByte()
+	// Commands are case insensitive, the switch on string(...) doesn't allocate
+	var cmdBuf [maxCommandLength]byte
+	cmd := lowerCommand(tokens[0], &cmdBuf)
+	c.lastCmd.Store(textCommands[string(cmd)])
+	if c.gc != nil && !loopText(cmd, tokens) {
+		c.offloadText(cmd, tokens, data)
+		return false
 	}
+	return c.runText(cmd, tokens, data)
+}
+
+// loopText reports whether a text command runs on the event loop: it
+// doesn't wait for a worker, submits its request or detaches itself. The
+// other commands are offloaded.
+func loopText(cmd []byte, tokens [][]byte) bool {
+	switch string(cmd) {
+	case "get", "gets":
+		// A multi-get waits for all workers at once
+		return len(tokens) <= 2
+	case "set", "add", "replace", "cas", "delete", "incr", "decr", "touch",
+		"mn", "verbosity", "quit", "version", "watch", "keyspace", "subscribe",
+		"publish", "blpop", "brpop", "lru_crawler", "admin":
+		return true
+	}
+	// Unknown commands only write an error
+	return textCommands[string(cmd)] == nil
+}
 
-	// Calculate TTL
+// offloadText offloads a text command, with its arguments copied out of
+// the inbound buffer.
+func (c *conn) offloadText(cmd []byte, tokens [][]byte, data []byte) {
+	name, args, value := bytes.Clone(cmd), cloneTokens(tokens), bytes.Clone(data)
+	c.offload(func() { c.runText(name, args, value) })
+}
+
+// runText runs a text command, see execText.
+func (c *conn) runText(cmd []byte, tokens [][]byte, data []byte) bool {
+	switch string(cmd) {
+	case "set":
+		c.handleTextStorage(tokens, data, "SET")
+	case "add":
+		c.handleTextStorage(tokens, data, "ADD")
+	case "replace":
+		c.handleTextStorage(tokens, data, "REPLACE")
+	case "append":
+		c.handleTextAppendPrepend(tokens, data, false)
+	case "prepend":
+		c.handleTextAppendPrepend(tokens, data, true)
+	case "cas":
+		c.handleTextCas(tokens, data)
+	case "get":
+		c.handleTextGet(tokens, false)
+	case "gets":
+		c.handleTextGet(tokens, true)
+	case "delete":
+		c.handleTextDelete(tokens)
+	case "incr":
+		c.handleTextIncrDecr(tokens, true)
+	case "decr":
+		c.handleTextIncrDecr(tokens, false)
+	case "touch":
+		c.handleTextTouch(tokens)
+	case "gat":
+		c.handleTextGat(tokens, false)
+	case "gats":
+		c.handleTextGat(tokens, true)
+	case "flush_all":
+		c.handleTextFlushAll(tokens)
+	case "ma":
+		c.handleMetaArithmetic(tokens)
+	case "mi":
+		c.handleMetaInvalidate(tokens)
+	case "ms":
+		c.handleMetaSet(tokens, data)
+	case "mn":
+		// Meta no-op, marks the end of a batch of quiet meta commands
+		c.writer.WriteString("MN\r\n")
+	case "verbosity":
+		// Silently accept verbosity command (noreply handled implicitly)
+	case "quit":
+		return true
+	case "version":
+		c.writer.WriteString("VERSION 1.0.0\r\n")
+	case "stats":
+		c.handleTextStats(tokens)
+	case "slowlog":
+		c.handleTextSlowlog(tokens)
+	case "watch":
+		c.handleTextWatch(tokens)
+	case "keyspace":
+		c.handleTextKeyspace(tokens)
+	case "subscribe":
+		c.handleTextSubscribe(tokens)
+	case "publish":
+		c.handleTextPublish(tokens, data)
+	case "hset":
+		c.handleTextHSet(tokens, data)
+	case "hget":
+		c.handleTextHGet(tokens)
+	case "hgetall":
+		c.handleTextHGetAll(tokens)
+	case "hdel":
+		c.handleTextHDel(tokens)
+	case "hincrby":
+		c.handleTextHIncrBy(tokens)
+	case "lpush":
+		c.handleTextPush(tokens, data, true)
+	case "rpush":
+		c.handleTextPush(tokens, data, false)
+	case "lpop":
+		c.handleTextPop(tokens, true)
+	case "rpop":
+		c.handleTextPop(tokens, false)
+	case "blpop":
+		c.handleTextBlockingPop(tokens, true)
+	case "brpop":
+		c.handleTextBlockingPop(tokens, false)
+	case "lrange":
+		c.handleTextLRange(tokens)
+	case "ltrim":
+		c.handleTextLTrim(tokens)
+	case "llen":
+		c.handleTextLLen(tokens)
+	case "sadd":
+		c.handleTextSAdd(tokens)
+	case "srem":
+		c.handleTextRemoveMembers(tokens, false)
+	case "sismember":
+		c.handleTextSIsMember(tokens)
+	case "smembers":
+		c.handleTextSMembers(tokens)
+	case "scard":
+		c.handleTextSCard(tokens)
+	case "zadd":
+		c.handleTextZAdd(tokens)
+	case "zincrby":
+		c.handleTextZIncrBy(tokens)
+	case "zrem":
+		c.handleTextRemoveMembers(tokens, true)
+	case "zrange":
+		c.handleTextZRange(tokens)
+	case "zrangebyscore":
+		c.handleTextZRangeByScore(tokens)
+	case "zrank":
+		c.handleTextZRank(tokens)
+	case "zscore":
+		c.handleTextZScore(tokens)
+	case "pfadd":
+		c.handleTextPFAdd(tokens)
+	case "pfcount":
+		c.handleTextPFCount(tokens)
+	case "pfmerge":
+		c.handleTextPFMerge(tokens)
+	case "bfreserve":
+		c.handleTextBFReserve(tokens)
+	case "bfadd":
+		c.handleTextBFAdd(tokens)
+	case "bfexists":
+		c.handleTextBFExists(tokens)
+	case "lru_crawler":
+		c.handleTextLruCrawler(tokens)
+	case "ns_invalidate":
+		c.handleTextNsInvalidate(tokens)
+	case "ns_generation":
+		c.handleTextNsGeneration(tokens)
+	case "tag_invalidate":
+		c.handleTextTagInvalidate(tokens)
+	case "admin":
+		c.handleTextAdmin(tokens)
+	case "delete_pattern":
+		c.handleTextDeletePattern(tokens)
+	default:
+		c.writer.WriteString("ERROR\r\n")
+	}
+	return false
+}
+
+// exptimeToTTL converts a memcached exptime (seconds, or a Unix timestamp
+// when larger than 30 days) to a TTL.
+func exptimeToTTL(exptime int64) time.Duration {
 	var ttl time.Duration
 	if exptime < 0 {
 		// Negative exptime means already expired
@@ -159,383 +407,563 @@ func (s *Server) handleTextStorage(reader *bufio.Reader, writer *bufio.Writer, p
 			ttl = time.Duration(exptime) * time.Second
 		}
 	}
+	return ttl
+}
+
+// writeUint writes a decimal number without allocating.
+func (c *conn) writeUint(n uint64) {
+	c.writer.Write(strconv.AppendUint(c.writer.AvailableBuffer(), n, 10))
+}
+
+// writeTextValue writes a VALUE line and data block of a get response.
+func (c *conn) writeTextValue(key, value []byte, flags int, cas uint64, withCas bool) {
+	c.writer.WriteString("VALUE ")
+	c.writer.Write(key)
+	c.writer.WriteByte(' ')
+	c.writeUint(uint64(flags))
+	c.writer.WriteByte(' ')
+	c.writeUint(uint64(len(value)))
+	if withCas {
+		c.writer.WriteByte(' ')
+		c.writeUint(cas)
+	}
+	c.writer.WriteString("\r\n")
+	c.writer.Write(value)
+	c.writer.WriteString("\r\n")
+}
+
+func (c *conn) handleTextStorage(tokens [][]byte, value []byte, op string) {
+	if len(tokens) < 5 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	// Validate flags (must be numeric)
+	if _, ok := parseUint(tokens[2], 32); !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	// Validate exptime (must be numeric)
+	exptime, ok := parseInt(tokens[3])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	// Validate bytes (must be numeric)
+	size, ok := parseSize(tokens[4])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	// Check value size limit (Memcached default is 1MB), the data was discarded
+	if size > maxValueSize {
+		c.writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
+	noreply := isNoreply(tokens, 5)
+
+	// The key is retained by the cache, so it is copied out of the read buffer
+	key := string(tokens[1])
+	ttl := exptimeToTTL(exptime)
+
+	if c.gc != nil {
+		req := &tqmemory.Request{Op: storageOps[op], Key: key, Value: bytes.Clone(value), TTL: ttl}
+		c.submit(req, func(resp *tqmemory.Response) { c.writeStored(resp.Err, noreply) })
+		return
+	}
 
+	var err error
 	switch op {
 	case "SET":
-		_, err = s.cache.Set(key, value, ttl)
+		_, err = c.cache.Set(key, value, ttl)
 	case "ADD":
-		_, err = s.cache.Add(key, value, ttl)
+		_, err = c.cache.Add(key, value, ttl)
 	case "REPLACE":
-		_, err = s.cache.Replace(key, value, ttl)
+		_, err = c.cache.Replace(key, value, ttl)
 	}
+	c.writeStored(err, noreply)
+}
+
+// storageOps maps the storage commands to their worker operation.
+var storageOps = map[string]tqmemory.OpType{
+	"SET":     tqmemory.OpSet,
+	"ADD":     tqmemory.OpAdd,
+	"REPLACE": tqmemory.OpReplace,
+}
 
+// writeStored writes the response to set, add or replace.
+func (c *conn) writeStored(err error, noreply bool) {
 	if err != nil {
 		if err == tqmemory.ErrKeyExists || err == tqmemory.ErrKeyNotFound {
 			if !noreply {
-				writer.WriteString("NOT_STORED\r\n")
+				c.writer.WriteString("NOT_STORED\r\n")
 			}
 			return
 		}
-		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		c.writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
 		return
 	}
 
 	if !noreply {
-		writer.WriteString("STORED\r\n")
+		c.writer.WriteString("STORED\r\n")
 	}
 }
 
-func (s *Server) handleTextCas(reader *bufio.Reader, writer *bufio.Writer, parts []string) {
-	// Need at least 5 parts to parse bytes (key, flags, exptime, bytes)
-	if len(parts) < 5 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+func (c *conn) handleTextCas(tokens [][]byte, value []byte) {
+	// Need at least 5 tokens to parse bytes (key, flags, exptime, bytes)
+	if len(tokens) < 5 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
 
-	key := parts[1]
 	// Validate flags (must be numeric)
-	_, err := strconv.ParseUint(parts[2], 10, 32)
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+	if _, ok := parseUint(tokens[2], 32); !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
 	// Validate exptime (must be numeric)
-	exptime, err := strconv.ParseInt(parts[3], 10, 64)
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+	exptime, ok := parseInt(tokens[3])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
-	// Validate bytes (must be numeric)
-	bytes, err := strconv.Atoi(parts[4])
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+	// Validate bytes (must be numeric), the data was consumed by the caller
+	size, ok := parseSize(tokens[4])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
-
-	// Read value (must always consume the data to stay in sync)
-	value := make([]byte, bytes)
-	if _, err2 := io.ReadFull(reader, value); err2 != nil {
-		writer.WriteString("SERVER_ERROR read error\r\n")
+	if size > maxValueSize {
+		c.writer.WriteString("SERVER_ERROR object too large for cache\r\n")
 		return
 	}
-	// Read \r\n
-	c, _ := reader.ReadByte()
-	if c == '\r' {
-		reader.ReadByte()
-	}
 
 	// Now check if cas token is present and valid
-	if len(parts) < 6 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+	if len(tokens) < 6 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
-	casToken, err := strconv.ParseUint(parts[5], 10, 64)
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+	casToken, ok := parseUint(tokens[5], 64)
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
-	noreply := len(parts) > 6 && parts[6] == "noreply"
+	noreply := isNoreply(tokens, 6)
 
-	// Calculate TTL
-	var ttl time.Duration
-	if exptime < 0 {
-		// Negative exptime means already expired
-		ttl = time.Nanosecond
-	} else if exptime > 0 {
-		if exptime > 2592000 {
-			// Unix timestamp
-			ttl = time.Until(time.Unix(exptime, 0))
-			if ttl <= 0 {
-				// Timestamp is in the past, already expired
-				ttl = time.Nanosecond
-			}
-		} else {
-			ttl = time.Duration(exptime) * time.Second
-		}
+	key, ttl := string(tokens[1]), exptimeToTTL(exptime)
+	if c.gc != nil {
+		req := &tqmemory.Request{Op: tqmemory.OpCas, Key: key, Value: bytes.Clone(value), TTL: ttl, Cas: casToken}
+		c.submit(req, func(resp *tqmemory.Response) { c.writeCasResult(resp.Err, noreply) })
+		return
 	}
+	_, err := c.cache.Cas(key, value, ttl, casToken)
+	c.writeCasResult(err, noreply)
+}
 
-	_, err = s.cache.Cas(key, value, ttl, casToken)
+// writeCasResult writes the response to cas.
+func (c *conn) writeCasResult(err error, noreply bool) {
 	if err != nil {
 		if err == tqmemory.ErrCasMismatch {
 			if !noreply {
-				writer.WriteString("EXISTS\r\n")
+				c.writer.WriteString("EXISTS\r\n")
 			}
 			return
 		}
 		if err == tqmemory.ErrKeyNotFound {
 			if !noreply {
-				writer.WriteString("NOT_FOUND\r\n")
+				c.writer.WriteString("NOT_FOUND\r\n")
 			}
 			return
 		}
-		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		c.writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
 		return
 	}
 
 	if !noreply {
-		writer.WriteString("STORED\r\n")
+		c.writer.WriteString("STORED\r\n")
 	}
 }
 
-func (s *Server) handleTextGet(writer *bufio.Writer, parts []string, withCas bool) {
-	if len(parts) < 2 {
-		writer.WriteString("ERROR\r\n")
+func (c *conn) handleTextGet(tokens [][]byte, withCas bool) {
+	if len(tokens) < 2 {
+		c.writer.WriteString("ERROR\r\n")
 		return
 	}
 
-	for _, key := range parts[1:] {
-		value, cas, flags, err := s.cache.Get(key)
-		if err == nil {
-			writer.WriteString("VALUE ")
-			writer.WriteString(key)
-			writer.WriteString(" ")
-			writer.WriteString(strconv.Itoa(flags))
-			writer.WriteString(" ")
-			writer.WriteString(strconv.Itoa(len(value)))
-			if withCas {
-				writer.WriteString(" ")
-				writer.WriteString(strconv.FormatUint(cas, 10))
+	if len(tokens) == 2 && c.gc != nil {
+		key := bytes.Clone(tokens[1])
+		c.submit(&tqmemory.Request{Op: tqmemory.OpGet, Key: string(key)}, func(resp *tqmemory.Response) {
+			if resp.Err == nil {
+				c.writeTextValue(key, resp.Value, resp.Flags, resp.Cas, withCas)
 			}
-			writer.WriteString("\r\n")
-			writer.Write(value)
-			writer.WriteString("\r\n")
+			c.writer.WriteString("END\r\n")
+		})
+		return
+	}
+
+	// The keys are only used for the lookup, so they may alias the read buffer
+	if len(tokens) == 2 {
+		value, cas, flags, err := c.cache.Get(keyString(tokens[1]))
+		if err == nil {
+			c.writeTextValue(tokens[1], value, flags, cas, withCas)
+		}
+		c.writer.WriteString("END\r\n")
+		return
+	}
+
+	// Query all shards at once and write the hits in key order
+	keys := make([]string, len(tokens)-1)
+	for i, key := range tokens[1:] {
+		keys[i] = keyString(key)
+	}
+	for i, r := range c.cache.GetMulti(keys) {
+		if r.Err == nil {
+			c.writeTextValue(tokens[i+1], r.Value, r.Flags, r.Cas, withCas)
 		}
 	}
-	writer.WriteString("END\r\n")
+	c.writer.WriteString("END\r\n")
 }
 
-func (s *Server) handleTextDelete(writer *bufio.Writer, parts []string) {
-	if len(parts) < 2 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+func (c *conn) handleTextDelete(tokens [][]byte) {
+	if len(tokens) < 2 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
-	key := parts[1]
-	noreply := len(parts) > 2 && parts[2] == "noreply"
+	noreply := isNoreply(tokens, 2)
 
-	err := s.cache.Delete(key)
+	key := string(tokens[1])
+	if c.gc != nil {
+		c.submit(&tqmemory.Request{Op: tqmemory.OpDelete, Key: key}, func(resp *tqmemory.Response) {
+			c.writeDeleted(resp.Err, noreply)
+		})
+		return
+	}
+	c.writeDeleted(c.cache.Delete(key), noreply)
+}
+
+// writeDeleted writes the response to delete.
+func (c *conn) writeDeleted(err error, noreply bool) {
 	if err == nil {
 		if !noreply {
-			writer.WriteString("DELETED\r\n")
+			c.writer.WriteString("DELETED\r\n")
 		}
 	} else {
 		if !noreply {
-			writer.WriteString("NOT_FOUND\r\n")
+			c.writer.WriteString("NOT_FOUND\r\n")
 		}
 	}
 }
 
-func (s *Server) handleTextIncrDecr(writer *bufio.Writer, parts []string, incr bool) {
-	if len(parts) < 3 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+func (c *conn) handleTextIncrDecr(tokens [][]byte, incr bool) {
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
-	key := parts[1]
-	valStr := parts[2]
-	delta, err := strconv.ParseUint(valStr, 10, 64)
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+	delta, ok := parseUint(tokens[2], 64)
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+	noreply := isNoreply(tokens, 3)
+
+	key := string(tokens[1])
+	if c.gc != nil {
+		req := &tqmemory.Request{Op: tqmemory.OpDecr, Key: key, Delta: delta}
+		if incr {
+			req.Op = tqmemory.OpIncr
+		}
+		c.submit(req, func(resp *tqmemory.Response) { c.writeCounter(resp.Counter(), resp.Err, noreply) })
 		return
 	}
-	noreply := len(parts) > 3 && parts[3] == "noreply"
 
 	var newVal uint64
+	var err error
 	if incr {
-		newVal, _, err = s.cache.Increment(key, delta)
+		newVal, _, err = c.cache.Increment(key, delta)
 	} else {
-		newVal, _, err = s.cache.Decrement(key, delta)
+		newVal, _, err = c.cache.Decrement(key, delta)
 	}
+	c.writeCounter(newVal, err, noreply)
+}
 
+// writeCounter writes the response to incr or decr.
+func (c *conn) writeCounter(newVal uint64, err error, noreply bool) {
 	if err != nil {
 		if err == tqmemory.ErrKeyNotFound {
 			if !noreply {
-				writer.WriteString("NOT_FOUND\r\n")
+				c.writer.WriteString("NOT_FOUND\r\n")
 			}
 			return
 		}
-		writer.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+		c.writer.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
 		return
 	}
 
 	if !noreply {
-		writer.WriteString(strconv.FormatUint(newVal, 10) + "\r\n")
+		c.writeUint(newVal)
+		c.writer.WriteString("\r\n")
 	}
 }
 
-func (s *Server) handleTextTouch(writer *bufio.Writer, parts []string) {
-	if len(parts) < 3 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+func (c *conn) handleTextTouch(tokens [][]byte) {
+	if len(tokens) < 3 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
 
-	key := parts[1]
-	exptime, _ := strconv.ParseInt(parts[2], 10, 64)
-	noreply := len(parts) > 3 && parts[3] == "noreply"
+	exptime, _ := parseInt(tokens[2])
+	noreply := isNoreply(tokens, 3)
 
-	var ttl time.Duration
-	if exptime < 0 {
-		// Negative exptime means already expired
-		ttl = time.Nanosecond
-	} else if exptime > 0 {
-		if exptime > 2592000 {
-			// Unix timestamp
-			ttl = time.Until(time.Unix(exptime, 0))
-			if ttl <= 0 {
-				// Timestamp is in the past, already expired
-				ttl = time.Nanosecond
-			}
-		} else {
-			ttl = time.Duration(exptime) * time.Second
-		}
+	key, ttl := string(tokens[1]), exptimeToTTL(exptime)
+	if c.gc != nil {
+		c.submit(&tqmemory.Request{Op: tqmemory.OpTouch, Key: key, TTL: ttl}, func(resp *tqmemory.Response) {
+			c.writeTouched(resp.Err, noreply)
+		})
+		return
 	}
+	_, err := c.cache.Touch(key, ttl)
+	c.writeTouched(err, noreply)
+}
 
-	_, err := s.cache.Touch(key, ttl)
+// writeTouched writes the response to touch.
+func (c *conn) writeTouched(err error, noreply bool) {
 	if err != nil {
 		if !noreply {
 			if err == tqmemory.ErrKeyNotFound {
-				writer.WriteString("NOT_FOUND\r\n")
+				c.writer.WriteString("NOT_FOUND\r\n")
 			} else {
-				writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+				c.writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
 			}
 		}
 		return
 	}
 
 	if !noreply {
-		writer.WriteString("TOUCHED\r\n")
+		c.writer.WriteString("TOUCHED\r\n")
 	}
 }
 
 // handleTextGat handles GAT (get and touch) and GATS commands
-func (s *Server) handleTextGat(writer *bufio.Writer, parts []string, withCas bool) {
-	if len(parts) < 3 {
-		writer.WriteString("ERROR\r\n")
+func (c *conn) handleTextGat(tokens [][]byte, withCas bool) {
+	if len(tokens) < 3 {
+		c.writer.WriteString("ERROR\r\n")
 		return
 	}
 
-	exptime, err := strconv.ParseInt(parts[1], 10, 64)
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+	exptime, ok := parseInt(tokens[1])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
-
-	// Calculate TTL
-	var ttl time.Duration
-	if exptime < 0 {
-		ttl = time.Nanosecond
-	} else if exptime > 0 {
-		if exptime > 2592000 {
-			ttl = time.Until(time.Unix(exptime, 0))
-			if ttl <= 0 {
-				ttl = time.Nanosecond
-			}
-		} else {
-			ttl = time.Duration(exptime) * time.Second
-		}
-	}
+	ttl := exptimeToTTL(exptime)
 
 	// Process each key
-	for _, key := range parts[2:] {
+	for _, keyBytes := range tokens[2:] {
+		key := string(keyBytes)
+
 		// Get the value first (before touching with potentially expired TTL)
-		value, cas, flags, err := s.cache.Get(key)
+		value, cas, flags, err := c.cache.Get(key)
 		if err != nil {
 			continue // Key not found, skip
 		}
 
 		// Now touch with new expiry
-		s.cache.Touch(key, ttl)
+		c.cache.Touch(key, ttl)
 
 		// Output the value with flags
-		writer.WriteString("VALUE ")
-		writer.WriteString(key)
-		writer.WriteString(" ")
-		writer.WriteString(strconv.Itoa(flags))
-		writer.WriteString(" ")
-		writer.WriteString(strconv.Itoa(len(value)))
-		if withCas {
-			writer.WriteString(" ")
-			writer.WriteString(strconv.FormatUint(cas, 10))
-		}
-		writer.WriteString("\r\n")
-		writer.Write(value)
-		writer.WriteString("\r\n")
-	}
-	writer.WriteString("END\r\n")
+		c.writeTextValue(keyBytes, value, flags, cas, withCas)
+	}
+	c.writer.WriteString("END\r\n")
 }
 
-func (s *Server) handleTextFlushAll(writer *bufio.Writer, parts []string) {
+func (c *conn) handleTextFlushAll(tokens [][]byte) {
 	noreply := false
-	for _, p := range parts[1:] {
-		if p == "noreply" {
+	for i := range tokens[1:] {
+		if isNoreply(tokens, i+1) {
 			noreply = true
 		}
 	}
 
-	s.cache.FlushAll()
+	c.cache.FlushAll()
 	if !noreply {
-		writer.WriteString("OK\r\n")
+		c.writer.WriteString("OK\r\n")
 	}
 }
 
-func (s *Server) handleTextAppendPrepend(reader *bufio.Reader, writer *bufio.Writer, parts []string, prepend bool) {
+func (c *conn) handleTextAppendPrepend(tokens [][]byte, value []byte, prepend bool) {
 	// append/prepend <key> <flags> <exptime> <bytes> [noreply]\r\n<data>\r\n
-	if len(parts) < 5 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+	if len(tokens) < 5 {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
 
-	key := parts[1]
-	// Validate bytes (must be numeric)
-	bytes, err := strconv.Atoi(parts[4])
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+	// Validate bytes (must be numeric), the data was consumed by the caller
+	size, ok := parseSize(tokens[4])
+	if !ok {
+		c.writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
-	noreply := len(parts) > 5 && parts[5] == "noreply"
-
-	// Read value
-	value := make([]byte, bytes)
-	if _, err := io.ReadFull(reader, value); err != nil {
-		writer.WriteString("SERVER_ERROR read error\r\n")
+	if size > maxValueSize {
+		c.writer.WriteString("SERVER_ERROR object too large for cache\r\n")
 		return
 	}
-
-	// Read \r\n
-	c, _ := reader.ReadByte()
-	if c == '\r' {
-		reader.ReadByte()
-	}
+	noreply := isNoreply(tokens, 5)
 
 	// Call cache append/prepend
+	key := string(tokens[1])
+	var err error
 	if prepend {
-		_, err = s.cache.Prepend(key, value)
+		_, err = c.cache.Prepend(key, value)
 	} else {
-		_, err = s.cache.Append(key, value)
+		_, err = c.cache.Append(key, value)
 	}
 
 	if err != nil {
 		if err == tqmemory.ErrKeyNotFound {
 			if !noreply {
-				writer.WriteString("NOT_STORED\r\n")
+				c.writer.WriteString("NOT_STORED\r\n")
 			}
 			return
 		}
-		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		if err == tqmemory.ErrWrongType {
+			c.writer.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+			return
+		}
+		c.writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
 		return
 	}
 
 	if !noreply {
-		writer.WriteString("STORED\r\n")
+		c.writer.WriteString("STORED\r\n")
+	}
+}
+
+// handleTextStats handles the stats command: stats [<group>]
+func (c *conn) handleTextStats(tokens [][]byte) {
+	var group string
+	if len(tokens) > 1 {
+		group = string(tokens[1])
+	}
+	switch group {
+	case "reset":
+		c.resetStats()
+		c.writer.WriteString("RESET\r\n")
+		return
+	case "detail":
+		c.handleTextStatsDetail(tokens)
+		return
+	case "cachedump":
+		c.handleTextCachedump(tokens)
+		return
+	}
+
+	stats, ok := c.statsGroup(group)
+	if !ok {
+		c.writer.WriteString("ERROR\r\n")
+		return
+	}
+	for _, st := range stats {
+		c.writer.WriteString("STAT " + st.name + " " + st.value + "\r\n")
+	}
+	c.writer.WriteString("END\r\n")
+}
+
+// handleTextStatsDetail handles the per-prefix stats: stats detail on|off|dump
+func (c *conn) handleTextStatsDetail(tokens [][]byte) {
+	if len(tokens) != 3 {
+		c.writer.WriteString("CLIENT_ERROR usage: stats detail on|off|dump\r\n")
+		return
+	}
+	switch string(tokens[2]) {
+	case "on":
+		c.cache.SetDetail(true)
+		c.writer.WriteString("OK\r\n")
+	case "off":
+		c.cache.SetDetail(false)
+		c.writer.WriteString("OK\r\n")
+	case "dump":
+		prefixes := c.cache.PrefixStats()
+		names := make([]string, 0, len(prefixes))
+		for name := range prefixes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ps := prefixes[name]
+			c.writer.WriteString("PREFIX " + name + " get ")
+			c.writeUint(ps.Gets)
+			c.writer.WriteString(" hit ")
+			c.writeUint(ps.Hits)
+			c.writer.WriteString(" set ")
+			c.writeUint(ps.Sets)
+			c.writer.WriteString(" del ")
+			c.writeUint(ps.Deletes)
+			c.writer.WriteString("\r\n")
+		}
+		c.writer.WriteString("END\r\n")
+	default:
+		c.writer.WriteString("CLIENT_ERROR usage: stats detail on|off|dump\r\n")
 	}
 }
 
-func (s *Server) handleTextStats(writer *bufio.Writer) {
-	stats := s.cache.Stats()
-	writer.WriteString(fmt.Sprintf("STAT pid %d\r\n", os.Getpid()))
-	writer.WriteString(fmt.Sprintf("STAT uptime %d\r\n", int64(time.Since(s.cache.GetStartTime()).Seconds())))
-	writer.WriteString(fmt.Sprintf("STAT time %d\r\n", time.Now().Unix()))
-	writer.WriteString("STAT version 1.0.0\r\n")
-	for k, v := range stats {
-		writer.WriteString(fmt.Sprintf("STAT %s %s\r\n", k, v))
+// defaultSlowlogCount is the number of entries "slowlog get" returns when
+// no count is given, like Redis.
+const defaultSlowlogCount = 10
+
+// handleTextSlowlog handles the slow log: slowlog get [count]|len|reset.
+// Entries are written newest first as
+// "SLOWLOG <id> <time> <us> <queue_us> <exec_us> <op> <key> <keys> <bytes> <shard> <client>".
+func (c *conn) handleTextSlowlog(tokens [][]byte) {
+	const usage = "CLIENT_ERROR usage: slowlog get [count]|len|reset\r\n"
+	if len(tokens) < 2 {
+		c.writer.WriteString(usage)
+		return
+	}
+	switch string(tokens[1]) {
+	case "get":
+		n := defaultSlowlogCount
+		if len(tokens) == 3 {
+			v, err := strconv.Atoi(string(tokens[2]))
+			if err != nil {
+				c.writer.WriteString(usage)
+				return
+			}
+			n = v
+		} else if len(tokens) > 3 {
+			c.writer.WriteString(usage)
+			return
+		}
+		us := func(d time.Duration) string { return strconv.FormatInt(d.Microseconds(), 10) }
+		dash := func(s string) string {
+			if s == "" {
+				return "-"
+			}
+			return s
+		}
+		for _, e := range c.cache.SlowLog(n) {
+			c.writer.WriteString("SLOWLOG ")
+			c.writeUint(e.ID)
+			c.writer.WriteString(" " + strconv.FormatInt(e.Time.Unix(), 10) + " " + us(e.Duration()) +
+				" " + us(e.Queue) + " " + us(e.Exec) + " " + e.Op + " " + dash(e.Key) +
+				" " + strconv.Itoa(e.Keys) + " " + strconv.Itoa(e.ValueSize) +
+				" " + strconv.Itoa(e.Shard) + " " + dash(e.Client) + "\r\n")
+		}
+		c.writer.WriteString("END\r\n")
+	case "len":
+		if len(tokens) != 2 {
+			c.writer.WriteString(usage)
+			return
+		}
+		c.writeUint(uint64(c.cache.SlowLogLen()))
+		c.writer.WriteString("\r\n")
+	case "reset":
+		if len(tokens) != 2 {
+			c.writer.WriteString(usage)
+			return
+		}
+		c.cache.ResetSlowLog()
+		c.writer.WriteString("RESET\r\n")
+	default:
+		c.writer.WriteString(usage)
 	}
-	writer.WriteString("END\r\n")
 }
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+// mapCache is a minimal single goroutine cache, so parser tests and
+// benchmarks measure the protocol layer and not the workers.
+type mapCache struct {
+	tqmemory.CacheInterface
+	items map[string][]byte
+	cas   uint64
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{items: make(map[string][]byte)}
+}
+
+func (m *mapCache) Get(key string) ([]byte, uint64, int, error) {
+	value, ok := m.items[key]
+	if !ok {
+		return nil, 0, 0, tqmemory.ErrKeyNotFound
+	}
+	return value, 1, 0, nil
+}
+
+func (m *mapCache) GetMulti(keys []string) []tqmemory.GetResult {
+	results := make([]tqmemory.GetResult, len(keys))
+	for i, key := range keys {
+		r := &results[i]
+		r.Value, r.Cas, r.Flags, r.Err = m.Get(key)
+	}
+	return results
+}
+
+func (m *mapCache) Set(key string, value []byte, ttl time.Duration) (uint64, error) {
+	m.items[key] = append([]byte(nil), value...)
+	m.cas++
+	return m.cas, nil
+}
+
+func (m *mapCache) Add(key string, value []byte, ttl time.Duration) (uint64, error) {
+	if _, ok := m.items[key]; ok {
+		return 0, tqmemory.ErrKeyExists
+	}
+	return m.Set(key, value, ttl)
+}
+
+func (m *mapCache) Replace(key string, value []byte, ttl time.Duration) (uint64, error) {
+	if _, ok := m.items[key]; !ok {
+		return 0, tqmemory.ErrKeyNotFound
+	}
+	return m.Set(key, value, ttl)
+}
+
+func (m *mapCache) Cas(key string, value []byte, ttl time.Duration, cas uint64) (uint64, error) {
+	if _, ok := m.items[key]; !ok {
+		return 0, tqmemory.ErrKeyNotFound
+	}
+	if cas != 1 {
+		return 0, tqmemory.ErrCasMismatch
+	}
+	return m.Set(key, value, ttl)
+}
+
+func (m *mapCache) Touch(key string, ttl time.Duration) (uint64, error) {
+	if _, ok := m.items[key]; !ok {
+		return 0, tqmemory.ErrKeyNotFound
+	}
+	return 1, nil
+}
+
+func (m *mapCache) Increment(key string, delta uint64) (uint64, uint64, error) {
+	value, ok := m.items[key]
+	if !ok {
+		return 0, 0, tqmemory.ErrKeyNotFound
+	}
+	n, _ := strconv.ParseUint(string(value), 10, 64)
+	m.items[key] = strconv.AppendUint(nil, n+delta, 10)
+	return n + delta, 1, nil
+}
+
+func (m *mapCache) Decrement(key string, delta uint64) (uint64, uint64, error) {
+	value, ok := m.items[key]
+	if !ok {
+		return 0, 0, tqmemory.ErrKeyNotFound
+	}
+	n, _ := strconv.ParseUint(string(value), 10, 64)
+	n -= min(n, delta)
+	m.items[key] = strconv.AppendUint(nil, n, 10)
+	return n, 1, nil
+}
+
+func (m *mapCache) IncrementOrCreate(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error) {
+	if _, ok := m.items[key]; !ok {
+		m.items[key] = strconv.AppendUint(nil, initial, 10)
+		return initial, 1, nil
+	}
+	return m.Increment(key, delta)
+}
+
+func (m *mapCache) DecrementOrCreate(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error) {
+	if _, ok := m.items[key]; !ok {
+		m.items[key] = strconv.AppendUint(nil, initial, 10)
+		return initial, 1, nil
+	}
+	return m.Decrement(key, delta)
+}
+
+func (m *mapCache) Append(key string, value []byte) (uint64, error) {
+	old, ok := m.items[key]
+	if !ok {
+		return 0, tqmemory.ErrKeyNotFound
+	}
+	m.items[key] = append(old, value...)
+	return 1, nil
+}
+
+func (m *mapCache) Prepend(key string, value []byte) (uint64, error) {
+	old, ok := m.items[key]
+	if !ok {
+		return 0, tqmemory.ErrKeyNotFound
+	}
+	m.items[key] = append(append([]byte(nil), value...), old...)
+	return 1, nil
+}
+
+func (m *mapCache) Delete(key string) error {
+	if _, ok := m.items[key]; !ok {
+		return tqmemory.ErrKeyNotFound
+	}
+	delete(m.items, key)
+	return nil
+}
+
+func (m *mapCache) FlushAll() {
+	clear(m.items)
+}
+
+// newTestConn returns a text protocol conn writing to out.
+func newTestConn(cache tqmemory.CacheInterface, out *bytes.Buffer) *conn {
+	return &conn{
+		Server: New(cache, "127.0.0.1:0"),
+		cache:  cache,
+		writer: bufio.NewWriterSize(out, 65536),
+	}
+}
+
+// newTestCache returns a cache that is closed when the test ends.
+func newTestCache(t testing.TB) *tqmemory.ShardedCache {
+	t.Helper()
+	cache, err := tqmemory.NewSharded(tqmemory.DefaultConfig(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return cache
+}
+
+// textTest is a command, without its final "\r\n", and its expected reply.
+type textTest struct {
+	cmd, want string
+}
+
+// runTextTests sends the commands one by one on c, which writes to out, and
+// checks the replies.
+func runTextTests(t *testing.T, c *conn, out *bytes.Buffer, tests []textTest) {
+	t.Helper()
+	for _, tt := range tests {
+		out.Reset()
+		processAll(c, []byte(tt.cmd+"\r\n"))
+		if out.String() != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.cmd, out.String(), tt.want)
+		}
+	}
+}
+
+// processAll feeds the chunks to processText like the event loop does,
+// keeping unconsumed bytes for the next chunk.
+func processAll(c *conn, chunks ...[]byte) {
+	var pending []byte
+	for _, chunk := range chunks {
+		pending = append(pending, chunk...)
+		consumed, quit := c.processText(pending)
+		pending = pending[consumed:]
+		if quit {
+			break
+		}
+	}
+	c.writer.Flush()
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"get foo\r", []string{"get", "foo"}},
+		{"  set  foo 0\t0 3 \r", []string{"set", "foo", "0", "0", "3"}},
+		{"\r", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, tok := range tokenize([]byte(tt.line), nil) {
+			got = append(got, string(tok))
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseNumbers(t *testing.T) {
+	if n, ok := parseUint([]byte("18446744073709551615"), 64); !ok || n != 1<<64-1 {
+		t.Errorf("parseUint max = %d, %v", n, ok)
+	}
+	if _, ok := parseUint([]byte("18446744073709551616"), 64); ok {
+		t.Error("parseUint should reject overflow")
+	}
+	if _, ok := parseUint([]byte("4294967296"), 32); ok {
+		t.Error("parseUint should reject 32-bit overflow")
+	}
+	if n, ok := parseInt([]byte("-1")); !ok || n != -1 {
+		t.Errorf("parseInt(-1) = %d, %v", n, ok)
+	}
+	if n, ok := parseInt([]byte("-9223372036854775808")); !ok || n != -1<<63 {
+		t.Errorf("parseInt(min) = %d, %v", n, ok)
+	}
+	if _, ok := parseSize([]byte("-1")); ok {
+		t.Error("parseSize should reject negative sizes")
+	}
+}
+
+func TestProcessTextPipeline(t *testing.T) {
+	var out bytes.Buffer
+	c := newTestConn(newMapCache(), &out)
+	processAll(c, []byte("SET foo 0 0 3\r\nbar\r\nget foo missing\r\ndelete foo\r\nget foo\r\n"))
+
+	want := "STORED\r\nVALUE foo 0 3\r\nbar\r\nEND\r\nDELETED\r\nEND\r\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	var out bytes.Buffer
+	c := newTestConn(newMapCache(), &out)
+	processAll(c, []byte("ma cnt\r\n"+
+		"ma cnt N0 J10 v Oa1 k\r\n"+
+		"ma cnt D5 v c\r\n"+
+		"ma cnt MD D20 q\r\n"+
+		"ma cnt v\r\n"+
+		"ma missing q\r\n"+
+		"ma cnt MX\r\n"+
+		"mn\r\n"))
+
+	want := "NF\r\n" +
+		"VA 2 Oa1 kcnt\r\n10\r\n" +
+		"VA 2 c1\r\n15\r\n" +
+		"VA 1\r\n1\r\n" +
+		"CLIENT_ERROR invalid mode for ma\r\n" +
+		"MN\r\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestProcessTextLongLine(t *testing.T) {
+	// A long line that is not a multi-get closes the connection
+	c := newTestConn(newMapCache(), &bytes.Buffer{})
+	if _, quit := c.processText(bytes.Repeat([]byte("a"), maxLineLength+1)); !quit {
+		t.Error("expected connection close on long line without newline")
+	}
+
+	// A long multi-get is allowed to span reads
+	line := "get " + strings.Repeat("foo ", maxLineLength)
+	if _, quit := c.processText([]byte(line)); quit {
+		t.Error("long multi-get should not close the connection")
+	}
+}
+
+func TestProcessTextGetHitAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	cache := newMapCache()
+	cache.Set("foo", []byte("bar"), 0)
+	c := newTestConn(cache, &bytes.Buffer{})
+	req := []byte("get foo\r\n")
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		c.processText(req)
+		c.writer.Reset(io.Discard)
+	})
+	if allocs != 0 {
+		t.Errorf("get hit allocates %v times per request, want 0", allocs)
+	}
+}
+
+func TestProcessTextGetHitShardedAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	cache := newTestCache(t)
+	cache.Set("foo", []byte("bar"), 0)
+	c := newTestConn(cache, &bytes.Buffer{})
+	req := []byte("get foo\r\n")
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		c.processText(req)
+		c.writer.Reset(io.Discard)
+	})
+	if allocs != 0 {
+		t.Errorf("get hit with the round trip to a worker allocates %v times per request, want 0", allocs)
+	}
+}
+
+// FuzzProcessText checks that responses don't depend on how the input is
+// split into reads, and that the parser never panics.
+func FuzzProcessText(f *testing.F) {
+	f.Add([]byte("set foo 0 0 3\r\nbar\r\nget foo\r\n"), 5)
+	f.Add([]byte("get a b c\r\ngets a\r\ndelete a noreply\r\n"), 3)
+	f.Add([]byte("set foo 0 0 2000000\r\n"), 10)
+	f.Add([]byte("set foo 0 0 -1\r\nxx\r\nversion\r\n"), 1)
+	f.Add([]byte("incr foo 18446744073709551616\r\nflush_all noreply\r\n"), 7)
+
+	f.Fuzz(func(t *testing.T, input []byte, split int) {
+		if bytes.Contains(bytes.ToLower(input), []byte("stats")) {
+			t.Skip("stats output is not deterministic")
+		}
+		// Whether a long line closes the connection depends on the reads
+		for _, line := range bytes.Split(input, []byte("\n")) {
+			if len(line) > maxLineLength {
+				t.Skip("long lines are read dependent")
+			}
+		}
+		if split < 0 || split > len(input) {
+			split = len(input) / 2
+		}
+
+		var whole, parts bytes.Buffer
+		processAll(newTestConn(newMapCache(), &whole), input)
+		processAll(newTestConn(newMapCache(), &parts), input[:split], input[split:])
+
+		if !bytes.Equal(whole.Bytes(), parts.Bytes()) {
+			t.Errorf("split at %d changes output:\n%q\n%q", split, whole.Bytes(), parts.Bytes())
+		}
+	})
+}
+
+func BenchmarkTokenize(b *testing.B) {
+	line := []byte("set some:fairly:long:key 0 3600 1024 noreply\r")
+	var tokenBuf [maxTokens][]byte
+	b.ReportAllocs()
+	for b.Loop() {
+		tokenize(line, tokenBuf[:0])
+	}
+}
+
+func BenchmarkProcessTextGetHit(b *testing.B) {
+	cache := newMapCache()
+	cache.Set("foo", bytes.Repeat([]byte("x"), 100), 0)
+	c := newTestConn(cache, &bytes.Buffer{})
+	c.writer.Reset(io.Discard)
+	req := []byte("get foo\r\n")
+	b.ReportAllocs()
+	for b.Loop() {
+		c.processText(req)
+	}
+}
+
+// BenchmarkProcessTextGetHitSharded is BenchmarkProcessTextGetHit with the
+// round trip to a worker.
+func BenchmarkProcessTextGetHitSharded(b *testing.B) {
+	cache := newTestCache(b)
+	cache.Set("foo", bytes.Repeat([]byte("x"), 100), 0)
+	c := newTestConn(cache, &bytes.Buffer{})
+	c.writer.Reset(io.Discard)
+	req := []byte("get foo\r\n")
+	b.ReportAllocs()
+	for b.Loop() {
+		c.processText(req)
+	}
+}
+
+func BenchmarkProcessTextGetMulti(b *testing.B) {
+	cache := newMapCache()
+	for _, k := range []string{"k1", "k2", "k3", "k4"} {
+		cache.Set(k, bytes.Repeat([]byte("x"), 100), 0)
+	}
+	c := newTestConn(cache, &bytes.Buffer{})
+	c.writer.Reset(io.Discard)
+	req := []byte("gets k1 k2 k3 k4 k5\r\n")
+	b.ReportAllocs()
+	for b.Loop() {
+		c.processText(req)
+	}
+}
+
+func BenchmarkProcessTextSet(b *testing.B) {
+	c := newTestConn(newMapCache(), &bytes.Buffer{})
+	c.writer.Reset(io.Discard)
+	req := []byte("set foo 0 0 100\r\n" + strings.Repeat("x", 100) + "\r\n")
+	b.ReportAllocs()
+	for b.Loop() {
+		c.processText(req)
+	}
+}
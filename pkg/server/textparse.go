@@ -0,0 +1,149 @@
+package server
+
+import "unsafe"
+
+// maxTokens is the number of tokens that fit in the stack allocated token
+// buffer. Longer command lines (large multi-gets) still work, but allocate.
+const maxTokens = 24
+
+// maxCommandLength is the longest command name, used for the stack
+// allocated lower case copy of the command.
+const maxCommandLength = 16
+
+var (
+	crlf        = []byte("\r\n")
+	tokNoreply  = []byte("noreply")
+	multiGetCmd = [][]byte{[]byte("get "), []byte("gets ")}
+)
+
+// isSpace reports whether b separates tokens on a command line.
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n' || b == '\v' || b == '\f'
+}
+
+// tokenize splits a command line into tokens and appends them to dst.
+// The tokens alias line, no bytes are copied.
+func tokenize(line []byte, dst [][]byte) [][]byte {
+	i := 0
+	for i < len(line) {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		start := i
+		for i < len(line) && !isSpace(line[i]) {
+			i++
+		}
+		if i > start {
+			dst = append(dst, line[start:i])
+		}
+	}
+	return dst
+}
+
+// lowerCommand writes the lower case form of cmd into buf, so it can be
+// matched in a switch without allocating. Commands that are too long to be
+// valid are returned unchanged (and won't match).
+func lowerCommand(cmd []byte, buf *[maxCommandLength]byte) []byte {
+	if len(cmd) > len(buf) {
+		return cmd
+	}
+	for i, b := range cmd {
+		if b >= 'A' && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		buf[i] = b
+	}
+	return buf[:len(cmd)]
+}
+
+// isNoreply reports whether the token at position i exists and is "noreply".
+func isNoreply(tokens [][]byte, i int) bool {
+	return len(tokens) > i && string(tokens[i]) == string(tokNoreply)
+}
+
+// parseUint parses a decimal unsigned integer that must fit in bits bits.
+func parseUint(b []byte, bits int) (uint64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	maxVal := uint64(1)<<uint(bits) - 1
+	if bits == 64 {
+		maxVal = ^uint64(0)
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		d := uint64(c - '0')
+		if n > (maxVal-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+	}
+	return n, true
+}
+
+// parseInt parses a decimal signed 64-bit integer with an optional sign.
+func parseInt(b []byte) (int64, bool) {
+	neg := false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg = b[0] == '-'
+		b = b[1:]
+	}
+	n, ok := parseUint(b, 63)
+	if !ok {
+		// -9223372036854775808 doesn't fit in 63 bits but is valid
+		if neg && string(b) == "9223372036854775808" {
+			return -1 << 63, true
+		}
+		return 0, false
+	}
+	if neg {
+		return -int64(n), true
+	}
+	return int64(n), true
+}
+
+// parseSize parses a non-negative decimal int, such as a data block length.
+func parseSize(b []byte) (int, bool) {
+	n, ok := parseUint(b, 31)
+	return int(n), ok
+}
+
+// decimalLen returns the number of decimal digits of n.
+func decimalLen(n uint64) int {
+	digits := 1
+	for n >= 10 {
+		n /= 10
+		digits++
+	}
+	return digits
+}
+
+// isMultiGet reports whether an unterminated command line is the start of a
+// get or gets command. Like memcached, only multi-gets may exceed
+// maxLineLength; any other command that long closes the connection.
+func isMultiGet(line []byte) bool {
+	i := 0
+	for i < len(line) && i <= 100 && line[i] == ' ' {
+		i++
+	}
+	var buf [maxCommandLength]byte
+	for _, prefix := range multiGetCmd {
+		if len(line)-i >= len(prefix) && string(lowerCommand(line[i:i+len(prefix)], &buf)) == string(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyString returns a string that aliases the key bytes without copying.
+// It may only be used for lookups that don't retain the key, because the
+// bytes are overwritten once the read buffer advances.
+func keyString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// watchBatch is the number of bytes of event lines written at once.
+const watchBatch = 16 * 1024
+
+// watchKinds maps the arguments of the watch command to event kinds.
+var watchKinds = map[string]tqmemory.WatchKind{
+	"fetchers":    tqmemory.WatchFetchers,
+	"mutations":   tqmemory.WatchMutations,
+	"evictions":   tqmemory.WatchEvictions,
+	"expirations": tqmemory.WatchExpirations,
+}
+
+// streamBacklog is the number of bytes a stream may have waiting in the
+// outbound buffer of an event-loop connection before its writes block.
+const streamBacklog = 4 * watchBatch
+
+// asyncWriter writes to an event-loop connection from another goroutine.
+// Like a write to a socket, a write blocks while the client doesn't read,
+// so a stream that falls behind drops events instead of buffering them.
+type asyncWriter struct {
+	gc       gnet.Conn
+	result   chan error
+	closed   chan struct{}
+	once     sync.Once
+	buffered int      // outbound bytes after the last write, set on the event loop
+	file     *os.File // a duplicate of the connection, made on the event loop once the stream falls behind
+}
+
+func newAsyncWriter(gc gnet.Conn) *asyncWriter {
+	return &asyncWriter{gc: gc, result: make(chan error, 1), closed: make(chan struct{})}
+}
+
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	// The write completes on the event loop, after p may have been reused
+	if err := w.queue(append([]byte(nil), p...)); err != nil {
+		return 0, err
+	}
+	if w.buffered > streamBacklog {
+		if err := w.drain(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// drain waits until the outbound buffer is back under streamBacklog. The
+// event loop doesn't report when it sent buffered bytes, but it sends them
+// as soon as the socket has room again: so the writer waits until the
+// duplicate of the connection is writable, and then reads the outbound
+// buffer with an empty write.
+func (w *asyncWriter) drain() error {
+	raw, err := w.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var qerr error
+	err = raw.Write(func(uintptr) bool {
+		// An empty write reads the outbound buffer on the event loop
+		if qerr = w.queue(nil); qerr != nil {
+			return true
+		}
+		return w.buffered <= streamBacklog
+	})
+	if qerr != nil {
+		return qerr
+	}
+	return err
+}
+
+// queue writes data on the event loop and waits until it is written or
+// added to the outbound buffer.
+func (w *asyncWriter) queue(data []byte) error {
+	err := w.gc.AsyncWrite(data, func(gc gnet.Conn, err error) error {
+		if err == nil {
+			w.buffered = gc.OutboundBuffered()
+			if w.buffered > streamBacklog && w.file == nil {
+				w.file, err = dupFile(gc)
+			}
+		}
+		w.result <- err
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-w.result:
+		return err
+	case <-w.closed:
+		return net.ErrClosed
+	}
+}
+
+// dupFile returns a duplicate of the socket of gc, that the runtime polls
+// for writability. It must be called on the event loop, while gc is open.
+func dupFile(gc gnet.Conn) (*os.File, error) {
+	fd, err := gc.Dup()
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "stream"), nil
+}
+
+// close makes pending and later writes fail, it is called when the
+// connection is closed.
+func (w *asyncWriter) close() {
+	w.once.Do(func() {
+		close(w.closed)
+		// Ends a drain, and the socket is only closed with its duplicate
+		if w.file != nil {
+			w.file.Close()
+		}
+	})
+}
+
+// handleTextWatch handles: watch [fetchers] [mutations] [evictions] [expirations]
+// Without arguments all streams are watched. After "OK" the connection
+// only streams event lines, further input is ignored.
+func (c *conn) handleTextWatch(tokens [][]byte) {
+	var kinds tqmemory.WatchKind
+	for _, token := range tokens[1:] {
+		kind, ok := watchKinds[string(token)]
+		if !ok {
+			c.writer.WriteString("CLIENT_ERROR unknown watcher type\r\n")
+			return
+		}
+		kinds |= kind
+	}
+	if kinds == 0 {
+		for _, kind := range watchKinds {
+			kinds |= kind
+		}
+	}
+
+	c.watcher = c.cache.Watch(kinds, 0)
+	c.writer.WriteString("OK\r\n")
+	// The events are written by another goroutine from now on
+	c.writer.Flush()
+	go streamEvents(c.streamWriter(), c.watcher, appendWatchEvent, appendSkipped)
+}
+
+// eventSource is a stream of events that drops events when its reader
+// falls behind, like a watcher, a keyspace subscription or a subscriber.
+type eventSource[E any] interface {
+	Events() <-chan E
+	Done() <-chan struct{}
+	Dropped() uint64
+	Close()
+}
+
+// streamEvents writes the events of a source to the stream of a connection
+// in batches until the source is closed, and closes it when the connection
+// fails. Dropped events are reported by appendSkipped before the next event.
+func streamEvents[E any](stream io.Writer, src eventSource[E], appendEvent func([]byte, *E) []byte,
+	appendSkipped func([]byte, uint64) []byte) {
+	buf := make([]byte, 0, watchBatch)
+	var skipped uint64
+	for {
+		select {
+		case <-src.Done():
+			return
+		case ev := <-src.Events():
+			buf = buf[:0]
+			if dropped := src.Dropped(); dropped > skipped {
+				buf = appendSkipped(buf, dropped-skipped)
+				skipped = dropped
+			}
+			buf = appendEvent(buf, &ev)
+		batch:
+			for len(buf) < watchBatch {
+				select {
+				case ev = <-src.Events():
+					buf = appendEvent(buf, &ev)
+				default:
+					break batch
+				}
+			}
+			if _, err := stream.Write(buf); err != nil {
+				src.Close()
+				return
+			}
+		}
+	}
+}
+
+// appendSkipped appends the number of dropped events like memcached's watch
+// does, as a "skipped=<count>" line.
+func appendSkipped(buf []byte, n uint64) []byte {
+	buf = append(buf, "skipped="...)
+	buf = strconv.AppendUint(buf, n, 10)
+	return append(buf, '\n')
+}
+
+// appendWatchEvent appends an event as a line in memcached's watch format,
+// e.g. "ts=1700000000.123456 gid=1 type=item_get key=foo status=found clsid=1 size=6".
+func appendWatchEvent(buf []byte, ev *tqmemory.WatchEvent) []byte {
+	buf = appendTimestamp(buf, ev.Time)
+	buf = append(buf, " gid="...)
+	buf = strconv.AppendUint(buf, ev.ID, 10)
+	buf = append(buf, " type="...)
+	buf = append(buf, ev.Type...)
+	buf = append(buf, " key="...)
+	buf = appendURIEncoded(buf, ev.Key)
+
+	switch ev.Kind {
+	case tqmemory.WatchFetchers:
+		buf = append(buf, " status="...)
+		buf = append(buf, ev.Status...)
+	case tqmemory.WatchMutations:
+		buf = append(buf, " status="...)
+		buf = append(buf, ev.Status...)
+		buf = append(buf, " cmd="...)
+		buf = append(buf, ev.Op...)
+		if ev.Type == "item_store" {
+			buf = append(buf, " ttl="...)
+			buf = strconv.AppendInt(buf, int64(ev.TTL/time.Second), 10)
+		}
+	case tqmemory.WatchEvictions, tqmemory.WatchExpirations:
+		buf = append(buf, " fetch="...)
+		buf = append(buf, yesNo(ev.Fetched)...)
+		buf = append(buf, " ttl="...)
+		if ev.TTL < 0 {
+			buf = append(buf, "-1"...)
+		} else {
+			buf = strconv.AppendInt(buf, int64(ev.TTL/time.Second), 10)
+		}
+	}
+
+	buf = append(buf, " clsid="...)
+	buf = strconv.AppendInt(buf, int64(ev.Class), 10)
+	buf = append(buf, " size="...)
+	buf = strconv.AppendInt(buf, int64(ev.Size), 10)
+	buf = append(buf, " shard="...)
+	buf = strconv.AppendInt(buf, int64(ev.Shard), 10)
+	if ev.Client != "" {
+		buf = append(buf, " client="...)
+		buf = append(buf, ev.Client...)
+	}
+	return append(buf, '\n')
+}
+
+// appendTimestamp appends "ts=" and t in seconds with microseconds.
+func appendTimestamp(buf []byte, t time.Time) []byte {
+	ts := t.UnixMicro()
+	buf = append(buf, "ts="...)
+	buf = strconv.AppendInt(buf, ts/1e6, 10)
+	buf = append(buf, '.')
+	frac := strconv.FormatInt(ts%1e6+1e6, 10) // zero padded to 6 digits
+	return append(buf, frac[1:]...)
+}
+
+// appendURIEncoded appends s percent-encoded like memcached encodes keys in
+// log lines: only letters, digits and "-._~" are kept.
+func appendURIEncoded(buf []byte, s string) []byte {
+	const hex = "0123456789ABCDEF"
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '.' || b == '_' || b == '~' {
+			buf = append(buf, b)
+		} else {
+			buf = append(buf, '%', hex[b>>4], hex[b&15])
+		}
+	}
+	return buf
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqmemory/pkg/tqmemory"
+)
+
+func TestTextWatch(t *testing.T) {
+	cache := newTestCache(t)
+
+	out := &bytes.Buffer{}
+	watching := newTestConn(cache, out)
+	pr, pw := io.Pipe()
+	watching.stream = pw
+	runTextTests(t, watching, out, []textTest{
+		{"watch bogus", "CLIENT_ERROR unknown watcher type\r\n"},
+		{"watch mutations", "OK\r\n"},
+		{"get ignored", ""},
+	})
+
+	c := newTestConn(cache, out)
+	runTextTests(t, c, out, []textTest{
+		{"get foo", "END\r\n"},
+		{"set foo 0 0 3\r\nbar", "STORED\r\n"},
+	})
+	line, err := bufio.NewReader(pr).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "ts=") || !strings.Contains(line, " gid=") ||
+		!strings.Contains(line, " type=item_store key=foo status=stored cmd=set ttl=0 clsid=1 size=6 shard=") {
+		t.Errorf("unexpected event %q", line)
+	}
+
+	watching.unregister(watching)
+	pr.Close()
+}
+
+func TestAppendWatchEvent(t *testing.T) {
+	ev := tqmemory.WatchEvent{Kind: tqmemory.WatchEvictions, ID: 7, Time: time.Unix(1700000000, 1000),
+		Type: "eviction", Key: "a b:c", TTL: -1, Size: 9, Class: 1, Shard: 2}
+	want := "ts=1700000000.000001 gid=7 type=eviction key=a%20b%3Ac fetch=no ttl=-1 clsid=1 size=9 shard=2\n"
+	if got := string(appendWatchEvent(nil, &ev)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWatchEventLoopSlowClient(t *testing.T) {
+	cache := newTestCache(t)
+	nc := dialTest(t, startEventLoop(t, cache))
+	nc.Write([]byte("watch mutations\r\n"))
+	r := bufio.NewReader(nc)
+	if line, _ := r.ReadString('\n'); line != "OK\r\n" {
+		t.Fatalf("got %q, want OK", line)
+	}
+
+	// Far more events than the socket buffers hold, while not reading,
+	// slowly enough for the stream to keep up with a reading client
+	prefix := strings.Repeat("k", 200)
+	for i := range 100000 {
+		cache.Set(prefix+strconv.Itoa(i), []byte("v"), 0)
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	var skipped bool
+	for {
+		nc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		skipped = skipped || strings.HasPrefix(line, "skipped=")
+	}
+	if !skipped {
+		t.Error("expected events to be skipped for a client that doesn't read")
+	}
+}
+
+func TestStreamEventLoopDrain(t *testing.T) {
+	cache := newTestCache(t)
+	prefix := strings.Repeat("k", 200)
+	for i := range 20000 {
+		cache.Set(prefix+strconv.Itoa(i), []byte("v"), 0)
+	}
+	nc := dialTest(t, startEventLoop(t, cache))
+
+	// The dump is far larger than the socket buffers and the stream
+	// backlog, its writes wait until the client reads
+	nc.Write([]byte("lru_crawler metadump all\r\n"))
+	time.Sleep(200 * time.Millisecond)
+	r := bufio.NewReader(nc)
+	items := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read after %d items: %v", items, err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		items++
+	}
+	if items != 20000 {
+		t.Errorf("got %d items, want 20000", items)
+	}
+}
@@ -0,0 +1,219 @@
+package tqmemory
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ErrBloomParams is returned when a Bloom filter is reserved with an error
+// rate or capacity out of range, or that would be too large.
+var ErrBloomParams = errors.New("error rate must be between 0 and 1 and capacity above 0, within the maximum item size")
+
+// The parameters of a Bloom filter created by adding to a missing key.
+const (
+	bloomDefaultErrorRate = 0.01
+	bloomDefaultCapacity  = 100
+)
+
+// bloomMaxSize bounds the bits of a Bloom filter in bytes when the maximum
+// value size is unlimited.
+const bloomMaxSize = 64 * 1024 * 1024
+
+// bloomValue is a Bloom filter: k bit positions per item in m bits. It has
+// a fixed size, so after more items than its capacity the rate of false
+// positives rises above the error rate it was reserved with.
+type bloomValue struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    int    // number of bit positions per item
+}
+
+// bloomParams returns the number of bits and the number of positions per
+// item for a Bloom filter of capacity items with the error rate.
+func bloomParams(errorRate float64, capacity int) (uint64, int) {
+	m := bloomBits(errorRate, capacity)
+	k := max(1, int(math.Round(m/float64(capacity)*math.Ln2)))
+	return uint64(m), k
+}
+
+// bloomBits returns the number of bits of a Bloom filter of capacity items
+// with the error rate. It is a float, so a size out of range can be
+// checked before it is converted.
+func bloomBits(errorRate float64, capacity int) float64 {
+	n := float64(capacity)
+	return math.Ceil(-n * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+}
+
+// bloomFits reports whether the bits of a Bloom filter of capacity items
+// with the error rate fit in maxSize bytes, or in bloomMaxSize bytes if
+// maxSize is 0 (unlimited).
+func bloomFits(errorRate float64, capacity, maxSize int) bool {
+	if maxSize <= 0 {
+		maxSize = bloomMaxSize
+	}
+	return bloomBits(errorRate, capacity)/8 <= float64(maxSize)
+}
+
+func newBloom(errorRate float64, capacity int) *bloomValue {
+	m, k := bloomParams(errorRate, capacity)
+	return &bloomValue{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+func newDefaultBloom() *bloomValue {
+	return newBloom(bloomDefaultErrorRate, bloomDefaultCapacity)
+}
+
+func (b *bloomValue) size() int64 {
+	return int64(len(b.bits)) * 8
+}
+
+// appendTo serializes the Bloom filter as the netstrings of the number of
+// positions per item and of its bits, as little-endian 64-bit words.
+func (b *bloomValue) appendTo(buf []byte) []byte {
+	buf = appendNetstring(buf, strconv.AppendInt(nil, int64(b.k), 10))
+	buf = strconv.AppendInt(buf, int64(len(b.bits))*8, 10)
+	buf = append(buf, ':')
+	for _, word := range b.bits {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	return append(buf, ',')
+}
+
+// positions calls fn with the bit positions of an item, derived from two
+// hashes by double hashing, until it returns false.
+func (b *bloomValue) positions(item string, fn func(pos uint64) bool) {
+	h1 := hash64(item)
+	h2 := mix64(h1^0x9e3779b97f4a7c15) | 1
+	for i := range b.k {
+		if !fn((h1 + uint64(i)*h2) % b.m) {
+			return
+		}
+	}
+}
+
+// has reports whether the item may have been added to the Bloom filter,
+// which may be nil.
+func (b *bloomValue) has(item string) bool {
+	if b == nil {
+		return false
+	}
+	found := true
+	b.positions(item, func(pos uint64) bool {
+		found = b.bits[pos/64]&(1<<(pos%64)) != 0
+		return found
+	})
+	return found
+}
+
+func (b *bloomValue) add(item string) {
+	b.positions(item, func(pos uint64) bool {
+		b.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+// handleBFReserve creates an empty Bloom filter with req.ErrorRate and
+// req.Capacity, and req.TTL. It returns ErrKeyExists if the key exists,
+// and ErrBloomParams if the filter would be too large.
+func (w *Worker) handleBFReserve(req *Request) *Response {
+	w.countSet(req.Key)
+	if _, ok := w.liveEntry(req.Key); ok {
+		return &Response{Err: ErrKeyExists}
+	}
+	// The bits are allocated up front, so the size is checked before
+	if !bloomFits(req.ErrorRate, req.Capacity, w.maxValueSize) {
+		return &Response{Err: ErrBloomParams}
+	}
+	b := newBloom(req.ErrorRate, req.Capacity)
+	entry, err := updateTyped(w, nil, req.Key, req.TTL, int64(len(req.Key))+b.size(),
+		func() *bloomValue { return b }, func(*bloomValue) {})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas}
+}
+
+// handleBFAdd adds the items in req.Fields, creating the Bloom filter with
+// the default parameters and req.TTL if needed, and returns the number of
+// items that were not in the filter yet in Count.
+func (w *Worker) handleBFAdd(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, b, err := lookupTyped[*bloomValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	var growth int64
+	if entry == nil {
+		growth = int64(len(req.Key)) + newDefaultBloom().size()
+	} else {
+		changes := false
+		for _, item := range req.Fields {
+			if !b.has(item) {
+				changes = true
+				break
+			}
+		}
+		if !changes {
+			return &Response{Cas: entry.Cas}
+		}
+	}
+
+	var added int
+	entry, err = updateTyped(w, entry, req.Key, req.TTL, growth, newDefaultBloom, func(b *bloomValue) {
+		for _, item := range req.Fields {
+			if !b.has(item) {
+				b.add(item)
+				added++
+			}
+		}
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas, Count: added}
+}
+
+// handleBFExists returns 1 in Count if req.Fields[0] may have been added.
+func (w *Worker) handleBFExists(req *Request) *Response {
+	entry, b, err := lookupTyped[*bloomValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil || !b.has(req.Fields[0]) {
+		return &Response{}
+	}
+	return &Response{Cas: entry.Cas, Count: 1}
+}
+
+// BFReserve creates an empty Bloom filter at key that holds capacity items
+// with the error rate (the chance of a false positive, between 0 and 1)
+// and the ttl (the default TTL if 0). It returns ErrKeyExists if the key
+// exists, and ErrBloomParams if the parameters are out of range or the
+// filter would be larger than the maximum value size (64MB if unlimited).
+func (sc *ShardedCache) BFReserve(key string, ttl time.Duration, errorRate float64, capacity int) error {
+	if !(errorRate > 0 && errorRate < 1) || capacity <= 0 || !bloomFits(errorRate, capacity, sc.config.MaxValueSize) {
+		return ErrBloomParams
+	}
+	return sc.sendRequest(sc.workerFor(key), &Request{Op: OpBFReserve, Key: key, TTL: ttl,
+		ErrorRate: errorRate, Capacity: capacity}).Err
+}
+
+// BFAdd adds items to the Bloom filter at key and returns the number of
+// items that were not in it yet. A missing filter is created with the ttl
+// (the default TTL if 0) for 100 items with an error rate of 1%.
+func (sc *ShardedCache) BFAdd(key string, ttl time.Duration, items ...string) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpBFAdd, Key: key, TTL: ttl, Fields: items})
+	return resp.Count, resp.Err
+}
+
+// BFExists reports whether item may have been added to the Bloom filter at
+// key. A false result is certain, a true result is wrong with the chance of
+// the error rate of the filter.
+func (sc *ShardedCache) BFExists(key, item string) (bool, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpBFExists, Key: key, Fields: []string{item}})
+	return resp.Count == 1, resp.Err
+}
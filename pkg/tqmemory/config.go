@@ -4,33 +4,54 @@ import "time"
 
 // Default configuration values matching memcached
 const (
-	DefaultThreadCount     = 4                // memcached -t default
-	DefaultMaxMemory       = 64 * 1024 * 1024 // memcached -m default (64MB)
-	DefaultMaxConnections  = 1024             // memcached -c default
-	DefaultPort            = 11211            // memcached -p default
-	DefaultMaxKeySize      = 250              // memcached max key size
-	DefaultMaxValueSize    = 1 * 1024 * 1024  // memcached default item size (1MB)
-	DefaultChannelCapacity = 1000             // internal buffer size
+	DefaultThreadCount        = 4                // memcached -t default
+	DefaultMaxMemory          = 64 * 1024 * 1024 // memcached -m default (64MB)
+	DefaultMaxConnections     = 1024             // memcached -c default
+	DefaultPort               = 11211            // memcached -p default
+	DefaultMaxKeySize         = 250              // memcached max key size
+	DefaultMaxValueSize       = 1 * 1024 * 1024  // memcached default item size (1MB)
+	DefaultChannelCapacity    = 1000             // internal buffer size
+	DefaultPrefixDelimiter    = ':'              // memcached -D default
+	DefaultNamespaceDelimiter = ':'              // ends the namespace of a key
 )
 
 // Config holds the configuration for TQMemory
 type Config struct {
-	DefaultTTL      time.Duration // Default TTL for keys (0 = no expiry)
-	MaxKeySize      int           // Maximum key size (250 bytes)
-	MaxValueSize    int           // Maximum value size (1MB)
-	MaxMemory       int64         // Maximum memory in bytes (0 = unlimited)
-	ChannelCapacity int           // Request channel capacity per worker
-	StaleMultiplier float64       // Hard expiry = TTL * StaleMultiplier (default 2.0, 0 = disabled)
+	DefaultTTL         time.Duration // Default TTL for keys (0 = no expiry)
+	MaxKeySize         int           // Maximum key size (250 bytes)
+	MaxValueSize       int           // Maximum value size (1MB)
+	MaxMemory          int64         // Maximum memory in bytes (0 = unlimited)
+	ChannelCapacity    int           // Request channel capacity per worker
+	StaleMultiplier    float64       // Hard expiry = TTL * StaleMultiplier (default 2.0, 0 = disabled)
+	PrefixDelimiter    byte          // Separates the key prefix for detail stats (default ':')
+	DetailEnabled      bool          // Collect per-prefix stats from the start (stats detail on)
+	NamespaceDelimiter byte          // Ends the namespace of a key for namespace invalidation (default ':')
+	HotKeys            int           // Hot keys tracked per worker for reads and for writes (0 = disabled)
+	HotKeyLogShare     float64       // Log keys above this share of a worker's reads or writes (0 = disabled)
+	SlowLogThreshold   time.Duration // Log requests whose queue wait plus execution time is at least this
+	SlowLogLen         int           // Slow log entries kept (0 = disabled)
+
+	// Callbacks for removed items, called in order on a goroutine of their
+	// own. Removals that find HookQueue (default DefaultHookQueue) removals
+	// waiting are dropped, see ShardedCache.HookDropped.
+	OnEvict   RemovalFunc // Items evicted by the LRU
+	OnExpire  RemovalFunc // Items removed after their hard expiry
+	OnDelete  RemovalFunc // Items deleted, flushed, invalidated or matched by DeletePattern
+	HookQueue int         // Removals waiting for the callbacks
 }
 
 // DefaultConfig returns memcached-compatible defaults
 func DefaultConfig() Config {
 	return Config{
-		DefaultTTL:      0,
-		MaxKeySize:      DefaultMaxKeySize,
-		MaxValueSize:    DefaultMaxValueSize,
-		MaxMemory:       DefaultMaxMemory,
-		ChannelCapacity: DefaultChannelCapacity,
-		StaleMultiplier: 2.0,
+		DefaultTTL:         0,
+		MaxKeySize:         DefaultMaxKeySize,
+		MaxValueSize:       DefaultMaxValueSize,
+		MaxMemory:          DefaultMaxMemory,
+		ChannelCapacity:    DefaultChannelCapacity,
+		StaleMultiplier:    2.0,
+		PrefixDelimiter:    DefaultPrefixDelimiter,
+		NamespaceDelimiter: DefaultNamespaceDelimiter,
+		SlowLogThreshold:   DefaultSlowLogThreshold,
+		SlowLogLen:         DefaultSlowLogLen,
 	}
 }
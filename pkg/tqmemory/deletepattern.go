@@ -0,0 +1,55 @@
+package tqmemory
+
+import "time"
+
+// handleDeletePattern removes the items of the next batch of entries that
+// match the pattern, or only counts them for a dry run.
+func (w *Worker) handleDeletePattern(req *Request) *Response {
+	now := time.Now().UnixMilli()
+	var matched []*IndexEntry
+	resp := &Response{}
+	resp.Cursor = w.index.Scan(req.Cursor, req.Count, func(entry *IndexEntry) {
+		if entry.HardExpiry > 0 && entry.HardExpiry <= now {
+			return
+		}
+		if len(w.pendingNamespaces) > 0 && w.invalidated(entry) {
+			return
+		}
+		if matchGlob(req.Pattern, entry.Key) {
+			matched = append(matched, entry)
+		}
+	})
+	resp.Count = len(matched)
+	if req.DryRun {
+		return resp
+	}
+	// Deleting only moves entries the scan already visited
+	for _, entry := range matched {
+		w.index.Delete(entry.Key)
+		w.itemRemoved(entrySize(entry))
+		w.notifyRemoved(entry, RemovedPattern)
+	}
+	w.stats.PatternDeleted += uint64(len(matched))
+	return resp
+}
+
+// DeletePattern removes all items whose key matches the glob pattern (see
+// Scan, "user:123:*" is matched as a prefix) and returns their number. With
+// dryRun the items are only counted. The workers are walked in batches, so
+// concurrent requests are served in between, and items stored during the
+// walk may or may not be removed.
+func (sc *ShardedCache) DeletePattern(pattern string, dryRun bool) int {
+	var n int
+	for i := range sc.workers {
+		cursor := 0
+		for {
+			resp := sc.sendRequest(i, &Request{Op: OpDeletePattern, Cursor: cursor, Count: scanBatch,
+				Pattern: pattern, DryRun: dryRun})
+			n += resp.Count
+			if cursor = resp.Cursor; cursor == 0 {
+				break
+			}
+		}
+	}
+	return n
+}
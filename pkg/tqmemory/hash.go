@@ -0,0 +1,243 @@
+package tqmemory
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrOverflow is returned by an increment that doesn't fit in an int64.
+var ErrOverflow = errors.New("increment or decrement would overflow")
+
+// hashValue is a hash: a map of fields to values inside a single item.
+type hashValue map[string][]byte
+
+func (h hashValue) size() int64 {
+	var n int64
+	for field, value := range h {
+		n += int64(len(field) + len(value))
+	}
+	return n
+}
+
+// appendTo serializes the hash as the netstrings of each field and its
+// value, ordered by field, e.g. "1:a,3:foo,1:b,3:bar,".
+func (h hashValue) appendTo(buf []byte) []byte {
+	for _, field := range h.sortedFields() {
+		buf = appendNetstring(buf, []byte(field))
+		buf = appendNetstring(buf, h[field])
+	}
+	return buf
+}
+
+func (h hashValue) sortedFields() []string {
+	fields := make([]string, 0, len(h))
+	for field := range h {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+func newHash() hashValue {
+	return make(hashValue)
+}
+
+// handleHSet stores the values in req.Elements in the fields in req.Fields,
+// creating the hash with req.TTL if needed, and returns the number of new
+// fields in Count.
+func (w *Worker) handleHSet(req *Request) *Response {
+	w.countSet(req.Key)
+	if len(req.Fields) == 0 {
+		return &Response{}
+	}
+	entry, h, err := lookupTyped[hashValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	var growth int64
+	if entry == nil {
+		growth = int64(len(req.Key))
+	}
+	for i, field := range req.Fields {
+		if old, ok := h[field]; ok {
+			growth += int64(len(req.Elements[i]) - len(old))
+		} else {
+			growth += int64(len(field) + len(req.Elements[i]))
+		}
+	}
+
+	var added int
+	entry, err = updateTyped(w, entry, req.Key, req.TTL, growth, newHash, func(h hashValue) {
+		for i, field := range req.Fields {
+			if _, ok := h[field]; !ok {
+				// The field may alias a connection's read buffer
+				field = strings.Clone(field)
+				added++
+			}
+			h[field] = slices.Clone(req.Elements[i])
+		}
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas, Count: added}
+}
+
+// handleHGet returns the value of the field req.Fields[0].
+func (w *Worker) handleHGet(req *Request) *Response {
+	entry, h, err := lookupTyped[hashValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	value, ok := h[req.Fields[0]]
+	if !ok {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	return &Response{Value: value, Cas: entry.Cas}
+}
+
+// handleHGetAll returns the fields and values of the hash, ordered by field.
+func (w *Worker) handleHGetAll(req *Request) *Response {
+	entry, h, err := lookupTyped[hashValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	resp := &Response{Cas: entry.Cas, Fields: h.sortedFields()}
+	resp.Values = make([][]byte, len(resp.Fields))
+	for i, field := range resp.Fields {
+		resp.Values[i] = h[field]
+	}
+	return resp
+}
+
+// handleHDel removes the fields in req.Fields and returns the number of
+// removed fields in Count. The item is removed with its last field.
+func (w *Worker) handleHDel(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, h, err := lookupTyped[hashValue](w, req.Key)
+	if err != nil || entry == nil {
+		return &Response{Err: err}
+	}
+	var removed int
+	entry, err = updateTyped(w, entry, req.Key, 0, 0, newHash, func(h hashValue) {
+		for _, field := range req.Fields {
+			if _, ok := h[field]; ok {
+				delete(h, field)
+				removed++
+			}
+		}
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	if len(h) == 0 {
+		w.removeTyped(entry)
+	}
+	return &Response{Cas: entry.Cas, Count: removed}
+}
+
+// handleHIncrBy adds req.Increment to the integer in the field
+// req.Fields[0], creating the field (and the hash, with req.TTL) with 0 if
+// needed, and returns the new value.
+func (w *Worker) handleHIncrBy(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, h, err := lookupTyped[hashValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	field := req.Fields[0]
+	var current int64
+	old, ok := h[field]
+	if ok {
+		if current, err = strconv.ParseInt(string(old), 10, 64); err != nil {
+			return &Response{Err: ErrNotNumeric}
+		}
+	}
+	if (req.Increment > 0 && current > math.MaxInt64-req.Increment) ||
+		(req.Increment < 0 && current < math.MinInt64-req.Increment) {
+		return &Response{Err: ErrOverflow}
+	}
+	value := strconv.AppendInt(nil, current+req.Increment, 10)
+
+	growth := int64(len(value) - len(old))
+	if !ok {
+		growth += int64(len(field))
+	}
+	if entry == nil {
+		growth += int64(len(req.Key))
+	}
+	entry, err = updateTyped(w, entry, req.Key, req.TTL, growth, newHash, func(h hashValue) {
+		if _, ok := h[field]; !ok {
+			field = strings.Clone(field)
+		}
+		h[field] = value
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Value: value, Cas: entry.Cas}
+}
+
+// HSet stores the fields in the hash at key, creating it with the ttl (the
+// default TTL if 0) if it doesn't exist; the TTL covers the whole hash and
+// is not changed by later updates. It returns the number of fields that
+// were added, or ErrWrongType if key holds another kind of value.
+func (sc *ShardedCache) HSet(key string, fields map[string][]byte, ttl time.Duration) (int, error) {
+	req := &Request{Op: OpHSet, Key: key, TTL: ttl,
+		Fields: make([]string, 0, len(fields)), Elements: make([][]byte, 0, len(fields))}
+	for field, value := range fields {
+		req.Fields = append(req.Fields, field)
+		req.Elements = append(req.Elements, value)
+	}
+	resp := sc.sendRequest(sc.workerFor(key), req)
+	return resp.Count, resp.Err
+}
+
+// HGet returns the value of a field of the hash at key, or ErrKeyNotFound
+// if the key or the field doesn't exist.
+func (sc *ShardedCache) HGet(key, field string) ([]byte, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpHGet, Key: key, Fields: []string{field}})
+	return resp.Value, resp.Err
+}
+
+// HGetAll returns all fields of the hash at key, or ErrKeyNotFound.
+func (sc *ShardedCache) HGetAll(key string) (map[string][]byte, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpHGetAll, Key: key})
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	fields := make(map[string][]byte, len(resp.Fields))
+	for i, field := range resp.Fields {
+		fields[field] = resp.Values[i]
+	}
+	return fields, nil
+}
+
+// HDel removes fields from the hash at key and returns the number of fields
+// that were removed. A hash without fields is removed.
+func (sc *ShardedCache) HDel(key string, fields ...string) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpHDel, Key: key, Fields: fields})
+	return resp.Count, resp.Err
+}
+
+// HIncrBy adds delta to the integer in a field of the hash at key and
+// returns the new value. A missing field starts at 0, a missing hash is
+// created with the ttl (the default TTL if 0).
+func (sc *ShardedCache) HIncrBy(key, field string, delta int64, ttl time.Duration) (int64, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpHIncrBy, Key: key, TTL: ttl,
+		Fields: []string{field}, Increment: delta})
+	if resp.Err != nil {
+		return 0, resp.Err
+	}
+	n, _ := strconv.ParseInt(string(resp.Value), 10, 64)
+	return n, nil
+}
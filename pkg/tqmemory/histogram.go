@@ -0,0 +1,149 @@
+package tqmemory
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram buckets: values below 16ns get a bucket each, above that every
+// power of two is split into 8 linear sub-buckets, like HdrHistogram with
+// one significant digit. Values up to 2^40ns (18 minutes) are recorded
+// within 12.5% of their actual value, larger values land in the last bucket.
+const (
+	histogramSubBits    = 3
+	histogramSubBuckets = 1 << histogramSubBits
+	histogramMaxBits    = 40
+	histogramBuckets    = (histogramMaxBits - histogramSubBits + 1) * histogramSubBuckets
+)
+
+// Histogram is a fixed-size log-linear latency histogram. Record only
+// increments two counters, so it is cheap enough to call for every
+// request. All methods are safe for concurrent use.
+type Histogram struct {
+	counts [histogramBuckets]uint64
+	sum    uint64 // nanoseconds
+}
+
+// LatencySummary holds the percentiles of a latency histogram.
+type LatencySummary struct {
+	Count uint64
+	P50   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+}
+
+// OpLatency holds the latency histograms of a worker operation type.
+type OpLatency struct {
+	Op    string    // Operation name, e.g. "get" or "get_multi"
+	Queue Histogram // Time waiting in the worker's request channel
+	Exec  Histogram // Time executing in the worker, until the response is sent
+}
+
+// histogramIndex returns the bucket of a value in nanoseconds.
+func histogramIndex(v uint64) int {
+	if v < 2*histogramSubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - histogramSubBits - 1
+	idx := shift*histogramSubBuckets + int(v>>uint(shift))
+	return min(idx, histogramBuckets-1)
+}
+
+// histogramUpper returns the largest value (in nanoseconds) of a bucket.
+func histogramUpper(idx int) uint64 {
+	if idx < 2*histogramSubBuckets {
+		return uint64(idx)
+	}
+	shift := uint(idx/histogramSubBuckets - 1)
+	mantissa := uint64(idx%histogramSubBuckets + histogramSubBuckets)
+	return (mantissa+1)<<shift - 1
+}
+
+// Record adds a duration to the histogram.
+func (h *Histogram) Record(d time.Duration) {
+	v := uint64(max(d, 0))
+	atomic.AddUint64(&h.counts[histogramIndex(v)], 1)
+	atomic.AddUint64(&h.sum, v)
+}
+
+// Count returns the number of recorded durations.
+func (h *Histogram) Count() uint64 {
+	var n uint64
+	for i := range h.counts {
+		n += atomic.LoadUint64(&h.counts[i])
+	}
+	return n
+}
+
+// Sum returns the total of the recorded durations.
+func (h *Histogram) Sum() time.Duration {
+	return time.Duration(atomic.LoadUint64(&h.sum))
+}
+
+// Quantile returns the duration below which the fraction q of the recorded
+// durations fall, rounded up to its bucket. It returns 0 if the histogram
+// is empty.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	var counts [histogramBuckets]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(q*float64(total) + 0.5)
+	rank = min(max(rank, 1), total)
+	var seen uint64
+	for i, n := range counts {
+		seen += n
+		if seen >= rank {
+			return time.Duration(histogramUpper(i))
+		}
+	}
+	return time.Duration(histogramUpper(histogramBuckets - 1))
+}
+
+// Summary returns the count and the p50, p99 and p999 of the histogram.
+func (h *Histogram) Summary() LatencySummary {
+	return LatencySummary{
+		Count: h.Count(),
+		P50:   h.Quantile(0.5),
+		P99:   h.Quantile(0.99),
+		P999:  h.Quantile(0.999),
+	}
+}
+
+// CountBelow returns the number of recorded durations that are known to be
+// at most d, for exporting cumulative buckets.
+func (h *Histogram) CountBelow(d time.Duration) uint64 {
+	var n uint64
+	for i := range h.counts {
+		if histogramUpper(i) > uint64(d) {
+			break
+		}
+		n += atomic.LoadUint64(&h.counts[i])
+	}
+	return n
+}
+
+// Merge adds the recorded durations of o to h.
+func (h *Histogram) Merge(o *Histogram) {
+	for i := range o.counts {
+		if n := atomic.LoadUint64(&o.counts[i]); n > 0 {
+			atomic.AddUint64(&h.counts[i], n)
+		}
+	}
+	atomic.AddUint64(&h.sum, atomic.LoadUint64(&o.sum))
+}
+
+// Reset removes all recorded durations.
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreUint64(&h.sum, 0)
+}
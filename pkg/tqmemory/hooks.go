@@ -0,0 +1,145 @@
+package tqmemory
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHookQueue is the number of removals that can wait for the
+// callbacks before removals are dropped.
+const DefaultHookQueue = 4096
+
+// RemovalReason tells why an item was removed from the cache.
+type RemovalReason int
+
+const (
+	RemovedEvicted     RemovalReason = iota // Evicted by the LRU (OnEvict)
+	RemovedExpired                          // Hard expiry passed (OnExpire)
+	RemovedDeleted                          // Deleted by key (OnDelete)
+	RemovedFlushed                          // Removed by FlushAll (OnDelete)
+	RemovedInvalidated                      // Namespace or tag invalidated (OnDelete)
+	RemovedPattern                          // Matched by DeletePattern (OnDelete)
+)
+
+var removalReasons = [...]string{
+	RemovedEvicted:     "evicted",
+	RemovedExpired:     "expired",
+	RemovedDeleted:     "deleted",
+	RemovedFlushed:     "flushed",
+	RemovedInvalidated: "invalidated",
+	RemovedPattern:     "pattern",
+}
+
+// String returns the name of the reason, e.g. "evicted".
+func (r RemovalReason) String() string {
+	if r >= 0 && int(r) < len(removalReasons) {
+		return removalReasons[r]
+	}
+	return "unknown"
+}
+
+// RemovalFunc is called after an item was removed, with the age of the
+// item since it was stored. The value must not be modified.
+type RemovalFunc func(key string, value []byte, reason RemovalReason, age time.Duration)
+
+// removal is a removed item waiting for its callback.
+type removal struct {
+	fn     RemovalFunc
+	key    string
+	value  []byte
+	data   typedValue // serialized on the hook goroutine, nil for a plain value
+	reason RemovalReason
+	age    time.Duration
+}
+
+// hookQueue delivers removals to the callbacks of the Config on a goroutine
+// of its own, so a slow callback can't stall a worker: when the queue is
+// full, removals are dropped and counted.
+type hookQueue struct {
+	onEvict  RemovalFunc
+	onExpire RemovalFunc
+	onDelete RemovalFunc
+	queue    chan removal
+	dropped  atomic.Uint64
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newHookQueue starts the delivery of removals, or returns nil if no
+// callbacks are configured.
+func newHookQueue(cfg Config) *hookQueue {
+	if cfg.OnEvict == nil && cfg.OnExpire == nil && cfg.OnDelete == nil {
+		return nil
+	}
+	size := cfg.HookQueue
+	if size <= 0 {
+		size = DefaultHookQueue
+	}
+	q := &hookQueue{
+		onEvict:  cfg.OnEvict,
+		onExpire: cfg.OnExpire,
+		onDelete: cfg.OnDelete,
+		queue:    make(chan removal, size),
+		done:     make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *hookQueue) run() {
+	defer close(q.done)
+	for r := range q.queue {
+		if r.data != nil {
+			r.value = r.data.appendTo(nil)
+		}
+		r.fn(r.key, r.value, r.reason, r.age)
+	}
+}
+
+// close delivers the queued removals and stops, after the workers stopped.
+// It is safe to call more than once.
+func (q *hookQueue) close() {
+	q.once.Do(func() { close(q.queue) })
+	<-q.done
+}
+
+// notifyRemoved publishes the removal of an entry to the keyspace
+// subscriptions and queues it for its callback. The entry is no longer in
+// the index, so its key and value are not modified anymore and a typed
+// value can be serialized on the hook goroutine, when it is not dropped.
+func (w *Worker) notifyRemoved(entry *IndexEntry, reason RemovalReason) {
+	if w.keyspace.mask.Load() != 0 {
+		w.keyspaceRemoved(entry, reason)
+	}
+	q := w.hooks
+	if q == nil {
+		return
+	}
+	fn := q.onDelete
+	switch reason {
+	case RemovedEvicted:
+		fn = q.onEvict
+	case RemovedExpired:
+		fn = q.onExpire
+	}
+	if fn == nil {
+		return
+	}
+	r := removal{fn: fn, key: entry.Key, value: entry.Value, data: entry.Data, reason: reason,
+		age: time.Duration(time.Now().UnixMilli()-entry.Created) * time.Millisecond}
+	select {
+	case q.queue <- r:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// HookDropped returns the number of removals that were not delivered to
+// the callbacks because the queue was full.
+func (sc *ShardedCache) HookDropped() uint64 {
+	if sc.hooks == nil {
+		return 0
+	}
+	return sc.hooks.dropped.Load()
+}
@@ -0,0 +1,166 @@
+package tqmemory
+
+import (
+	"hash/maphash"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Hot key tracking: every worker estimates the access counts of its keys
+// with a count-min sketch and keeps the keys with the highest estimates.
+// Counts are halved every hotKeyDecayTicks maintenance ticks (10 seconds),
+// so the ranking follows the current traffic.
+const (
+	hotKeySketchDepth = 4
+	hotKeySketchWidth = 2048 // must be a power of two
+	hotKeyDecayTicks  = 100
+	hotKeyMinOps      = 1000 // traffic needed before a hot key is logged
+)
+
+// HotKey is a frequently accessed key with its estimated access count.
+type HotKey struct {
+	Key   string
+	Count uint64  // Estimated accesses, decayed over time
+	Share float64 // Fraction of the shard's (decayed) traffic
+	Shard int     // Worker that owns the key
+}
+
+// HotKeys holds the most frequently read and written keys.
+type HotKeys struct {
+	Reads  []HotKey
+	Writes []HotKey
+}
+
+// hotKeyTracker finds the most frequently accessed keys of one kind of
+// access (reads or writes) of a worker. It is owned by the worker goroutine.
+type hotKeyTracker struct {
+	kind     string // "read" or "write", for logging
+	seed     maphash.Seed
+	sketch   [hotKeySketchDepth][hotKeySketchWidth]uint32
+	total    uint64             // decayed number of accesses
+	top      map[string]*HotKey // at most k keys
+	k        int
+	minCount uint64 // lowest count in top, once it is full
+	logShare float64
+	logged   map[string]bool // keys logged since the last decay
+}
+
+func newHotKeyTracker(kind string, k int, logShare float64) *hotKeyTracker {
+	return &hotKeyTracker{
+		kind:     kind,
+		seed:     maphash.MakeSeed(),
+		top:      make(map[string]*HotKey, k),
+		k:        k,
+		logShare: logShare,
+		logged:   make(map[string]bool),
+	}
+}
+
+// add counts an access to key.
+func (t *hotKeyTracker) add(key string, shard int) {
+	h := maphash.String(t.seed, key)
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	est := ^uint32(0)
+	for i := range t.sketch {
+		c := &t.sketch[i][(h1+uint32(i)*h2)&(hotKeySketchWidth-1)]
+		if *c < ^uint32(0) {
+			*c++
+		}
+		est = min(est, *c)
+	}
+	t.total++
+	count := uint64(est)
+
+	if e, ok := t.top[key]; ok {
+		e.Count = count
+	} else {
+		if len(t.top) >= t.k {
+			// Counts only grow between decays, so minCount is a lower bound
+			if count <= t.minCount {
+				return
+			}
+			minKey := t.minKey()
+			if count <= t.top[minKey].Count {
+				t.minCount = t.top[minKey].Count
+				return
+			}
+			delete(t.top, minKey)
+		}
+		// The key may alias a connection's read buffer
+		key = strings.Clone(key)
+		t.top[key] = &HotKey{Key: key, Count: count, Shard: shard}
+		if len(t.top) == t.k {
+			t.minCount = t.top[t.minKey()].Count
+		}
+	}
+
+	if t.logShare > 0 && t.total >= hotKeyMinOps && !t.logged[key] &&
+		float64(count) >= t.logShare*float64(t.total) {
+		t.logged[strings.Clone(key)] = true
+		log.Printf("Hot %s key %q on shard %d: %.0f%% of %d recent %ss",
+			t.kind, key, shard, 100*float64(count)/float64(t.total), t.total, t.kind)
+	}
+}
+
+// minKey returns the key with the lowest count in top.
+func (t *hotKeyTracker) minKey() string {
+	var minKey string
+	minCount := ^uint64(0)
+	for key, e := range t.top {
+		if e.Count <= minCount {
+			minKey, minCount = key, e.Count
+		}
+	}
+	return minKey
+}
+
+// decay halves all counts, forgetting keys that are no longer accessed.
+func (t *hotKeyTracker) decay() {
+	for i := range t.sketch {
+		for j := range t.sketch[i] {
+			t.sketch[i][j] >>= 1
+		}
+	}
+	t.total >>= 1
+	for key, e := range t.top {
+		if e.Count >>= 1; e.Count == 0 {
+			delete(t.top, key)
+		}
+	}
+	t.minCount >>= 1
+	clear(t.logged)
+}
+
+// reset forgets all counts.
+func (t *hotKeyTracker) reset() {
+	t.sketch = [hotKeySketchDepth][hotKeySketchWidth]uint32{}
+	t.total = 0
+	t.minCount = 0
+	clear(t.top)
+	clear(t.logged)
+}
+
+// snapshot returns the tracked keys ordered by count, highest first.
+func (t *hotKeyTracker) snapshot() []HotKey {
+	keys := make([]HotKey, 0, len(t.top))
+	for _, e := range t.top {
+		hk := *e
+		if t.total > 0 {
+			hk.Share = float64(hk.Count) / float64(t.total)
+		}
+		keys = append(keys, hk)
+	}
+	sortHotKeys(keys)
+	return keys
+}
+
+// sortHotKeys orders keys by count, highest first, and by key on ties.
+func sortHotKeys(keys []HotKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+}
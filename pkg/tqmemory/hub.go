@@ -0,0 +1,151 @@
+package tqmemory
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// subscription receives the events of a hub whose mask bits it selects and
+// whose key is one of its keys or matches one of its patterns. Events are delivered through a
+// buffered channel without ever blocking the workers: when the buffer is
+// full, events are dropped and counted.
+type subscription[E any] struct {
+	mask    uint32
+	keys    []string // Exact keys, matched besides the patterns
+	match   []string // Glob patterns, no keys and no patterns for all keys
+	events  chan E
+	done    chan struct{}
+	dropped atomic.Uint64
+	hub     *hub[E]
+	once    sync.Once
+}
+
+// Events returns the channel the events are delivered on. It is never
+// closed, select on Done to notice that the subscription was closed.
+func (s *subscription[E]) Events() <-chan E {
+	return s.events
+}
+
+// Done returns a channel that is closed when the subscription is closed.
+func (s *subscription[E]) Done() <-chan struct{} {
+	return s.done
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (s *subscription[E]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops the delivery of events. It is safe to call more than once.
+func (s *subscription[E]) Close() {
+	s.once.Do(func() {
+		s.hub.remove(s)
+		close(s.done)
+	})
+}
+
+// matches reports whether the subscription wants an event of mask for key,
+// or for all keys, like a flush.
+func (s *subscription[E]) matches(mask uint32, key string, all bool) bool {
+	if s.mask&mask == 0 {
+		return false
+	}
+	if len(s.keys) == 0 && len(s.match) == 0 || all {
+		return true
+	}
+	for _, k := range s.keys {
+		if k == key {
+			return true
+		}
+	}
+	for _, pattern := range s.match {
+		if matchGlob(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// hub fans the events of all workers out to the subscriptions. The list is
+// copied on write, so publishing never takes a lock, and mask lets the
+// workers skip building events nobody receives.
+type hub[E any] struct {
+	mu   sync.Mutex
+	subs atomic.Pointer[[]*subscription[E]]
+	mask atomic.Uint32
+	ids  atomic.Uint64
+}
+
+// wants reports whether any subscription selects a bit of mask.
+func (h *hub[E]) wants(mask uint32) bool {
+	return h.mask.Load()&mask != 0
+}
+
+// subscribe initializes s and adds it to the hub.
+func (h *hub[E]) subscribe(s *subscription[E], mask uint32, buffer int, keys, match []string) {
+	s.mask = mask
+	s.keys = append([]string(nil), keys...)
+	s.match = append([]string(nil), match...)
+	s.events = make(chan E, buffer)
+	s.done = make(chan struct{})
+	s.hub = h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var subs []*subscription[E]
+	if old := h.subs.Load(); old != nil {
+		subs = append(subs, *old...)
+	}
+	h.update(append(subs, s))
+}
+
+func (h *hub[E]) remove(s *subscription[E]) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var subs []*subscription[E]
+	for _, o := range *h.subs.Load() {
+		if o != s {
+			subs = append(subs, o)
+		}
+	}
+	h.update(subs)
+}
+
+// update publishes a new subscription list. The caller holds mu.
+func (h *hub[E]) update(subs []*subscription[E]) {
+	var mask uint32
+	for _, s := range subs {
+		mask |= s.mask
+	}
+	h.subs.Store(&subs)
+	h.mask.Store(mask)
+}
+
+// publish delivers an event of mask for key, or for all keys, to the
+// matching subscriptions, dropping it for the subscriptions that have no room. The event is made
+// by event, with the next event number, once a subscription matches. It
+// returns the number of subscriptions the event was delivered to and
+// dropped for.
+func (h *hub[E]) publish(mask uint32, key string, all bool, event func(id uint64) E) (delivered, dropped int) {
+	subs := h.subs.Load()
+	if subs == nil {
+		return 0, 0
+	}
+	var ev E
+	made := false
+	for _, s := range *subs {
+		if !s.matches(mask, key, all) {
+			continue
+		}
+		if !made {
+			ev, made = event(h.ids.Add(1)), true
+		}
+		select {
+		case s.events <- ev:
+			delivered++
+		default:
+			s.dropped.Add(1)
+			dropped++
+		}
+	}
+	return delivered, dropped
+}
@@ -0,0 +1,268 @@
+package tqmemory
+
+import (
+	"math"
+	"math/bits"
+	"slices"
+	"time"
+)
+
+// A HyperLogLog estimates the number of distinct elements added to it with
+// a standard error of 0.81%, in a fixed 12KB: 2^14 registers of 6 bits
+// that each hold the longest run of leading zeros seen in the hashes of the
+// elements that map to it.
+const (
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+	hllBytes     = hllRegisters * 6 / 8
+)
+
+// hllValue is a HyperLogLog with its registers packed in 6 bits each.
+type hllValue struct {
+	// registers has one byte more than needed, so every register can be
+	// read as a 16-bit word
+	registers []byte
+	cached    int // the estimate, -1 after a change
+}
+
+func newHLL() *hllValue {
+	return &hllValue{registers: make([]byte, hllBytes+1)}
+}
+
+func (h *hllValue) size() int64 {
+	return hllBytes + 1
+}
+
+// appendTo serializes the HyperLogLog as its packed registers.
+func (h *hllValue) appendTo(buf []byte) []byte {
+	return append(buf, h.registers[:hllBytes]...)
+}
+
+func (h *hllValue) get(i int) uint8 {
+	pos := i * 6
+	word := uint16(h.registers[pos/8]) | uint16(h.registers[pos/8+1])<<8
+	return uint8(word>>(pos%8)) & 63
+}
+
+func (h *hllValue) set(i int, v uint8) {
+	pos := i * 6
+	word := uint16(h.registers[pos/8]) | uint16(h.registers[pos/8+1])<<8
+	word = word&^(63<<(pos%8)) | uint16(v)<<(pos%8)
+	h.registers[pos/8] = byte(word)
+	h.registers[pos/8+1] = byte(word >> 8)
+}
+
+// hllRegister returns the register of an element and the value it sets.
+func hllRegister(element string) (int, uint8) {
+	hash := hash64(element)
+	// The guard bit limits the run to the 50 bits after the register index
+	rest := hash<<hllPrecision | 1<<(hllPrecision-1)
+	return int(hash >> (64 - hllPrecision)), uint8(bits.LeadingZeros64(rest) + 1)
+}
+
+// changes reports whether adding any of the elements changes a register of
+// the HyperLogLog, which may be nil.
+func (h *hllValue) changes(elements []string) bool {
+	for _, element := range elements {
+		i, v := hllRegister(element)
+		if h == nil || v > h.get(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hllValue) add(element string) {
+	i, v := hllRegister(element)
+	if v > h.get(i) {
+		h.set(i, v)
+		h.cached = -1
+	}
+}
+
+// merge sets each register to the maximum of itself and the same register
+// in the packed registers of another HyperLogLog.
+func (h *hllValue) merge(registers []byte) {
+	other := hllValue{registers: registers}
+	for i := range hllRegisters {
+		if v := other.get(i); v > h.get(i) {
+			h.set(i, v)
+		}
+	}
+	h.cached = -1
+}
+
+// count returns the estimated number of distinct elements, using linear
+// counting for small estimates where the raw estimate is biased.
+func (h *hllValue) count() int {
+	if h.cached >= 0 {
+		return h.cached
+	}
+	const m = float64(hllRegisters)
+	var sum float64
+	var zeros int
+	for i := range hllRegisters {
+		v := h.get(i)
+		sum += 1 / float64(uint64(1)<<v)
+		if v == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	h.cached = int(math.Round(estimate))
+	return h.cached
+}
+
+// hash64 is a 64-bit FNV-1a hash followed by the murmur3 finalizer, as FNV
+// alone doesn't spread short inputs over the high bits. It doesn't depend on
+// the process, so the registers of HyperLogLogs and the bits of Bloom filters
+// stay valid when their serialization is stored elsewhere and loaded again.
+func hash64(s string) uint64 {
+	const (
+		offset64 = uint64(14695981039346656037)
+		prime64  = uint64(1099511628211)
+	)
+	h := offset64
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return mix64(h)
+}
+
+// mix64 is the murmur3 finalizer, which makes every bit of the result
+// depend on every bit of h.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// handlePFAdd adds the elements in req.Fields, creating the HyperLogLog
+// with req.TTL if needed, and returns 1 in Count if the estimate may have
+// changed.
+func (w *Worker) handlePFAdd(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, h, err := lookupTyped[*hllValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	if entry != nil && !h.changes(req.Fields) {
+		return &Response{Cas: entry.Cas}
+	}
+	var growth int64
+	if entry == nil {
+		growth = int64(len(req.Key)) + hllBytes + 1
+	}
+	entry, err = updateTyped(w, entry, req.Key, req.TTL, growth, newHLL, func(h *hllValue) {
+		for _, element := range req.Fields {
+			h.add(element)
+		}
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas, Count: 1}
+}
+
+// handlePFCount returns the estimate in Count, and a copy of the registers
+// (with the padding byte) in Value if req.Values is set.
+func (w *Worker) handlePFCount(req *Request) *Response {
+	entry, h, err := lookupTyped[*hllValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil {
+		return &Response{}
+	}
+	resp := &Response{Cas: entry.Cas, Count: h.count()}
+	if req.Values {
+		resp.Value = slices.Clone(h.registers)
+	}
+	return resp
+}
+
+// handlePFMerge merges the registers in req.Elements into the HyperLogLog,
+// creating it with req.TTL if needed.
+func (w *Worker) handlePFMerge(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, _, err := lookupTyped[*hllValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	var growth int64
+	if entry == nil {
+		growth = int64(len(req.Key)) + hllBytes + 1
+	}
+	entry, err = updateTyped(w, entry, req.Key, req.TTL, growth, newHLL, func(h *hllValue) {
+		for _, registers := range req.Elements {
+			h.merge(registers)
+		}
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas}
+}
+
+// PFAdd adds elements to the HyperLogLog at key and reports whether its
+// estimate may have changed. A missing HyperLogLog is created with the ttl
+// (the default TTL if 0).
+func (sc *ShardedCache) PFAdd(key string, ttl time.Duration, elements ...string) (bool, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpPFAdd, Key: key, TTL: ttl, Fields: elements})
+	return resp.Count == 1, resp.Err
+}
+
+// PFCount returns the estimated number of distinct elements added to the
+// HyperLogLogs at the keys together. Missing keys count as empty.
+func (sc *ShardedCache) PFCount(keys ...string) (int, error) {
+	if len(keys) == 1 {
+		resp := sc.sendRequest(sc.workerFor(keys[0]), &Request{Op: OpPFCount, Key: keys[0]})
+		return resp.Count, resp.Err
+	}
+	registers, err := sc.hllRegisters(keys)
+	if err != nil {
+		return 0, err
+	}
+	h := newHLL()
+	for _, r := range registers {
+		h.merge(r)
+	}
+	return h.count(), nil
+}
+
+// PFMerge merges the HyperLogLogs at the source keys into the one at dest,
+// which is created with the ttl (the default TTL if 0) if missing. The
+// sources are read one by one, so the merge is not atomic with changes to
+// them.
+func (sc *ShardedCache) PFMerge(dest string, ttl time.Duration, sources ...string) error {
+	registers, err := sc.hllRegisters(sources)
+	if err != nil {
+		return err
+	}
+	return sc.sendRequest(sc.workerFor(dest), &Request{Op: OpPFMerge, Key: dest, TTL: ttl,
+		Elements: registers}).Err
+}
+
+// hllRegisters returns copies of the registers of the HyperLogLogs at the
+// keys that exist.
+func (sc *ShardedCache) hllRegisters(keys []string) ([][]byte, error) {
+	registers := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpPFCount, Key: key, Values: true})
+		if resp.Err != nil {
+			return nil, resp.Err
+		}
+		if resp.Value != nil {
+			registers = append(registers, resp.Value)
+		}
+	}
+	return registers, nil
+}
@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"container/list"
 	"errors"
+	"time"
 )
 
 // Common errors
@@ -24,7 +25,13 @@ type IndexEntry struct {
 	HardExpiry int64  // Unix timestamp in milliseconds, deleted after this (TTL * StaleMultiplier)
 	Cas        uint64
 	Refreshing bool          // True after first stale access (prevents subsequent refresh flags)
+	Fetched    bool          // True after the first get (for the *_unfetched stats)
+	LastAccess int64         // Unix timestamp in seconds of the last read or write
+	Tags       []string      // Tags the entry can be invalidated by
+	Created    int64         // Unix timestamp in milliseconds when the item was stored
+	Data       typedValue    // Typed value such as a hash, instead of Value (nil = plain value)
 	lruElem    *list.Element // Direct pointer to LRU element (avoids lruMap lookup)
+	pos        int           // Position in Index.entries
 }
 
 // ExpiryEntry represents an entry in the expiry heap
@@ -108,8 +115,11 @@ func (h *ExpiryHeap) Remove(key string) {
 // LRU list stores *IndexEntry directly, avoiding key duplication.
 type Index struct {
 	data       map[string]*IndexEntry // key → *IndexEntry
+	entries    []*IndexEntry          // All entries without gaps, for Scan
 	expiryHeap *ExpiryHeap
-	lruList    *list.List // Stores *IndexEntry directly
+	lruList    *list.List                     // Stores *IndexEntry directly
+	clock      int64                          // Unix seconds, updated by the worker, for LastAccess
+	tags       map[string]map[string]struct{} // tag → keys of the entries carrying it
 }
 
 func NewIndex() *Index {
@@ -117,6 +127,7 @@ func NewIndex() *Index {
 		data:       make(map[string]*IndexEntry),
 		expiryHeap: NewExpiryHeap(),
 		lruList:    list.New(),
+		clock:      time.Now().Unix(),
 	}
 }
 
@@ -130,6 +141,24 @@ func (idx *Index) Get(key string) (*IndexEntry, bool) {
 func (idx *Index) Set(entry *IndexEntry) {
 	old, existed := idx.data[entry.Key]
 	idx.data[entry.Key] = entry
+	entry.LastAccess = idx.clock
+
+	// Update the entries, an existing entry keeps its position
+	if existed {
+		entry.pos = old.pos
+	} else {
+		entry.pos = len(idx.entries)
+		idx.entries = append(idx.entries, nil)
+	}
+	idx.entries[entry.pos] = entry
+
+	// Update the tag index, unless the entry was updated in place
+	if old != entry {
+		if existed {
+			idx.untag(old)
+		}
+		idx.tag(entry)
+	}
 
 	// Update expiry heap (use HardExpiry for removal timing)
 	if entry.HardExpiry > 0 {
@@ -158,6 +187,14 @@ func (idx *Index) Delete(key string) *IndexEntry {
 	}
 	delete(idx.data, key)
 	idx.expiryHeap.Remove(key)
+	idx.untag(entry)
+
+	// Move the last entry into the gap
+	last := idx.entries[len(idx.entries)-1]
+	idx.entries[entry.pos] = last
+	last.pos = entry.pos
+	idx.entries[len(idx.entries)-1] = nil
+	idx.entries = idx.entries[:len(idx.entries)-1]
 
 	// Remove from LRU list using direct pointer
 	if entry.lruElem != nil {
@@ -173,6 +210,7 @@ func (idx *Index) Touch(key string) {
 	entry, ok := idx.data[key]
 	if ok && entry.lruElem != nil {
 		idx.lruList.MoveToBack(entry.lruElem)
+		entry.LastAccess = idx.clock
 	}
 }
 
@@ -185,6 +223,61 @@ func (idx *Index) GetOldest() *IndexEntry {
 	return elem.Value.(*IndexEntry)
 }
 
+// Scan calls fn for up to count entries and returns the cursor to continue
+// with, or 0 when all entries were visited. Scans start with cursor 0.
+// Entries are walked from the last position down and a delete only moves
+// the last entry, so an entry that exists during the whole scan is visited
+// at least once (entries moved by a delete may be visited twice).
+func (idx *Index) Scan(cursor, count int, fn func(*IndexEntry)) int {
+	pos := len(idx.entries)
+	if cursor > 0 {
+		pos = min(cursor, pos)
+	}
+	for ; pos > 0 && count > 0; count-- {
+		pos--
+		fn(idx.entries[pos])
+	}
+	return pos
+}
+
+// tag adds the entry's key to the tag index.
+func (idx *Index) tag(entry *IndexEntry) {
+	if len(entry.Tags) == 0 {
+		return
+	}
+	if idx.tags == nil {
+		idx.tags = make(map[string]map[string]struct{})
+	}
+	for _, tag := range entry.Tags {
+		keys := idx.tags[tag]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			idx.tags[tag] = keys
+		}
+		keys[entry.Key] = struct{}{}
+	}
+}
+
+// untag removes the entry's key from the tag index.
+func (idx *Index) untag(entry *IndexEntry) {
+	for _, tag := range entry.Tags {
+		keys := idx.tags[tag]
+		delete(keys, entry.Key)
+		if len(keys) == 0 {
+			delete(idx.tags, tag)
+		}
+	}
+}
+
+// Tagged returns the keys of the entries carrying tag.
+func (idx *Index) Tagged(tag string) []string {
+	keys := make([]string, 0, len(idx.tags[tag]))
+	for key := range idx.tags[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 // Count returns the number of entries
 func (idx *Index) Count() int {
 	return len(idx.data)
@@ -6,6 +6,8 @@ import "time"
 // Allows server to work with the cache implementation.
 type CacheInterface interface {
 	Get(key string) (value []byte, cas uint64, flags int, err error)
+	GetMulti(keys []string) []GetResult
+	Submit(req *Request)
 	Set(key string, value []byte, ttl time.Duration) (uint64, error)
 	Add(key string, value []byte, ttl time.Duration) (uint64, error)
 	Replace(key string, value []byte, ttl time.Duration) (uint64, error)
@@ -14,10 +16,69 @@ type CacheInterface interface {
 	Touch(key string, ttl time.Duration) (uint64, error)
 	Increment(key string, delta uint64) (uint64, uint64, error)
 	Decrement(key string, delta uint64) (uint64, uint64, error)
+	IncrementOrCreate(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error)
+	DecrementOrCreate(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error)
 	Append(key string, value []byte) (uint64, error)
 	Prepend(key string, value []byte) (uint64, error)
 	FlushAll()
 	Stats() map[string]string
+	WorkerStats() []Stats
+	QueueDepths() []int
+	Latency() []OpLatency
+	HotKeys() HotKeys
+	SlowLog(n int) []SlowLogEntry
+	SlowLogLen() int
+	ResetSlowLog()
+	WithClient(addr string) CacheInterface
+	Watch(kinds WatchKind, buffer int) *Watcher
+	SubscribeKeyspace(types KeyspaceEventType, buffer int, match ...string) *KeyspaceSubscription
+	Metadump(shard int, fn func(ItemMeta) bool)
+	Scan(cursor uint64, match string, count int) ([]string, uint64)
+	Range(fn func(key string, value []byte, meta ItemMeta) bool)
+	InvalidateNamespace(ns string) uint64
+	NamespaceGeneration(ns string) uint64
+	SetWithTags(key string, value []byte, ttl time.Duration, tags []string) (uint64, error)
+	InvalidateTag(tag string) int
+	DeletePattern(pattern string, dryRun bool) int
+	HSet(key string, fields map[string][]byte, ttl time.Duration) (int, error)
+	HGet(key, field string) ([]byte, error)
+	HGetAll(key string) (map[string][]byte, error)
+	HDel(key string, fields ...string) (int, error)
+	HIncrBy(key, field string, delta int64, ttl time.Duration) (int64, error)
+	LPush(key string, ttl time.Duration, values ...[]byte) (int, error)
+	RPush(key string, ttl time.Duration, values ...[]byte) (int, error)
+	LPop(key string) ([]byte, error)
+	RPop(key string) ([]byte, error)
+	BLPop(key string, timeout time.Duration, done <-chan struct{}) ([]byte, error)
+	BRPop(key string, timeout time.Duration, done <-chan struct{}) ([]byte, error)
+	LRange(key string, start, stop int) ([][]byte, error)
+	LTrim(key string, start, stop int) error
+	LLen(key string) (int, error)
+	SAdd(key string, ttl time.Duration, members ...string) (int, error)
+	SRem(key string, members ...string) (int, error)
+	SIsMember(key, member string) (bool, error)
+	SMembers(key string) ([]string, error)
+	SCard(key string) (int, error)
+	ZAdd(key string, ttl time.Duration, members ...ZMember) (int, error)
+	ZIncrBy(key, member string, delta float64, ttl time.Duration) (float64, error)
+	ZRem(key string, members ...string) (int, error)
+	ZRange(key string, start, stop int, reverse bool) ([]ZMember, error)
+	ZRangeByScore(key string, min, max float64) ([]ZMember, error)
+	ZRank(key, member string, reverse bool) (int, error)
+	ZScore(key, member string) (float64, error)
+	PFAdd(key string, ttl time.Duration, elements ...string) (bool, error)
+	PFCount(keys ...string) (int, error)
+	PFMerge(dest string, ttl time.Duration, sources ...string) error
+	BFReserve(key string, ttl time.Duration, errorRate float64, capacity int) error
+	BFAdd(key string, ttl time.Duration, items ...string) (int, error)
+	BFExists(key, item string) (bool, error)
+	ItemStats() ItemStats
+	ResetStats()
+	SetDetail(on bool)
+	DetailEnabled() bool
+	PrefixStats() map[string]PrefixStats
+	Config() Config
+	WorkerCount() int
 	Close() error
 	GetStartTime() time.Time
 }
@@ -0,0 +1,132 @@
+package tqmemory
+
+import (
+	"strings"
+	"time"
+)
+
+// KeyspaceEventType selects the changes a keyspace subscription receives.
+type KeyspaceEventType uint32
+
+const (
+	KeyspaceSet    KeyspaceEventType = 1 << iota // An item was stored or its value changed
+	KeyspaceDelete                               // An item was deleted, invalidated or matched by DeletePattern
+	KeyspaceExpire                               // An item was removed after its hard expiry
+	KeyspaceEvict                                // An item was evicted by the LRU
+	KeyspaceFlush                                // A worker was flushed, the event has no key
+
+	// KeyspaceAll selects all event types.
+	KeyspaceAll = KeyspaceSet | KeyspaceDelete | KeyspaceExpire | KeyspaceEvict | KeyspaceFlush
+)
+
+// DefaultKeyspaceBuffer is the number of events a keyspace subscription can
+// fall behind before events are dropped.
+const DefaultKeyspaceBuffer = 1024
+
+// String returns the name of the event type, e.g. "set".
+func (t KeyspaceEventType) String() string {
+	switch t {
+	case KeyspaceSet:
+		return "set"
+	case KeyspaceDelete:
+		return "delete"
+	case KeyspaceExpire:
+		return "expire"
+	case KeyspaceEvict:
+		return "evict"
+	case KeyspaceFlush:
+		return "flush"
+	}
+	return "unknown"
+}
+
+// KeyspaceEvent is a change of the cache contents.
+type KeyspaceEvent struct {
+	Type  KeyspaceEventType
+	ID    uint64    // Increasing event number, shared by all subscriptions
+	Time  time.Time // When the change happened
+	Key   string    // Changed key, empty for KeyspaceFlush
+	Shard int       // Worker that owns the key
+}
+
+// KeyspaceSubscription receives the keyspace events of its types whose key
+// matches one of its patterns. Delivery is at most once: when the buffer is
+// full, events are dropped and counted, the workers never wait.
+type KeyspaceSubscription struct {
+	subscription[KeyspaceEvent]
+}
+
+// keyspaceHub fans the keyspace events of all workers out to the
+// subscriptions.
+type keyspaceHub struct {
+	hub[KeyspaceEvent]
+}
+
+// wants reports whether any subscription receives events of type t.
+func (h *keyspaceHub) wants(t KeyspaceEventType) bool {
+	return h.hub.wants(uint32(t))
+}
+
+// publish delivers an event to the matching subscriptions. The key may
+// alias a connection's read buffer, so it is copied once a subscription
+// matches. A flush has no key and is delivered for all keys.
+func (h *keyspaceHub) publish(t KeyspaceEventType, key string, shard int) {
+	h.hub.publish(uint32(t), key, t == KeyspaceFlush, func(id uint64) KeyspaceEvent {
+		return KeyspaceEvent{Type: t, ID: id, Time: time.Now(), Key: strings.Clone(key), Shard: shard}
+	})
+}
+
+// keyspaceRequest publishes the set event of an executed request.
+func (w *Worker) keyspaceRequest(req *Request, resp *Response) {
+	if resp.Err != nil {
+		return
+	}
+	switch req.Op {
+	case OpSet, OpAdd, OpReplace, OpCas, OpAppend, OpPrepend,
+		OpIncr, OpDecr, OpIncrOrCreate, OpDecrOrCreate, OpHSet, OpHIncrBy, OpZAdd, OpZIncrBy,
+		OpPFMerge, OpBFReserve:
+		w.keyspace.publish(KeyspaceSet, req.Key, w.shard)
+	case OpLPush, OpRPush, OpLPop, OpRPop, OpBLPop, OpBRPop, OpLTrim:
+		// Removing the last element deletes the item, elements pushed to a
+		// blocking pop are not stored
+		if _, ok := w.index.Get(req.Key); ok {
+			w.keyspace.publish(KeyspaceSet, req.Key, w.shard)
+		}
+	case OpHDel, OpSAdd, OpSRem, OpZRem, OpPFAdd, OpBFAdd:
+		// Only if members were added or removed, and not the last one
+		if _, ok := w.index.Get(req.Key); ok && resp.Count > 0 {
+			w.keyspace.publish(KeyspaceSet, req.Key, w.shard)
+		}
+	}
+}
+
+// keyspaceRemoved publishes the removal of an item.
+func (w *Worker) keyspaceRemoved(entry *IndexEntry, reason RemovalReason) {
+	t := KeyspaceDelete
+	switch reason {
+	case RemovedEvicted:
+		t = KeyspaceEvict
+	case RemovedExpired:
+		t = KeyspaceExpire
+	case RemovedFlushed:
+		// Published once per worker by the flush
+		return
+	}
+	if w.keyspace.wants(t) {
+		w.keyspace.publish(t, entry.Key, w.shard)
+	}
+}
+
+// SubscribeKeyspace returns a subscription to the changes of the given types
+// (KeyspaceAll for all) to keys that match one of the glob patterns (see
+// Scan), or to all keys without patterns. Up to buffer events
+// (DefaultKeyspaceBuffer if buffer <= 0) wait for the subscriber before
+// events are dropped. Close the subscription when done.
+func (sc *ShardedCache) SubscribeKeyspace(types KeyspaceEventType, buffer int, match ...string) *KeyspaceSubscription {
+	if buffer <= 0 {
+		buffer = DefaultKeyspaceBuffer
+	}
+	s := &KeyspaceSubscription{}
+	sc.keyspace.subscribe(&s.subscription, uint32(types), buffer, nil, match)
+	return s
+}
@@ -0,0 +1,403 @@
+package tqmemory
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// listValue is a list with O(1) pushes and pops at both ends: the first
+// elements are in front in reverse order, the others in back.
+type listValue struct {
+	front [][]byte
+	back  [][]byte
+	bytes int64
+}
+
+func newList() *listValue {
+	return &listValue{}
+}
+
+func (l *listValue) size() int64 {
+	return l.bytes
+}
+
+// appendTo serializes the list as the netstrings of its elements in order,
+// e.g. "3:foo,3:bar,".
+func (l *listValue) appendTo(buf []byte) []byte {
+	for i := range l.len() {
+		buf = appendNetstring(buf, l.at(i))
+	}
+	return buf
+}
+
+func (l *listValue) len() int {
+	return len(l.front) + len(l.back)
+}
+
+func (l *listValue) at(i int) []byte {
+	if i < len(l.front) {
+		return l.front[len(l.front)-1-i]
+	}
+	return l.back[i-len(l.front)]
+}
+
+func (l *listValue) push(value []byte, front bool) {
+	if front {
+		l.front = append(l.front, value)
+	} else {
+		l.back = append(l.back, value)
+	}
+	l.bytes += int64(len(value))
+}
+
+// pop removes and returns the first (or the last) element of a non-empty
+// list.
+func (l *listValue) pop(front bool) []byte {
+	var value []byte
+	switch {
+	case front && len(l.front) > 0:
+		value, l.front = l.front[len(l.front)-1], l.front[:len(l.front)-1]
+	case front:
+		value, l.back[0], l.back = l.back[0], nil, l.back[1:]
+	case len(l.back) > 0:
+		value, l.back = l.back[len(l.back)-1], l.back[:len(l.back)-1]
+	default:
+		value, l.front[0], l.front = l.front[0], nil, l.front[1:]
+	}
+	l.bytes -= int64(len(value))
+	return value
+}
+
+// trim keeps the elements from start to stop (inclusive).
+func (l *listValue) trim(start, stop int) {
+	back := make([][]byte, 0, stop-start+1)
+	l.bytes = 0
+	for i := start; i <= stop; i++ {
+		back = append(back, l.at(i))
+		l.bytes += int64(len(l.at(i)))
+	}
+	l.front, l.back = nil, back
+}
+
+// listRange converts the start and stop of a range, which count from the
+// end when negative, to positions in a list of n elements. It returns false
+// if the range is empty.
+func listRange(n, start, stop int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	stop = min(stop, n-1)
+	return start, stop, start <= stop
+}
+
+// popWaiter is a parked blocking pop.
+type popWaiter struct {
+	req      *Request
+	deadline int64 // Unix timestamp in milliseconds, 0 to wait until served or cancelled
+}
+
+// handlePush pushes the elements in req.Elements one by one to the front
+// (or the back) of the list, creating it with req.TTL if needed, and
+// returns its length in Count. Parked blocking pops of an empty list are
+// served first, the remaining elements are stored; like in Redis the
+// length is then that right after the push, before the pops.
+func (w *Worker) handlePush(req *Request, front bool) *Response {
+	w.countSet(req.Key)
+	entry, _, err := lookupTyped[*listValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	elements := make([][]byte, len(req.Elements))
+	var growth int64
+	if entry == nil {
+		growth = int64(len(req.Key))
+	}
+	for i, element := range req.Elements {
+		// The elements may alias a connection's read buffer
+		elements[i] = slices.Clone(element)
+		growth += int64(len(element))
+	}
+
+	if w.tooLarge(entry, growth) {
+		// Before the elements are handed to waiters
+		return &Response{Err: ErrValueTooLarge}
+	}
+	if entry == nil && len(w.popWaiters[req.Key]) > 0 {
+		l := newList()
+		for _, element := range elements {
+			l.push(element, front)
+		}
+		w.servePopWaiters(req.Key, l)
+		if l.len() == 0 {
+			return &Response{Count: len(elements)}
+		}
+		entry, err = updateTyped(w, nil, req.Key, req.TTL, growth, func() *listValue { return l },
+			func(*listValue) {})
+		if err != nil {
+			return &Response{Err: err}
+		}
+		return &Response{Cas: entry.Cas, Count: len(elements)}
+	}
+
+	var n int
+	entry, err = updateTyped(w, entry, req.Key, req.TTL, growth, newList, func(l *listValue) {
+		for _, element := range elements {
+			l.push(element, front)
+		}
+		n = l.len()
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas, Count: n}
+}
+
+// servePopWaiters answers the parked pops of key, oldest first, with the
+// elements of l until either runs out.
+func (w *Worker) servePopWaiters(key string, l *listValue) {
+	waiters := w.popWaiters[key]
+	for len(waiters) > 0 && l.len() > 0 {
+		req := waiters[0].req
+		waiters[0], waiters = popWaiter{}, waiters[1:]
+		req.respond(&Response{Value: l.pop(req.Op == OpBLPop)})
+	}
+	if len(waiters) == 0 {
+		delete(w.popWaiters, key)
+	} else {
+		w.popWaiters[key] = waiters
+	}
+}
+
+// handlePop removes and returns the first (or last) element of the list.
+// A blocking pop of an empty list with a req.TTL timeout is parked until an
+// element is pushed or the timeout passes, and nil is returned.
+func (w *Worker) handlePop(req *Request, front bool) *Response {
+	w.countSet(req.Key)
+	entry, _, err := lookupTyped[*listValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	if entry == nil {
+		if (req.Op == OpBLPop || req.Op == OpBRPop) && req.TTL >= 0 {
+			key := strings.Clone(req.Key)
+			var deadline int64
+			if req.TTL > 0 {
+				deadline = time.Now().Add(req.TTL).UnixMilli()
+			}
+			w.popWaiters[key] = append(w.popWaiters[key], popWaiter{req: req, deadline: deadline})
+			return nil
+		}
+		return &Response{Err: ErrKeyNotFound}
+	}
+
+	var value []byte
+	var empty bool
+	entry, err = updateTyped(w, entry, req.Key, 0, 0, newList, func(l *listValue) {
+		value = l.pop(front)
+		empty = l.len() == 0
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	if empty {
+		w.removeTyped(entry)
+	}
+	return &Response{Value: value, Cas: entry.Cas}
+}
+
+// expirePopWaiters answers the parked pops whose timeout passed with
+// ErrKeyNotFound.
+func (w *Worker) expirePopWaiters() {
+	now := time.Now().UnixMilli()
+	for key, waiters := range w.popWaiters {
+		waiting := waiters[:0]
+		for _, waiter := range waiters {
+			if waiter.deadline > 0 && waiter.deadline <= now {
+				waiter.req.respond(&Response{Err: ErrKeyNotFound})
+			} else {
+				waiting = append(waiting, waiter)
+			}
+		}
+		clear(waiters[len(waiting):])
+		if len(waiting) == 0 {
+			delete(w.popWaiters, key)
+		} else {
+			w.popWaiters[key] = waiting
+		}
+	}
+}
+
+// handleCancelPop answers the blocking pop req.Waiter with ErrKeyNotFound
+// if it is still parked. A pop that was answered already is left alone.
+func (w *Worker) handleCancelPop(req *Request) *Response {
+	waiters := w.popWaiters[req.Key]
+	for i, waiter := range waiters {
+		if waiter.req != req.Waiter {
+			continue
+		}
+		waiter.req.respond(&Response{Err: ErrKeyNotFound})
+		if waiters = slices.Delete(waiters, i, i+1); len(waiters) == 0 {
+			delete(w.popWaiters, req.Key)
+		} else {
+			w.popWaiters[req.Key] = waiters
+		}
+		break
+	}
+	return &Response{}
+}
+
+// releasePopWaiters answers all parked pops with ErrKeyNotFound, when the
+// worker stops.
+func (w *Worker) releasePopWaiters() {
+	for _, waiters := range w.popWaiters {
+		for _, waiter := range waiters {
+			waiter.req.respond(&Response{Err: ErrKeyNotFound})
+		}
+	}
+	clear(w.popWaiters)
+}
+
+// handleLRange returns the elements from req.Start to req.Stop in Values.
+func (w *Worker) handleLRange(req *Request) *Response {
+	entry, l, err := lookupTyped[*listValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	resp := &Response{Cas: entry.Cas}
+	if start, stop, ok := listRange(l.len(), req.Start, req.Stop); ok {
+		resp.Values = make([][]byte, 0, stop-start+1)
+		for i := start; i <= stop; i++ {
+			resp.Values = append(resp.Values, l.at(i))
+		}
+	}
+	return resp
+}
+
+// handleLTrim keeps the elements from req.Start to req.Stop. The item is
+// removed when no elements are left.
+func (w *Worker) handleLTrim(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, l, err := lookupTyped[*listValue](w, req.Key)
+	if err != nil || entry == nil {
+		return &Response{Err: err}
+	}
+	start, stop, ok := listRange(l.len(), req.Start, req.Stop)
+	if !ok {
+		w.removeTyped(entry)
+		return &Response{}
+	}
+	entry, err = updateTyped(w, entry, req.Key, 0, 0, newList, func(l *listValue) {
+		l.trim(start, stop)
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas}
+}
+
+// handleLLen returns the length of the list in Count.
+func (w *Worker) handleLLen(req *Request) *Response {
+	entry, l, err := lookupTyped[*listValue](w, req.Key)
+	if err != nil || entry == nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas, Count: l.len()}
+}
+
+// LPush pushes the values one by one to the front of the list at key, so
+// the last value becomes the first element, and returns the length of the
+// list. A missing list is created with the ttl (the default TTL if 0).
+func (sc *ShardedCache) LPush(key string, ttl time.Duration, values ...[]byte) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpLPush, Key: key, TTL: ttl, Elements: values})
+	return resp.Count, resp.Err
+}
+
+// RPush appends the values to the list at key, like LPush.
+func (sc *ShardedCache) RPush(key string, ttl time.Duration, values ...[]byte) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpRPush, Key: key, TTL: ttl, Elements: values})
+	return resp.Count, resp.Err
+}
+
+// LPop removes and returns the first element of the list at key, or
+// ErrKeyNotFound. A list without elements is removed.
+func (sc *ShardedCache) LPop(key string) ([]byte, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpLPop, Key: key})
+	return resp.Value, resp.Err
+}
+
+// RPop removes and returns the last element of the list at key, like LPop.
+func (sc *ShardedCache) RPop(key string) ([]byte, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpRPop, Key: key})
+	return resp.Value, resp.Err
+}
+
+// BLPop is LPop, but waits up to timeout for an element to be pushed if the
+// list is empty. Waiting pops are parked in the worker and served in order
+// by the next pushes; their timeout is checked every 100ms. ErrKeyNotFound
+// is returned when the timeout passes, or when done (which may be nil) is
+// closed while waiting. An element popped just before done was closed is
+// still returned, it is up to the caller to push it back. Like in Redis, a
+// timeout of 0 waits until an element is pushed or done is closed; a
+// negative timeout doesn't wait.
+func (sc *ShardedCache) BLPop(key string, timeout time.Duration, done <-chan struct{}) ([]byte, error) {
+	return sc.blockingPop(&Request{Op: OpBLPop, Key: key, TTL: timeout}, done)
+}
+
+// BRPop is RPop, but waits up to timeout like BLPop.
+func (sc *ShardedCache) BRPop(key string, timeout time.Duration, done <-chan struct{}) ([]byte, error) {
+	return sc.blockingPop(&Request{Op: OpBRPop, Key: key, TTL: timeout}, done)
+}
+
+// blockingPop sends a blocking pop, and cancels it when done is closed
+// before it is answered.
+func (sc *ShardedCache) blockingPop(req *Request, done <-chan struct{}) ([]byte, error) {
+	if done == nil {
+		resp := sc.sendRequest(sc.workerFor(req.Key), req)
+		return resp.Value, resp.Err
+	}
+	i := sc.workerFor(req.Key)
+	respChan := respChanPool.Get().(chan *Response)
+	req.RespChan = respChan
+	req.Sent = time.Now()
+	req.Client = sc.client
+	sc.workers[i].RequestChan() <- req
+	var resp *Response
+	select {
+	case resp = <-respChan:
+	case <-done:
+		// The pop is answered either way, by the cancel if still parked
+		sc.sendRequest(i, &Request{Op: OpCancelPop, Key: req.Key, Waiter: req})
+		resp = <-respChan
+	}
+	respChanPool.Put(respChan)
+	return resp.Value, resp.Err
+}
+
+// LRange returns the elements of the list at key from start to stop
+// (inclusive), which count from the end when negative (-1 is the last
+// element).
+func (sc *ShardedCache) LRange(key string, start, stop int) ([][]byte, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpLRange, Key: key, Start: start, Stop: stop})
+	return resp.Values, resp.Err
+}
+
+// LTrim keeps the elements of the list at key from start to stop, counted
+// like LRange, e.g. LTrim(key, 0, 99) caps a list at 100 elements.
+func (sc *ShardedCache) LTrim(key string, start, stop int) error {
+	return sc.sendRequest(sc.workerFor(key), &Request{Op: OpLTrim, Key: key, Start: start, Stop: stop}).Err
+}
+
+// LLen returns the length of the list at key, 0 if it doesn't exist.
+func (sc *ShardedCache) LLen(key string) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpLLen, Key: key})
+	return resp.Count, resp.Err
+}
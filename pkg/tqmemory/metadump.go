@@ -0,0 +1,61 @@
+package tqmemory
+
+import "time"
+
+// ItemMeta describes a stored item without its value.
+type ItemMeta struct {
+	Key        string
+	SoftExpiry time.Time // Becomes stale (the TTL), zero if it doesn't expire
+	HardExpiry time.Time // Is removed, zero if it doesn't expire
+	LastAccess time.Time // Last read or write, with a 100ms resolution
+	Size       int       // Key plus value size
+	Cas        uint64
+	Fetched    bool // Read since it was stored
+	Class      int  // Size class, numbered from 1 like "stats items"
+	Shard      int  // Worker that owns the key
+}
+
+// itemMeta returns the metadata of an entry.
+func (w *Worker) itemMeta(entry *IndexEntry) ItemMeta {
+	meta := ItemMeta{
+		Key:        entry.Key,
+		LastAccess: time.Unix(entry.LastAccess, 0),
+		Size:       int(entrySize(entry)),
+		Cas:        entry.Cas,
+		Fetched:    entry.Fetched,
+		Class:      sizeClass(entrySize(entry)) + 1,
+		Shard:      w.shard,
+	}
+	if entry.SoftExpiry > 0 {
+		meta.SoftExpiry = time.UnixMilli(entry.SoftExpiry)
+	}
+	if entry.HardExpiry > 0 {
+		meta.HardExpiry = time.UnixMilli(entry.HardExpiry)
+	}
+	return meta
+}
+
+// Metadump calls fn with the metadata of every item of a shard (all shards
+// if shard < 0) until fn returns false. The shards are walked in batches,
+// so other requests are served in between: items stored during the dump
+// may be missed and items moved by a delete may be reported twice.
+func (sc *ShardedCache) Metadump(shard int, fn func(ItemMeta) bool) {
+	first, last := 0, len(sc.workers)-1
+	if shard >= 0 {
+		first, last = shard, min(shard, last)
+	}
+	for i := first; i <= last; i++ {
+		cursor := 0
+		for {
+			resp := sc.sendRequest(i, &Request{Op: OpScan, Cursor: cursor, Count: scanBatch})
+			for _, meta := range resp.Scanned {
+				if !fn(meta) {
+					return
+				}
+			}
+			if cursor = resp.Cursor; cursor == 0 {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package tqmemory
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// namespaceSweepBatch is the number of entries a worker checks per
+// maintenance tick while invalidated entries remain.
+const namespaceSweepBatch = 10000
+
+// maxNamespaceGenerations bounds the namespaces whose generation is kept.
+// Namespaces are chosen by the clients, so without a bound every name ever
+// invalidated would be kept for the lifetime of the process.
+const maxNamespaceGenerations = 1 << 16
+
+// Namespaces: a namespace is a key prefix that ends at the namespace delimiter,
+// "tenant:42" holds the keys that start with "tenant:42:". Invalidating a
+// namespace bumps its generation and records each worker's CAS counter, every
+// entry of the namespace with a lower or equal CAS is treated as missing.
+// Such entries are removed when they are accessed, and by a sweep over the
+// index in the maintenance ticks. Once a sweep that started after the
+// invalidation completes, the namespace no longer needs to be checked.
+// The generations are counted once for all workers, and only for the most
+// recently invalidated namespaces: the generation of a namespace that
+// dropped out restarts at 0.
+
+// namespaceGenerations counts the invalidations of the most recently
+// invalidated namespaces, least recently invalidated first.
+type namespaceGenerations struct {
+	mu    sync.Mutex
+	byNs  map[string]*list.Element
+	order list.List // of *namespaceGeneration
+}
+
+type namespaceGeneration struct {
+	ns  string
+	gen uint64
+}
+
+func newNamespaceGenerations() *namespaceGenerations {
+	return &namespaceGenerations{byNs: make(map[string]*list.Element)}
+}
+
+// bump increments and returns the generation of ns, dropping the least
+// recently invalidated namespace when the table is full.
+func (g *namespaceGenerations) bump(ns string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e, ok := g.byNs[ns]; ok {
+		g.order.MoveToBack(e)
+		e.Value.(*namespaceGeneration).gen++
+		return e.Value.(*namespaceGeneration).gen
+	}
+	if g.order.Len() >= maxNamespaceGenerations {
+		oldest := g.order.Remove(g.order.Front()).(*namespaceGeneration)
+		delete(g.byNs, oldest.ns)
+	}
+	ns = strings.Clone(ns)
+	g.byNs[ns] = g.order.PushBack(&namespaceGeneration{ns: ns, gen: 1})
+	return 1
+}
+
+// get returns the generation of ns, 0 if it was not invalidated or dropped
+// out.
+func (g *namespaceGenerations) get(ns string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e, ok := g.byNs[ns]; ok {
+		return e.Value.(*namespaceGeneration).gen
+	}
+	return 0
+}
+
+// invalidated reports whether an entry belongs to a namespace that was
+// invalidated after the entry was stored.
+func (w *Worker) invalidated(entry *IndexEntry) bool {
+	key := entry.Key
+	for i := 0; i < len(key); i++ {
+		if key[i] != w.namespaceDelimiter {
+			continue
+		}
+		if cas, ok := w.pendingNamespaces[key[:i]]; ok && entry.Cas <= cas {
+			return true
+		}
+	}
+	return false
+}
+
+// reclaim removes the entry of key if it belongs to an invalidated
+// namespace, so the request sees it as missing.
+func (w *Worker) reclaim(key string) {
+	if entry, ok := w.index.Get(key); ok && w.invalidated(entry) {
+		w.index.Delete(key)
+		w.itemRemoved(entrySize(entry))
+		w.notifyRemoved(entry, RemovedInvalidated)
+		w.stats.NamespaceReclaimed++
+	}
+}
+
+// handleInvalidateNamespace invalidates the namespace in req.Key.
+func (w *Worker) handleInvalidateNamespace(req *Request) *Response {
+	w.pendingNamespaces[strings.Clone(req.Key)] = w.casCounter
+	// Entries stored from now on have a higher CAS
+	w.casCounter++
+
+	if !w.sweeping {
+		w.sweepCursor, w.sweepCas, w.sweeping = 0, w.casCounter, true
+	}
+	return &Response{}
+}
+
+// sweepNamespaces removes the next batch of invalidated entries.
+func (w *Worker) sweepNamespaces() {
+	var stale []*IndexEntry
+	w.sweepCursor = w.index.Scan(w.sweepCursor, namespaceSweepBatch, func(entry *IndexEntry) {
+		if w.invalidated(entry) {
+			stale = append(stale, entry)
+		}
+	})
+	for _, entry := range stale {
+		w.index.Delete(entry.Key)
+		w.itemRemoved(entrySize(entry))
+		w.notifyRemoved(entry, RemovedInvalidated)
+		w.stats.NamespaceReclaimed++
+	}
+	if w.sweepCursor > 0 {
+		return
+	}
+
+	// All entries of the namespaces invalidated before the sweep started
+	// are gone, sweep again for the ones invalidated since
+	for ns, cas := range w.pendingNamespaces {
+		if cas < w.sweepCas {
+			delete(w.pendingNamespaces, ns)
+		}
+	}
+	w.sweeping = len(w.pendingNamespaces) > 0
+	w.sweepCas = w.casCounter
+}
+
+// InvalidateNamespace invalidates all keys in namespace ns (the keys that
+// start with ns followed by the namespace delimiter) in O(1) per worker,
+// and returns the new generation of the namespace. The memory of the keys
+// is reclaimed lazily.
+func (sc *ShardedCache) InvalidateNamespace(ns string) uint64 {
+	gen := sc.generations.bump(ns)
+	for i := range sc.workers {
+		sc.sendRequest(i, &Request{Op: OpInvalidateNamespace, Key: ns})
+	}
+	return gen
+}
+
+// NamespaceGeneration returns the number of times namespace ns was
+// invalidated, 0 once it dropped out of the most recently invalidated
+// namespaces.
+func (sc *ShardedCache) NamespaceGeneration(ns string) uint64 {
+	return sc.generations.get(ns)
+}
@@ -0,0 +1,100 @@
+package tqmemory
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// Message is a message published on a channel.
+type Message struct {
+	ID      uint64 // Increasing message number, shared by all subscribers
+	Channel string
+	Data    []byte
+}
+
+// Subscriber receives the messages of its channels and of the channels that
+// match its patterns, once per message. A subscriber that doesn't keep up
+// loses messages instead of slowing down the publishers: when the buffer is
+// full, messages are dropped and counted.
+type Subscriber struct {
+	subscription[Message]
+}
+
+// Pattern returns the pattern a message of channel was delivered for, ""
+// if the subscriber subscribed to the channel itself.
+func (s *Subscriber) Pattern(channel string) string {
+	for _, k := range s.keys {
+		if k == channel {
+			return ""
+		}
+	}
+	for _, pattern := range s.match {
+		if matchGlob(pattern, channel) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// PubSub routes published messages to the subscribers of their channel.
+// Channels are independent of the keys of the cache. The zero value is
+// ready to use.
+type PubSub struct {
+	hub       hub[Message]
+	published atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// Subscribe returns a subscriber to the channels and to the channels that
+// match the glob patterns (see Scan). Up to buffer messages wait for the
+// subscriber before messages are dropped. Close the subscriber when done.
+func (p *PubSub) Subscribe(channels, patterns []string, buffer int) *Subscriber {
+	s := &Subscriber{}
+	p.hub.subscribe(&s.subscription, 1, buffer, channels, patterns)
+	return s
+}
+
+// Publish delivers a copy of data to the subscribers of channel, and
+// returns the number of subscribers it was delivered to.
+func (p *PubSub) Publish(channel string, data []byte) int {
+	p.published.Add(1)
+	delivered, dropped := p.hub.publish(1, channel, false, func(id uint64) Message {
+		return Message{ID: id, Channel: channel, Data: bytes.Clone(data)}
+	})
+	p.delivered.Add(uint64(delivered))
+	p.dropped.Add(uint64(dropped))
+	return delivered
+}
+
+// Counts returns the number of channels and patterns with subscribers.
+func (p *PubSub) Counts() (channels, patterns int) {
+	subs := p.hub.subs.Load()
+	if subs == nil {
+		return 0, 0
+	}
+	names := make(map[string]struct{})
+	globs := make(map[string]struct{})
+	for _, s := range *subs {
+		for _, k := range s.keys {
+			names[k] = struct{}{}
+		}
+		for _, pattern := range s.match {
+			globs[pattern] = struct{}{}
+		}
+	}
+	return len(names), len(globs)
+}
+
+// Stats returns the number of messages published, and of messages
+// delivered to and dropped for subscribers.
+func (p *PubSub) Stats() (published, delivered, dropped uint64) {
+	return p.published.Load(), p.delivered.Load(), p.dropped.Load()
+}
+
+// ResetStats sets the counters of Stats to zero.
+func (p *PubSub) ResetStats() {
+	p.published.Store(0)
+	p.delivered.Store(0)
+	p.dropped.Store(0)
+}
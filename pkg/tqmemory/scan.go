@@ -0,0 +1,194 @@
+package tqmemory
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// scanBatch is the number of entries a worker walks per request when
+	// walking the whole cache, so other requests are served in between.
+	scanBatch = 1000
+	// DefaultScanCount is the number of entries Scan walks if count <= 0.
+	DefaultScanCount = 10
+)
+
+// handleScan returns the items of the next batch of entries that match the
+// pattern, skipping entries that are expired but not yet removed.
+func (w *Worker) handleScan(req *Request) *Response {
+	now := time.Now().UnixMilli()
+	resp := &Response{}
+	resp.Cursor = w.index.Scan(req.Cursor, req.Count, func(entry *IndexEntry) {
+		if entry.HardExpiry > 0 && entry.HardExpiry <= now {
+			return
+		}
+		if req.Pattern != "" && !matchGlob(req.Pattern, entry.Key) {
+			return
+		}
+		if len(w.pendingNamespaces) > 0 && w.invalidated(entry) {
+			return
+		}
+		resp.Scanned = append(resp.Scanned, w.itemMeta(entry))
+		if req.Values {
+			resp.Values = append(resp.Values, entryValue(entry))
+		}
+	})
+	return resp
+}
+
+// Scan returns the keys matching the glob pattern match ("" matches all)
+// among the next count entries (DefaultScanCount if count <= 0), and the
+// cursor to continue with. Start with cursor 0, the scan is complete when
+// the returned cursor is 0. Like Redis' SCAN, a batch may hold fewer keys
+// than count, or none, before the scan is complete.
+//
+// Each call walks a single batch of a single worker, so concurrent requests
+// are not held up. Keys that exist during the whole scan are returned at
+// least once, keys stored or deleted during the scan may or may not be,
+// and a key may be returned twice.
+func (sc *ShardedCache) Scan(cursor uint64, match string, count int) ([]string, uint64) {
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+	// The cursor holds the worker and the position within it
+	n := uint64(len(sc.workers))
+	shard, pos := int(cursor%n), int(cursor/n)
+
+	resp := sc.sendRequest(shard, &Request{Op: OpScan, Cursor: pos, Count: count, Pattern: match})
+	keys := make([]string, len(resp.Scanned))
+	for i := range resp.Scanned {
+		keys[i] = resp.Scanned[i].Key
+	}
+
+	if resp.Cursor > 0 {
+		return keys, uint64(resp.Cursor)*n + uint64(shard)
+	}
+	if shard+1 < len(sc.workers) {
+		// Start the next worker at position 0
+		return keys, uint64(shard + 1)
+	}
+	return keys, 0
+}
+
+// Range calls fn for every item in the cache until fn returns false. The
+// value must not be modified. The workers are walked in batches, so
+// concurrent mutations are served in between, with the same guarantees as
+// Scan.
+func (sc *ShardedCache) Range(fn func(key string, value []byte, meta ItemMeta) bool) {
+	for i := range sc.workers {
+		cursor := 0
+		for {
+			resp := sc.sendRequest(i, &Request{Op: OpScan, Cursor: cursor, Count: scanBatch, Values: true})
+			for j, meta := range resp.Scanned {
+				if !fn(meta.Key, resp.Values[j], meta) {
+					return
+				}
+			}
+			if cursor = resp.Cursor; cursor == 0 {
+				break
+			}
+		}
+	}
+}
+
+// matchGlob reports whether s matches the glob pattern, which supports
+// '*', '?', character classes such as "[a-z]" or "[^0-9]" and '\' to
+// escape, like Redis' KEYS and SCAN. Patterns without special characters
+// other than a trailing '*' are matched as a prefix.
+func matchGlob(pattern, s string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, `*?[\`) {
+		return strings.HasPrefix(s, prefix)
+	}
+
+	// Backtrack to the last '*' on a mismatch
+	starP, starS := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				starP, starS = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if end, ok := matchClass(pattern[p:], s[i]); end > 0 {
+					if ok {
+						p += end
+						i++
+						continue
+					}
+					break
+				}
+				if s[i] == '[' {
+					p++
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if c == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starS++
+		p, i = starP+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches b against the character class at the start of
+// pattern. It returns the length of the class, or 0 if it is not closed.
+func matchClass(pattern string, b byte) (int, bool) {
+	i := 1
+	negate := i < len(pattern) && (pattern[i] == '^' || pattern[i] == '!')
+	if negate {
+		i++
+	}
+	matched := false
+	for first := true; i < len(pattern); first = false {
+		c := pattern[i]
+		if c == ']' && !first {
+			return i + 1, matched != negate
+		}
+		if c == '\\' && i+1 < len(pattern) {
+			i++
+			c = pattern[i]
+		}
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			if c <= b && b <= pattern[i+2] {
+				matched = true
+			}
+			i += 3
+			continue
+		}
+		if c == b {
+			matched = true
+		}
+		i++
+	}
+	return 0, false
+}
+
+// MatchGlob reports whether s matches the glob pattern, with the syntax of
+// the Scan patterns.
+func MatchGlob(pattern, s string) bool {
+	return matchGlob(pattern, s)
+}
@@ -0,0 +1,184 @@
+package tqmemory
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// setValue is a set of members.
+type setValue struct {
+	members map[string]struct{}
+	bytes   int64
+}
+
+func newSet() *setValue {
+	return &setValue{members: make(map[string]struct{})}
+}
+
+func (s *setValue) size() int64 {
+	return s.bytes
+}
+
+// appendTo serializes the set as the netstrings of its sorted members.
+func (s *setValue) appendTo(buf []byte) []byte {
+	for _, member := range s.sorted() {
+		buf = appendNetstring(buf, []byte(member))
+	}
+	return buf
+}
+
+func (s *setValue) sorted() []string {
+	members := make([]string, 0, len(s.members))
+	for member := range s.members {
+		members = append(members, member)
+	}
+	slices.Sort(members)
+	return members
+}
+
+// handleSAdd adds the members in req.Fields, creating the set with req.TTL
+// if needed, and returns the number of new members in Count.
+func (w *Worker) handleSAdd(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, s, err := lookupTyped[*setValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	if len(req.Fields) == 0 {
+		return &Response{}
+	}
+	var growth int64
+	if entry == nil {
+		growth = int64(len(req.Key))
+	}
+	for _, member := range req.Fields {
+		if !s.has(member) {
+			growth += int64(len(member))
+		}
+	}
+
+	var added int
+	entry, err = updateTyped(w, entry, req.Key, req.TTL, growth, newSet, func(s *setValue) {
+		for _, member := range req.Fields {
+			if !s.has(member) {
+				// The member may alias a connection's read buffer
+				s.members[strings.Clone(member)] = struct{}{}
+				s.bytes += int64(len(member))
+				added++
+			}
+		}
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas, Count: added}
+}
+
+// has reports whether member is in the set, which may be nil.
+func (s *setValue) has(member string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.members[member]
+	return ok
+}
+
+// handleSRem removes the members in req.Fields and returns the number of
+// removed members in Count. The item is removed with its last member.
+func (w *Worker) handleSRem(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, _, err := lookupTyped[*setValue](w, req.Key)
+	if err != nil || entry == nil {
+		return &Response{Err: err}
+	}
+	var removed int
+	var empty bool
+	entry, err = updateTyped(w, entry, req.Key, 0, 0, newSet, func(s *setValue) {
+		for _, member := range req.Fields {
+			if s.has(member) {
+				delete(s.members, member)
+				s.bytes -= int64(len(member))
+				removed++
+			}
+		}
+		empty = len(s.members) == 0
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	if empty {
+		w.removeTyped(entry)
+	}
+	return &Response{Cas: entry.Cas, Count: removed}
+}
+
+// handleSIsMember returns 1 in Count if req.Fields[0] is a member.
+func (w *Worker) handleSIsMember(req *Request) *Response {
+	entry, s, err := lookupTyped[*setValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil || !s.has(req.Fields[0]) {
+		return &Response{}
+	}
+	return &Response{Cas: entry.Cas, Count: 1}
+}
+
+// handleSMembers returns the sorted members in Fields.
+func (w *Worker) handleSMembers(req *Request) *Response {
+	entry, s, err := lookupTyped[*setValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	return &Response{Cas: entry.Cas, Fields: s.sorted()}
+}
+
+// handleSCard returns the number of members in Count.
+func (w *Worker) handleSCard(req *Request) *Response {
+	entry, s, err := lookupTyped[*setValue](w, req.Key)
+	if err != nil || entry == nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas, Count: len(s.members)}
+}
+
+// SAdd adds members to the set at key and returns the number of members
+// that were added. A missing set is created with the ttl (the default TTL
+// if 0).
+func (sc *ShardedCache) SAdd(key string, ttl time.Duration, members ...string) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpSAdd, Key: key, TTL: ttl, Fields: members})
+	return resp.Count, resp.Err
+}
+
+// SRem removes members from the set at key and returns the number of
+// members that were removed. A set without members is removed.
+func (sc *ShardedCache) SRem(key string, members ...string) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpSRem, Key: key, Fields: members})
+	return resp.Count, resp.Err
+}
+
+// SIsMember reports whether member is in the set at key.
+func (sc *ShardedCache) SIsMember(key, member string) (bool, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpSIsMember, Key: key, Fields: []string{member}})
+	return resp.Count == 1, resp.Err
+}
+
+// SMembers returns the members of the set at key in sorted order, or
+// ErrKeyNotFound.
+func (sc *ShardedCache) SMembers(key string) ([]string, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpSMembers, Key: key})
+	return resp.Fields, resp.Err
+}
+
+// SCard returns the number of members of the set at key, 0 if it doesn't
+// exist.
+func (sc *ShardedCache) SCard(key string) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpSCard, Key: key})
+	return resp.Count, resp.Err
+}
@@ -1,9 +1,10 @@
 package tqmemory
 
 import (
-	"fmt"
 	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,13 +13,27 @@ var respChanPool = sync.Pool{
 	New: func() any { return make(chan *Response, 1) },
 }
 
+// getRequestPool and getResponsePool pool the request and response of a
+// single key get, so a get hit doesn't allocate.
+var (
+	getRequestPool  = sync.Pool{New: func() any { return new(Request) }}
+	getResponsePool = sync.Pool{New: func() any { return new(Response) }}
+)
+
 // ShardedCache wraps multiple Worker instances for concurrent access.
 // Keys are distributed across workers using FNV-1a hash.
 // Each worker is operated by a dedicated goroutine, eliminating lock contention.
 type ShardedCache struct {
-	workers   []*Worker
-	config    Config
-	StartTime time.Time
+	workers     []*Worker
+	config      Config
+	detail      *atomic.Bool // per-prefix stats are collected
+	slowLog     *slowLog     // nil when disabled
+	watch       *watchHub
+	hooks       *hookQueue // nil without removal callbacks
+	keyspace    *keyspaceHub
+	generations *namespaceGenerations
+	client      string // client address of the requests, see WithClient
+	StartTime   time.Time
 }
 
 // NewSharded creates a new sharded cache with the specified number of workers.
@@ -39,9 +54,18 @@ func NewSharded(cfg Config, workerCount int) (*ShardedCache, error) {
 	runtime.GOMAXPROCS(gomaxprocs)
 
 	sc := &ShardedCache{
-		workers:   make([]*Worker, workerCount),
-		config:    cfg,
-		StartTime: time.Now(),
+		workers:     make([]*Worker, workerCount),
+		config:      cfg,
+		detail:      new(atomic.Bool),
+		watch:       &watchHub{},
+		hooks:       newHookQueue(cfg),
+		keyspace:    &keyspaceHub{},
+		generations: newNamespaceGenerations(),
+		StartTime:   time.Now(),
+	}
+	sc.detail.Store(cfg.DetailEnabled)
+	if cfg.SlowLogLen > 0 {
+		sc.slowLog = newSlowLog(cfg.SlowLogThreshold, cfg.SlowLogLen)
 	}
 
 	// Divide max memory evenly among workers
@@ -50,6 +74,24 @@ func NewSharded(cfg Config, workerCount int) (*ShardedCache, error) {
 	// Create a worker for each shard
 	for i := 0; i < workerCount; i++ {
 		worker := NewWorker(cfg.DefaultTTL, cfg.ChannelCapacity, maxMemoryPerWorker, cfg.StaleMultiplier)
+		// Zero keeps the ':' defaults of NewWorker
+		if cfg.PrefixDelimiter != 0 {
+			worker.prefixDelimiter = cfg.PrefixDelimiter
+		}
+		if cfg.NamespaceDelimiter != 0 {
+			worker.namespaceDelimiter = cfg.NamespaceDelimiter
+		}
+		worker.maxValueSize = cfg.MaxValueSize
+		worker.detail = cfg.DetailEnabled
+		worker.shard = i
+		worker.slowLog = sc.slowLog
+		worker.watch = sc.watch
+		worker.hooks = sc.hooks
+		worker.keyspace = sc.keyspace
+		if cfg.HotKeys > 0 {
+			worker.hotReads = newHotKeyTracker("read", cfg.HotKeys, cfg.HotKeyLogShare)
+			worker.hotWrites = newHotKeyTracker("write", cfg.HotKeys, cfg.HotKeyLogShare)
+		}
 		worker.Start()
 		sc.workers[i] = worker
 	}
@@ -81,27 +123,120 @@ func (sc *ShardedCache) Close() error {
 			err = e
 		}
 	}
+	if sc.hooks != nil {
+		sc.hooks.close()
+	}
 	return err
 }
 
+// WithClient returns a view of the cache that shares its workers, but
+// records addr as the client of its requests in the slow log.
+func (sc *ShardedCache) WithClient(addr string) CacheInterface {
+	view := *sc
+	view.client = addr
+	return &view
+}
+
 // sendRequest sends a request to the appropriate worker and waits for response.
 func (sc *ShardedCache) sendRequest(workerIdx int, req *Request) *Response {
 	respChan := respChanPool.Get().(chan *Response)
 	req.RespChan = respChan
+	req.Sent = time.Now()
+	req.Client = sc.client
 	sc.workers[workerIdx].RequestChan() <- req
 	resp := <-respChan
 	respChanPool.Put(respChan)
 	return resp
 }
 
+// Submit sends req to the worker of its key without waiting for the
+// response: the worker passes it to req.Done, which must be set. Done runs
+// on the worker, so it must not block. A worker with a full queue gets the
+// request from another goroutine, so Submit never blocks either.
+func (sc *ShardedCache) Submit(req *Request) {
+	req.Sent = time.Now()
+	req.Client = sc.client
+	reqChan := sc.workers[sc.workerFor(req.Key)].RequestChan()
+	select {
+	case reqChan <- req:
+	default:
+		go func() { reqChan <- req }()
+	}
+}
+
 // Get retrieves a value from the cache.
 // Returns flags: 0=fresh, 1=stale, 3=refresh (once only).
 func (sc *ShardedCache) Get(key string) ([]byte, uint64, int, error) {
-	resp := sc.sendRequest(sc.workerFor(key), &Request{
-		Op:  OpGet,
-		Key: key,
-	})
-	return resp.Value, resp.Cas, resp.Flags, resp.Err
+	req := getRequestPool.Get().(*Request)
+	*req = Request{Op: OpGet, Key: key}
+	resp := sc.sendRequest(sc.workerFor(key), req)
+	value, cas, flags, err := resp.Value, resp.Cas, resp.Flags, resp.Err
+
+	// Both are answered, the worker is done with them
+	*req = Request{}
+	getRequestPool.Put(req)
+	*resp = Response{}
+	getResponsePool.Put(resp)
+	return value, cas, flags, err
+}
+
+// GetMulti retrieves multiple keys, returning the results in key order.
+// The keys are grouped per worker and all workers are queried at once, so
+// the latency depends on the slowest worker and not on the number of keys.
+func (sc *ShardedCache) GetMulti(keys []string) []GetResult {
+	results := make([]GetResult, len(keys))
+	if len(keys) == 0 {
+		return results
+	}
+
+	// Order the keys by worker (counting sort), so each worker gets a
+	// contiguous slice of keys and results
+	owner := make([]int, len(keys))
+	start := make([]int, len(sc.workers)+1)
+	for i, key := range keys {
+		owner[i] = sc.workerFor(key)
+		start[owner[i]+1]++
+	}
+	for w := range sc.workers {
+		start[w+1] += start[w]
+	}
+	order := make([]int, len(keys))
+	sorted := make([]string, len(keys))
+	next := append([]int(nil), start[:len(sc.workers)]...)
+	for i, w := range owner {
+		order[next[w]] = i
+		sorted[next[w]] = keys[i]
+		next[w]++
+	}
+
+	// Dispatch to all involved workers before waiting for any of them
+	batch := make([]GetResult, len(keys))
+	respChans := make([]chan *Response, len(sc.workers))
+	for w := range sc.workers {
+		if start[w] == start[w+1] {
+			continue
+		}
+		respChans[w] = respChanPool.Get().(chan *Response)
+		sc.workers[w].RequestChan() <- &Request{
+			Op:       OpGetMulti,
+			Keys:     sorted[start[w]:start[w+1]],
+			Results:  batch[start[w]:start[w+1]],
+			RespChan: respChans[w],
+			Sent:     time.Now(),
+			Client:   sc.client,
+		}
+	}
+	for _, respChan := range respChans {
+		if respChan != nil {
+			<-respChan
+			respChanPool.Put(respChan)
+		}
+	}
+
+	for j, i := range order {
+		results[i] = batch[j]
+	}
+	return results
 }
 
 // Set stores a value in the cache.
@@ -175,14 +310,7 @@ func (sc *ShardedCache) Increment(key string, delta uint64) (uint64, uint64, err
 		Key:   key,
 		Delta: delta,
 	})
-	// Parse value as uint64
-	var val uint64
-	for _, b := range resp.Value {
-		if b >= '0' && b <= '9' {
-			val = val*10 + uint64(b-'0')
-		}
-	}
-	return val, resp.Cas, resp.Err
+	return counterValue(resp.Value), resp.Cas, resp.Err
 }
 
 // Decrement decrements a numeric value.
@@ -192,14 +320,44 @@ func (sc *ShardedCache) Decrement(key string, delta uint64) (uint64, uint64, err
 		Key:   key,
 		Delta: delta,
 	})
-	// Parse value as uint64
+	return counterValue(resp.Value), resp.Cas, resp.Err
+}
+
+// IncrementOrCreate increments a numeric value, or stores initial with the
+// given TTL if the key doesn't exist. Returns the new value and CAS.
+func (sc *ShardedCache) IncrementOrCreate(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{
+		Op:      OpIncrOrCreate,
+		Key:     key,
+		Delta:   delta,
+		Initial: initial,
+		TTL:     ttl,
+	})
+	return counterValue(resp.Value), resp.Cas, resp.Err
+}
+
+// DecrementOrCreate decrements a numeric value, or stores initial with the
+// given TTL if the key doesn't exist. Returns the new value and CAS.
+func (sc *ShardedCache) DecrementOrCreate(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{
+		Op:      OpDecrOrCreate,
+		Key:     key,
+		Delta:   delta,
+		Initial: initial,
+		TTL:     ttl,
+	})
+	return counterValue(resp.Value), resp.Cas, resp.Err
+}
+
+// counterValue parses the decimal counter value returned by the worker.
+func counterValue(value []byte) uint64 {
 	var val uint64
-	for _, b := range resp.Value {
+	for _, b := range value {
 		if b >= '0' && b <= '9' {
 			val = val*10 + uint64(b-'0')
 		}
 	}
-	return val, resp.Cas, resp.Err
+	return val
 }
 
 // Append appends data to an existing value.
@@ -229,19 +387,167 @@ func (sc *ShardedCache) FlushAll() {
 	}
 }
 
-// Stats returns cache statistics.
-func (sc *ShardedCache) Stats() map[string]string {
-	totalItems := 0
+// WorkerStats returns a snapshot of the counters of each worker.
+// The counters are read by the workers themselves, so this is race-free.
+func (sc *ShardedCache) WorkerStats() []Stats {
+	stats := make([]Stats, len(sc.workers))
+	for i := range sc.workers {
+		stats[i] = *sc.sendRequest(i, &Request{Op: OpStats}).Stats
+	}
+	return stats
+}
 
-	for _, worker := range sc.workers {
-		totalItems += worker.Index().Count()
+// Stats returns cache statistics aggregated over all workers, by their
+// memcached stats name.
+func (sc *ShardedCache) Stats() map[string]string {
+	var total Stats
+	for _, s := range sc.WorkerStats() {
+		total.Add(&s)
 	}
 
-	stats := make(map[string]string)
-	stats["curr_items"] = fmt.Sprintf("%d", totalItems)
+	stats := total.toMap()
+	stats["threads"] = strconv.Itoa(len(sc.workers))
+	if sc.hooks != nil {
+		stats["hook_dropped"] = strconv.FormatUint(sc.hooks.dropped.Load(), 10)
+	}
 	return stats
 }
 
+// QueueDepths returns the number of requests waiting in each worker's
+// request channel.
+func (sc *ShardedCache) QueueDepths() []int {
+	depths := make([]int, len(sc.workers))
+	for i, w := range sc.workers {
+		depths[i] = len(w.reqChan)
+	}
+	return depths
+}
+
+// Latency returns the queue and execution latency histograms of each
+// operation type that was executed, merged over all workers. The
+// histograms are read without involving the workers.
+func (sc *ShardedCache) Latency() []OpLatency {
+	var latency []OpLatency
+	for op := range numOps {
+		l := OpLatency{Op: op.String()}
+		for _, w := range sc.workers {
+			l.Queue.Merge(&w.queueLatency[op])
+			l.Exec.Merge(&w.execLatency[op])
+		}
+		if l.Exec.Count() > 0 {
+			latency = append(latency, l)
+		}
+	}
+	return latency
+}
+
+// HotKeys returns the most read and most written keys over all workers,
+// at most Config.HotKeys of each, ordered by their estimated count.
+func (sc *ShardedCache) HotKeys() HotKeys {
+	var hot HotKeys
+	for i := range sc.workers {
+		resp := sc.sendRequest(i, &Request{Op: OpHotKeys})
+		hot.Reads = append(hot.Reads, resp.HotKeys.Reads...)
+		hot.Writes = append(hot.Writes, resp.HotKeys.Writes...)
+	}
+	sortHotKeys(hot.Reads)
+	sortHotKeys(hot.Writes)
+	hot.Reads = hot.Reads[:min(len(hot.Reads), sc.config.HotKeys)]
+	hot.Writes = hot.Writes[:min(len(hot.Writes), sc.config.HotKeys)]
+	return hot
+}
+
+// Watch returns a watcher for the events of the given kinds. Up to buffer
+// events are queued for it (DefaultWatchBuffer if buffer <= 0), further
+// events are dropped until it catches up. Close the watcher when done.
+func (sc *ShardedCache) Watch(kinds WatchKind, buffer int) *Watcher {
+	if buffer <= 0 {
+		buffer = DefaultWatchBuffer
+	}
+	return sc.watch.add(kinds, buffer)
+}
+
+// SlowLog returns up to n slow log entries, newest first (all of them if
+// n < 0). It does not wait for the workers, so it also works while a
+// worker is stalled.
+func (sc *ShardedCache) SlowLog(n int) []SlowLogEntry {
+	if sc.slowLog == nil {
+		return nil
+	}
+	return sc.slowLog.get(n)
+}
+
+// SlowLogLen returns the number of entries in the slow log.
+func (sc *ShardedCache) SlowLogLen() int {
+	if sc.slowLog == nil {
+		return 0
+	}
+	return sc.slowLog.len()
+}
+
+// ResetSlowLog removes all entries from the slow log.
+func (sc *ShardedCache) ResetSlowLog() {
+	if sc.slowLog != nil {
+		sc.slowLog.reset()
+	}
+}
+
+// ItemStats returns the item size statistics summed over all workers.
+func (sc *ShardedCache) ItemStats() ItemStats {
+	total := newItemStats()
+	for i := range sc.workers {
+		total.add(sc.sendRequest(i, &Request{Op: OpItemStats}).Items)
+	}
+	return total
+}
+
+// ResetStats zeroes the counters of all workers.
+func (sc *ShardedCache) ResetStats() {
+	for i := range sc.workers {
+		sc.sendRequest(i, &Request{Op: OpResetStats})
+	}
+}
+
+// SetDetail turns the per-prefix counters on or off, like memcached's
+// "stats detail on|off". Counters collected so far are kept.
+func (sc *ShardedCache) SetDetail(on bool) {
+	for i := range sc.workers {
+		sc.sendRequest(i, &Request{Op: OpSetDetail, Enable: on})
+	}
+	sc.detail.Store(on)
+}
+
+// DetailEnabled reports whether the per-prefix counters are collected.
+func (sc *ShardedCache) DetailEnabled() bool {
+	return sc.detail.Load()
+}
+
+// PrefixStats returns the per-prefix counters merged over all workers.
+func (sc *ShardedCache) PrefixStats() map[string]PrefixStats {
+	total := make(map[string]PrefixStats)
+	for i := range sc.workers {
+		for prefix, ps := range sc.sendRequest(i, &Request{Op: OpPrefixStats}).Prefixes {
+			t := total[prefix]
+			t.Gets += ps.Gets
+			t.Hits += ps.Hits
+			t.Sets += ps.Sets
+			t.Deletes += ps.Deletes
+			total[prefix] = t
+		}
+	}
+	return total
+}
+
+// Config returns the configuration the cache was created with.
+func (sc *ShardedCache) Config() Config {
+	return sc.config
+}
+
+// WorkerCount returns the number of workers.
+func (sc *ShardedCache) WorkerCount() int {
+	return len(sc.workers)
+}
+
 // GetStartTime returns when the cache was started
 func (sc *ShardedCache) GetStartTime() time.Time {
 	return sc.StartTime
@@ -0,0 +1,121 @@
+package tqmemory
+
+import "sort"
+
+// Items are not stored in slabs, but their sizes are grouped into classes
+// like memcached's slab classes, so "stats items" and "stats slabs" report
+// a familiar layout.
+const (
+	SizeClassMin    = 96   // Chunk size of the smallest class (memcached -n 48 plus header)
+	SizeClassFactor = 1.25 // Chunk size growth factor between classes (memcached -f)
+	SizeBucket      = 32   // Granularity of the "stats sizes" histogram
+)
+
+// sizeClasses holds the chunk size of each class, class i+1 at index i.
+// The last class holds all items larger than half the max item size,
+// like memcached's largest slab class.
+var sizeClasses = func() []int64 {
+	var classes []int64
+	size := float64(SizeClassMin)
+	for int64(size) <= DefaultMaxValueSize/2 {
+		chunk := (int64(size) + 7) &^ 7 // 8-byte aligned
+		classes = append(classes, chunk)
+		size = float64(chunk) * SizeClassFactor
+	}
+	return append(classes, DefaultMaxValueSize)
+}()
+
+// sizeClass returns the index in sizeClasses of the class holding an item
+// of the given size.
+func sizeClass(size int64) int {
+	i := sort.Search(len(sizeClasses), func(i int) bool { return sizeClasses[i] >= size })
+	return min(i, len(sizeClasses)-1)
+}
+
+// ClassStats holds the counters of a single size class.
+type ClassStats struct {
+	ChunkSize        int64  // Largest item size in this class
+	Items            uint64 // Items currently stored
+	Bytes            int64  // Memory used by keys and values
+	Evicted          uint64 // Items evicted by the LRU
+	EvictedUnfetched uint64 // Evicted items that were never fetched
+	ExpiredUnfetched uint64 // Expired items that were never fetched
+}
+
+// ItemStats holds the item size statistics of a worker, or their sum over
+// all workers.
+type ItemStats struct {
+	Classes []ClassStats     // Class i+1 at index i, as numbered by memcached
+	Sizes   map[int64]uint64 // Item count by size, rounded up to SizeBucket
+}
+
+func newItemStats() ItemStats {
+	classes := make([]ClassStats, len(sizeClasses))
+	for i := range classes {
+		classes[i].ChunkSize = sizeClasses[i]
+	}
+	return ItemStats{Classes: classes, Sizes: make(map[int64]uint64)}
+}
+
+// add adds the counters of o to s.
+func (s *ItemStats) add(o *ItemStats) {
+	for i := range o.Classes {
+		c, oc := &s.Classes[i], &o.Classes[i]
+		c.Items += oc.Items
+		c.Bytes += oc.Bytes
+		c.Evicted += oc.Evicted
+		c.EvictedUnfetched += oc.EvictedUnfetched
+		c.ExpiredUnfetched += oc.ExpiredUnfetched
+	}
+	for size, n := range o.Sizes {
+		s.Sizes[size] += n
+	}
+}
+
+// clone returns a deep copy of s.
+func (s *ItemStats) clone() *ItemStats {
+	c := newItemStats()
+	c.add(s)
+	return &c
+}
+
+// class returns the counters of the class holding an item of the given size.
+func (s *ItemStats) class(size int64) *ClassStats {
+	return &s.Classes[sizeClass(size)]
+}
+
+// itemAdded accounts for a stored item of the given size.
+func (s *ItemStats) itemAdded(size int64) {
+	c := s.class(size)
+	c.Items++
+	c.Bytes += size
+	s.Sizes[(size+SizeBucket-1)/SizeBucket*SizeBucket]++
+}
+
+// itemRemoved accounts for an item of the given size that is gone.
+func (s *ItemStats) itemRemoved(size int64) {
+	c := s.class(size)
+	c.Items--
+	c.Bytes -= size
+	bucket := (size + SizeBucket - 1) / SizeBucket * SizeBucket
+	if s.Sizes[bucket]--; s.Sizes[bucket] == 0 {
+		delete(s.Sizes, bucket)
+	}
+}
+
+// resetCounters zeroes the event counters, but not the item counts.
+func (s *ItemStats) resetCounters() {
+	for i := range s.Classes {
+		c := &s.Classes[i]
+		c.Evicted, c.EvictedUnfetched, c.ExpiredUnfetched = 0, 0, 0
+	}
+}
+
+// entrySize returns the memory accounted for an entry: its key and value.
+func entrySize(entry *IndexEntry) int64 {
+	size := int64(len(entry.Key) + len(entry.Value))
+	if entry.Data != nil {
+		size += entry.Data.size()
+	}
+	return size
+}
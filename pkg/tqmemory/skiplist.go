@@ -0,0 +1,174 @@
+package tqmemory
+
+import "math/rand/v2"
+
+// skiplistMaxLevel bounds the levels of a node, enough for 2^64 members
+// with a 1/4 chance of each next level.
+const skiplistMaxLevel = 32
+
+// skiplist keeps the members of a sorted set in score order, like the
+// zskiplist of Redis. Each link counts the nodes it spans, so looking up a
+// rank takes O(log n) like looking up a member, and so do inserts and
+// removals.
+type skiplist struct {
+	head   skipNode  // Sentinel before the first node, with all levels
+	tail   *skipNode // Last node, nil if empty
+	length int
+	level  int // Levels in use, at least 1
+}
+
+type skipNode struct {
+	ZMember
+	prev  *skipNode // Previous node, nil for the first node
+	links []skipLink
+}
+
+// skipLink is the link of a node to the next node of its level.
+type skipLink struct {
+	next *skipNode
+	span int // Nodes from the node to next, counting next
+}
+
+func newSkiplist() *skiplist {
+	l := &skiplist{level: 1}
+	l.head.links = make([]skipLink, skiplistMaxLevel)
+	return l
+}
+
+// randomLevel returns the levels of a new node.
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Uint32()&3 == 0 {
+		level++
+	}
+	return level
+}
+
+// first returns the first node, or nil if the list is empty.
+func (l *skiplist) first() *skipNode {
+	return l.head.links[0].next
+}
+
+// insert adds m, which must not be in the list.
+func (l *skiplist) insert(m ZMember) {
+	var update [skiplistMaxLevel]*skipNode
+	var rank [skiplistMaxLevel]int // Rank of update[i], counted from 1
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		if i < l.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.links[i].next != nil && compareZMembers(x.links[i].next.ZMember, m) < 0 {
+			rank[i] += x.links[i].span
+			x = x.links[i].next
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	for i := l.level; i < level; i++ {
+		update[i] = &l.head
+		update[i].links[i].span = l.length
+	}
+	l.level = max(l.level, level)
+
+	n := &skipNode{ZMember: m, links: make([]skipLink, level)}
+	for i := range level {
+		n.links[i].next = update[i].links[i].next
+		update[i].links[i].next = n
+		n.links[i].span = update[i].links[i].span - (rank[0] - rank[i])
+		update[i].links[i].span = rank[0] - rank[i] + 1
+	}
+	// The higher links now span the new node too
+	for i := level; i < l.level; i++ {
+		update[i].links[i].span++
+	}
+
+	if update[0] != &l.head {
+		n.prev = update[0]
+	}
+	if next := n.links[0].next; next != nil {
+		next.prev = n
+	} else {
+		l.tail = n
+	}
+	l.length++
+}
+
+// remove removes m and reports whether it was in the list.
+func (l *skiplist) remove(m ZMember) bool {
+	var update [skiplistMaxLevel]*skipNode
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.links[i].next != nil && compareZMembers(x.links[i].next.ZMember, m) < 0 {
+			x = x.links[i].next
+		}
+		update[i] = x
+	}
+	x = x.links[0].next
+	if x == nil || compareZMembers(x.ZMember, m) != 0 {
+		return false
+	}
+
+	for i := range l.level {
+		if update[i].links[i].next == x {
+			update[i].links[i].span += x.links[i].span - 1
+			update[i].links[i].next = x.links[i].next
+		} else {
+			update[i].links[i].span--
+		}
+	}
+	if next := x.links[0].next; next != nil {
+		next.prev = x.prev
+	} else {
+		l.tail = x.prev
+	}
+	for l.level > 1 && l.head.links[l.level-1].next == nil {
+		l.level--
+	}
+	l.length--
+	return true
+}
+
+// rank returns the position of m, which must be in the list, counted
+// from 0.
+func (l *skiplist) rank(m ZMember) int {
+	rank := 0
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.links[i].next != nil && compareZMembers(x.links[i].next.ZMember, m) <= 0 {
+			rank += x.links[i].span
+			x = x.links[i].next
+		}
+	}
+	return rank - 1
+}
+
+// at returns the node at position rank, counted from 0, or nil if the list
+// is shorter.
+func (l *skiplist) at(rank int) *skipNode {
+	rank++ // The spans count from 1
+	traversed := 0
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.links[i].next != nil && traversed+x.links[i].span <= rank {
+			traversed += x.links[i].span
+			x = x.links[i].next
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// seek returns the first node that doesn't sort before m, or nil.
+func (l *skiplist) seek(m ZMember) *skipNode {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.links[i].next != nil && compareZMembers(x.links[i].next.ZMember, m) < 0 {
+			x = x.links[i].next
+		}
+	}
+	return x.links[0].next
+}
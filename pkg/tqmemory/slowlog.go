@@ -0,0 +1,140 @@
+package tqmemory
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slow log defaults, like Redis' slowlog-log-slower-than and slowlog-max-len
+const (
+	DefaultSlowLogThreshold = 10 * time.Millisecond
+	DefaultSlowLogLen       = 128
+	slowLogMaxKeyLen        = 64 // longer keys are truncated
+)
+
+// SlowLogEntry is a request whose queue wait plus execution time exceeded
+// the slow log threshold.
+type SlowLogEntry struct {
+	ID        uint64        // Increasing entry number
+	Time      time.Time     // When the request finished executing
+	Queue     time.Duration // Time waiting in the worker's request channel
+	Exec      time.Duration // Time executing in the worker
+	Op        string        // Operation name, e.g. "append" or "get_multi"
+	Key       string        // Key (the first one of a multi-get), truncated
+	Keys      int           // Number of keys of the request
+	ValueSize int           // Bytes stored or returned
+	Shard     int           // Worker that executed the request
+	Client    string        // Client address, if known
+}
+
+// Duration returns the queue wait plus the execution time.
+func (e *SlowLogEntry) Duration() time.Duration {
+	return e.Queue + e.Exec
+}
+
+// slowLog is a bounded ring of slow requests shared by the workers. Only
+// slow requests take the lock, so it stays off the fast path.
+type slowLog struct {
+	threshold time.Duration
+	mu        sync.Mutex
+	entries   []SlowLogEntry // ring, entries[next] is the oldest once full
+	next      int
+	count     int
+	id        uint64
+}
+
+func newSlowLog(threshold time.Duration, maxLen int) *slowLog {
+	return &slowLog{threshold: threshold, entries: make([]SlowLogEntry, maxLen)}
+}
+
+// add records an entry, replacing the oldest one when the ring is full.
+func (l *slowLog) add(e SlowLogEntry) {
+	l.mu.Lock()
+	e.ID = l.id
+	l.id++
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	l.count = min(l.count+1, len(l.entries))
+	l.mu.Unlock()
+}
+
+// get returns up to n entries, newest first (all of them if n < 0).
+func (l *slowLog) get(n int) []SlowLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n < 0 || n > l.count {
+		n = l.count
+	}
+	entries := make([]SlowLogEntry, n)
+	for i := range entries {
+		entries[i] = l.entries[(l.next-1-i+2*len(l.entries))%len(l.entries)]
+	}
+	return entries
+}
+
+func (l *slowLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+// reset removes all entries, the entry numbers keep increasing.
+func (l *slowLog) reset() {
+	l.mu.Lock()
+	clear(l.entries)
+	l.next, l.count = 0, 0
+	l.mu.Unlock()
+}
+
+// recordSlow adds a request to the slow log. It is called before the
+// response is sent, so the key and value are still owned by the request.
+func (w *Worker) recordSlow(req *Request, resp *Response, queue, exec time.Duration) {
+	e := SlowLogEntry{
+		Time:   time.Now(),
+		Queue:  queue,
+		Exec:   exec,
+		Op:     req.Op.String(),
+		Key:    req.Key,
+		Keys:   1,
+		Shard:  w.shard,
+		Client: req.Client,
+	}
+	switch req.Op {
+	case OpGet, OpHGet, OpLPop, OpRPop, OpBLPop, OpBRPop:
+		e.ValueSize = len(resp.Value)
+	case OpGetMulti:
+		e.Keys = len(req.Keys)
+		if len(req.Keys) > 0 {
+			e.Key = req.Keys[0]
+		}
+		for i := range req.Results {
+			e.ValueSize += len(req.Results[i].Value)
+		}
+	case OpStats, OpItemStats, OpResetStats, OpSetDetail, OpPrefixStats, OpHotKeys, OpScan, OpFlushAll,
+		OpInvalidateNamespace, OpInvalidateTag, OpDeletePattern:
+		e.Keys = 0
+	default:
+		// Typed values are read and written as fields, members and elements
+		e.ValueSize = len(req.Value)
+		for _, b := range req.Elements {
+			e.ValueSize += len(b)
+		}
+		for _, b := range resp.Values {
+			e.ValueSize += len(b)
+		}
+		for _, f := range req.Fields {
+			e.ValueSize += len(f)
+		}
+		for _, f := range resp.Fields {
+			e.ValueSize += len(f)
+		}
+	}
+	// The key may alias a connection's read buffer, so always copy it
+	if len(e.Key) > slowLogMaxKeyLen {
+		e.Key = e.Key[:slowLogMaxKeyLen] + "..."
+	} else {
+		e.Key = strings.Clone(e.Key)
+	}
+	w.slowLog.add(e)
+}
@@ -0,0 +1,138 @@
+package tqmemory
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Stats holds the memcached compatible counters of a worker, or their sum
+// over all workers. The counters are owned by the worker goroutine and are
+// only read through an OpStats request, so they need no synchronization.
+type Stats struct {
+	CurrItems          uint64 // Items currently stored
+	TotalItems         uint64 // Items stored since start
+	Bytes              int64  // Memory used by keys and values
+	LimitMaxBytes      int64  // Memory limit (0 = unlimited)
+	CmdGet             uint64 // Keys requested by get commands
+	CmdSet             uint64 // Storage commands (set, add, replace, cas, append, prepend)
+	CmdFlush           uint64 // Flush commands
+	CmdTouch           uint64 // Touch commands
+	GetHits            uint64 // Keys found by get commands
+	GetMisses          uint64 // Keys not found by get commands (including expired)
+	GetExpired         uint64 // Keys not found by get commands because they expired
+	DeleteHits         uint64 // Deletes of existing keys
+	DeleteMisses       uint64 // Deletes of missing keys
+	IncrHits           uint64 // Increments of existing keys
+	IncrMisses         uint64 // Increments of missing keys
+	DecrHits           uint64 // Decrements of existing keys
+	DecrMisses         uint64 // Decrements of missing keys
+	CasHits            uint64 // Successful CAS updates
+	CasMisses          uint64 // CAS updates of missing keys
+	CasBadval          uint64 // CAS updates with a mismatching CAS value
+	TouchHits          uint64 // Touches of existing keys
+	TouchMisses        uint64 // Touches of missing keys
+	Evictions          uint64 // Items evicted by the LRU
+	EvictedUnfetched   uint64 // Evicted items that were never fetched
+	ExpiredUnfetched   uint64 // Expired items that were never fetched
+	NamespaceReclaimed uint64 // Items removed because their namespace was invalidated
+	TagInvalidated     uint64 // Items removed by a tag invalidation
+	PatternDeleted     uint64 // Items removed by a pattern delete
+	BlockedClients     uint64 // Blocking pops waiting for an element
+}
+
+// PrefixStats holds the counters of the keys sharing a prefix, like
+// memcached's "stats detail dump".
+type PrefixStats struct {
+	Gets    uint64 // Keys requested by get commands
+	Hits    uint64 // Keys found by get commands
+	Sets    uint64 // Storage commands
+	Deletes uint64 // Delete commands
+}
+
+// prefixStats returns the counters of the key's prefix, or nil if detail
+// stats are off or the key has no prefix.
+func (w *Worker) prefixStats(key string) *PrefixStats {
+	if !w.detail {
+		return nil
+	}
+	i := strings.IndexByte(key, w.prefixDelimiter)
+	if i < 0 {
+		return nil
+	}
+	ps, ok := w.prefixes[key[:i]]
+	if !ok {
+		// The key may alias a connection's read buffer
+		ps = &PrefixStats{}
+		w.prefixes[strings.Clone(key[:i])] = ps
+	}
+	return ps
+}
+
+// Add adds the counters of o to s.
+func (s *Stats) Add(o *Stats) {
+	s.CurrItems += o.CurrItems
+	s.TotalItems += o.TotalItems
+	s.Bytes += o.Bytes
+	s.LimitMaxBytes += o.LimitMaxBytes
+	s.CmdGet += o.CmdGet
+	s.CmdSet += o.CmdSet
+	s.CmdFlush += o.CmdFlush
+	s.CmdTouch += o.CmdTouch
+	s.GetHits += o.GetHits
+	s.GetMisses += o.GetMisses
+	s.GetExpired += o.GetExpired
+	s.DeleteHits += o.DeleteHits
+	s.DeleteMisses += o.DeleteMisses
+	s.IncrHits += o.IncrHits
+	s.IncrMisses += o.IncrMisses
+	s.DecrHits += o.DecrHits
+	s.DecrMisses += o.DecrMisses
+	s.CasHits += o.CasHits
+	s.CasMisses += o.CasMisses
+	s.CasBadval += o.CasBadval
+	s.TouchHits += o.TouchHits
+	s.TouchMisses += o.TouchMisses
+	s.Evictions += o.Evictions
+	s.EvictedUnfetched += o.EvictedUnfetched
+	s.ExpiredUnfetched += o.ExpiredUnfetched
+	s.NamespaceReclaimed += o.NamespaceReclaimed
+	s.TagInvalidated += o.TagInvalidated
+	s.PatternDeleted += o.PatternDeleted
+	s.BlockedClients += o.BlockedClients
+}
+
+// toMap returns the counters by their memcached stats name.
+func (s *Stats) toMap() map[string]string {
+	u := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	return map[string]string{
+		"curr_items":        u(s.CurrItems),
+		"total_items":       u(s.TotalItems),
+		"bytes":             strconv.FormatInt(s.Bytes, 10),
+		"limit_maxbytes":    strconv.FormatInt(s.LimitMaxBytes, 10),
+		"cmd_get":           u(s.CmdGet),
+		"cmd_set":           u(s.CmdSet),
+		"cmd_flush":         u(s.CmdFlush),
+		"cmd_touch":         u(s.CmdTouch),
+		"get_hits":          u(s.GetHits),
+		"get_misses":        u(s.GetMisses),
+		"get_expired":       u(s.GetExpired),
+		"delete_hits":       u(s.DeleteHits),
+		"delete_misses":     u(s.DeleteMisses),
+		"incr_hits":         u(s.IncrHits),
+		"incr_misses":       u(s.IncrMisses),
+		"decr_hits":         u(s.DecrHits),
+		"decr_misses":       u(s.DecrMisses),
+		"cas_hits":          u(s.CasHits),
+		"cas_misses":        u(s.CasMisses),
+		"cas_badval":        u(s.CasBadval),
+		"touch_hits":        u(s.TouchHits),
+		"touch_misses":      u(s.TouchMisses),
+		"evictions":         u(s.Evictions),
+		"evicted_unfetched": u(s.EvictedUnfetched),
+		"expired_unfetched": u(s.ExpiredUnfetched),
+		"ns_reclaimed":      u(s.NamespaceReclaimed),
+		"tag_invalidated":   u(s.TagInvalidated),
+		"pattern_deleted":   u(s.PatternDeleted),
+		"blocked_clients":   u(s.BlockedClients),
+	}
+}
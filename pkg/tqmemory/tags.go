@@ -0,0 +1,50 @@
+package tqmemory
+
+import "time"
+
+// handleInvalidateTag removes the entries carrying the tag in req.Key and
+// returns their number in Count. Entries past their hard expiry are removed
+// as expired and not counted.
+func (w *Worker) handleInvalidateTag(req *Request) *Response {
+	now := time.Now().UnixMilli()
+	count := 0
+	for _, key := range w.index.Tagged(req.Key) {
+		entry := w.index.Delete(key)
+		if entry == nil {
+			continue
+		}
+		if entry.HardExpiry > 0 && entry.HardExpiry <= now {
+			w.expired(entry)
+			continue
+		}
+		w.itemRemoved(entrySize(entry))
+		w.notifyRemoved(entry, RemovedInvalidated)
+		count++
+	}
+	w.stats.TagInvalidated += uint64(count)
+	return &Response{Count: count}
+}
+
+// SetWithTags stores a value like Set, with tags that InvalidateTag can
+// remove it by. Tags are replaced by the next store of the key, and kept by
+// touch, incr/decr and append/prepend.
+func (sc *ShardedCache) SetWithTags(key string, value []byte, ttl time.Duration, tags []string) (uint64, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{
+		Op:    OpSet,
+		Key:   key,
+		Value: value,
+		TTL:   ttl,
+		Tags:  tags,
+	})
+	return resp.Cas, resp.Err
+}
+
+// InvalidateTag removes all items carrying tag from all workers and returns
+// the number of items removed.
+func (sc *ShardedCache) InvalidateTag(tag string) int {
+	var n int
+	for i := range sc.workers {
+		n += sc.sendRequest(i, &Request{Op: OpInvalidateTag, Key: tag}).Count
+	}
+	return n
+}
@@ -2,6 +2,10 @@ package tqmemory
 
 import (
 	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -62,6 +66,40 @@ func TestSetGet(t *testing.T) {
 	}
 }
 
+func TestGetMulti(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// Keys spread over all workers, with misses and duplicates in between
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if i%3 != 0 {
+			c.Set(key, []byte("value"+key), 0)
+		}
+		keys = append(keys, key)
+	}
+	keys = append(keys, "key1", "key1")
+
+	results := c.GetMulti(keys)
+	if len(results) != len(keys) {
+		t.Fatalf("Expected %d results, got %d", len(keys), len(results))
+	}
+	for i, key := range keys {
+		value, cas, _, err := c.Get(key)
+		if results[i].Err != err {
+			t.Errorf("%s: expected err %v, got %v", key, err, results[i].Err)
+		}
+		if string(results[i].Value) != string(value) || results[i].Cas != cas {
+			t.Errorf("%s: expected %q (cas %d), got %q (cas %d)", key, value, cas, results[i].Value, results[i].Cas)
+		}
+	}
+
+	if results := c.GetMulti(nil); len(results) != 0 {
+		t.Errorf("Expected no results, got %d", len(results))
+	}
+}
+
 func TestAdd(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
@@ -387,6 +425,83 @@ func TestDecrement(t *testing.T) {
 	}
 }
 
+func TestIncrementOrCreate(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// Missing key is created with the initial value, delta is not applied
+	newVal, cas, err := c.IncrementOrCreate("counter", 5, 100, 0)
+	if err != nil {
+		t.Fatalf("IncrementOrCreate failed: %v", err)
+	}
+	if newVal != 100 {
+		t.Errorf("Expected 100, got %d", newVal)
+	}
+	if cas == 0 {
+		t.Error("Expected non-zero CAS")
+	}
+
+	// Existing key is incremented
+	newVal, _, err = c.IncrementOrCreate("counter", 5, 100, 0)
+	if err != nil {
+		t.Fatalf("IncrementOrCreate failed: %v", err)
+	}
+	if newVal != 105 {
+		t.Errorf("Expected 105, got %d", newVal)
+	}
+
+	// Decrement creates with the initial value too
+	newVal, _, err = c.DecrementOrCreate("down", 5, 7, 0)
+	if err != nil {
+		t.Fatalf("DecrementOrCreate failed: %v", err)
+	}
+	if newVal != 7 {
+		t.Errorf("Expected 7, got %d", newVal)
+	}
+	val, _, _, _ := c.Get("down")
+	if string(val) != "7" {
+		t.Errorf("Expected '7', got '%s'", val)
+	}
+
+	// Non-numeric values are not replaced
+	c.Set("text", []byte("abc"), 0)
+	if _, _, err := c.IncrementOrCreate("text", 1, 0, 0); err != ErrNotNumeric {
+		t.Errorf("Expected ErrNotNumeric, got %v", err)
+	}
+
+	// TTL applies to the created key
+	c.IncrementOrCreate("short", 1, 1, 50*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	if _, _, _, err := c.Get("short"); err != ErrKeyNotFound {
+		t.Errorf("Expected created counter to expire, got %v", err)
+	}
+}
+
+func TestIncrementOrCreateConcurrency(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	const numGoroutines = 100
+
+	// Every goroutine either creates the counter with 1 or increments it
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := c.IncrementOrCreate("counter", 1, 1, 0); err != nil {
+				t.Errorf("IncrementOrCreate failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, _, _, _ := c.Get("counter")
+	if string(val) != fmt.Sprintf("%d", numGoroutines) {
+		t.Errorf("Expected counter=%d, got %s", numGoroutines, val)
+	}
+}
+
 func TestAppend(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
@@ -463,211 +578,1612 @@ func TestStats(t *testing.T) {
 	if stats["curr_items"] != "2" {
 		t.Errorf("Expected 2 items, got %s", stats["curr_items"])
 	}
-}
 
-func TestExpiry(t *testing.T) {
-	c, cleanup := setupTestCache(t)
-	defer cleanup()
+	// Command counters are summed over all workers
+	c.Get("key1")
+	c.GetMulti([]string{"key2", "missing"})
+	c.Delete("key1")
+	c.Delete("key1")
+	c.Increment("missing", 1)
+	cas, _ := c.Set("key3", []byte("1"), 0)
+	c.Cas("key3", []byte("2"), 0, cas+1)
+	c.Touch("key3", time.Hour)
+	c.Increment("key3", 1)
+	c.Increment("key2", 1) // non-numeric, not a hit
 
-	// Set a key with short TTL (200ms soft, 400ms hard with 2.0 multiplier)
-	cas, setErr := c.Set("expiry_key", []byte("expiry_value"), 200*time.Millisecond)
-	if setErr != nil {
-		t.Fatalf("Set failed: %v", setErr)
-	}
-	if cas == 0 {
-		t.Error("Expected non-zero CAS")
+	stats = c.Stats()
+	expected := map[string]string{
+		"curr_items":     "2",
+		"total_items":    "3",
+		"cmd_get":        "3",
+		"get_hits":       "2",
+		"get_misses":     "1",
+		"cmd_set":        "4",
+		"delete_hits":    "1",
+		"delete_misses":  "1",
+		"incr_misses":    "1",
+		"incr_hits":      "1",
+		"cas_badval":     "1",
+		"touch_hits":     "1",
+		"bytes":          "15",
+		"limit_maxbytes": fmt.Sprintf("%d", DefaultMaxMemory),
+		"threads":        "4",
+	}
+	for name, value := range expected {
+		if stats[name] != value {
+			t.Errorf("Expected %s=%s, got %s", name, value, stats[name])
+		}
 	}
+}
 
-	// Should be accessible immediately with flags=0 (fresh)
-	val, _, flags, err := c.Get("expiry_key")
+func TestStatsUnfetched(t *testing.T) {
+	config := DefaultConfig()
+	config.StaleMultiplier = 0
+	c, err := NewSharded(config, 1)
 	if err != nil {
-		t.Fatalf("Key should be accessible immediately: err=%v", err)
-	}
-	if string(val) != "expiry_value" {
-		t.Errorf("Expected 'expiry_value', got '%s'", val)
-	}
-	if flags != 0 {
-		t.Errorf("Expected flags=0 (fresh) immediately after set, got %d", flags)
+		t.Fatal(err)
 	}
+	defer c.Close()
 
-	// Wait past soft-expiry (200ms) but before hard-expiry (400ms)
+	c.Set("fetched", []byte("value"), 50*time.Millisecond)
+	c.Set("unfetched", []byte("value"), 50*time.Millisecond)
+	c.Get("fetched")
+
+	// Wait for the background expiry
 	time.Sleep(250 * time.Millisecond)
 
-	// First stale access should return flags=3 (refresh)
-	val, _, flags, err = c.Get("expiry_key")
+	stats := c.WorkerStats()[0]
+	if stats.ExpiredUnfetched != 1 {
+		t.Errorf("Expected 1 expired unfetched item, got %d", stats.ExpiredUnfetched)
+	}
+	if stats.CurrItems != 0 {
+		t.Errorf("Expected 0 items, got %d", stats.CurrItems)
+	}
+}
+
+func TestItemStats(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemory = 4096
+	c, err := NewSharded(config, 1)
 	if err != nil {
-		t.Fatalf("Key should still be accessible after soft-expiry: err=%v", err)
+		t.Fatal(err)
 	}
-	if string(val) != "expiry_value" {
-		t.Errorf("Expected 'expiry_value', got '%s'", val)
+	defer c.Close()
+
+	c.Set("small", make([]byte, 10), 0)   // 15 bytes, class 1
+	c.Set("large", make([]byte, 1000), 0) // 1005 bytes
+	c.Set("counter", []byte("99"), 0)     // 9 bytes, class 1
+	c.Increment("counter", 1)             // 10 bytes
+	c.Append("small", make([]byte, 100))  // 115 bytes, class 2
+	c.Set("large", make([]byte, 900), 0)  // 905 bytes, same class
+	c.Set("deleted", make([]byte, 10), 0) // removed below
+	c.Delete("deleted")
+
+	items := c.ItemStats()
+	large := sizeClass(905)
+	want := map[int]uint64{0: 1, 1: 1, large: 1}
+	for i, class := range items.Classes {
+		if class.Items != want[i] {
+			t.Errorf("class %d (chunk size %d) has %d items, want %d", i+1, class.ChunkSize, class.Items, want[i])
+		}
 	}
-	if flags != 3 {
-		t.Errorf("Expected flags=3 (refresh) on first stale access, got %d", flags)
+	if items.Classes[large].Bytes != 905 {
+		t.Errorf("Expected 905 bytes in class %d, got %d", large+1, items.Classes[large].Bytes)
+	}
+	wantSizes := map[int64]uint64{32: 1, 128: 1, 928: 1}
+	if fmt.Sprint(items.Sizes) != fmt.Sprint(wantSizes) {
+		t.Errorf("Expected sizes %v, got %v", wantSizes, items.Sizes)
 	}
 
-	// Second stale access should return flags=1 (stale, not refresh)
-	val, _, flags, err = c.Get("expiry_key")
-	if err != nil {
-		t.Fatalf("Key should still be accessible after soft-expiry: err=%v", err)
+	// Fill the cache to 4045 bytes, then exceed the limit by 6 bytes, so
+	// only the least recently used item (the counter) is evicted
+	for i := range 3 {
+		c.Set(fmt.Sprintf("fill%d", i), make([]byte, 1000), 0)
 	}
-	if string(val) != "expiry_value" {
-		t.Errorf("Expected 'expiry_value', got '%s'", val)
+	c.Set("fill3", make([]byte, 52), 0)
+	items = c.ItemStats()
+	if items.Classes[0].Evicted != 1 || items.Classes[0].EvictedUnfetched != 1 {
+		t.Errorf("Expected 1 unfetched eviction in class 1, got %+v", items.Classes[0])
 	}
-	if flags != 1 {
-		t.Errorf("Expected flags=1 (stale) on subsequent access, got %d", flags)
+	var bytes int64
+	for _, class := range items.Classes {
+		bytes += class.Bytes
+	}
+	if stats := c.WorkerStats()[0]; stats.Bytes != bytes {
+		t.Errorf("Expected %d bytes used, got %d", bytes, stats.Bytes)
 	}
 
-	// Wait past hard-expiry (400ms total from set)
-	time.Sleep(200 * time.Millisecond)
+	// Reset zeroes the counters but keeps the items
+	c.ResetStats()
+	items = c.ItemStats()
+	if items.Classes[0].Evicted != 0 || items.Classes[large].Items == 0 {
+		t.Errorf("Unexpected stats after reset: %+v", items.Classes)
+	}
+	if stats := c.WorkerStats()[0]; stats.TotalItems != 0 || stats.CurrItems == 0 {
+		t.Errorf("Unexpected stats after reset: %+v", stats)
+	}
 
-	// Should be gone after hard-expiry (ErrKeyNotFound)
-	_, _, _, err = c.Get("expiry_key")
-	if err != ErrKeyNotFound {
-		t.Errorf("Expected ErrKeyNotFound after hard-expiry, got %v", err)
+	c.FlushAll()
+	if items = c.ItemStats(); len(items.Sizes) != 0 || items.Classes[large].Items != 0 {
+		t.Errorf("Expected no items after flush, got %+v", items)
 	}
 }
 
-func TestSingleFlightRefresh(t *testing.T) {
+func TestPrefixStats(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
 
-	const numGoroutines = 50
-	const key = "single_flight_key"
-
-	// Set a key with short TTL (100ms soft, 200ms hard with 2.0 multiplier)
-	_, err := c.Set(key, []byte("value"), 100*time.Millisecond)
-	if err != nil {
-		t.Fatalf("Set failed: %v", err)
+	// Nothing is counted while detail stats are off
+	c.Set("user:1", []byte("a"), 0)
+	if prefixes := c.PrefixStats(); len(prefixes) != 0 {
+		t.Errorf("Expected no prefix stats, got %v", prefixes)
 	}
 
-	// Wait past soft-expiry but before hard-expiry
-	time.Sleep(150 * time.Millisecond)
-
-	// Launch goroutines that all try to get the stale key simultaneously
-	var wg sync.WaitGroup
-	refreshCount := int64(0)
-	staleCount := int64(0)
-	freshCount := int64(0)
-	errorCount := int64(0)
-
-	// Use a barrier to ensure all goroutines start at the same time
-	startChan := make(chan struct{})
-
-	for i := 0; i < numGoroutines; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			// Wait for start signal
-			<-startChan
-
-			_, _, flags, err := c.Get(key)
-			if err != nil {
-				atomic.AddInt64(&errorCount, 1)
-				return
-			}
-
-			switch flags {
-			case 0:
-				atomic.AddInt64(&freshCount, 1)
-			case 1:
-				atomic.AddInt64(&staleCount, 1)
-			case 3:
-				atomic.AddInt64(&refreshCount, 1)
-			}
-		}()
+	c.SetDetail(true)
+	for i := range 10 {
+		c.Set(fmt.Sprintf("user:%d", i), []byte("a"), 0)
 	}
+	c.GetMulti([]string{"user:1", "user:2", "user:missing", "nodelimiter"})
+	c.Get("session:1")
+	c.Delete("user:1")
+	c.Append("user:2", []byte("b"))
 
-	// Start all goroutines simultaneously
-	close(startChan)
-	wg.Wait()
+	want := map[string]PrefixStats{
+		"user":    {Gets: 3, Hits: 2, Sets: 11, Deletes: 1},
+		"session": {Gets: 1},
+	}
+	if got := c.PrefixStats(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
 
-	// Verify exactly one goroutine got refresh flag
-	if refreshCount != 1 {
-		t.Errorf("Expected exactly 1 refresh (flags=3), got %d", refreshCount)
+	// Turning detail off keeps the counters, reset clears them
+	c.SetDetail(false)
+	c.Get("user:2")
+	if got := c.PrefixStats()["user"].Gets; got != 3 {
+		t.Errorf("Expected 3 gets, got %d", got)
+	}
+	c.ResetStats()
+	if prefixes := c.PrefixStats(); len(prefixes) != 0 {
+		t.Errorf("Expected no prefix stats after reset, got %v", prefixes)
 	}
+}
 
-	// All other successful goroutines should get stale flag
-	expectedStale := int64(numGoroutines) - refreshCount - errorCount
-	if staleCount != expectedStale {
-		t.Errorf("Expected %d stale (flags=1), got %d", expectedStale, staleCount)
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	if h.Quantile(0.5) != 0 {
+		t.Error("Expected 0 for an empty histogram")
+	}
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	if h.Count() != 1000 {
+		t.Errorf("Expected 1000 values, got %d", h.Count())
+	}
+	if h.Sum() != 500500*time.Microsecond {
+		t.Errorf("Expected sum 500.5ms, got %v", h.Sum())
 	}
 
-	// No fresh flags should be returned (we're past soft expiry)
-	if freshCount != 0 {
-		t.Errorf("Expected 0 fresh (flags=0), got %d", freshCount)
+	// Quantiles are rounded up to the bucket, at most 12.5% above the value
+	for _, tt := range []struct {
+		q    float64
+		want time.Duration
+	}{{0.5, 500 * time.Microsecond}, {0.99, 990 * time.Microsecond}, {1, time.Millisecond}} {
+		got := h.Quantile(tt.q)
+		if got < tt.want || got > tt.want+tt.want/8 {
+			t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+	if n := h.CountBelow(100 * time.Microsecond); n < 88 || n > 100 {
+		t.Errorf("Expected about 100 values below 100µs, got %d", n)
 	}
 
-	if errorCount > 0 {
-		t.Errorf("Unexpected errors: %d", errorCount)
+	// Bucket bounds are contiguous
+	for i := 1; i < histogramBuckets; i++ {
+		if idx := histogramIndex(histogramUpper(i-1) + 1); idx != i {
+			t.Fatalf("Value %d after bucket %d lands in bucket %d", histogramUpper(i-1)+1, i-1, idx)
+		}
 	}
 
-	t.Logf("Single-flight test passed: refresh=%d, stale=%d, fresh=%d, errors=%d",
-		refreshCount, staleCount, freshCount, errorCount)
+	var merged Histogram
+	merged.Merge(&h)
+	merged.Merge(&h)
+	if merged.Count() != 2000 || merged.Quantile(0.5) != h.Quantile(0.5) {
+		t.Errorf("Unexpected merge result: %d values, median %v", merged.Count(), merged.Quantile(0.5))
+	}
+	merged.Reset()
+	if merged.Count() != 0 || merged.Sum() != 0 {
+		t.Error("Expected an empty histogram after reset")
+	}
 }
 
-func TestStaleFlags(t *testing.T) {
+func TestLatency(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
 
-	const key = "stale_test_key"
+	c.Set("key1", []byte("value1"), 0)
+	c.Get("key1")
+	c.Get("missing")
+	c.GetMulti([]string{"key1", "key2"})
+
+	counts := make(map[string]uint64)
+	for _, l := range c.Latency() {
+		if l.Queue.Count() != l.Exec.Count() {
+			t.Errorf("%s: %d queued but %d executed", l.Op, l.Queue.Count(), l.Exec.Count())
+		}
+		if l.Exec.Summary().P999 <= 0 {
+			t.Errorf("%s: expected a positive p999", l.Op)
+		}
+		counts[l.Op] = l.Exec.Count()
+	}
+	// The multi-get touches one or two workers
+	if counts["set"] != 1 || counts["get"] != 2 || counts["get_multi"] < 1 || counts["get_multi"] > 2 {
+		t.Errorf("Unexpected operation counts: %v", counts)
+	}
 
-	// Test 1: Fresh access should return flags=0
-	_, err := c.Set(key, []byte("fresh_value"), 100*time.Millisecond)
-	if err != nil {
-		t.Fatalf("Set failed: %v", err)
+	c.ResetStats()
+	for _, l := range c.Latency() {
+		if l.Op != "reset_stats" {
+			t.Errorf("Expected no latency for %s after reset", l.Op)
+		}
 	}
+}
 
-	_, _, flags, err := c.Get(key)
+func TestHotKeys(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HotKeys = 10
+	c, err := NewSharded(cfg, 4)
 	if err != nil {
-		t.Fatalf("Get failed: %v", err)
+		t.Fatal(err)
 	}
-	if flags != 0 {
-		t.Errorf("Test 1: Expected flags=0 (fresh), got %d", flags)
+	defer c.Close()
+
+	for i := range 100 {
+		c.Set(fmt.Sprintf("key%d", i), []byte("value"), 0)
+		c.Get(fmt.Sprintf("key%d", i))
+		c.Get("hot")
+	}
+	for range 50 {
+		c.Set("written", []byte("value"), 0)
 	}
 
-	// Test 2: After soft expiry, first access should return flags=3 (refresh)
-	time.Sleep(150 * time.Millisecond)
-	_, _, flags, err = c.Get(key)
-	if err != nil {
-		t.Fatalf("Get failed after soft expiry: %v", err)
+	hot := c.HotKeys()
+	if len(hot.Reads) != cfg.HotKeys || len(hot.Writes) != cfg.HotKeys {
+		t.Fatalf("Expected %d read and write keys, got %d and %d", cfg.HotKeys, len(hot.Reads), len(hot.Writes))
 	}
-	if flags != 3 {
-		t.Errorf("Test 2: Expected flags=3 (refresh), got %d", flags)
+	if k := hot.Reads[0]; k.Key != "hot" || k.Count < 100 || k.Share <= 0 || k.Share > 1 {
+		t.Errorf("Expected hot to be read most, got %+v", k)
+	}
+	if k := hot.Writes[0]; k.Key != "written" || k.Count < 50 {
+		t.Errorf("Expected written to be written most, got %+v", k)
 	}
 
-	// Test 3: Subsequent stale access should return flags=1
-	_, _, flags, err = c.Get(key)
-	if err != nil {
-		t.Fatalf("Get failed for subsequent stale access: %v", err)
+	c.ResetStats()
+	if hot := c.HotKeys(); len(hot.Reads) != 0 || len(hot.Writes) != 0 {
+		t.Errorf("Expected no hot keys after reset, got %+v", hot)
 	}
-	if flags != 1 {
-		t.Errorf("Test 3: Expected flags=1 (stale), got %d", flags)
+}
+
+func TestHotKeyTrackerDecay(t *testing.T) {
+	tr := newHotKeyTracker("read", 2, 0)
+	for range 8 {
+		tr.add("a", 0)
+	}
+	for range 4 {
+		tr.add("b", 0)
+	}
+	tr.add("c", 0)
+	if keys := tr.snapshot(); len(keys) != 2 || keys[0].Key != "a" || keys[1].Key != "b" {
+		t.Fatalf("Expected a and b, got %+v", keys)
 	}
 
-	// Test 4: After refresh (re-set), should be fresh again
-	_, err = c.Set(key, []byte("refreshed_value"), 100*time.Millisecond)
-	if err != nil {
-		t.Fatalf("Re-set failed: %v", err)
+	tr.decay()
+	tr.decay()
+	tr.decay()
+	if keys := tr.snapshot(); len(keys) != 1 || keys[0].Key != "a" || keys[0].Count != 1 {
+		t.Errorf("Expected a with count 1 after decay, got %+v", keys)
 	}
-	_, _, flags, err = c.Get(key)
+}
+
+func TestSlowLog(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SlowLogThreshold = 0 // log every request
+	cfg.SlowLogLen = 3
+	c, err := NewSharded(cfg, 2)
 	if err != nil {
-		t.Fatalf("Get failed after refresh: %v", err)
+		t.Fatal(err)
 	}
-	if flags != 0 {
-		t.Errorf("Test 4: Expected flags=0 (fresh) after refresh, got %d", flags)
+	defer c.Close()
+
+	client := c.WithClient("tcp:10.0.0.1:5000")
+	client.Set("key1", []byte("value1"), 0)
+	client.Append("key1", []byte("more"))
+	client.GetMulti([]string{"key1"})
+	c.Get(strings.Repeat("k", 100))
+
+	if n := c.SlowLogLen(); n != 3 {
+		t.Fatalf("Expected 3 entries, got %d", n)
+	}
+	entries := c.SlowLog(-1)
+	if e := entries[0]; e.ID != 3 || e.Op != "get" || e.Key != strings.Repeat("k", 64)+"..." || e.Client != "" {
+		t.Errorf("Unexpected newest entry %+v", e)
+	}
+	if e := entries[1]; e.Op != "get_multi" || e.Key != "key1" || e.Keys != 1 || e.ValueSize != 10 || e.Client != "tcp:10.0.0.1:5000" {
+		t.Errorf("Unexpected multi-get entry %+v", e)
+	}
+	if e := entries[2]; e.Op != "append" || e.ValueSize != 4 || e.Shard != c.workerFor("key1") || e.Duration() <= 0 {
+		t.Errorf("Unexpected append entry %+v", e)
+	}
+	if got := c.SlowLog(1); len(got) != 1 || got[0].ID != 3 {
+		t.Errorf("Expected only the newest entry, got %+v", got)
 	}
 
-	// Test 5: After hard expiry, key should be gone
-	time.Sleep(250 * time.Millisecond)
-	_, _, _, err = c.Get(key)
-	if err != ErrKeyNotFound {
-		t.Errorf("Test 5: Expected ErrKeyNotFound after hard expiry, got %v", err)
+	c.ResetSlowLog()
+	if n := c.SlowLogLen(); n != 0 {
+		t.Errorf("Expected an empty slow log after reset, got %d entries", n)
 	}
 
-	t.Log("All stale flag tests passed")
+	// Typed values count their fields, members and elements
+	c.HSet("h", map[string][]byte{"field": []byte("value")}, 0)
+	c.HGetAll("h")
+	c.RPush("l", 0, []byte("abc"), []byte("de"))
+	c.LRange("l", 0, -1)
+	entries = c.SlowLog(-1)
+	for i, want := range []struct {
+		op   string
+		size int
+	}{{"lrange", 5}, {"rpush", 5}, {"hgetall", 10}} {
+		if e := entries[i]; e.Op != want.op || e.ValueSize != want.size {
+			t.Errorf("Expected %s with value size %d, got %+v", want.op, want.size, e)
+		}
+	}
 }
 
-func TestLargeValue(t *testing.T) {
+func TestWatch(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	w := c.Watch(WatchFetchers|WatchMutations, 2)
+	defer w.Close()
+	client := c.WithClient("tcp:10.0.0.1:5000")
+	client.Set("key1", []byte("value1"), time.Minute)
+	client.Get("key1")
+	client.Get("missing")
+
+	ev := <-w.Events()
+	if ev.Type != "item_store" || ev.Key != "key1" || ev.Status != "stored" || ev.Op != "set" ||
+		ev.TTL != time.Minute || ev.Size != 10 || ev.Class != 1 || ev.Client != "tcp:10.0.0.1:5000" {
+		t.Errorf("Unexpected store event %+v", ev)
+	}
+	if ev = <-w.Events(); ev.Type != "item_get" || ev.Status != "found" || ev.ID != 2 {
+		t.Errorf("Unexpected get event %+v", ev)
+	}
+	// The buffer was full when the third event was published
+	if w.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", w.Dropped())
+	}
+
+	w.Close()
+	w.Close()
+	<-w.Done()
+	c.Set("key2", []byte("value2"), 0)
+	select {
+	case ev := <-w.Events():
+		t.Errorf("Unexpected event after close %+v", ev)
+	default:
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	var p PubSub
+	s := p.Subscribe([]string{"news"}, []string{"n*", "user:*"}, 4)
+	defer s.Close()
+	other := p.Subscribe([]string{"other"}, nil, 4)
+	defer other.Close()
+
+	data := []byte("hello")
+	if n := p.Publish("news", data); n != 1 {
+		t.Errorf("Expected 1 subscriber, got %d", n)
+	}
+	data[0] = 'j'
+	p.Publish("user:1", []byte("hi"))
+	p.Publish("missing", []byte("x"))
+	// An empty channel is not a wildcard
+	p.Publish("", []byte("x"))
+
+	msg := <-s.Events()
+	if msg.Channel != "news" || string(msg.Data) != "hello" || s.Pattern(msg.Channel) != "" {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+	msg = <-s.Events()
+	if msg.Channel != "user:1" || s.Pattern(msg.Channel) != "user:*" {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+	if len(s.Events()) != 0 || len(other.Events()) != 0 {
+		t.Errorf("Expected each message once, got %d and %d more", len(s.Events()), len(other.Events()))
+	}
+	if channels, patterns := p.Counts(); channels != 2 || patterns != 2 {
+		t.Errorf("Expected 2 channels and 2 patterns, got %d and %d", channels, patterns)
+	}
+	if published, delivered, dropped := p.Stats(); published != 4 || delivered != 2 || dropped != 0 {
+		t.Errorf("Expected 4 published and 2 delivered, got %d, %d and %d dropped", published, delivered, dropped)
+	}
+
+	s.Close()
+	other.Close()
+	if channels, patterns := p.Counts(); channels != 0 || patterns != 0 {
+		t.Errorf("Expected no channels and patterns after close, got %d and %d", channels, patterns)
+	}
+}
+
+func TestWatchEvictions(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxMemory = 100
+	c, err := NewSharded(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	w := c.Watch(WatchEvictions|WatchExpirations, 0)
+	defer w.Close()
+	c.Set("old", make([]byte, 60), 0)
+	c.Set("new", make([]byte, 60), 0)
+	if ev := <-w.Events(); ev.Type != "eviction" || ev.Key != "old" || ev.Fetched || ev.TTL != -1 {
+		t.Errorf("Unexpected eviction event %+v", ev)
+	}
+
+	c.Set("short", []byte("x"), 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	c.Get("short")
+	if ev := <-w.Events(); ev.Type != "expired" || ev.Key != "short" || ev.Kind != WatchExpirations {
+		t.Errorf("Unexpected expiration event %+v", ev)
+	}
+}
+
+func TestRemovalHooks(t *testing.T) {
+	type removed struct {
+		key, value string
+		reason     RemovalReason
+		age        time.Duration
+	}
+	ch := make(chan removed, 10)
+	hook := func(key string, value []byte, reason RemovalReason, age time.Duration) {
+		ch <- removed{key, string(value), reason, age}
+	}
+	cfg := DefaultConfig()
+	cfg.MaxMemory = 100
+	cfg.StaleMultiplier = 0
+	cfg.OnEvict, cfg.OnExpire, cfg.OnDelete = hook, hook, hook
+	c, err := NewSharded(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Set("old", []byte("value"), 0)
+	time.Sleep(20 * time.Millisecond)
+	c.Set("big", make([]byte, 90), 0)
+	if r := <-ch; r.key != "old" || r.value != "value" || r.reason != RemovedEvicted || r.age < 20*time.Millisecond {
+		t.Errorf("Unexpected eviction %+v", r)
+	}
+	c.Delete("big")
+	if r := <-ch; r.key != "big" || r.reason != RemovedDeleted {
+		t.Errorf("Unexpected delete %+v", r)
+	}
+	c.Set("short", []byte("x"), 10*time.Millisecond)
+	if r := <-ch; r.key != "short" || r.reason != RemovedExpired {
+		t.Errorf("Unexpected expiration %+v", r)
+	}
+	c.Set("a", []byte("x"), 0)
+	c.FlushAll()
+	if r := <-ch; r.key != "a" || r.reason != RemovedFlushed || r.reason.String() != "flushed" {
+		t.Errorf("Unexpected flush %+v", r)
+	}
+	// A typed value is delivered serialized, like a get returns it
+	c.RPush("list", 0, []byte("a"), []byte("bc"))
+	c.Delete("list")
+	if r := <-ch; r.key != "list" || r.value != "1:a,2:bc," || r.reason != RemovedDeleted {
+		t.Errorf("Unexpected list delete %+v", r)
+	}
+}
+
+func TestRemovalHookQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	cfg := DefaultConfig()
+	cfg.HookQueue = 1
+	cfg.OnDelete = func(string, []byte, RemovalReason, time.Duration) { <-block }
+	c, err := NewSharded(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A blocked callback must not block the worker
+	for i := range 10 {
+		key := fmt.Sprintf("key%d", i)
+		c.Set(key, []byte("x"), 0)
+		c.Delete(key)
+	}
+	// One removal is in the callback, one in the queue
+	if dropped := c.HookDropped(); dropped < 8 {
+		t.Errorf("Expected at least 8 dropped removals, got %d", dropped)
+	}
+	if c.Stats()["hook_dropped"] != strconv.FormatUint(c.HookDropped(), 10) {
+		t.Errorf("Expected hook_dropped in the stats")
+	}
+	close(block)
+	c.Close()
+}
+
+func TestSubscribeKeyspace(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxMemory = 100
+	cfg.StaleMultiplier = 0
+	c, err := NewSharded(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := c.SubscribeKeyspace(KeyspaceAll, 0, "user:*")
+	defer s.Close()
+	c.Set("user:1", []byte("a"), 0)
+	c.Set("other", []byte("a"), 0)
+	c.Append("user:1", []byte("b"))
+	c.Add("user:1", []byte("c"), 0) // fails, no event
+	c.Delete("user:1")
+	c.Set("user:2", []byte("x"), 0)
+	c.Set("user:3", make([]byte, 50), 0)
+	c.Set("user:4", make([]byte, 50), 0) // evicts other, user:2 and user:3
+	c.FlushAll()
+
+	want := []string{"set user:1", "set user:1", "delete user:1", "set user:2", "set user:3",
+		"evict user:2", "evict user:3", "set user:4", "flush "}
+	var lastID uint64
+	for _, w := range want {
+		ev := <-s.Events()
+		if got := ev.Type.String() + " " + ev.Key; got != w {
+			t.Errorf("Expected %q, got %q", w, got)
+		}
+		if ev.ID <= lastID {
+			t.Errorf("Expected increasing IDs, got %d after %d", ev.ID, lastID)
+		}
+		lastID = ev.ID
+	}
+	select {
+	case ev := <-s.Events():
+		t.Errorf("Unexpected event %+v", ev)
+	default:
+	}
+
+	// Expirations are found by the maintenance tick or a read
+	e := c.SubscribeKeyspace(KeyspaceExpire, 1)
+	defer e.Close()
+	c.Set("short", []byte("x"), 10*time.Millisecond)
+	c.Set("short2", []byte("x"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	c.Get("short")
+	c.Get("short2")
+	if ev := <-e.Events(); ev.Type != KeyspaceExpire || ev.Key != "short" {
+		t.Errorf("Unexpected event %+v", ev)
+	}
+	if e.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", e.Dropped())
+	}
+}
+
+func TestHash(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	n, err := c.HSet("user:1", map[string][]byte{"name": []byte("alice"), "visits": []byte("1")}, 0)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 fields added, got %d, %v", n, err)
+	}
+	if n, _ := c.HSet("user:1", map[string][]byte{"name": []byte("bob")}, 0); n != 0 {
+		t.Errorf("Expected an update to add no fields, got %d", n)
+	}
+	if value, err := c.HGet("user:1", "name"); err != nil || string(value) != "bob" {
+		t.Errorf("Expected bob, got %q, %v", value, err)
+	}
+	if _, err := c.HGet("user:1", "missing"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for a missing field, got %v", err)
+	}
+	if n, err := c.HIncrBy("user:1", "visits", 41, 0); err != nil || n != 42 {
+		t.Errorf("Expected 42, got %d, %v", n, err)
+	}
+	if _, err := c.HIncrBy("user:1", "name", 1, 0); err != ErrNotNumeric {
+		t.Errorf("Expected ErrNotNumeric, got %v", err)
+	}
+	if n, _ := c.HIncrBy("user:1", "logins", -3, 0); n != -3 {
+		t.Errorf("Expected a missing field to start at 0, got %d", n)
+	}
+
+	// A get returns the netstrings of the fields and values, ordered by field
+	value, _, _, err := c.Get("user:1")
+	if want := "6:logins,2:-3,4:name,3:bob,6:visits,2:42,"; err != nil || string(value) != want {
+		t.Errorf("Expected %q, got %q, %v", want, value, err)
+	}
+	if got := c.Stats()["bytes"]; got != strconv.Itoa(len("user:1logins-3namebobvisits42")) {
+		t.Errorf("Expected the fields to be counted in bytes, got %s", got)
+	}
+
+	fields, err := c.HGetAll("user:1")
+	if err != nil || len(fields) != 3 || string(fields["visits"]) != "42" {
+		t.Errorf("Expected 3 fields, got %v, %v", fields, err)
+	}
+	if _, err := c.Append("user:1", []byte("x")); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType for append, got %v", err)
+	}
+	c.Set("plain", []byte("value"), 0)
+	if _, err := c.HSet("plain", map[string][]byte{"a": nil}, 0); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType for a plain value, got %v", err)
+	}
+
+	if n, _ := c.HDel("user:1", "name", "missing", "logins"); n != 2 {
+		t.Errorf("Expected 2 fields removed, got %d", n)
+	}
+	if n, _ := c.HDel("user:1", "visits"); n != 1 {
+		t.Errorf("Expected 1 field removed, got %d", n)
+	}
+	if _, err := c.HGetAll("user:1"); err != ErrKeyNotFound {
+		t.Errorf("Expected the hash to be removed with its last field, got %v", err)
+	}
+	if got := c.Stats()["bytes"]; got != "10" {
+		t.Errorf("Expected only plain to be counted in bytes, got %s", got)
+	}
+
+	// The TTL of the hash is set when it is created
+	c.HSet("session", map[string][]byte{"a": []byte("1")}, 50*time.Millisecond)
+	c.HSet("session", map[string][]byte{"b": []byte("2")}, 0)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.HGet("session", "b"); err != ErrKeyNotFound {
+		t.Errorf("Expected the hash to expire, got %v", err)
+	}
+}
+
+func TestTypedValueTooLarge(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxValueSize = 100
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	big := []byte(strings.Repeat("x", 80))
+	if _, err := c.HSet("h", map[string][]byte{"a": big}, 0); err != nil {
+		t.Fatalf("Expected a hash within the limit to be stored, got %v", err)
+	}
+	if _, err := c.HSet("h", map[string][]byte{"b": big}, 0); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge for a hash over the limit, got %v", err)
+	}
+	if fields, _ := c.HGetAll("h"); len(fields) != 1 {
+		t.Errorf("Expected the hash to be unchanged, got %d fields", len(fields))
+	}
+	// Replacing a field only counts the difference
+	if _, err := c.HSet("h", map[string][]byte{"a": []byte(strings.Repeat("y", 95))}, 0); err != nil {
+		t.Errorf("Expected a larger field within the limit to be stored, got %v", err)
+	}
+
+	if _, err := c.RPush("l", 0, big, big); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge for a list over the limit, got %v", err)
+	}
+	if _, _, _, err := c.Get("l"); err != ErrKeyNotFound {
+		t.Errorf("Expected the list not to be created, got %v", err)
+	}
+	if _, err := c.SAdd("s", 0, string(big), string(big[1:])); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge for a set over the limit, got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	if n, err := c.RPush("queue", 0, []byte("b"), []byte("c")); err != nil || n != 2 {
+		t.Fatalf("Expected length 2, got %d, %v", n, err)
+	}
+	if n, _ := c.LPush("queue", 0, []byte("a"), []byte("z")); n != 4 {
+		t.Errorf("Expected length 4, got %d", n)
+	}
+	values, err := c.LRange("queue", 0, -1)
+	if got := fmt.Sprintf("%s", values); err != nil || got != "[z a b c]" {
+		t.Errorf("Expected [z a b c], got %s, %v", got, err)
+	}
+	if values, _ := c.LRange("queue", -2, 10); fmt.Sprintf("%s", values) != "[b c]" {
+		t.Errorf("Expected [b c], got %s", values)
+	}
+	value, _, _, _ := c.Get("queue")
+	if want := "1:z,1:a,1:b,1:c,"; string(value) != want {
+		t.Errorf("Expected %q, got %q", want, value)
+	}
+	if got := c.Stats()["bytes"]; got != "9" {
+		t.Errorf("Expected 9 bytes, got %s", got)
+	}
+
+	if value, _ := c.LPop("queue"); string(value) != "z" {
+		t.Errorf("Expected z, got %q", value)
+	}
+	if value, _ := c.RPop("queue"); string(value) != "c" {
+		t.Errorf("Expected c, got %q", value)
+	}
+	// Pops from the end that was never pushed to
+	if value, _ := c.RPop("queue"); string(value) != "b" {
+		t.Errorf("Expected b, got %q", value)
+	}
+	if n, _ := c.LLen("queue"); n != 1 {
+		t.Errorf("Expected length 1, got %d", n)
+	}
+	c.LPop("queue")
+	if _, err := c.LPop("queue"); err != ErrKeyNotFound {
+		t.Errorf("Expected the empty list to be removed, got %v", err)
+	}
+	if got := c.Stats()["bytes"]; got != "0" {
+		t.Errorf("Expected 0 bytes, got %s", got)
+	}
+
+	// Capped list
+	for i := range 10 {
+		c.LPush("recent", 0, []byte(strconv.Itoa(i)))
+		c.LTrim("recent", 0, 2)
+	}
+	if values, _ := c.LRange("recent", 0, -1); fmt.Sprintf("%s", values) != "[9 8 7]" {
+		t.Errorf("Expected [9 8 7], got %s", values)
+	}
+	c.Set("plain", []byte("value"), 0)
+	if _, err := c.LPush("plain", 0, []byte("a")); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	start := time.Now()
+	if _, err := c.BLPop("jobs", 150*time.Millisecond, nil); err != ErrKeyNotFound {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected to wait about 150ms, waited %v", elapsed)
+	}
+
+	// Waiters are served in order, the remaining elements are stored
+	results := make(chan string, 2)
+	for i := range 2 {
+		go func() {
+			value, err := c.BLPop("jobs", 5*time.Second, nil)
+			results <- fmt.Sprintf("%s %v", value, err)
+		}()
+		for c.Stats()["blocked_clients"] != strconv.Itoa(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if n, _ := c.RPush("jobs", 0, []byte("a"), []byte("b"), []byte("c")); n != 3 {
+		t.Errorf("Expected the length right after the push, 3, got %d", n)
+	}
+	for range 2 {
+		if got := <-results; got != "a <nil>" && got != "b <nil>" {
+			t.Errorf("Expected a or b, got %s", got)
+		}
+	}
+	if values, _ := c.LRange("jobs", 0, -1); fmt.Sprintf("%s", values) != "[c]" {
+		t.Errorf("Expected [c], got %s", values)
+	}
+
+	// A timeout of 0 waits past the timeout checks, a cancelled pop stops
+	// waiting, later pushes are stored
+	cancel := make(chan struct{})
+	go func() {
+		_, err := c.BLPop("queue", 0, cancel)
+		results <- fmt.Sprint(err)
+	}()
+	for c.Stats()["blocked_clients"] != "1" {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if got := c.Stats()["blocked_clients"]; got != "1" {
+		t.Errorf("Expected the pop to keep waiting, got %s blocked clients", got)
+	}
+	close(cancel)
+	if got := <-results; got != ErrKeyNotFound.Error() {
+		t.Errorf("Expected ErrKeyNotFound after cancel, got %s", got)
+	}
+	if got := c.Stats()["blocked_clients"]; got != "0" {
+		t.Errorf("Expected no blocked clients after cancel, got %s", got)
+	}
+	if n, _ := c.RPush("queue", 0, []byte("kept")); n != 1 {
+		t.Errorf("Expected the element to be stored, got length %d", n)
+	}
+
+	// Closing the cache releases the waiters
+	done := make(chan error)
+	go func() {
+		_, err := c.BRPop("other", time.Hour, nil)
+		done <- err
+	}()
+	for c.Stats()["blocked_clients"] != "1" {
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+	if err := <-done; err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after close, got %v", err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	if n, err := c.SAdd("online", 0, "bob", "alice", "bob"); err != nil || n != 2 {
+		t.Fatalf("Expected 2 members added, got %d, %v", n, err)
+	}
+	if n, _ := c.SAdd("online", 0, "alice", "carol"); n != 1 {
+		t.Errorf("Expected 1 member added, got %d", n)
+	}
+	if ok, _ := c.SIsMember("online", "carol"); !ok {
+		t.Error("Expected carol to be a member")
+	}
+	if ok, err := c.SIsMember("missing", "carol"); ok || err != nil {
+		t.Errorf("Expected no member of a missing set, got %v, %v", ok, err)
+	}
+	if members, _ := c.SMembers("online"); fmt.Sprint(members) != "[alice bob carol]" {
+		t.Errorf("Expected [alice bob carol], got %v", members)
+	}
+	value, _, _, _ := c.Get("online")
+	if want := "5:alice,3:bob,5:carol,"; string(value) != want {
+		t.Errorf("Expected %q, got %q", want, value)
+	}
+	if got := c.Stats()["bytes"]; got != "19" {
+		t.Errorf("Expected 19 bytes, got %s", got)
+	}
+	if n, _ := c.SRem("online", "bob", "dave"); n != 1 {
+		t.Errorf("Expected 1 member removed, got %d", n)
+	}
+	if n, _ := c.SCard("online"); n != 2 {
+		t.Errorf("Expected 2 members, got %d", n)
+	}
+	c.SRem("online", "alice", "carol")
+	if _, err := c.SMembers("online"); err != ErrKeyNotFound {
+		t.Errorf("Expected the empty set to be removed, got %v", err)
+	}
+	c.LPush("list", 0, []byte("a"))
+	if _, err := c.SAdd("list", 0, "a"); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+}
+
+func TestSortedSet(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	n, err := c.ZAdd("board", 0, ZMember{"alice", 10}, ZMember{"bob", 12}, ZMember{"carol", 8})
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 members added, got %d, %v", n, err)
+	}
+	if n, _ := c.ZAdd("board", 0, ZMember{"carol", 11}); n != 0 {
+		t.Errorf("Expected a score update to add no members, got %d", n)
+	}
+	if score, _ := c.ZIncrBy("board", "alice", 2.5, 0); score != 12.5 {
+		t.Errorf("Expected 12.5, got %v", score)
+	}
+	if score, _ := c.ZIncrBy("board", "dave", -1, 0); score != -1 {
+		t.Errorf("Expected a new member to start at 0, got %v", score)
+	}
+
+	top, _ := c.ZRange("board", 0, 1, true)
+	if fmt.Sprint(top) != "[{alice 12.5} {bob 12}]" {
+		t.Errorf("Expected alice and bob on top, got %v", top)
+	}
+	if all, _ := c.ZRange("board", 0, -1, false); fmt.Sprint(all) != "[{dave -1} {carol 11} {bob 12} {alice 12.5}]" {
+		t.Errorf("Expected all members in score order, got %v", all)
+	}
+	if members, _ := c.ZRangeByScore("board", 11, 12); fmt.Sprint(members) != "[{carol 11} {bob 12}]" {
+		t.Errorf("Expected carol and bob, got %v", members)
+	}
+	if rank, _ := c.ZRank("board", "carol", false); rank != 1 {
+		t.Errorf("Expected rank 1, got %d", rank)
+	}
+	if rank, _ := c.ZRank("board", "carol", true); rank != 2 {
+		t.Errorf("Expected reverse rank 2, got %d", rank)
+	}
+	if _, err := c.ZRank("board", "missing", false); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if score, _ := c.ZScore("board", "bob"); score != 12 {
+		t.Errorf("Expected 12, got %v", score)
+	}
+	value, _, _, _ := c.Get("board")
+	if want := "4:dave,2:-1,5:carol,2:11,3:bob,2:12,5:alice,4:12.5,"; string(value) != want {
+		t.Errorf("Expected %q, got %q", want, value)
+	}
+	if got := c.Stats()["bytes"]; got != strconv.Itoa(len("board")+len("davecarolbobalice")+4*8) {
+		t.Errorf("Expected the members and scores to be counted, got %s", got)
+	}
+	if _, err := c.ZIncrBy("board", "bob", math.NaN(), 0); err != ErrNotNumeric {
+		t.Errorf("Expected ErrNotNumeric for NaN, got %v", err)
+	}
+	if n, _ := c.ZRem("board", "dave", "carol", "bob", "alice"); n != 4 {
+		t.Errorf("Expected 4 members removed, got %d", n)
+	}
+	if _, err := c.ZRange("board", 0, -1, false); err != ErrKeyNotFound {
+		t.Errorf("Expected the empty sorted set to be removed, got %v", err)
+	}
+}
+
+func TestSkiplist(t *testing.T) {
+	l := newSkiplist()
+	var want []ZMember
+	check := func() {
+		t.Helper()
+		if l.length != len(want) {
+			t.Fatalf("Expected %d members, got %d", len(want), l.length)
+		}
+		n := l.first()
+		for i, m := range want {
+			if n == nil || n.ZMember != m {
+				t.Fatalf("Expected %v at %d, got %v", m, i, n)
+			}
+			if got := l.at(i); got != n {
+				t.Fatalf("Expected node %v at rank %d, got %v", m, i, got)
+			}
+			if got := l.rank(m); got != i {
+				t.Fatalf("Expected rank %d for %v, got %d", i, m, got)
+			}
+			if n.links[0].next == nil && l.tail != n {
+				t.Fatalf("Expected %v to be the tail", m)
+			}
+			n = n.links[0].next
+		}
+		if l.at(len(want)) != nil {
+			t.Fatal("Expected no node past the end")
+		}
+	}
+
+	// Random inserts and removals with many equal scores
+	for i := range 2000 {
+		m := ZMember{strconv.Itoa(i % 500), float64(i % 7)}
+		j, found := slices.BinarySearchFunc(want, m, compareZMembers)
+		if found {
+			if !l.remove(m) {
+				t.Fatalf("Expected %v to be removed", m)
+			}
+			want = slices.Delete(want, j, j+1)
+		} else {
+			l.insert(m)
+			want = slices.Insert(want, j, m)
+		}
+		if i%100 == 0 {
+			check()
+		}
+	}
+	check()
+	if l.remove(ZMember{"missing", 1}) {
+		t.Error("Expected a missing member not to be removed")
+	}
+	if n := l.seek(ZMember{"", 3}); n == nil || n.Score != 3 || n.prev.Score != 2 {
+		t.Errorf("Expected seek to find the first member with score 3, got %v", n)
+	}
+	for _, m := range want {
+		l.remove(m)
+	}
+	want = nil
+	check()
+	if l.tail != nil || l.level != 1 {
+		t.Errorf("Expected an empty list, got tail %v and level %d", l.tail, l.level)
+	}
+}
+
+func TestIndexScan(t *testing.T) {
+	idx := NewIndex()
+	for i := range 100 {
+		idx.Set(&IndexEntry{Key: fmt.Sprintf("key%d", i)})
+	}
+
+	// Delete and add entries between batches, all entries that exist
+	// during the whole scan must be visited
+	seen := make(map[string]bool)
+	cursor, batches := 0, 0
+	for {
+		cursor = idx.Scan(cursor, 10, func(e *IndexEntry) { seen[e.Key] = true })
+		batches++
+		if cursor == 0 {
+			break
+		}
+		idx.Delete(fmt.Sprintf("key%d", batches*7))
+		idx.Set(&IndexEntry{Key: fmt.Sprintf("new%d", batches)})
+	}
+	for i := range 100 {
+		key := fmt.Sprintf("key%d", i)
+		if _, ok := idx.Get(key); ok && !seen[key] {
+			t.Errorf("Scan missed %s", key)
+		}
+	}
+	if batches > 11 {
+		t.Errorf("Expected at most 11 batches, got %d", batches)
+	}
+	if idx.Count() != len(idx.entries) {
+		t.Errorf("Expected %d entries, got %d", idx.Count(), len(idx.entries))
+	}
+}
+
+func TestMetadump(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	for i := range 2500 {
+		c.Set(fmt.Sprintf("key%d", i), []byte("value"), 0)
+	}
+	c.Set("ttl", []byte("value"), time.Minute)
+	c.Get("ttl")
+
+	seen := make(map[string]ItemMeta)
+	c.Metadump(-1, func(meta ItemMeta) bool {
+		seen[meta.Key] = meta
+		return true
+	})
+	if len(seen) != 2501 {
+		t.Fatalf("Expected 2501 items, got %d", len(seen))
+	}
+	meta := seen["ttl"]
+	if !meta.Fetched || meta.Size != 8 || meta.Class != 1 || meta.Cas == 0 ||
+		meta.SoftExpiry.IsZero() || !meta.HardExpiry.After(meta.SoftExpiry) ||
+		time.Since(meta.LastAccess) > time.Minute || meta.Shard != c.workerFor("ttl") {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+	if meta := seen["key1"]; meta.Fetched || !meta.SoftExpiry.IsZero() || !meta.HardExpiry.IsZero() {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+
+	// A single shard, stopping early
+	n := 0
+	c.Metadump(0, func(meta ItemMeta) bool {
+		if meta.Shard != 0 {
+			t.Errorf("Expected only shard 0, got %d", meta.Shard)
+		}
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Errorf("Expected to stop after 10 items, got %d", n)
+	}
+}
+
+func TestScan(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	for i := range 100 {
+		c.Set(fmt.Sprintf("user:%d", i), []byte("value"), 0)
+		c.Set(fmt.Sprintf("session:%d", i), []byte("value"), 0)
+	}
+
+	seen := make(map[string]int)
+	var cursor uint64
+	for {
+		var keys []string
+		keys, cursor = c.Scan(cursor, "user:*", 7)
+		if len(keys) > 7 {
+			t.Errorf("Expected at most 7 keys, got %d", len(keys))
+		}
+		for _, key := range keys {
+			seen[key]++
+		}
+		// Mutations between batches must not break the scan
+		c.Delete("session:1")
+		c.Set("user:new", []byte("value"), 0)
+		if cursor == 0 {
+			break
+		}
+	}
+	for i := range 100 {
+		if key := fmt.Sprintf("user:%d", i); seen[key] == 0 {
+			t.Errorf("Scan missed %s", key)
+		}
+	}
+	for key := range seen {
+		if !strings.HasPrefix(key, "user:") {
+			t.Errorf("Unexpected key %s", key)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	c.Set("key1", []byte("value1"), time.Minute)
+	c.Set("key2", []byte("value2"), 0)
+
+	values := make(map[string]string)
+	c.Range(func(key string, value []byte, meta ItemMeta) bool {
+		values[key] = string(value)
+		if meta.Key != key || meta.Size != len(key)+len(value) {
+			t.Errorf("Unexpected metadata %+v", meta)
+		}
+		return true
+	})
+	if len(values) != 2 || values["key1"] != "value1" || values["key2"] != "value2" {
+		t.Errorf("Unexpected items %v", values)
+	}
+
+	n := 0
+	c.Range(func(string, []byte, ItemMeta) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Expected Range to stop after 1 item, got %d", n)
+	}
+}
+
+func TestNamespaceInvalidation(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	for i := range 100 {
+		c.Set(fmt.Sprintf("tenant:42:%d", i), []byte("value"), 0)
+		c.Set(fmt.Sprintf("tenant:4:%d", i), []byte("value"), 0)
+	}
+	c.Set("tenant:42:sub:1", []byte("value"), 0)
+
+	if gen := c.InvalidateNamespace("tenant:42"); gen != 1 {
+		t.Errorf("Expected generation 1, got %d", gen)
+	}
+	if gen := c.NamespaceGeneration("tenant:42"); gen != 1 {
+		t.Errorf("Expected generation 1, got %d", gen)
+	}
+	if gen := c.NamespaceGeneration("tenant:4"); gen != 0 {
+		t.Errorf("Expected generation 0, got %d", gen)
+	}
+
+	for _, key := range []string{"tenant:42:1", "tenant:42:sub:1"} {
+		if _, _, _, err := c.Get(key); err != ErrKeyNotFound {
+			t.Errorf("Expected %s to be invalidated, got %v", key, err)
+		}
+	}
+	if _, _, _, err := c.Get("tenant:4:1"); err != nil {
+		t.Errorf("Expected tenant:4:1 to survive, got %v", err)
+	}
+	if _, err := c.Add("tenant:42:2", []byte("new"), 0); err != nil {
+		t.Errorf("Expected add of an invalidated key to succeed, got %v", err)
+	}
+	if value, _, _, err := c.Get("tenant:42:2"); err != nil || string(value) != "new" {
+		t.Errorf("Expected the new value, got %q, %v", value, err)
+	}
+	var keys []string
+	for cursor := uint64(0); ; {
+		var batch []string
+		batch, cursor = c.Scan(cursor, "tenant:42:*", 1000)
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(keys) != 1 || keys[0] != "tenant:42:2" {
+		t.Errorf("Expected Scan to return only tenant:42:2, got %v", keys)
+	}
+
+	// The sweep in the maintenance ticks reclaims the other entries
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Stats()["curr_items"] != "101" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := c.Stats()
+	if stats["curr_items"] != "101" || stats["ns_reclaimed"] != "101" {
+		t.Errorf("Expected 101 items and 101 reclaimed, got %s and %s", stats["curr_items"], stats["ns_reclaimed"])
+	}
+	if gen := c.InvalidateNamespace("tenant:42"); gen != 2 {
+		t.Errorf("Expected generation 2, got %d", gen)
+	}
+}
+
+func TestNamespaceDelimiter(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NamespaceDelimiter = '/'
+	c, err := NewSharded(cfg, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Set("tenant/42/a", []byte("value"), 0)
+	c.Set("tenant:42:a", []byte("value"), 0)
+	c.InvalidateNamespace("tenant/42")
+	c.InvalidateNamespace("tenant:42")
+
+	if _, _, _, err := c.Get("tenant/42/a"); err != ErrKeyNotFound {
+		t.Errorf("Expected tenant/42/a to be invalidated, got %v", err)
+	}
+	if _, _, _, err := c.Get("tenant:42:a"); err != nil {
+		t.Errorf("Expected tenant:42:a to survive, got %v", err)
+	}
+}
+
+func TestNamespaceDelimiterDefault(t *testing.T) {
+	c, err := NewSharded(Config{}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Set("tenant:42:a", []byte("value"), 0)
+	c.Set("tenant:4:a", []byte("value"), 0)
+	c.InvalidateNamespace("tenant:42")
+
+	if _, _, _, err := c.Get("tenant:42:a"); err != ErrKeyNotFound {
+		t.Errorf("Expected tenant:42:a to be invalidated, got %v", err)
+	}
+	if _, _, _, err := c.Get("tenant:4:a"); err != nil {
+		t.Errorf("Expected tenant:4:a to survive, got %v", err)
+	}
+}
+
+func TestNamespaceGenerationsBounded(t *testing.T) {
+	g := newNamespaceGenerations()
+	g.bump("first")
+	g.bump("second")
+	g.bump("first") // first is now the most recently invalidated
+	for i := range maxNamespaceGenerations - 1 {
+		g.bump(fmt.Sprintf("ns%d", i))
+	}
+
+	if len(g.byNs) != maxNamespaceGenerations || g.order.Len() != maxNamespaceGenerations {
+		t.Errorf("Expected %d namespaces, got %d and %d", maxNamespaceGenerations, len(g.byNs), g.order.Len())
+	}
+	if gen := g.get("second"); gen != 0 {
+		t.Errorf("Expected the generation of second to be dropped, got %d", gen)
+	}
+	if gen := g.get("first"); gen != 2 {
+		t.Errorf("Expected generation 2 for first, got %d", gen)
+	}
+	if gen := g.bump("second"); gen != 1 {
+		t.Errorf("Expected the generation of second to restart at 1, got %d", gen)
+	}
+}
+
+func TestIndexTags(t *testing.T) {
+	idx := NewIndex()
+	idx.Set(&IndexEntry{Key: "a", Tags: []string{"product:1", "product:2"}})
+	idx.Set(&IndexEntry{Key: "b", Tags: []string{"product:1"}})
+	if keys := idx.Tagged("product:1"); len(keys) != 2 {
+		t.Errorf("Expected 2 keys, got %v", keys)
+	}
+
+	// Replacing an entry replaces its tags, updating it in place keeps them
+	idx.Set(&IndexEntry{Key: "a", Tags: []string{"product:3"}})
+	entry, _ := idx.Get("a")
+	idx.Set(entry)
+	if keys := idx.Tagged("product:2"); len(keys) != 0 {
+		t.Errorf("Expected no keys, got %v", keys)
+	}
+	if keys := idx.Tagged("product:3"); len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("Expected [a], got %v", keys)
+	}
+
+	idx.Delete("a")
+	idx.Delete("b")
+	if len(idx.tags) != 0 {
+		t.Errorf("Expected an empty tag index, got %v", idx.tags)
+	}
+}
+
+func TestInvalidateTag(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	for i := range 20 {
+		tags := []string{"product:1"}
+		if i%2 == 0 {
+			tags = append(tags, "product:2")
+		}
+		c.SetWithTags(fmt.Sprintf("page:%d", i), []byte("html"), 0, tags)
+	}
+	c.Set("page:untagged", []byte("html"), 0)
+	c.Delete("page:0")
+	// A store without tags removes the tags
+	c.Set("page:2", []byte("html"), 0)
+
+	if n := c.InvalidateTag("product:2"); n != 8 {
+		t.Errorf("Expected 8 items removed, got %d", n)
+	}
+	if _, _, _, err := c.Get("page:4"); err != ErrKeyNotFound {
+		t.Errorf("Expected page:4 to be removed, got %v", err)
+	}
+	if n := c.InvalidateTag("product:1"); n != 10 {
+		t.Errorf("Expected 10 items removed, got %d", n)
+	}
+	if n := c.InvalidateTag("product:1"); n != 0 {
+		t.Errorf("Expected no items removed, got %d", n)
+	}
+	stats := c.Stats()
+	if stats["curr_items"] != "2" || stats["tag_invalidated"] != "18" {
+		t.Errorf("Expected 2 items and 18 invalidated, got %s and %s", stats["curr_items"], stats["tag_invalidated"])
+	}
+}
+
+func TestInvalidateTagExpired(t *testing.T) {
+	// Not started, so the maintenance ticks don't remove the expired entry first
+	w := NewWorker(0, 1, 0, 0)
+	w.handleSet(&Request{Op: OpSet, Key: "live", Value: []byte("x"), Tags: []string{"t"}})
+	w.handleSet(&Request{Op: OpSet, Key: "expired", Value: []byte("x"), TTL: time.Hour, Tags: []string{"t"}})
+	entry, _ := w.index.Get("expired")
+	entry.HardExpiry = time.Now().UnixMilli() - 1
+
+	if resp := w.handleInvalidateTag(&Request{Op: OpInvalidateTag, Key: "t"}); resp.Count != 1 {
+		t.Errorf("Expected 1 item removed, got %d", resp.Count)
+	}
+	if w.stats.TagInvalidated != 1 || w.stats.ExpiredUnfetched != 1 {
+		t.Errorf("Expected 1 invalidated and 1 expired, got %d and %d", w.stats.TagInvalidated, w.stats.ExpiredUnfetched)
+	}
+	if w.index.Count() != 0 || w.usedMemory != 0 {
+		t.Errorf("Expected an empty index, got %d items of %d bytes", w.index.Count(), w.usedMemory)
+	}
+}
+
+func TestDeletePattern(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	for i := range 2500 {
+		c.Set(fmt.Sprintf("user:%d:profile", i), []byte("value"), 0)
+	}
+	c.Set("user:123:session", []byte("value"), 0)
+
+	if n := c.DeletePattern("user:123:*", true); n != 2 {
+		t.Errorf("Expected 2 matches, got %d", n)
+	}
+	if _, _, _, err := c.Get("user:123:session"); err != nil {
+		t.Errorf("Expected a dry run to keep the items, got %v", err)
+	}
+	if n := c.DeletePattern("user:123:*", false); n != 2 {
+		t.Errorf("Expected 2 items deleted, got %d", n)
+	}
+	if _, _, _, err := c.Get("user:123:session"); err != ErrKeyNotFound {
+		t.Errorf("Expected user:123:session to be deleted, got %v", err)
+	}
+	// Spans several batches per worker
+	if n := c.DeletePattern("user:*[05]:profile", false); n != 500 {
+		t.Errorf("Expected 500 items deleted, got %d", n)
+	}
+	stats := c.Stats()
+	if stats["curr_items"] != "1999" || stats["pattern_deleted"] != "502" {
+		t.Errorf("Expected 1999 items and 502 deleted, got %s and %s", stats["curr_items"], stats["pattern_deleted"])
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "session:1", false},
+		{"*:1", "user:1", true},
+		{"*:1", "user:12", false},
+		{"u?er:*", "user:1", true},
+		{"user:[0-4]", "user:3", true},
+		{"user:[0-4]", "user:5", false},
+		{"user:[^0-4]", "user:5", true},
+		{"user:[ab]*", "user:bc", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"[unclosed", "[unclosed", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// Set a key with short TTL (200ms soft, 400ms hard with 2.0 multiplier)
+	cas, setErr := c.Set("expiry_key", []byte("expiry_value"), 200*time.Millisecond)
+	if setErr != nil {
+		t.Fatalf("Set failed: %v", setErr)
+	}
+	if cas == 0 {
+		t.Error("Expected non-zero CAS")
+	}
+
+	// Should be accessible immediately with flags=0 (fresh)
+	val, _, flags, err := c.Get("expiry_key")
+	if err != nil {
+		t.Fatalf("Key should be accessible immediately: err=%v", err)
+	}
+	if string(val) != "expiry_value" {
+		t.Errorf("Expected 'expiry_value', got '%s'", val)
+	}
+	if flags != 0 {
+		t.Errorf("Expected flags=0 (fresh) immediately after set, got %d", flags)
+	}
+
+	// Wait past soft-expiry (200ms) but before hard-expiry (400ms)
+	time.Sleep(250 * time.Millisecond)
+
+	// First stale access should return flags=3 (refresh)
+	val, _, flags, err = c.Get("expiry_key")
+	if err != nil {
+		t.Fatalf("Key should still be accessible after soft-expiry: err=%v", err)
+	}
+	if string(val) != "expiry_value" {
+		t.Errorf("Expected 'expiry_value', got '%s'", val)
+	}
+	if flags != 3 {
+		t.Errorf("Expected flags=3 (refresh) on first stale access, got %d", flags)
+	}
+
+	// Second stale access should return flags=1 (stale, not refresh)
+	val, _, flags, err = c.Get("expiry_key")
+	if err != nil {
+		t.Fatalf("Key should still be accessible after soft-expiry: err=%v", err)
+	}
+	if string(val) != "expiry_value" {
+		t.Errorf("Expected 'expiry_value', got '%s'", val)
+	}
+	if flags != 1 {
+		t.Errorf("Expected flags=1 (stale) on subsequent access, got %d", flags)
+	}
+
+	// Wait past hard-expiry (400ms total from set)
+	time.Sleep(200 * time.Millisecond)
+
+	// Should be gone after hard-expiry (ErrKeyNotFound)
+	_, _, _, err = c.Get("expiry_key")
+	if err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after hard-expiry, got %v", err)
+	}
+}
+
+func TestSingleFlightRefresh(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	const numGoroutines = 50
+	const key = "single_flight_key"
+
+	// Set a key with short TTL (100ms soft, 200ms hard with 2.0 multiplier)
+	_, err := c.Set(key, []byte("value"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Wait past soft-expiry but before hard-expiry
+	time.Sleep(150 * time.Millisecond)
+
+	// Launch goroutines that all try to get the stale key simultaneously
+	var wg sync.WaitGroup
+	refreshCount := int64(0)
+	staleCount := int64(0)
+	freshCount := int64(0)
+	errorCount := int64(0)
+
+	// Use a barrier to ensure all goroutines start at the same time
+	startChan := make(chan struct{})
+
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Wait for start signal
+			<-startChan
+
+			_, _, flags, err := c.Get(key)
+			if err != nil {
+				atomic.AddInt64(&errorCount, 1)
+				return
+			}
+
+			switch flags {
+			case 0:
+				atomic.AddInt64(&freshCount, 1)
+			case 1:
+				atomic.AddInt64(&staleCount, 1)
+			case 3:
+				atomic.AddInt64(&refreshCount, 1)
+			}
+		}()
+	}
+
+	// Start all goroutines simultaneously
+	close(startChan)
+	wg.Wait()
+
+	// Verify exactly one goroutine got refresh flag
+	if refreshCount != 1 {
+		t.Errorf("Expected exactly 1 refresh (flags=3), got %d", refreshCount)
+	}
+
+	// All other successful goroutines should get stale flag
+	expectedStale := int64(numGoroutines) - refreshCount - errorCount
+	if staleCount != expectedStale {
+		t.Errorf("Expected %d stale (flags=1), got %d", expectedStale, staleCount)
+	}
+
+	// No fresh flags should be returned (we're past soft expiry)
+	if freshCount != 0 {
+		t.Errorf("Expected 0 fresh (flags=0), got %d", freshCount)
+	}
+
+	if errorCount > 0 {
+		t.Errorf("Unexpected errors: %d", errorCount)
+	}
+
+	t.Logf("Single-flight test passed: refresh=%d, stale=%d, fresh=%d, errors=%d",
+		refreshCount, staleCount, freshCount, errorCount)
+}
+
+func TestStaleFlags(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	const key = "stale_test_key"
+
+	// Test 1: Fresh access should return flags=0
+	_, err := c.Set(key, []byte("fresh_value"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	_, _, flags, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if flags != 0 {
+		t.Errorf("Test 1: Expected flags=0 (fresh), got %d", flags)
+	}
+
+	// Test 2: After soft expiry, first access should return flags=3 (refresh)
+	time.Sleep(150 * time.Millisecond)
+	_, _, flags, err = c.Get(key)
+	if err != nil {
+		t.Fatalf("Get failed after soft expiry: %v", err)
+	}
+	if flags != 3 {
+		t.Errorf("Test 2: Expected flags=3 (refresh), got %d", flags)
+	}
+
+	// Test 3: Subsequent stale access should return flags=1
+	_, _, flags, err = c.Get(key)
+	if err != nil {
+		t.Fatalf("Get failed for subsequent stale access: %v", err)
+	}
+	if flags != 1 {
+		t.Errorf("Test 3: Expected flags=1 (stale), got %d", flags)
+	}
+
+	// Test 4: After refresh (re-set), should be fresh again
+	_, err = c.Set(key, []byte("refreshed_value"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Re-set failed: %v", err)
+	}
+	_, _, flags, err = c.Get(key)
+	if err != nil {
+		t.Fatalf("Get failed after refresh: %v", err)
+	}
+	if flags != 0 {
+		t.Errorf("Test 4: Expected flags=0 (fresh) after refresh, got %d", flags)
+	}
+
+	// Test 5: After hard expiry, key should be gone
+	time.Sleep(250 * time.Millisecond)
+	_, _, _, err = c.Get(key)
+	if err != ErrKeyNotFound {
+		t.Errorf("Test 5: Expected ErrKeyNotFound after hard expiry, got %v", err)
+	}
+
+	t.Log("All stale flag tests passed")
+}
+
+func TestLargeValue(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
 
@@ -838,3 +2354,129 @@ func TestValueWithBinaryData(t *testing.T) {
 		}
 	}
 }
+
+func TestHyperLogLog(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	if changed, err := c.PFAdd("visitors", 0, "a", "b", "c"); err != nil || !changed {
+		t.Fatalf("Expected the first add to change the estimate, got %v, %v", changed, err)
+	}
+	if changed, _ := c.PFAdd("visitors", 0, "a", "b"); changed {
+		t.Error("Expected re-adding elements not to change the estimate")
+	}
+	if n, _ := c.PFCount("visitors"); n != 3 {
+		t.Errorf("Expected 3, got %d", n)
+	}
+	if n, err := c.PFCount("missing"); err != nil || n != 0 {
+		t.Errorf("Expected 0 for a missing key, got %d, %v", n, err)
+	}
+
+	for i := range 100000 {
+		c.PFAdd("big", 0, "user"+strconv.Itoa(i))
+		if i%2 == 0 {
+			c.PFAdd("half", 0, "user"+strconv.Itoa(i))
+		}
+	}
+	for _, tc := range []struct {
+		keys []string
+		want float64
+	}{
+		{[]string{"big"}, 100000},
+		{[]string{"half"}, 50000},
+		{[]string{"big", "half", "missing"}, 100000},
+	} {
+		n, err := c.PFCount(tc.keys...)
+		if err != nil || math.Abs(float64(n)-tc.want) > tc.want*0.03 {
+			t.Errorf("PFCount(%v): expected about %v, got %d, %v", tc.keys, tc.want, n, err)
+		}
+	}
+
+	if err := c.PFMerge("all", 0, "visitors", "half"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := c.PFCount("all"); math.Abs(float64(n)-50003) > 50003*0.03 {
+		t.Errorf("Expected about 50003 after the merge, got %d", n)
+	}
+	if v, _, _, _ := c.Get("visitors"); len(v) != hllBytes {
+		t.Errorf("Expected the registers from a get, got %d bytes", len(v))
+	}
+
+	c.Set("plain", []byte("x"), 0)
+	if _, err := c.PFAdd("plain", 0, "a"); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+	if err := c.PFMerge("all", 0, "plain"); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType from a plain source, got %v", err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	if err := c.BFReserve("seen", 0, 0.01, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BFReserve("seen", 0, 0.01, 1000); err != ErrKeyExists {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	if err := c.BFReserve("bad", 0, 1, 1000); err != ErrBloomParams {
+		t.Errorf("Expected ErrBloomParams, got %v", err)
+	}
+	if err := c.BFReserve("huge", 0, 0.001, 100000000); err != ErrBloomParams {
+		t.Errorf("Expected ErrBloomParams, got %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.MaxValueSize = 0
+	unlimited, err := NewSharded(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlimited.Close()
+	for _, capacity := range []int{1000000000, math.MaxInt} {
+		if err := unlimited.BFReserve("huge", 0, 0.001, capacity); err != ErrBloomParams {
+			t.Errorf("Expected ErrBloomParams for capacity %d without a maximum value size, got %v", capacity, err)
+		}
+	}
+
+	if n, err := c.BFAdd("seen", 0, "a", "b", "a"); err != nil || n != 2 {
+		t.Errorf("Expected 2 items added, got %d, %v", n, err)
+	}
+	for i := range 1000 {
+		c.BFAdd("seen", 0, "id"+strconv.Itoa(i))
+	}
+	for i := range 1000 {
+		if ok, _ := c.BFExists("seen", "id"+strconv.Itoa(i)); !ok {
+			t.Fatalf("Expected added item %d to exist", i)
+		}
+	}
+	falsePositives := 0
+	for i := range 10000 {
+		if ok, _ := c.BFExists("seen", "other"+strconv.Itoa(i)); ok {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Expected about 1%% false positives, got %d of 10000", falsePositives)
+	}
+
+	// Adding to a missing key creates a filter with the default parameters
+	if n, _ := c.BFAdd("auto", 0, "x"); n != 1 {
+		t.Errorf("Expected 1 item added, got %d", n)
+	}
+	if ok, err := c.BFExists("auto", "x"); err != nil || !ok {
+		t.Errorf("Expected x to exist, got %v, %v", ok, err)
+	}
+	if ok, err := c.BFExists("missing", "x"); err != nil || ok {
+		t.Errorf("Expected nothing in a missing filter, got %v, %v", ok, err)
+	}
+	if _, err := c.BFExists("seen", "x"); err != nil {
+		t.Error(err)
+	}
+	c.Set("plain", []byte("x"), 0)
+	if _, err := c.BFAdd("plain", 0, "a"); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package tqmemory
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrWrongType is returned by an operation on a key that holds a value of
+// another type, such as a hash operation on a plain value.
+var ErrWrongType = errors.New("operation against a key holding the wrong kind of value")
+
+// Typed values: instead of bytes, an entry can hold a structure such as a
+// hash in Data, which the typed operations change in place. Data counts
+// towards the memory of the entry, and a get returns its serialization.
+
+// typedValue is a structure stored in IndexEntry.Data.
+type typedValue interface {
+	// size returns the bytes counted for the value in usedMemory.
+	size() int64
+	// appendTo appends the serialization returned by a get.
+	appendTo(buf []byte) []byte
+}
+
+// entryValue returns the value of an entry as bytes, serializing a typed
+// value.
+func entryValue(entry *IndexEntry) []byte {
+	if entry.Data != nil {
+		return entry.Data.appendTo(nil)
+	}
+	return entry.Value
+}
+
+// appendNetstring appends b as a netstring, "<length>:<bytes>,", the
+// element format of the typed value serializations.
+func appendNetstring(buf, b []byte) []byte {
+	buf = strconv.AppendInt(buf, int64(len(b)), 10)
+	buf = append(buf, ':')
+	buf = append(buf, b...)
+	return append(buf, ',')
+}
+
+// liveEntry returns the entry of key if it exists and is not past its hard
+// expiry.
+func (w *Worker) liveEntry(key string) (*IndexEntry, bool) {
+	entry, ok := w.index.Get(key)
+	if !ok || (entry.HardExpiry > 0 && entry.HardExpiry <= time.Now().UnixMilli()) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// lookupTyped returns the live entry of key and its value, or a nil entry
+// if the key doesn't exist. It returns ErrWrongType if the key holds a
+// value of another type.
+func lookupTyped[T typedValue](w *Worker, key string) (*IndexEntry, T, error) {
+	var zero T
+	entry, ok := w.liveEntry(key)
+	if !ok {
+		return nil, zero, nil
+	}
+	v, ok := entry.Data.(T)
+	if !ok {
+		return nil, zero, ErrWrongType
+	}
+	return entry, v, nil
+}
+
+// updateTyped changes the value of entry with update, after evicting items
+// to make room for growth more bytes. If entry is nil, or was evicted, the
+// key is stored first with the value returned by create and the ttl (the
+// default TTL if 0). The entry gets a new CAS and is returned. The value
+// is not changed and ErrValueTooLarge is returned if the item would grow
+// beyond the maximum value size.
+func updateTyped[T typedValue](w *Worker, entry *IndexEntry, key string, ttl time.Duration,
+	growth int64, create func() T, update func(v T)) (*IndexEntry, error) {
+	if w.tooLarge(entry, growth) {
+		return entry, ErrValueTooLarge
+	}
+	if growth > 0 && w.maxMemory > 0 {
+		w.evictLRU(growth)
+		if current, ok := w.index.Get(key); !ok || current != entry {
+			entry = nil
+		}
+	}
+	if entry == nil {
+		w.doSet(key, nil, ttl, 0, false, nil)
+		entry, _ = w.index.Get(key)
+		w.itemRemoved(entrySize(entry))
+		entry.Data = create()
+		w.itemAdded(entrySize(entry))
+	}
+
+	w.itemRemoved(entrySize(entry))
+	update(entry.Data.(T))
+	w.casCounter++
+	entry.Cas = w.casCounter
+	w.index.Set(entry)
+	w.index.Touch(entry.Key)
+	w.itemAdded(entrySize(entry))
+	return entry, nil
+}
+
+// tooLarge reports whether the item of entry (nil for a new item) would
+// exceed the maximum value size after growing by growth bytes.
+func (w *Worker) tooLarge(entry *IndexEntry, growth int64) bool {
+	if growth <= 0 || w.maxValueSize <= 0 {
+		return false
+	}
+	if entry != nil {
+		growth += entrySize(entry)
+	}
+	return growth > int64(w.maxValueSize)
+}
+
+// removeTyped deletes the entry of a typed value that became empty.
+func (w *Worker) removeTyped(entry *IndexEntry) {
+	w.index.Delete(entry.Key)
+	w.itemRemoved(entrySize(entry))
+	w.notifyRemoved(entry, RemovedDeleted)
+}
+
+// readTyped counts a read of a typed value like a get.
+func (w *Worker) readTyped(key string, entry *IndexEntry) {
+	w.stats.CmdGet++
+	ps := w.prefixStats(key)
+	if ps != nil {
+		ps.Gets++
+	}
+	if entry == nil {
+		w.stats.GetMisses++
+		return
+	}
+	w.stats.GetHits++
+	if ps != nil {
+		ps.Hits++
+	}
+	entry.Fetched = true
+	w.index.Touch(entry.Key)
+}
@@ -0,0 +1,160 @@
+package tqmemory
+
+import (
+	"strings"
+	"time"
+)
+
+// WatchKind selects the event streams of a Watcher, like the arguments of
+// memcached's "watch" command.
+type WatchKind uint32
+
+const (
+	WatchFetchers    WatchKind = 1 << iota // item_get and item_touch events
+	WatchMutations                         // item_store and deleted events
+	WatchEvictions                         // eviction events
+	WatchExpirations                       // expired events
+)
+
+// DefaultWatchBuffer is the number of events a watcher can fall behind
+// before events are dropped.
+const DefaultWatchBuffer = 1024
+
+// WatchEvent is a cache event delivered to watchers. Type, Status and Op
+// use the names of memcached's watch output.
+type WatchEvent struct {
+	Kind    WatchKind
+	ID      uint64        // Increasing event number (memcached's gid)
+	Time    time.Time     // When the event happened
+	Type    string        // "item_get", "item_touch", "item_store", "deleted", "eviction" or "expired"
+	Key     string        // Key of the item
+	Status  string        // Request outcome, e.g. "found", "not_found", "stored" or "exists"
+	Op      string        // Operation of a mutation, e.g. "set" or "append"
+	TTL     time.Duration // Requested TTL of a mutation, or the remaining TTL of a removed item (-1 = none)
+	Size    int           // Key plus value size of the item, 0 if it was not found
+	Class   int           // Size class of the item, numbered from 1 like "stats items"
+	Fetched bool          // Evictions and expirations: the item was read before
+	Shard   int           // Worker that owns the key
+	Client  string        // Client address of the request, if known
+}
+
+// Watcher receives the cache events of the kinds it watches. Events are
+// delivered through a buffered channel without ever blocking the workers:
+// when the buffer is full, events are dropped and counted.
+type Watcher struct {
+	subscription[WatchEvent]
+}
+
+// watchHub fans the events of all workers out to the watchers.
+type watchHub struct {
+	hub[WatchEvent]
+}
+
+// wants reports whether any watcher watches kind.
+func (h *watchHub) wants(kind WatchKind) bool {
+	return h.hub.wants(uint32(kind))
+}
+
+func (h *watchHub) add(kinds WatchKind, buffer int) *Watcher {
+	w := &Watcher{}
+	h.subscribe(&w.subscription, uint32(kinds), buffer, nil, nil)
+	return w
+}
+
+// publish delivers an event to the watchers of its kind. The key may alias
+// a connection's read buffer, so it is copied first.
+func (h *watchHub) publish(ev WatchEvent) {
+	h.hub.publish(uint32(ev.Kind), ev.Key, false, func(id uint64) WatchEvent {
+		ev.ID = id
+		ev.Time = time.Now()
+		ev.Key = strings.Clone(ev.Key)
+		return ev
+	})
+}
+
+// watchStatus returns the watch status of a request outcome.
+func watchStatus(err error, ok string) string {
+	switch err {
+	case nil:
+		return ok
+	case ErrKeyNotFound:
+		return "not_found"
+	case ErrKeyExists:
+		return "not_stored"
+	case ErrCasMismatch:
+		return "exists"
+	case ErrValueTooLarge:
+		return "too_large"
+	case ErrNotNumeric:
+		return "non_numeric"
+	case ErrWrongType:
+		return "wrong_type"
+	}
+	return "error"
+}
+
+// watchRequest publishes the fetch and mutation events of an executed
+// request. It is called before the response is sent, while the request's
+// key and value may still be read.
+func (w *Worker) watchRequest(req *Request, resp *Response) {
+	fetch := func(typ, key string, value []byte, err error) {
+		ev := WatchEvent{Kind: WatchFetchers, Type: typ, Key: key,
+			Status: watchStatus(err, "found"), Shard: w.shard, Client: req.Client}
+		if err == nil {
+			ev.Size = len(key) + len(value)
+			ev.Class = sizeClass(int64(ev.Size)) + 1
+		}
+		w.watch.publish(ev)
+	}
+	switch req.Op {
+	case OpGet:
+		if w.watch.wants(WatchFetchers) {
+			fetch("item_get", req.Key, resp.Value, resp.Err)
+		}
+	case OpGetMulti:
+		if w.watch.wants(WatchFetchers) {
+			for i, key := range req.Keys {
+				fetch("item_get", key, req.Results[i].Value, req.Results[i].Err)
+			}
+		}
+	case OpTouch:
+		if w.watch.wants(WatchFetchers) {
+			fetch("item_touch", req.Key, nil, resp.Err)
+		}
+	case OpSet, OpAdd, OpReplace, OpCas, OpAppend, OpPrepend,
+		OpIncr, OpDecr, OpIncrOrCreate, OpDecrOrCreate, OpDelete, OpHSet, OpHDel, OpHIncrBy,
+		OpLPush, OpRPush, OpLPop, OpRPop, OpBLPop, OpBRPop, OpLTrim,
+		OpSAdd, OpSRem, OpZAdd, OpZIncrBy, OpZRem, OpPFAdd, OpPFMerge, OpBFReserve, OpBFAdd:
+		if !w.watch.wants(WatchMutations) {
+			return
+		}
+		ev := WatchEvent{Kind: WatchMutations, Type: "item_store", Key: req.Key,
+			Status: watchStatus(resp.Err, "stored"), Op: req.Op.String(), TTL: req.TTL,
+			Shard: w.shard, Client: req.Client}
+		if req.Op == OpDelete {
+			ev.Type, ev.Status, ev.TTL = "deleted", watchStatus(resp.Err, "deleted"), 0
+		}
+		if entry, ok := w.index.Get(req.Key); ok && resp.Err == nil {
+			ev.Size = int(entrySize(entry))
+			ev.Class = sizeClass(entrySize(entry)) + 1
+		}
+		w.watch.publish(ev)
+	}
+}
+
+// watchRemoved publishes the eviction or expiration of an item.
+func (w *Worker) watchRemoved(kind WatchKind, entry *IndexEntry) {
+	if !w.watch.wants(kind) {
+		return
+	}
+	ev := WatchEvent{Kind: kind, Type: "eviction", Key: entry.Key, TTL: -1,
+		Size: int(entrySize(entry)), Class: sizeClass(entrySize(entry)) + 1,
+		Fetched: entry.Fetched, Shard: w.shard}
+	if kind == WatchExpirations {
+		ev.Type = "expired"
+	}
+	if entry.HardExpiry > 0 {
+		ev.TTL = max(time.Duration(entry.HardExpiry-time.Now().UnixMilli())*time.Millisecond, 0)
+	}
+	w.watch.publish(ev)
+}
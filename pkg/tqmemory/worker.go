@@ -1,6 +1,7 @@
 package tqmemory
 
 import (
+	"slices"
 	"strconv"
 	"time"
 )
@@ -10,6 +11,7 @@ type OpType int
 
 const (
 	OpGet OpType = iota
+	OpGetMulti
 	OpSet
 	OpAdd
 	OpReplace
@@ -18,21 +20,171 @@ const (
 	OpCas
 	OpIncr
 	OpDecr
+	OpIncrOrCreate
+	OpDecrOrCreate
 	OpAppend
 	OpPrepend
 	OpFlushAll
 	OpStats
+	OpItemStats
+	OpResetStats
+	OpSetDetail
+	OpPrefixStats
+	OpHotKeys
+	OpScan
+	OpInvalidateNamespace
+	OpInvalidateTag
+	OpDeletePattern
+	OpHSet
+	OpHGet
+	OpHGetAll
+	OpHDel
+	OpHIncrBy
+	OpLPush
+	OpRPush
+	OpLPop
+	OpRPop
+	OpBLPop
+	OpBRPop
+	OpLRange
+	OpLTrim
+	OpLLen
+	OpCancelPop
+	OpSAdd
+	OpSRem
+	OpSIsMember
+	OpSMembers
+	OpSCard
+	OpZAdd
+	OpZIncrBy
+	OpZRem
+	OpZRange
+	OpZRangeByScore
+	OpZRank
+	OpZScore
+	OpPFAdd
+	OpPFCount
+	OpPFMerge
+	OpBFReserve
+	OpBFAdd
+	OpBFExists
+
+	numOps // number of operation types
 )
 
+var opNames = [numOps]string{
+	OpGet:          "get",
+	OpGetMulti:     "get_multi",
+	OpSet:          "set",
+	OpAdd:          "add",
+	OpReplace:      "replace",
+	OpDelete:       "delete",
+	OpTouch:        "touch",
+	OpCas:          "cas",
+	OpIncr:         "incr",
+	OpDecr:         "decr",
+	OpIncrOrCreate: "incr_or_create",
+	OpDecrOrCreate: "decr_or_create",
+	OpAppend:       "append",
+	OpPrepend:      "prepend",
+	OpFlushAll:     "flush_all",
+	OpStats:        "stats",
+	OpItemStats:    "item_stats",
+	OpResetStats:   "reset_stats",
+	OpSetDetail:    "set_detail",
+	OpPrefixStats:  "prefix_stats",
+	OpHotKeys:      "hot_keys",
+	OpScan:         "scan",
+
+	OpInvalidateNamespace: "invalidate_namespace",
+	OpInvalidateTag:       "invalidate_tag",
+	OpDeletePattern:       "delete_pattern",
+	OpHSet:                "hset",
+	OpHGet:                "hget",
+	OpHGetAll:             "hgetall",
+	OpHDel:                "hdel",
+	OpHIncrBy:             "hincrby",
+	OpLPush:               "lpush",
+	OpRPush:               "rpush",
+	OpLPop:                "lpop",
+	OpRPop:                "rpop",
+	OpBLPop:               "blpop",
+	OpBRPop:               "brpop",
+	OpLRange:              "lrange",
+	OpLTrim:               "ltrim",
+	OpLLen:                "llen",
+	OpCancelPop:           "cancel_pop",
+	OpSAdd:                "sadd",
+	OpSRem:                "srem",
+	OpSIsMember:           "sismember",
+	OpSMembers:            "smembers",
+	OpSCard:               "scard",
+	OpZAdd:                "zadd",
+	OpZIncrBy:             "zincrby",
+	OpZRem:                "zrem",
+	OpZRange:              "zrange",
+	OpZRangeByScore:       "zrangebyscore",
+	OpZRank:               "zrank",
+	OpZScore:              "zscore",
+	OpPFAdd:               "pfadd",
+	OpPFCount:             "pfcount",
+	OpPFMerge:             "pfmerge",
+	OpBFReserve:           "bfreserve",
+	OpBFAdd:               "bfadd",
+	OpBFExists:            "bfexists",
+}
+
+// String returns the name of the operation, as used in the latency stats.
+func (op OpType) String() string {
+	if op >= 0 && op < numOps {
+		return opNames[op]
+	}
+	return "op" + strconv.Itoa(int(op))
+}
+
 // Request represents a cache operation request
 type Request struct {
-	Op       OpType
-	Key      string
-	Value    []byte
-	TTL      time.Duration
-	Cas      uint64
-	Delta    uint64
-	RespChan chan *Response
+	Op        OpType
+	Key       string
+	Value     []byte
+	TTL       time.Duration
+	Cas       uint64
+	Delta     uint64
+	Enable    bool        // OpSetDetail: turn detail stats on or off
+	Sent      time.Time   // when the request was queued, for the queue latency
+	Initial   uint64      // value stored by OpIncrOrCreate/OpDecrOrCreate on a miss
+	Keys      []string    // keys of an OpGetMulti request
+	Results   []GetResult // filled in by OpGetMulti, one per key
+	RespChan  chan *Response
+	Done      func(*Response) // called with the response instead of sending it on RespChan, see Submit
+	Client    string          // client address for the slow log (optional)
+	Cursor    int             // OpScan: position to continue from, 0 to start
+	Count     int             // OpScan: entries to walk
+	Pattern   string          // OpScan: glob pattern the keys must match ("" = all)
+	Values    bool            // OpScan: also return the values; OpPFCount: also return the registers
+	Tags      []string        // Storage ops: tags of the stored item
+	DryRun    bool            // OpDeletePattern: only count the matching items
+	Fields    []string        // Hash ops: the fields; set and sorted set ops: the members; OpPFAdd, OpBFAdd, OpBFExists: the elements
+	Elements  [][]byte        // OpHSet: the values of the fields; list pushes: the elements; OpPFMerge: the registers to merge
+	Start     int             // OpLRange, OpLTrim: first position
+	Stop      int             // OpLRange, OpLTrim: last position (inclusive)
+	Reverse   bool            // OpZRange, OpZRank: count from the highest score
+	Scores    []float64       // OpZAdd: the scores of the members
+	Score     float64         // OpZIncrBy: the amount to add
+	Min       float64         // OpZRangeByScore: lowest score
+	Max       float64         // OpZRangeByScore: highest score
+	Increment int64           // OpHIncrBy: the amount to add
+	ErrorRate float64         // OpBFReserve: chance of a false positive
+	Capacity  int             // OpBFReserve: number of items
+	Waiter    *Request        // OpCancelPop: the parked blocking pop
+}
+
+// GetResult is the result for a single key of a multi-key get
+type GetResult struct {
+	Value []byte
+	Cas   uint64
+	Flags int // 0=fresh, 1=stale, 3=refresh (once only)
+	Err   error
 }
 
 // Response represents a cache operation response
@@ -41,37 +193,90 @@ type Response struct {
 	Cas   uint64
 	Flags int // 0=fresh, 1=stale, 2=refresh (once only)
 	Err   error
-	Stats map[string]string
+	Stats *Stats
+	Items *ItemStats
+	// Prefixes holds a copy of the per-prefix counters (OpPrefixStats)
+	Prefixes map[string]PrefixStats
+	HotKeys  *HotKeys
+	Scanned  []ItemMeta // OpScan: the items of the batch
+	Values   [][]byte   // OpScan: their values, if requested; OpLRange: the elements
+	Cursor   int        // OpScan: cursor of the next batch, 0 when done
+	Count    int        // OpInvalidateTag, OpDeletePattern: items removed (or matched); hash ops: fields added or removed; list and set ops: length; OpZRank: rank; OpPFCount: estimate; OpBFAdd: items added
+	Fields   []string   // OpHGetAll: the fields, their values are in Values; OpSMembers, OpZRange, OpZRangeByScore: the members
+	Scores   []float64  // OpZRange, OpZRangeByScore: the scores of the members
+	Score    float64    // OpZIncrBy, OpZScore: the score
+}
+
+// Counter returns the new value of an increment or decrement.
+func (r *Response) Counter() uint64 {
+	return counterValue(r.Value)
+}
+
+// respond answers req with resp, through Done if set.
+func (req *Request) respond(resp *Response) {
+	if req.Done != nil {
+		req.Done(resp)
+		return
+	}
+	req.RespChan <- resp
 }
 
 // Worker is the single-threaded cache worker
 type Worker struct {
-	index           *Index
-	reqChan         chan *Request
-	stopChan        chan struct{}
-	casCounter      uint64
-	DefaultTTL      time.Duration
-	staleMultiplier float64 // Hard expiry = TTL * staleMultiplier (0 = disabled)
-	maxMemory       int64   // Max memory in bytes (0 = unlimited)
-	usedMemory      int64   // Current memory usage
-	evictions       uint64
-	running         bool
-	done            chan struct{}
+	index              *Index
+	reqChan            chan *Request
+	stopChan           chan struct{}
+	casCounter         uint64
+	DefaultTTL         time.Duration
+	staleMultiplier    float64   // Hard expiry = TTL * staleMultiplier (0 = disabled)
+	maxMemory          int64     // Max memory in bytes (0 = unlimited)
+	maxValueSize       int       // Max size of a typed item in bytes (0 = unlimited)
+	usedMemory         int64     // Current memory usage
+	stats              Stats     // Counters, only accessed by the worker goroutine
+	items              ItemStats // Item sizes, only accessed by the worker goroutine
+	detail             bool      // Per-prefix counters are collected
+	prefixDelimiter    byte      // Ends the key prefix of the per-prefix counters
+	namespaceDelimiter byte      // Ends the namespace of a key
+	prefixes           map[string]*PrefixStats
+	shard              int                    // Index of the worker in the ShardedCache
+	hotReads           *hotKeyTracker         // Most read keys (nil = disabled)
+	hotWrites          *hotKeyTracker         // Most written keys (nil = disabled)
+	slowLog            *slowLog               // Shared by all workers (nil = disabled)
+	watch              *watchHub              // Shared by all workers
+	hooks              *hookQueue             // Shared by all workers (nil = no removal callbacks)
+	keyspace           *keyspaceHub           // Shared by all workers
+	ticks              int                    // Maintenance ticks, for the hot key decay
+	pendingNamespaces  map[string]uint64      // Invalidated namespaces with entries left, by CAS counter at invalidation
+	sweepCursor        int                    // Index position of the namespace sweep
+	sweepCas           uint64                 // CAS counter when the namespace sweep started
+	sweeping           bool                   // A namespace sweep is in progress
+	popWaiters         map[string][]popWaiter // Parked blocking pops by key, oldest first
+	queueLatency       [numOps]Histogram      // Time requests wait in reqChan
+	execLatency        [numOps]Histogram      // Time requests take to execute
+	running            bool
+	done               chan struct{}
 }
 
 // NewWorker creates a new worker
 func NewWorker(defaultTTL time.Duration, channelCapacity int, maxMemory int64, staleMultiplier float64) *Worker {
 	return &Worker{
-		index:           NewIndex(),
-		reqChan:         make(chan *Request, channelCapacity),
-		stopChan:        make(chan struct{}),
-		casCounter:      uint64(time.Now().UnixNano()),
-		DefaultTTL:      defaultTTL,
-		staleMultiplier: staleMultiplier,
-		maxMemory:       maxMemory,
-		usedMemory:      0,
-		evictions:       0,
-		done:            make(chan struct{}),
+		index:              NewIndex(),
+		reqChan:            make(chan *Request, channelCapacity),
+		stopChan:           make(chan struct{}),
+		casCounter:         uint64(time.Now().UnixNano()),
+		DefaultTTL:         defaultTTL,
+		staleMultiplier:    staleMultiplier,
+		maxMemory:          maxMemory,
+		usedMemory:         0,
+		items:              newItemStats(),
+		prefixDelimiter:    DefaultPrefixDelimiter,
+		namespaceDelimiter: DefaultNamespaceDelimiter,
+		prefixes:           make(map[string]*PrefixStats),
+		watch:              &watchHub{},
+		keyspace:           &keyspaceHub{},
+		pendingNamespaces:  make(map[string]uint64),
+		popWaiters:         make(map[string][]popWaiter),
+		done:               make(chan struct{}),
 	}
 }
 
@@ -107,7 +312,19 @@ func (w *Worker) UsedMemory() int64 {
 
 // Evictions returns the number of LRU evictions
 func (w *Worker) Evictions() uint64 {
-	return w.evictions
+	return w.stats.Evictions
+}
+
+// itemAdded accounts for the memory and size class of a stored item.
+func (w *Worker) itemAdded(size int64) {
+	w.usedMemory += size
+	w.items.itemAdded(size)
+}
+
+// itemRemoved accounts for the memory and size class of a removed item.
+func (w *Worker) itemRemoved(size int64) {
+	w.usedMemory -= size
+	w.items.itemRemoved(size)
 }
 
 // Close stops the worker
@@ -126,10 +343,50 @@ func (w *Worker) run() {
 	for {
 		select {
 		case req := <-w.reqChan:
-			w.handleRequest(req)
+			// The request may be reused once it is answered
+			op, start := req.Op, time.Now()
+			var queue time.Duration
+			if !req.Sent.IsZero() {
+				queue = start.Sub(req.Sent)
+				if op >= 0 && op < numOps {
+					w.queueLatency[op].Record(queue)
+				}
+			}
+			resp := w.handleRequest(req)
+			if resp == nil {
+				// A parked blocking pop, answered by a push or its timeout
+				continue
+			}
+			if w.watch.mask.Load() != 0 {
+				w.watchRequest(req, resp)
+			}
+			if w.keyspace.wants(KeyspaceSet) {
+				w.keyspaceRequest(req, resp)
+			}
+			// Measured before the send, which includes scheduling the caller
+			exec := time.Since(start)
+			if op >= 0 && op < numOps {
+				w.execLatency[op].Record(exec)
+			}
+			if w.slowLog != nil && queue+exec >= w.slowLog.threshold {
+				w.recordSlow(req, resp, queue, exec)
+			}
+			req.respond(resp)
 		case <-ticker.C:
+			w.index.clock = time.Now().Unix()
 			w.expireKeys()
+			if w.sweeping {
+				w.sweepNamespaces()
+			}
+			if len(w.popWaiters) > 0 {
+				w.expirePopWaiters()
+			}
+			if w.ticks++; w.ticks%hotKeyDecayTicks == 0 && w.hotReads != nil {
+				w.hotReads.decay()
+				w.hotWrites.decay()
+			}
 		case <-w.stopChan:
+			w.releasePopWaiters()
 			return
 		}
 	}
@@ -143,13 +400,24 @@ func (w *Worker) expireKeys() {
 			break
 		}
 		// Remove expired key and update memory
-		deleted := w.index.Delete(entry.Key)
-		if deleted != nil {
-			w.usedMemory -= int64(len(deleted.Key) + len(deleted.Value))
+		if deleted := w.index.Delete(entry.Key); deleted != nil {
+			w.expired(deleted)
 		}
 	}
 }
 
+// expired accounts for an entry past its hard expiry that was removed from
+// the index.
+func (w *Worker) expired(entry *IndexEntry) {
+	w.itemRemoved(entrySize(entry))
+	w.watchRemoved(WatchExpirations, entry)
+	w.notifyRemoved(entry, RemovedExpired)
+	if !entry.Fetched {
+		w.stats.ExpiredUnfetched++
+		w.items.class(entrySize(entry)).ExpiredUnfetched++
+	}
+}
+
 // evictLRU evicts the least recently used items until we have enough space
 func (w *Worker) evictLRU(needed int64) {
 	if w.maxMemory == 0 {
@@ -163,18 +431,69 @@ func (w *Worker) evictLRU(needed int64) {
 			break // No more items to evict
 		}
 
-		w.usedMemory -= int64(len(oldest.Key) + len(oldest.Value))
+		size := entrySize(oldest)
+		w.itemRemoved(size)
 		w.index.Delete(oldest.Key)
-		w.evictions++
+		w.watchRemoved(WatchEvictions, oldest)
+		w.notifyRemoved(oldest, RemovedEvicted)
+		w.stats.Evictions++
+		class := w.items.class(size)
+		class.Evicted++
+		if !oldest.Fetched {
+			w.stats.EvictedUnfetched++
+			class.EvictedUnfetched++
+		}
+	}
+}
+
+// trackHotKey counts the access to the key of a request for the hot keys.
+func (w *Worker) trackHotKey(req *Request) {
+	switch req.Op {
+	case OpGet, OpHGet, OpHGetAll, OpLRange, OpLLen, OpSIsMember, OpSMembers, OpSCard,
+		OpZRange, OpZRangeByScore, OpZRank, OpZScore, OpPFCount, OpBFExists:
+		w.hotReads.add(req.Key, w.shard)
+	case OpGetMulti:
+		for _, key := range req.Keys {
+			w.hotReads.add(key, w.shard)
+		}
+	case OpSet, OpAdd, OpReplace, OpCas, OpDelete, OpTouch, OpIncr, OpDecr,
+		OpIncrOrCreate, OpDecrOrCreate, OpAppend, OpPrepend, OpHSet, OpHDel, OpHIncrBy,
+		OpLPush, OpRPush, OpLPop, OpRPop, OpBLPop, OpBRPop, OpLTrim,
+		OpSAdd, OpSRem, OpZAdd, OpZIncrBy, OpZRem, OpPFAdd, OpPFMerge, OpBFReserve, OpBFAdd:
+		w.hotWrites.add(req.Key, w.shard)
 	}
 }
 
-func (w *Worker) handleRequest(req *Request) {
+// handleRequest executes a request and returns its response.
+func (w *Worker) handleRequest(req *Request) *Response {
 	var resp *Response
 
+	if w.hotReads != nil {
+		w.trackHotKey(req)
+	}
+	if len(w.pendingNamespaces) > 0 {
+		// Entries of invalidated namespaces must not be seen
+		switch req.Op {
+		case OpGetMulti:
+			for _, key := range req.Keys {
+				w.reclaim(key)
+			}
+		case OpGet, OpSet, OpAdd, OpReplace, OpCas, OpDelete, OpTouch, OpIncr, OpDecr,
+			OpIncrOrCreate, OpDecrOrCreate, OpAppend, OpPrepend,
+			OpHSet, OpHGet, OpHGetAll, OpHDel, OpHIncrBy,
+			OpLPush, OpRPush, OpLPop, OpRPop, OpBLPop, OpBRPop, OpLRange, OpLTrim, OpLLen,
+			OpSAdd, OpSRem, OpSIsMember, OpSMembers, OpSCard,
+			OpZAdd, OpZIncrBy, OpZRem, OpZRange, OpZRangeByScore, OpZRank, OpZScore,
+			OpPFAdd, OpPFCount, OpPFMerge, OpBFReserve, OpBFAdd, OpBFExists:
+			w.reclaim(req.Key)
+		}
+	}
+
 	switch req.Op {
 	case OpGet:
 		resp = w.handleGet(req)
+	case OpGetMulti:
+		resp = w.handleGetMulti(req)
 	case OpSet:
 		resp = w.handleSet(req)
 	case OpAdd:
@@ -191,6 +510,10 @@ func (w *Worker) handleRequest(req *Request) {
 		resp = w.handleIncr(req)
 	case OpDecr:
 		resp = w.handleDecr(req)
+	case OpIncrOrCreate:
+		resp = w.doIncrDecrOrCreate(req, true)
+	case OpDecrOrCreate:
+		resp = w.doIncrDecrOrCreate(req, false)
 	case OpAppend:
 		resp = w.handleAppend(req)
 	case OpPrepend:
@@ -199,27 +522,141 @@ func (w *Worker) handleRequest(req *Request) {
 		resp = w.handleFlushAll()
 	case OpStats:
 		resp = w.handleStats()
+	case OpItemStats:
+		resp = &Response{Items: w.items.clone()}
+	case OpResetStats:
+		resp = w.handleResetStats()
+	case OpSetDetail:
+		w.detail = req.Enable
+		resp = &Response{}
+	case OpPrefixStats:
+		resp = w.handlePrefixStats()
+	case OpScan:
+		resp = w.handleScan(req)
+	case OpInvalidateNamespace:
+		resp = w.handleInvalidateNamespace(req)
+	case OpInvalidateTag:
+		resp = w.handleInvalidateTag(req)
+	case OpDeletePattern:
+		resp = w.handleDeletePattern(req)
+	case OpHSet:
+		resp = w.handleHSet(req)
+	case OpHGet:
+		resp = w.handleHGet(req)
+	case OpHGetAll:
+		resp = w.handleHGetAll(req)
+	case OpHDel:
+		resp = w.handleHDel(req)
+	case OpHIncrBy:
+		resp = w.handleHIncrBy(req)
+	case OpLPush:
+		resp = w.handlePush(req, true)
+	case OpRPush:
+		resp = w.handlePush(req, false)
+	case OpLPop, OpBLPop:
+		resp = w.handlePop(req, true)
+	case OpRPop, OpBRPop:
+		resp = w.handlePop(req, false)
+	case OpLRange:
+		resp = w.handleLRange(req)
+	case OpLTrim:
+		resp = w.handleLTrim(req)
+	case OpLLen:
+		resp = w.handleLLen(req)
+	case OpCancelPop:
+		resp = w.handleCancelPop(req)
+	case OpSAdd:
+		resp = w.handleSAdd(req)
+	case OpSRem:
+		resp = w.handleSRem(req)
+	case OpSIsMember:
+		resp = w.handleSIsMember(req)
+	case OpSMembers:
+		resp = w.handleSMembers(req)
+	case OpSCard:
+		resp = w.handleSCard(req)
+	case OpZAdd:
+		resp = w.handleZAdd(req)
+	case OpZIncrBy:
+		resp = w.handleZIncrBy(req)
+	case OpZRem:
+		resp = w.handleZRem(req)
+	case OpZRange:
+		resp = w.handleZRange(req)
+	case OpZRangeByScore:
+		resp = w.handleZRangeByScore(req)
+	case OpZRank:
+		resp = w.handleZRank(req)
+	case OpZScore:
+		resp = w.handleZScore(req)
+	case OpPFAdd:
+		resp = w.handlePFAdd(req)
+	case OpPFCount:
+		resp = w.handlePFCount(req)
+	case OpPFMerge:
+		resp = w.handlePFMerge(req)
+	case OpBFReserve:
+		resp = w.handleBFReserve(req)
+	case OpBFAdd:
+		resp = w.handleBFAdd(req)
+	case OpBFExists:
+		resp = w.handleBFExists(req)
+	case OpHotKeys:
+		resp = &Response{HotKeys: &HotKeys{}}
+		if w.hotReads != nil {
+			resp.HotKeys.Reads = w.hotReads.snapshot()
+			resp.HotKeys.Writes = w.hotWrites.snapshot()
+		}
 	default:
 		resp = &Response{Err: ErrKeyNotFound}
 	}
 
-	req.RespChan <- resp
+	return resp
 }
 
 func (w *Worker) handleGet(req *Request) *Response {
-	entry, ok := w.index.Get(req.Key)
+	resp := getResponsePool.Get().(*Response)
+	resp.Value, resp.Cas, resp.Flags, resp.Err = w.doGet(req.Key)
+	return resp
+}
+
+// handleGetMulti looks up all keys of the request in one pass, so a
+// multi-key get costs a single channel round trip per worker.
+func (w *Worker) handleGetMulti(req *Request) *Response {
+	for i, key := range req.Keys {
+		r := &req.Results[i]
+		r.Value, r.Cas, r.Flags, r.Err = w.doGet(key)
+	}
+	return &Response{}
+}
+
+func (w *Worker) doGet(key string) ([]byte, uint64, int, error) {
+	w.stats.CmdGet++
+	ps := w.prefixStats(key)
+	if ps != nil {
+		ps.Gets++
+	}
+	entry, ok := w.index.Get(key)
 	if !ok {
-		return &Response{Err: ErrKeyNotFound}
+		w.stats.GetMisses++
+		return nil, 0, 0, ErrKeyNotFound
 	}
 
 	now := time.Now().UnixMilli()
 
 	// Check hard expiry - if past hard expiry, key is gone
 	if entry.HardExpiry > 0 && entry.HardExpiry <= now {
-		w.usedMemory -= int64(len(entry.Key) + len(entry.Value))
-		w.index.Delete(req.Key)
-		return &Response{Err: ErrKeyNotFound}
+		w.index.Delete(key)
+		w.expired(entry)
+		w.stats.GetMisses++
+		w.stats.GetExpired++
+		return nil, 0, 0, ErrKeyNotFound
+	}
+	w.stats.GetHits++
+	if ps != nil {
+		ps.Hits++
 	}
+	entry.Fetched = true
 
 	// Determine flags based on soft expiry and refresh state
 	// 0 = fresh, 1 = stale, 3 = refresh (once only)
@@ -240,50 +677,65 @@ func (w *Worker) handleGet(req *Request) *Response {
 	// Update access time for LRU
 	w.index.Touch(entry.Key)
 
-	return &Response{Value: entry.Value, Cas: entry.Cas, Flags: flags}
+	return entryValue(entry), entry.Cas, flags, nil
+}
+
+// countSet counts a storage command, in total and for the key's prefix.
+func (w *Worker) countSet(key string) {
+	w.stats.CmdSet++
+	if ps := w.prefixStats(key); ps != nil {
+		ps.Sets++
+	}
 }
 
 func (w *Worker) handleSet(req *Request) *Response {
-	return w.doSet(req.Key, req.Value, req.TTL, 0, false)
+	w.countSet(req.Key)
+	return w.doSet(req.Key, req.Value, req.TTL, 0, false, req.Tags)
 }
 
 func (w *Worker) handleAdd(req *Request) *Response {
+	w.countSet(req.Key)
 	entry, ok := w.index.Get(req.Key)
 	if ok && (entry.HardExpiry == 0 || entry.HardExpiry > time.Now().UnixMilli()) {
 		return &Response{Err: ErrKeyExists}
 	}
-	return w.doSet(req.Key, req.Value, req.TTL, 0, false)
+	return w.doSet(req.Key, req.Value, req.TTL, 0, false, req.Tags)
 }
 
 func (w *Worker) handleReplace(req *Request) *Response {
+	w.countSet(req.Key)
 	entry, ok := w.index.Get(req.Key)
 	if !ok || (entry.HardExpiry > 0 && entry.HardExpiry <= time.Now().UnixMilli()) {
 		return &Response{Err: ErrKeyNotFound}
 	}
-	return w.doSet(req.Key, req.Value, req.TTL, 0, false)
+	return w.doSet(req.Key, req.Value, req.TTL, 0, false, req.Tags)
 }
 
 func (w *Worker) handleCas(req *Request) *Response {
+	w.countSet(req.Key)
 	entry, ok := w.index.Get(req.Key)
 	if !ok || (entry.HardExpiry > 0 && entry.HardExpiry <= time.Now().UnixMilli()) {
+		w.stats.CasMisses++
 		return &Response{Err: ErrKeyNotFound}
 	}
 	if entry.Cas != req.Cas {
+		w.stats.CasBadval++
 		return &Response{Err: ErrCasMismatch}
 	}
-	return w.doSet(req.Key, req.Value, req.TTL, req.Cas, true)
+	w.stats.CasHits++
+	return w.doSet(req.Key, req.Value, req.TTL, req.Cas, true, req.Tags)
 }
 
-func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas uint64, checkCas bool) *Response {
+func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas uint64, checkCas bool, tags []string) *Response {
 	// Apply default TTL if none specified
 	if ttl == 0 && w.DefaultTTL > 0 {
 		ttl = w.DefaultTTL
 	}
 
 	// Calculate soft and hard expiry
+	now := time.Now()
 	var softExpiry, hardExpiry int64
 	if ttl > 0 {
-		now := time.Now()
 		softExpiry = now.Add(ttl).UnixMilli()
 		// If staleMultiplier is set, calculate hard expiry
 		if w.staleMultiplier > 0 {
@@ -296,20 +748,25 @@ func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas
 	}
 
 	// Calculate memory needed for this entry
-	entrySize := int64(len(key) + len(value))
+	size := int64(len(key) + len(value))
 
 	// Check if key already exists and get its current size
 	var oldSize int64
 	if existing, ok := w.index.Get(key); ok {
-		oldSize = int64(len(existing.Key) + len(existing.Value))
+		oldSize = entrySize(existing)
 	}
 
 	// Evict if needed before storing
-	additionalMemory := entrySize - oldSize
+	additionalMemory := size - oldSize
 	if additionalMemory > 0 && w.maxMemory > 0 {
 		w.evictLRU(additionalMemory)
 	}
 
+	// The old item may have been evicted above, only account for it if not
+	if existing, ok := w.index.Get(key); ok {
+		w.itemRemoved(entrySize(existing))
+	}
+
 	// Generate new CAS
 	w.casCounter++
 	cas := w.casCounter
@@ -325,29 +782,43 @@ func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas
 		SoftExpiry: softExpiry,
 		HardExpiry: hardExpiry,
 		Cas:        cas,
+		Created:    now.UnixMilli(),
+	}
+	if len(tags) > 0 {
+		entry.Tags = slices.Clone(tags)
 	}
 	w.index.Set(entry)
 
 	// Update memory tracking
-	w.usedMemory += additionalMemory
+	w.itemAdded(size)
+	w.stats.TotalItems++
 
 	return &Response{Cas: cas}
 }
 
 func (w *Worker) handleDelete(req *Request) *Response {
+	if ps := w.prefixStats(req.Key); ps != nil {
+		ps.Deletes++
+	}
 	entry := w.index.Delete(req.Key)
 	if entry == nil {
+		w.stats.DeleteMisses++
 		return &Response{Err: ErrKeyNotFound}
 	}
-	w.usedMemory -= int64(len(entry.Key) + len(entry.Value))
+	w.stats.DeleteHits++
+	w.itemRemoved(entrySize(entry))
+	w.notifyRemoved(entry, RemovedDeleted)
 	return &Response{}
 }
 
 func (w *Worker) handleTouch(req *Request) *Response {
+	w.stats.CmdTouch++
 	entry, ok := w.index.Get(req.Key)
 	if !ok || (entry.HardExpiry > 0 && entry.HardExpiry <= time.Now().UnixMilli()) {
+		w.stats.TouchMisses++
 		return &Response{Err: ErrKeyNotFound}
 	}
+	w.stats.TouchHits++
 
 	// Apply new TTL
 	ttl := req.TTL
@@ -389,8 +860,16 @@ func (w *Worker) handleDecr(req *Request) *Response {
 func (w *Worker) doIncrDecr(key string, delta uint64, incr bool) *Response {
 	entry, ok := w.index.Get(key)
 	if !ok || (entry.HardExpiry > 0 && entry.HardExpiry <= time.Now().UnixMilli()) {
+		if incr {
+			w.stats.IncrMisses++
+		} else {
+			w.stats.DecrMisses++
+		}
 		return &Response{Err: ErrKeyNotFound}
 	}
+	if entry.Data != nil {
+		return &Response{Err: ErrWrongType}
+	}
 
 	// Parse current value as uint64
 	currentStr := string(entry.Value)
@@ -398,6 +877,12 @@ func (w *Worker) doIncrDecr(key string, delta uint64, incr bool) *Response {
 	if err != nil {
 		return &Response{Err: ErrNotNumeric}
 	}
+	// Like memcached, a non-numeric value is neither a hit nor a miss
+	if incr {
+		w.stats.IncrHits++
+	} else {
+		w.stats.DecrHits++
+	}
 
 	// Apply increment/decrement
 	var newVal uint64
@@ -411,10 +896,8 @@ func (w *Worker) doIncrDecr(key string, delta uint64, incr bool) *Response {
 		}
 	}
 
-	// Calculate memory change
-	oldSize := int64(len(entry.Value))
 	newValStr := strconv.FormatUint(newVal, 10)
-	newSize := int64(len(newValStr))
+	w.itemRemoved(entrySize(entry))
 
 	w.casCounter++
 	entry.Value = []byte(newValStr)
@@ -422,11 +905,26 @@ func (w *Worker) doIncrDecr(key string, delta uint64, incr bool) *Response {
 	w.index.Set(entry)
 	w.index.Touch(entry.Key)
 
-	w.usedMemory += (newSize - oldSize)
+	w.itemAdded(entrySize(entry))
 
 	return &Response{Value: []byte(newValStr), Cas: entry.Cas}
 }
 
+// doIncrDecrOrCreate applies the delta, or stores the initial value (without
+// applying the delta) if the key doesn't exist. As the worker is single
+// threaded, concurrent callers can't both create the counter.
+func (w *Worker) doIncrDecrOrCreate(req *Request, incr bool) *Response {
+	resp := w.doIncrDecr(req.Key, req.Delta, incr)
+	if resp.Err != ErrKeyNotFound {
+		return resp
+	}
+
+	value := []byte(strconv.FormatUint(req.Initial, 10))
+	resp = w.doSet(req.Key, value, req.TTL, 0, false, nil)
+	resp.Value = value
+	return resp
+}
+
 func (w *Worker) handleAppend(req *Request) *Response {
 	return w.doAppendPrepend(req.Key, req.Value, false)
 }
@@ -436,10 +934,14 @@ func (w *Worker) handlePrepend(req *Request) *Response {
 }
 
 func (w *Worker) doAppendPrepend(key string, value []byte, prepend bool) *Response {
+	w.countSet(key)
 	entry, ok := w.index.Get(key)
 	if !ok || (entry.HardExpiry > 0 && entry.HardExpiry <= time.Now().UnixMilli()) {
 		return &Response{Err: ErrKeyNotFound}
 	}
+	if entry.Data != nil {
+		return &Response{Err: ErrWrongType}
+	}
 
 	// Calculate new memory needed
 	additionalMemory := int64(len(value))
@@ -449,6 +951,12 @@ func (w *Worker) doAppendPrepend(key string, value []byte, prepend bool) *Respon
 		w.evictLRU(additionalMemory)
 	}
 
+	// The entry itself may have been evicted to make room
+	if _, ok := w.index.Get(key); !ok {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	w.itemRemoved(entrySize(entry))
+
 	// Create new value
 	var newValue []byte
 	if prepend {
@@ -468,22 +976,69 @@ func (w *Worker) doAppendPrepend(key string, value []byte, prepend bool) *Respon
 	w.index.Set(entry)
 	w.index.Touch(entry.Key)
 
-	w.usedMemory += additionalMemory
+	w.itemAdded(entrySize(entry))
 
 	return &Response{Cas: entry.Cas}
 }
 
 func (w *Worker) handleFlushAll() *Response {
+	w.stats.CmdFlush++
+	if w.hooks != nil && w.hooks.onDelete != nil {
+		w.index.Scan(0, w.index.Count(), func(entry *IndexEntry) {
+			w.notifyRemoved(entry, RemovedFlushed)
+		})
+	}
+	if w.keyspace.wants(KeyspaceFlush) {
+		w.keyspace.publish(KeyspaceFlush, "", w.shard)
+	}
 	// Create new empty index
 	w.index = NewIndex()
 	w.usedMemory = 0
+	for i := range w.items.Classes {
+		c := &w.items.Classes[i]
+		c.Items, c.Bytes = 0, 0
+	}
+	clear(w.items.Sizes)
+	// No entries of invalidated namespaces are left
+	clear(w.pendingNamespaces)
+	w.sweeping = false
 	return &Response{}
 }
 
 func (w *Worker) handleStats() *Response {
-	stats := make(map[string]string)
-	stats["curr_items"] = strconv.Itoa(w.index.Count())
-	stats["bytes"] = strconv.FormatInt(w.usedMemory, 10)
-	stats["evictions"] = strconv.FormatUint(w.evictions, 10)
-	return &Response{Stats: stats}
+	// Return a copy, the worker keeps updating its own counters
+	stats := w.stats
+	stats.CurrItems = uint64(w.index.Count())
+	stats.Bytes = w.usedMemory
+	stats.LimitMaxBytes = w.maxMemory
+	for _, waiters := range w.popWaiters {
+		stats.BlockedClients += uint64(len(waiters))
+	}
+	return &Response{Stats: &stats}
+}
+
+// handleResetStats zeroes the counters, like memcached's "stats reset".
+// Gauges such as the item count and memory usage are kept.
+func (w *Worker) handleResetStats() *Response {
+	w.stats = Stats{}
+	w.items.resetCounters()
+	clear(w.prefixes)
+	if w.hotReads != nil {
+		w.hotReads.reset()
+		w.hotWrites.reset()
+	}
+	for op := range numOps {
+		w.queueLatency[op].Reset()
+		w.execLatency[op].Reset()
+	}
+	return &Response{}
+}
+
+// handlePrefixStats returns a copy of the per-prefix counters.
+func (w *Worker) handlePrefixStats() *Response {
+	prefixes := make(map[string]PrefixStats, len(w.prefixes))
+	for prefix, ps := range w.prefixes {
+		prefixes[prefix] = *ps
+	}
+	return &Response{Prefixes: prefixes}
 }
@@ -0,0 +1,369 @@
+package tqmemory
+
+import (
+	"cmp"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ZMember is a member of a sorted set with its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// compareZMembers orders members by score, then by member.
+func compareZMembers(a, b ZMember) int {
+	if c := cmp.Compare(a.Score, b.Score); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Member, b.Member)
+}
+
+// zsetValue is a sorted set: the scores by member, and the members in
+// score order for the rank and range lookups.
+type zsetValue struct {
+	scores map[string]float64
+	sorted *skiplist
+	bytes  int64
+}
+
+// zsetMemberSize is the bytes counted for a member besides its name, its
+// score.
+const zsetMemberSize = 8
+
+func newZSet() *zsetValue {
+	return &zsetValue{scores: make(map[string]float64), sorted: newSkiplist()}
+}
+
+func (z *zsetValue) size() int64 {
+	return z.bytes
+}
+
+// appendTo serializes the sorted set as the netstrings of each member and
+// its score, in score order, e.g. "5:alice,2:10,3:bob,2:12,".
+func (z *zsetValue) appendTo(buf []byte) []byte {
+	for n := z.sorted.first(); n != nil; n = n.links[0].next {
+		buf = appendNetstring(buf, []byte(n.Member))
+		buf = appendNetstring(buf, strconv.AppendFloat(nil, n.Score, 'f', -1, 64))
+	}
+	return buf
+}
+
+// has reports whether member is in the sorted set, which may be nil.
+func (z *zsetValue) has(member string) bool {
+	if z == nil {
+		return false
+	}
+	_, ok := z.scores[member]
+	return ok
+}
+
+// set sets the score of a member and reports whether the member was added.
+func (z *zsetValue) set(member string, score float64) bool {
+	old, ok := z.scores[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		z.sorted.remove(ZMember{member, old})
+	} else {
+		// The member may alias a connection's read buffer
+		member = strings.Clone(member)
+		z.bytes += int64(len(member) + zsetMemberSize)
+	}
+	z.scores[member] = score
+	z.sorted.insert(ZMember{member, score})
+	return !ok
+}
+
+// remove removes a member and reports whether it existed.
+func (z *zsetValue) remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	z.sorted.remove(ZMember{member, score})
+	delete(z.scores, member)
+	z.bytes -= int64(len(member) + zsetMemberSize)
+	return true
+}
+
+// rank returns the position of a member in score order, from the highest
+// score if reverse.
+func (z *zsetValue) rank(member string, reverse bool) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	i := z.sorted.rank(ZMember{member, score})
+	if reverse {
+		i = z.sorted.length - 1 - i
+	}
+	return i, true
+}
+
+// handleZAdd sets the scores in req.Scores of the members in req.Fields,
+// creating the sorted set with req.TTL if needed, and returns the number of
+// new members in Count.
+func (w *Worker) handleZAdd(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, z, err := lookupTyped[*zsetValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	if len(req.Fields) == 0 {
+		return &Response{}
+	}
+	var growth int64
+	if entry == nil {
+		growth = int64(len(req.Key))
+	}
+	for i, member := range req.Fields {
+		if math.IsNaN(req.Scores[i]) {
+			return &Response{Err: ErrNotNumeric}
+		}
+		if !z.has(member) {
+			growth += int64(len(member) + zsetMemberSize)
+		}
+	}
+
+	var added int
+	entry, err = updateTyped(w, entry, req.Key, req.TTL, growth, newZSet, func(z *zsetValue) {
+		for i, member := range req.Fields {
+			if z.set(member, req.Scores[i]) {
+				added++
+			}
+		}
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas, Count: added}
+}
+
+// handleZIncrBy adds req.Score to the score of the member req.Fields[0],
+// which starts at 0 (creating the sorted set with req.TTL if needed), and
+// returns the new score in Score.
+func (w *Worker) handleZIncrBy(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, z, err := lookupTyped[*zsetValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	member := req.Fields[0]
+	var score float64
+	var growth int64
+	if z.has(member) {
+		score = z.scores[member]
+	} else {
+		growth = int64(len(member) + zsetMemberSize)
+	}
+	if entry == nil {
+		growth += int64(len(req.Key))
+	}
+	score += req.Score
+	if math.IsNaN(score) {
+		return &Response{Err: ErrNotNumeric}
+	}
+	entry, err = updateTyped(w, entry, req.Key, req.TTL, growth, newZSet, func(z *zsetValue) {
+		z.set(member, score)
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Cas: entry.Cas, Score: score}
+}
+
+// handleZRem removes the members in req.Fields and returns the number of
+// removed members in Count. The item is removed with its last member.
+func (w *Worker) handleZRem(req *Request) *Response {
+	w.countSet(req.Key)
+	entry, _, err := lookupTyped[*zsetValue](w, req.Key)
+	if err != nil || entry == nil {
+		return &Response{Err: err}
+	}
+	var removed int
+	var empty bool
+	entry, err = updateTyped(w, entry, req.Key, 0, 0, newZSet, func(z *zsetValue) {
+		for _, member := range req.Fields {
+			if z.remove(member) {
+				removed++
+			}
+		}
+		empty = z.sorted.length == 0
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	if empty {
+		w.removeTyped(entry)
+	}
+	return &Response{Cas: entry.Cas, Count: removed}
+}
+
+// handleZRange returns the members from rank req.Start to req.Stop (counted
+// like LRange, from the highest score if req.Reverse) in Fields and their
+// scores in Scores.
+func (w *Worker) handleZRange(req *Request) *Response {
+	entry, z, err := lookupTyped[*zsetValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	resp := &Response{Cas: entry.Cas}
+	start, stop, ok := listRange(z.sorted.length, req.Start, req.Stop)
+	if !ok {
+		return resp
+	}
+	if req.Reverse {
+		n := z.sorted.at(z.sorted.length - 1 - start)
+		for rank := start; rank <= stop; rank, n = rank+1, n.prev {
+			resp.Fields = append(resp.Fields, n.Member)
+			resp.Scores = append(resp.Scores, n.Score)
+		}
+		return resp
+	}
+	n := z.sorted.at(start)
+	for rank := start; rank <= stop; rank, n = rank+1, n.links[0].next {
+		resp.Fields = append(resp.Fields, n.Member)
+		resp.Scores = append(resp.Scores, n.Score)
+	}
+	return resp
+}
+
+// handleZRangeByScore returns the members with a score from req.Min to
+// req.Max (inclusive) in score order, in Fields and Scores.
+func (w *Worker) handleZRangeByScore(req *Request) *Response {
+	entry, z, err := lookupTyped[*zsetValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	resp := &Response{Cas: entry.Cas}
+	// "" sorts before all members with the same score
+	for n := z.sorted.seek(ZMember{"", req.Min}); n != nil && n.Score <= req.Max; n = n.links[0].next {
+		resp.Fields = append(resp.Fields, n.Member)
+		resp.Scores = append(resp.Scores, n.Score)
+	}
+	return resp
+}
+
+// handleZRank returns the rank of the member req.Fields[0] in Count, from
+// the highest score if req.Reverse.
+func (w *Worker) handleZRank(req *Request) *Response {
+	entry, z, err := lookupTyped[*zsetValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	rank, ok := z.rank(req.Fields[0], req.Reverse)
+	if !ok {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	return &Response{Cas: entry.Cas, Count: rank}
+}
+
+// handleZScore returns the score of the member req.Fields[0] in Score.
+func (w *Worker) handleZScore(req *Request) *Response {
+	entry, z, err := lookupTyped[*zsetValue](w, req.Key)
+	if err != nil {
+		return &Response{Err: err}
+	}
+	w.readTyped(req.Key, entry)
+	if entry == nil {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	score, ok := z.scores[req.Fields[0]]
+	if !ok {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	return &Response{Cas: entry.Cas, Score: score}
+}
+
+// zMembers pairs the members and scores of a range response.
+func zMembers(resp *Response) []ZMember {
+	members := make([]ZMember, len(resp.Fields))
+	for i := range members {
+		members[i] = ZMember{resp.Fields[i], resp.Scores[i]}
+	}
+	return members
+}
+
+// ZAdd sets the scores of members of the sorted set at key and returns the
+// number of members that were added. A missing sorted set is created with
+// the ttl (the default TTL if 0). Scores must not be NaN.
+func (sc *ShardedCache) ZAdd(key string, ttl time.Duration, members ...ZMember) (int, error) {
+	req := &Request{Op: OpZAdd, Key: key, TTL: ttl,
+		Fields: make([]string, len(members)), Scores: make([]float64, len(members))}
+	for i, m := range members {
+		req.Fields[i], req.Scores[i] = m.Member, m.Score
+	}
+	resp := sc.sendRequest(sc.workerFor(key), req)
+	return resp.Count, resp.Err
+}
+
+// ZIncrBy adds delta to the score of a member of the sorted set at key and
+// returns the new score. A missing member starts at 0, a missing sorted set
+// is created with the ttl (the default TTL if 0).
+func (sc *ShardedCache) ZIncrBy(key, member string, delta float64, ttl time.Duration) (float64, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpZIncrBy, Key: key, TTL: ttl,
+		Fields: []string{member}, Score: delta})
+	return resp.Score, resp.Err
+}
+
+// ZRem removes members from the sorted set at key and returns the number of
+// members that were removed. A sorted set without members is removed.
+func (sc *ShardedCache) ZRem(key string, members ...string) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpZRem, Key: key, Fields: members})
+	return resp.Count, resp.Err
+}
+
+// ZRange returns the members of the sorted set at key from rank start to
+// stop (inclusive, counted from the end when negative) in score order, or
+// from the highest score if reverse, e.g. ZRange(key, 0, 9, true) returns
+// the top 10 of a leaderboard.
+func (sc *ShardedCache) ZRange(key string, start, stop int, reverse bool) ([]ZMember, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpZRange, Key: key, Start: start, Stop: stop,
+		Reverse: reverse})
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return zMembers(resp), nil
+}
+
+// ZRangeByScore returns the members of the sorted set at key with a score
+// from min to max (inclusive) in score order.
+func (sc *ShardedCache) ZRangeByScore(key string, min, max float64) ([]ZMember, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpZRangeByScore, Key: key, Min: min, Max: max})
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return zMembers(resp), nil
+}
+
+// ZRank returns the rank of a member of the sorted set at key, counted from
+// 0 in score order or from the highest score if reverse, or ErrKeyNotFound.
+func (sc *ShardedCache) ZRank(key, member string, reverse bool) (int, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpZRank, Key: key, Fields: []string{member},
+		Reverse: reverse})
+	return resp.Count, resp.Err
+}
+
+// ZScore returns the score of a member of the sorted set at key, or
+// ErrKeyNotFound.
+func (sc *ShardedCache) ZScore(key, member string) (float64, error) {
+	resp := sc.sendRequest(sc.workerFor(key), &Request{Op: OpZScore, Key: key, Fields: []string{member}})
+	return resp.Score, resp.Err
+}
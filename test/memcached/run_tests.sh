@@ -11,8 +11,10 @@ TEST_DIR="$SCRIPT_DIR"
 PORT="${TQMEMORY_PORT:-11299}"
 BINARY="$SCRIPT_DIR/tqmemory_test"
 
-# Test files to download from official memcached repo
-MEMCACHED_RAW="https://raw.githubusercontent.com/memcached/memcached/master"
+# Test files to download from official memcached repo, pinned to a release
+# so the counts in LIMITATIONS.md don't change with upstream master
+MEMCACHED_TAG="1.6.38"
+MEMCACHED_RAW="https://raw.githubusercontent.com/memcached/memcached/$MEMCACHED_TAG"
 TEST_FILES=(
     "t/lib/MemcachedTest.pm"
     "t/getset.t"
@@ -36,7 +38,7 @@ download_tests() {
         if [ ! -f "$dest" ]; then
             echo "Downloading $file..."
             mkdir -p "$(dirname "$dest")"
-            curl -sL "$url" -o "$dest"
+            curl -fsSL "$url" -o "$dest"
         fi
     done
     echo ""
@@ -110,24 +112,6 @@ patch_test_files() {
         ' "$cas_file"
     fi
     
-    # Patch getset.t - disable first subtest
-    local getset_file="$TEST_DIR/t/getset.t"
-    if [ -f "$getset_file" ] && ! grep -q "TQMEMORY_PATCHED" "$getset_file" 2>/dev/null; then
-        echo "Patching getset.t..."
-        perl -i -pe '
-            # Mark as patched at the start
-            if (/^use strict;/ && !$patched) {
-                $_ .= "# TQMEMORY_PATCHED\n";
-                $patched = 1;
-            }
-        ' "$getset_file"
-        
-        # Comment out the subtest block
-        perl -i -0777 -pe '
-            s/(subtest .close if no get found in 2k. => sub \{.*?\};)/# Disabled for TQMemory:\n# $1 =~ s|^|# |gmr/se;
-        ' "$getset_file"
-    fi
-    
     echo "Patched test files"
     echo ""
 }